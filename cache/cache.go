@@ -0,0 +1,16 @@
+package cache
+
+import "time"
+
+// Cache is a byte-oriented key/value store with per-entry expiry. Values are
+// opaque so the same decorators work against the in-process LRU and Redis.
+type Cache interface {
+	// Get returns the value stored under key and whether it was found
+	Get(key string) ([]byte, bool, error)
+	// Set stores value under key for ttl (no expiry when ttl is zero)
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes the given keys, ignoring ones that don't exist
+	Delete(keys ...string) error
+	// Clear removes every entry
+	Clear() error
+}
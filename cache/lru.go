@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruEntry is a single cached value tracked by the LRU list
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// lruCache is an in-process Cache evicting the least recently used entry once
+// it holds size entries. Expired entries are dropped lazily on access.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewLRU creates an in-process Cache holding at most size entries
+func NewLRU(size int) Cache {
+	if size <= 0 {
+		size = 1
+	}
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key and whether it was found
+func (lc *lruCache) Get(key string) ([]byte, bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	element, ok := lc.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		lc.remove(element)
+		return nil, false, nil
+	}
+
+	lc.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+// Set stores value under key for ttl, evicting the oldest entry when full
+func (lc *lruCache) Set(key string, value []byte, ttl time.Duration) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if element, ok := lc.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		lc.order.MoveToFront(element)
+		return nil
+	}
+
+	lc.entries[key] = lc.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for lc.order.Len() > lc.size {
+		lc.remove(lc.order.Back())
+	}
+	return nil
+}
+
+// Delete removes the given keys
+func (lc *lruCache) Delete(keys ...string) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := lc.entries[key]; ok {
+			lc.remove(element)
+		}
+	}
+	return nil
+}
+
+// Clear removes every entry
+func (lc *lruCache) Clear() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.order.Init()
+	lc.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// remove drops element from both the list and the index; callers hold mu
+func (lc *lruCache) remove(element *list.Element) {
+	lc.order.Remove(element)
+	delete(lc.entries, element.Value.(*lruEntry).key)
+}
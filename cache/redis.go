@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCache is a Cache backed by any server speaking the Redis protocol
+type redisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis connects to the Redis-protocol server at url (redis://host:6379/0)
+// and namespaces every key with prefix
+func NewRedis(url, prefix string) (Cache, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisCache{client: client, prefix: prefix}, nil
+}
+
+// Get returns the value stored under key and whether it was found
+func (rc *redisCache) Get(key string) ([]byte, bool, error) {
+	value, err := rc.client.Get(context.Background(), rc.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set stores value under key for ttl
+func (rc *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	return rc.client.Set(context.Background(), rc.prefix+key, value, ttl).Err()
+}
+
+// Delete removes the given keys
+func (rc *redisCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = rc.prefix + key
+	}
+	return rc.client.Del(context.Background(), prefixed...).Err()
+}
+
+// Clear removes every key under this cache's prefix
+func (rc *redisCache) Clear() error {
+	ctx := context.Background()
+	iter := rc.client.Scan(ctx, 0, rc.prefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return rc.client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,108 @@
+// Command logintiming measures how long /login takes for a registered email
+// versus unregistered ones, to check that response times don't reveal which
+// emails have accounts. Run it against a local server, e.g.
+//
+//	go run . --storage=memory &
+//	go run ./cmd/logintiming -email admin@example.com -n 200
+//
+// Wrong passwords soon lock the registered account; locked logins are meant
+// to take the same time too, but raise LOGIN_MAX_FAILURES and
+// LOGIN_IP_MAX_FAILURES on the server to time plain wrong-password logins.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080", "base URL of the server")
+	email := flag.String("email", "admin@example.com", "registered email to compare against")
+	samples := flag.Int("n", 100, "requests per group")
+	threshold := flag.Float64("t", 4, "fail when |Welch's t| exceeds this")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var known, unknown []time.Duration
+
+	// Interleave the groups so drift in server load affects both equally
+	for i := 0; i < *samples; i++ {
+		known = append(known, timeLogin(client, *baseURL, *email))
+		unknown = append(unknown, timeLogin(client, *baseURL, uuid.New().String()+"@example.com"))
+	}
+
+	report("registered", known)
+	report("unregistered", unknown)
+
+	t := welchT(known, unknown)
+	fmt.Printf("\nWelch's t = %.2f (threshold %.2f)\n", t, *threshold)
+	if math.Abs(t) > *threshold {
+		fmt.Println("FAIL: login time depends on whether the email is registered")
+		os.Exit(1)
+	}
+	fmt.Println("OK: no significant timing difference")
+}
+
+// timeLogin times one failed login for email
+func timeLogin(client *http.Client, baseURL, email string) time.Duration {
+	body, _ := json.Marshal(map[string]string{"email": email, "password": "not-the-password"})
+
+	start := time.Now()
+	resp, err := client.Post(baseURL+"/login", "application/json", bytes.NewReader(body))
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Fatalf("login request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		log.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	return elapsed
+}
+
+// report prints the distribution of durations
+func report(name string, durations []time.Duration) {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mean, stddev := meanStddev(durations)
+
+	fmt.Printf("%-13s n=%d min=%v p50=%v p90=%v p99=%v max=%v mean=%v stddev=%v\n",
+		name, len(sorted), sorted[0], percentile(sorted, 50), percentile(sorted, 90),
+		percentile(sorted, 99), sorted[len(sorted)-1],
+		time.Duration(mean), time.Duration(stddev))
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func meanStddev(durations []time.Duration) (float64, float64) {
+	var sum float64
+	for _, d := range durations {
+		sum += float64(d)
+	}
+	mean := sum / float64(len(durations))
+
+	var squares float64
+	for _, d := range durations {
+		squares += (float64(d) - mean) * (float64(d) - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(durations)-1))
+}
+
+// welchT is Welch's t statistic for the difference between the two means
+func welchT(a, b []time.Duration) float64 {
+	meanA, sdA := meanStddev(a)
+	meanB, sdB := meanStddev(b)
+	return (meanA - meanB) / math.Sqrt(sdA*sdA/float64(len(a))+sdB*sdB/float64(len(b)))
+}
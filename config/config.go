@@ -3,6 +3,10 @@ package config
 import (
     "log"
     "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "time"
 
     "github.com/joho/godotenv"
 )
@@ -11,6 +15,202 @@ type Config struct {
     Port        string
     DatabaseURL string
     JWTSecret   string
+    Storage     string
+
+    // User lookup cache: "none", "memory" (in-process LRU) or "redis"
+    CacheBackend     string
+    CacheSize        int
+    CacheTTL         time.Duration
+    CacheNegativeTTL time.Duration
+    RedisURL         string
+
+    // Soft-deleted users are purged once older than UserRetention (0 keeps them)
+    UserRetention time.Duration
+    PurgeInterval time.Duration
+
+    // Brute-force protection for /login
+    LoginMaxFailures   int
+    LoginIPMaxFailures int
+    LoginFailureWindow time.Duration
+    LoginLockout       time.Duration
+    LoginBaseDelay     time.Duration
+
+    // Proxies allowed to set X-Forwarded-For; the per-IP lockout relies on it
+    TrustedProxies []string
+
+    // Don't reveal on /register whether an email is already registered
+    PrivateRegistration bool
+
+    // Password hashing: algorithm for new hashes ("argon2id", "bcrypt" or
+    // "scrypt"), its cost, an optional pepper and the bounded worker pool
+    PasswordAlgorithm string
+    BcryptCost        int
+    Argon2Memory      int // KiB
+    Argon2Iterations  int
+    Argon2Parallelism int
+    PasswordPepper    string
+    PasswordPepperID  string
+    // RetiredPeppers are earlier peppers by ID, still used to verify (and
+    // then rehash) the hashes made with them
+    RetiredPeppers    map[string]string
+    // HashWorkers bounds the hashes computed at once. With Argon2 they hold
+    // up to HashWorkers × Argon2Memory KiB and run HashWorkers ×
+    // Argon2Parallelism threads; the default is NumCPU / Argon2Parallelism.
+    HashWorkers       int
+    HashQueueSize     int
+    HashQueueTimeout  time.Duration
+
+    // Password policy for registration, password changes and resets
+    PasswordMinLength  int
+    PasswordMaxBytes   int
+    PasswordMinClasses int
+    PasswordMinScore   int // zxcvbn score 0-4
+    PasswordHistory    int
+    // BreachedPasswords is a local HIBP list: a sorted file of SHA-1 hashes
+    // or a directory of range files
+    BreachedPasswords string
+
+    // Password for the seeded admin account. If empty, a random one is
+    // written to AdminPasswordFile (mode 0600) rather than logged.
+    AdminPassword     string
+    AdminPasswordFile string
+
+    // Email verification
+    RequireVerifiedEmail       bool
+    VerificationTTL            time.Duration
+    VerificationResendInterval time.Duration
+    // AppURL is the base of links in emails
+    AppURL string
+
+    // Password reset links and how often they can be requested (per email
+    // and per IP; the IP limit also covers redeeming links)
+    PasswordResetTTL time.Duration
+    ResetEmailLimit  int
+    ResetIPLimit     int
+    ResetLimitWindow time.Duration
+
+    // Two-factor authentication: the issuer shown in authenticator apps, how
+    // long a login has to give its second factor, and how many recovery
+    // codes users get
+    MFAIssuer        string
+    MFAChallengeTTL  time.Duration
+    MFARecoveryCodes int
+
+    // Cookie sessions for browsers: timeouts and how the cookie is set.
+    // SessionCookieSameSite is "strict", "lax" or "none".
+    SessionIdleTimeout     time.Duration
+    SessionAbsoluteTimeout time.Duration
+    SessionCookieName      string
+    SessionCookieDomain    string
+    SessionCookieSecure    bool
+    SessionCookieSameSite  string
+
+    // Login history: whether users are mailed about suspicious logins, and
+    // how many failures within LoginFailureWindow make the next success
+    // suspicious (0 turns that check off)
+    LoginAlerts        bool
+    LoginAlertFailures int
+
+    // Personal access tokens: how many each user can have (0 = no limit)
+    AccessTokenLimit int
+
+    // Service accounts: how long their client_credentials tokens last
+    ServiceTokenTTL time.Duration
+
+    // OAuth apps: how long authorization codes, access tokens and unused
+    // refresh tokens last
+    OAuthCodeTTL         time.Duration
+    OAuthAccessTokenTTL  time.Duration
+    OAuthRefreshTokenTTL time.Duration
+    // PEM file with the RSA key ID tokens are signed with; a temporary key
+    // is generated if empty
+    OIDCSigningKeyFile string
+
+    // External OpenID Connect providers users can log in with, and how
+    // long they have to do so once they are sent to one
+    OIDCProviders []OIDCProvider
+    OIDCLoginTTL  time.Duration
+
+    // How passwords are checked at login, tried in order: "local" (the
+    // password stored with the account) and "ldap"
+    LoginAuthenticators []string
+    // LDAP directory of the "ldap" authenticator. Filters take %s for the
+    // email (users) or the user's DN (groups); without a group filter the
+    // memberOf attribute is read. Members of LDAPAdminGroups get the admin
+    // role, listed with semicolons since DNs contain commas.
+    LDAPURL               string
+    LDAPStartTLS          bool
+    LDAPCAFile            string
+    LDAPBindDN            string
+    LDAPBindPassword      string
+    LDAPBaseDN            string
+    LDAPUserFilter        string
+    LDAPEmailAttribute    string
+    LDAPUsernameAttribute string
+    LDAPGroupBaseDN       string
+    LDAPGroupFilter       string
+    LDAPAdminGroups       []string
+    LDAPSignup            bool
+    LDAPTimeout           time.Duration
+
+    // External SAML 2.0 identity providers users can log in with, and how
+    // long they have to do so. The PEM files hold our certificate and RSA
+    // key, which sign AuthnRequests and decrypt assertions; optional.
+    SAMLProviders []SAMLProvider
+    SAMLLoginTTL  time.Duration
+    SAMLCertFile  string
+    SAMLKeyFile   string
+
+    // Outgoing email: "smtp", "file" (writes .eml files to MailOutboxDir) or
+    // "log" (development only; links lose their tokens). It has to be
+    // chosen, except with in-memory storage, which defaults to "log".
+    Mailer        string
+    MailFrom      string
+    MailOutboxDir string
+    SMTPHost      string
+    SMTPPort      int
+    SMTPUsername  string
+    SMTPPassword  string
+}
+
+// OIDCProvider is an external OpenID Connect provider. OIDC_PROVIDERS
+// lists their IDs; each one is configured with OIDC_<ID>_ISSUER,
+// OIDC_<ID>_CLIENT_ID, OIDC_<ID>_CLIENT_SECRET and optionally
+// OIDC_<ID>_NAME, OIDC_<ID>_SCOPES and OIDC_<ID>_SIGNUP.
+type OIDCProvider struct {
+    ID           string
+    Name         string
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    Scopes       []string
+    // Signup creates accounts on the first login of unknown emails
+    Signup bool
+}
+
+// SAMLProvider is an external SAML identity provider. SAML_PROVIDERS lists
+// their IDs; each one is configured with SAML_<ID>_METADATA_URL or
+// SAML_<ID>_METADATA_FILE and optionally SAML_<ID>_NAME, _BINDING
+// (redirect or post), _NAMEID_FORMAT, _SUBJECT_ATTRIBUTE,
+// _EMAIL_ATTRIBUTE, _USERNAME_ATTRIBUTE, _ROLE_ATTRIBUTE, _ADMIN_ROLES,
+// _SIGNUP and _IDP_INITIATED.
+type SAMLProvider struct {
+    ID                string
+    Name              string
+    MetadataURL       string
+    MetadataFile      string
+    Binding           string
+    NameIDFormat      string
+    SubjectAttribute  string
+    EmailAttribute    string
+    UsernameAttribute string
+    // Users whose RoleAttribute lists one of AdminRoles get the admin role
+    RoleAttribute string
+    AdminRoles    []string
+    // Signup creates accounts on the first login of unknown emails
+    Signup bool
+    // IDPInitiated accepts logins started at the provider
+    IDPInitiated bool
 }
 
 func LoadConfig() *Config {
@@ -19,10 +219,121 @@ func LoadConfig() *Config {
         log.Fatal("Error loading .env file")
     }
 
+    // Every Argon2 hash runs this many threads, so the default pool keeps
+    // all hashing within the CPUs and leaves room for other requests
+    argon2Parallelism := getEnvInt("ARGON2_PARALLELISM", 4)
+
     return &Config{
         Port:        getEnv("PORT", "8080"),
         DatabaseURL: getEnv("DATABASE_URL", ""),
         JWTSecret:   getEnv("JWT_SECRET", ""),
+        Storage:     getEnv("STORAGE", "database"),
+
+        CacheBackend:     getEnv("CACHE_BACKEND", "none"),
+        CacheSize:        getEnvInt("CACHE_SIZE", 10000),
+        CacheTTL:         getEnvDuration("CACHE_TTL", 5*time.Minute),
+        CacheNegativeTTL: getEnvDuration("CACHE_NEGATIVE_TTL", 30*time.Second),
+        RedisURL:         getEnv("REDIS_URL", "redis://localhost:6379/0"),
+
+        UserRetention: getEnvDuration("USER_RETENTION", 30*24*time.Hour),
+        PurgeInterval: getEnvDuration("PURGE_INTERVAL", time.Hour),
+
+        LoginMaxFailures:   getEnvInt("LOGIN_MAX_FAILURES", 5),
+        LoginIPMaxFailures: getEnvInt("LOGIN_IP_MAX_FAILURES", 50),
+        LoginFailureWindow: getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+        LoginLockout:       getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+        LoginBaseDelay:     getEnvDuration("LOGIN_BASE_DELAY", time.Second),
+
+        TrustedProxies: getEnvList("TRUSTED_PROXIES", nil),
+
+        PrivateRegistration: getEnvBool("PRIVATE_REGISTRATION", false),
+
+        PasswordAlgorithm: getEnv("PASSWORD_ALGORITHM", "argon2id"),
+        BcryptCost:        getEnvInt("BCRYPT_COST", 10),
+        Argon2Memory:      getEnvInt("ARGON2_MEMORY", 64*1024),
+        Argon2Iterations:  getEnvInt("ARGON2_ITERATIONS", 3),
+        Argon2Parallelism: argon2Parallelism,
+        PasswordPepper:    getEnv("PASSWORD_PEPPER", ""),
+        PasswordPepperID:  getEnv("PASSWORD_PEPPER_ID", "1"),
+        RetiredPeppers:    getRetiredPeppers(),
+        HashWorkers:       getEnvInt("HASH_WORKERS", max(1, runtime.NumCPU()/max(1, argon2Parallelism))),
+        HashQueueSize:     getEnvInt("HASH_QUEUE_SIZE", 64),
+        HashQueueTimeout:  getEnvDuration("HASH_QUEUE_TIMEOUT", 2*time.Second),
+
+        PasswordMinLength:  getEnvInt("PASSWORD_MIN_LENGTH", 8),
+        PasswordMaxBytes:   getEnvInt("PASSWORD_MAX_BYTES", 72),
+        PasswordMinClasses: getEnvInt("PASSWORD_MIN_CLASSES", 1),
+        PasswordMinScore:   getEnvInt("PASSWORD_MIN_SCORE", 2),
+        PasswordHistory:    getEnvInt("PASSWORD_HISTORY", 5),
+        BreachedPasswords:  getEnv("BREACHED_PASSWORDS", ""),
+
+        AdminPassword:     getEnv("ADMIN_PASSWORD", ""),
+        AdminPasswordFile: getEnv("ADMIN_PASSWORD_FILE", "admin-password.txt"),
+
+        RequireVerifiedEmail:       getEnvBool("REQUIRE_VERIFIED_EMAIL", false),
+        VerificationTTL:            getEnvDuration("VERIFICATION_TTL", 24*time.Hour),
+        VerificationResendInterval: getEnvDuration("VERIFICATION_RESEND_INTERVAL", time.Minute),
+        AppURL:                     strings.TrimSuffix(getEnv("APP_URL", "http://localhost:8080"), "/"),
+
+        PasswordResetTTL: getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+        ResetEmailLimit:  getEnvInt("RESET_EMAIL_LIMIT", 3),
+        ResetIPLimit:     getEnvInt("RESET_IP_LIMIT", 20),
+        ResetLimitWindow: getEnvDuration("RESET_LIMIT_WINDOW", time.Hour),
+
+        MFAIssuer:        getEnv("MFA_ISSUER", "Gin Tutorial"),
+        MFAChallengeTTL:  getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute),
+        MFARecoveryCodes: getEnvInt("MFA_RECOVERY_CODES", 10),
+
+        SessionIdleTimeout:     getEnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+        SessionAbsoluteTimeout: getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", 12*time.Hour),
+        SessionCookieName:      getEnv("SESSION_COOKIE_NAME", "session"),
+        SessionCookieDomain:    getEnv("SESSION_COOKIE_DOMAIN", ""),
+        SessionCookieSecure:    getEnvBool("SESSION_COOKIE_SECURE", true),
+        SessionCookieSameSite:  getEnv("SESSION_COOKIE_SAMESITE", "lax"),
+
+        LoginAlerts:        getEnvBool("LOGIN_ALERTS", true),
+        LoginAlertFailures: getEnvInt("LOGIN_ALERT_FAILURES", 5),
+
+        AccessTokenLimit: getEnvInt("ACCESS_TOKEN_LIMIT", 50),
+
+        ServiceTokenTTL: getEnvDuration("SERVICE_TOKEN_TTL", time.Hour),
+
+        OAuthCodeTTL:         getEnvDuration("OAUTH_CODE_TTL", time.Minute),
+        OAuthAccessTokenTTL:  getEnvDuration("OAUTH_ACCESS_TOKEN_TTL", time.Hour),
+        OAuthRefreshTokenTTL: getEnvDuration("OAUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour),
+        OIDCSigningKeyFile:   getEnv("OIDC_SIGNING_KEY_FILE", ""),
+
+        OIDCProviders: getOIDCProviders(),
+        OIDCLoginTTL:  getEnvDuration("OIDC_LOGIN_TTL", 10*time.Minute),
+
+        LoginAuthenticators:   getEnvList("LOGIN_AUTHENTICATORS", []string{"local"}),
+        LDAPURL:               getEnv("LDAP_URL", ""),
+        LDAPStartTLS:          getEnvBool("LDAP_START_TLS", false),
+        LDAPCAFile:            getEnv("LDAP_CA_FILE", ""),
+        LDAPBindDN:            getEnv("LDAP_BIND_DN", ""),
+        LDAPBindPassword:      getEnv("LDAP_BIND_PASSWORD", ""),
+        LDAPBaseDN:            getEnv("LDAP_BASE_DN", ""),
+        LDAPUserFilter:        getEnv("LDAP_USER_FILTER", "(&(objectClass=person)(mail=%s))"),
+        LDAPEmailAttribute:    getEnv("LDAP_EMAIL_ATTRIBUTE", "mail"),
+        LDAPUsernameAttribute: getEnv("LDAP_USERNAME_ATTRIBUTE", "uid"),
+        LDAPGroupBaseDN:       getEnv("LDAP_GROUP_BASE_DN", ""),
+        LDAPGroupFilter:       getEnv("LDAP_GROUP_FILTER", ""),
+        LDAPAdminGroups:       getEnvDNList("LDAP_ADMIN_GROUPS"),
+        LDAPSignup:            getEnvBool("LDAP_SIGNUP", true),
+        LDAPTimeout:           getEnvDuration("LDAP_TIMEOUT", 5*time.Second),
+
+        SAMLProviders: getSAMLProviders(),
+        SAMLLoginTTL:  getEnvDuration("SAML_LOGIN_TTL", 10*time.Minute),
+        SAMLCertFile:  getEnv("SAML_CERT_FILE", ""),
+        SAMLKeyFile:   getEnv("SAML_KEY_FILE", ""),
+
+        Mailer:        getEnv("MAILER", ""),
+        MailFrom:      getEnv("MAIL_FROM", "Gin Tutorial <no-reply@localhost>"),
+        MailOutboxDir: getEnv("MAIL_OUTBOX_DIR", "outbox"),
+        SMTPHost:      getEnv("SMTP_HOST", "localhost"),
+        SMTPPort:      getEnvInt("SMTP_PORT", 1025),
+        SMTPUsername:  getEnv("SMTP_USERNAME", ""),
+        SMTPPassword:  getEnv("SMTP_PASSWORD", ""),
     }
 }
 
@@ -32,3 +343,135 @@ func getEnv(key, defaultValue string) string {
     }
     return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+    value, exists := os.LookupEnv(key)
+    if !exists {
+        return defaultValue
+    }
+    parsed, err := strconv.Atoi(value)
+    if err != nil {
+        log.Fatalf("Invalid integer for %s: %v", key, err)
+    }
+    return parsed
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+    value, exists := os.LookupEnv(key)
+    if !exists {
+        return defaultValue
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        log.Fatalf("Invalid duration for %s: %v", key, err)
+    }
+    return parsed
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+    value, exists := os.LookupEnv(key)
+    if !exists {
+        return defaultValue
+    }
+    var list []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+// getEnvDNList reads a semicolon-separated list of LDAP DNs
+func getEnvDNList(key string) []string {
+    var list []string
+    for _, item := range strings.Split(getEnv(key, ""), ";") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+// getRetiredPeppers reads the IDs in PASSWORD_RETIRED_PEPPERS and each
+// one's secret from PASSWORD_PEPPER_<ID>
+func getRetiredPeppers() map[string]string {
+    peppers := make(map[string]string)
+    for _, id := range getEnvList("PASSWORD_RETIRED_PEPPERS", nil) {
+        key := "PASSWORD_PEPPER_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+        pepper := getEnv(key, "")
+        if pepper == "" {
+            log.Fatalf("%s is required for retired pepper %q", key, id)
+        }
+        peppers[id] = pepper
+    }
+    return peppers
+}
+
+func getOIDCProviders() []OIDCProvider {
+    var providers []OIDCProvider
+    for _, id := range getEnvList("OIDC_PROVIDERS", nil) {
+        if id == "ldap" {
+            // Identities of provider ldap link accounts to the LDAP directory
+            log.Fatal("ldap is reserved and can't be the ID of a OIDC provider")
+        }
+        prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+        provider := OIDCProvider{
+            ID:           id,
+            Name:         getEnv(prefix+"NAME", id),
+            Issuer:       getEnv(prefix+"ISSUER", ""),
+            ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+            ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+            Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+            Signup:       getEnvBool(prefix+"SIGNUP", true),
+        }
+        if provider.Issuer == "" || provider.ClientID == "" {
+            log.Fatalf("%sISSUER and %sCLIENT_ID are required", prefix, prefix)
+        }
+        providers = append(providers, provider)
+    }
+    return providers
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+    value, exists := os.LookupEnv(key)
+    if !exists {
+        return defaultValue
+    }
+    parsed, err := strconv.ParseBool(value)
+    if err != nil {
+        log.Fatalf("Invalid boolean for %s: %v", key, err)
+    }
+    return parsed
+}
+
+func getSAMLProviders() []SAMLProvider {
+    var providers []SAMLProvider
+    for _, id := range getEnvList("SAML_PROVIDERS", nil) {
+        if id == "ldap" {
+            // Identities of provider ldap link accounts to the LDAP directory
+            log.Fatal("ldap is reserved and can't be the ID of a SAML provider")
+        }
+        prefix := "SAML_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+        provider := SAMLProvider{
+            ID:                id,
+            Name:              getEnv(prefix+"NAME", id),
+            MetadataURL:       getEnv(prefix+"METADATA_URL", ""),
+            MetadataFile:      getEnv(prefix+"METADATA_FILE", ""),
+            Binding:           getEnv(prefix+"BINDING", "redirect"),
+            NameIDFormat:      getEnv(prefix+"NAMEID_FORMAT", ""),
+            SubjectAttribute:  getEnv(prefix+"SUBJECT_ATTRIBUTE", ""),
+            EmailAttribute:    getEnv(prefix+"EMAIL_ATTRIBUTE", ""),
+            UsernameAttribute: getEnv(prefix+"USERNAME_ATTRIBUTE", ""),
+            RoleAttribute:     getEnv(prefix+"ROLE_ATTRIBUTE", ""),
+            AdminRoles:        getEnvList(prefix+"ADMIN_ROLES", nil),
+            Signup:            getEnvBool(prefix+"SIGNUP", true),
+            IDPInitiated:      getEnvBool(prefix+"IDP_INITIATED", false),
+        }
+        if (provider.MetadataURL == "") == (provider.MetadataFile == "") {
+            log.Fatalf("One of %sMETADATA_URL and %sMETADATA_FILE is required", prefix, prefix)
+        }
+        providers = append(providers, provider)
+    }
+    return providers
+}
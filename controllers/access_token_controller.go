@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AccessTokenController defines the interface for users managing their
+// personal access tokens
+type AccessTokenController interface {
+	CreateToken(c *gin.Context)
+	ListTokens(c *gin.Context)
+	GetToken(c *gin.Context)
+	UpdateToken(c *gin.Context)
+	RevokeToken(c *gin.Context)
+}
+
+// accessTokenControllerImpl is the concrete implementation of AccessTokenController
+type accessTokenControllerImpl struct {
+	accessTokenService services.AccessTokenService
+}
+
+// NewAccessTokenController creates a new AccessTokenController instance
+func NewAccessTokenController(accessTokenService services.AccessTokenService) AccessTokenController {
+	return &accessTokenControllerImpl{
+		accessTokenService: accessTokenService,
+	}
+}
+
+// @Summary Create a personal access token
+// @Description Create a long-lived bearer token for scripts, limited to the given scopes. The response holds the token, which is not shown again.
+// @Tags Access tokens
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param token body models.CreateAccessTokenRequest true "Token details"
+// @Success 201 {object} models.CreatedAccessTokenResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input, scope or expiry"
+// @Failure 409 {object} models.ErrorResponse "Too many tokens"
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/tokens [post]
+func (ac *accessTokenControllerImpl) CreateToken(c *gin.Context) {
+	var input models.CreateAccessTokenRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	token, accessToken, err := ac.accessTokenService.Create(user.(*models.User), input.Name, input.Scopes, input.ExpiresAt)
+	if err != nil {
+		respondAccessTokenError(c, err)
+		return
+	}
+	response := accessTokenResponse(accessToken)
+	response["token"] = token
+	c.JSON(http.StatusCreated, response)
+}
+
+// @Summary List personal access tokens
+// @Description List the current user's personal access tokens, without the tokens themselves
+// @Tags Access tokens
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.AccessTokenResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/tokens [get]
+func (ac *accessTokenControllerImpl) ListTokens(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	tokens, err := ac.accessTokenService.List(user.(*models.User).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list access tokens"})
+		return
+	}
+	response := make([]gin.H, len(tokens))
+	for i := range tokens {
+		response[i] = accessTokenResponse(&tokens[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Get a personal access token
+// @Description Retrieve one of the current user's personal access tokens, without the token itself
+// @Tags Access tokens
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Token ID"
+// @Success 200 {object} models.AccessTokenResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /profile/tokens/{id} [get]
+func (ac *accessTokenControllerImpl) GetToken(c *gin.Context) {
+	id, ok := parseTokenID(c)
+	if !ok {
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	token, err := ac.accessTokenService.Get(user.(*models.User).ID, id)
+	if err != nil {
+		respondAccessTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accessTokenResponse(token))
+}
+
+// @Summary Update a personal access token
+// @Description Rename one of the current user's personal access tokens or change its scopes
+// @Tags Access tokens
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Token ID"
+// @Param token body models.UpdateAccessTokenRequest true "Fields to change"
+// @Success 200 {object} models.AccessTokenResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input or scope"
+// @Failure 404 {object} models.ErrorResponse
+// @Router /profile/tokens/{id} [patch]
+func (ac *accessTokenControllerImpl) UpdateToken(c *gin.Context) {
+	id, ok := parseTokenID(c)
+	if !ok {
+		return
+	}
+
+	var input models.UpdateAccessTokenRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	token, err := ac.accessTokenService.Update(user.(*models.User), id, services.AccessTokenChanges{
+		Name:   input.Name,
+		Scopes: input.Scopes,
+	})
+	if err != nil {
+		respondAccessTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accessTokenResponse(token))
+}
+
+// @Summary Revoke a personal access token
+// @Description Delete one of the current user's personal access tokens; it stops working right away
+// @Tags Access tokens
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Token ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /profile/tokens/{id} [delete]
+func (ac *accessTokenControllerImpl) RevokeToken(c *gin.Context) {
+	id, ok := parseTokenID(c)
+	if !ok {
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	if err := ac.accessTokenService.Revoke(user.(*models.User).ID, id); err != nil {
+		respondAccessTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Access token revoked successfully"})
+}
+
+// parseTokenID reads the :id path parameter, responding 400 if it is invalid
+func parseTokenID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// respondAccessTokenError maps access token service errors onto HTTP status codes
+func respondAccessTokenError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAccessTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidScope), errors.Is(err, services.ErrInvalidExpiry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTooManyAccessTokens):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
+
+// accessTokenResponse renders a token for API responses (see
+// models.AccessTokenResponse)
+func accessTokenResponse(token *models.AccessToken) gin.H {
+	return gin.H{
+		"id":           token.ID,
+		"name":         token.Name,
+		"hint":         token.Hint,
+		"scopes":       token.ScopeList(),
+		"expires_at":   token.ExpiresAt,
+		"last_used_at": token.LastUsedAt,
+		"last_used_ip": token.LastUsedIP,
+		"created_at":   token.CreatedAt,
+	}
+}
@@ -0,0 +1,602 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminController defines the interface for the admin-only user management controller
+type AdminController interface {
+	ListUsers(c *gin.Context)
+	GetUser(c *gin.Context)
+	UpdateUser(c *gin.Context)
+	PatchUser(c *gin.Context)
+	DeleteUser(c *gin.Context)
+	RestoreUser(c *gin.Context)
+	PurgeUser(c *gin.Context)
+	UnlockUser(c *gin.Context)
+	ResetUserMFA(c *gin.Context)
+	ListUserSessions(c *gin.Context)
+	RevokeUserSession(c *gin.Context)
+	RevokeUserSessions(c *gin.Context)
+	ListUserLogins(c *gin.Context)
+	ListUserIdentities(c *gin.Context)
+	MergeUser(c *gin.Context)
+}
+
+// adminControllerImpl is the concrete implementation of AdminController
+type adminControllerImpl struct {
+	userService       services.UserService
+	mfaService        services.MFAService
+	sessionService    services.SessionService
+	loginHistory      services.LoginHistory
+	federationService services.FederationService
+}
+
+// NewAdminController creates a new AdminController instance
+func NewAdminController(userService services.UserService, mfaService services.MFAService, sessionService services.SessionService, loginHistory services.LoginHistory, federationService services.FederationService) AdminController {
+	return &adminControllerImpl{
+		userService:       userService,
+		mfaService:        mfaService,
+		sessionService:    sessionService,
+		loginHistory:      loginHistory,
+		federationService: federationService,
+	}
+}
+
+// @Summary List users
+// @Description List users; deleted=only lists the trash, deleted=include lists everyone
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param deleted query string false "Soft-delete filter" Enums(include, only)
+// @Success 200 {array} models.UserResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /users [get]
+func (ac *adminControllerImpl) ListUsers(c *gin.Context) {
+	users, err := ac.userService.ListUsers(c.Query("deleted"))
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	response := make([]gin.H, len(users))
+	for i := range users {
+		response[i] = userResponse(&users[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Get a user
+// @Description Retrieve a user; the response carries its ETag
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param If-None-Match header string false "ETag from a previous response"
+// @Success 200 {object} models.UserResponse
+// @Success 304 "Not Modified"
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id} [get]
+func (ac *adminControllerImpl) GetUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := ac.userService.GetProfile(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if notModified(c, user) {
+		return
+	}
+
+	c.JSON(http.StatusOK, userResponse(user))
+}
+
+// @Summary Replace a user
+// @Description Replace a user's username, email and role. Requires the user's current ETag in If-Match.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param If-Match header string true "Current ETag of the user"
+// @Param user body models.UpdateUserRequest true "New user details"
+// @Success 200 {object} models.UserResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse
+// @Failure 412 {object} models.ErrorResponse
+// @Failure 428 {object} models.ErrorResponse
+// @Router /users/{id} [put]
+func (ac *adminControllerImpl) UpdateUser(c *gin.Context) {
+	var input models.UpdateUserRequest
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ac.updateUser(c, services.UserChanges{
+		Username: &input.Username,
+		Email:    &input.Email,
+		Role:     &input.Role,
+	})
+}
+
+// @Summary Update a user
+// @Description Change some of a user's username, email and role. Requires the user's current ETag in If-Match.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param If-Match header string true "Current ETag of the user"
+// @Param user body models.PatchUserRequest true "Fields to change"
+// @Success 200 {object} models.UserResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse
+// @Failure 412 {object} models.ErrorResponse
+// @Failure 428 {object} models.ErrorResponse
+// @Router /users/{id} [patch]
+func (ac *adminControllerImpl) PatchUser(c *gin.Context) {
+	var input models.PatchUserRequest
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ac.updateUser(c, services.UserChanges{
+		Username: input.Username,
+		Email:    input.Email,
+		Role:     input.Role,
+	})
+}
+
+// updateUser applies changes to the user in the path, honouring If-Match
+func (ac *adminControllerImpl) updateUser(c *gin.Context, changes services.UserChanges) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	current, isUser := c.Get("user")
+	if isUser && changes.Role != nil && current.(*models.User).ID == userID && *changes.Role != current.(*models.User).Role {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role"})
+		return
+	}
+
+	user, err := ac.userService.GetProfile(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if !checkIfMatch(c, user) {
+		return
+	}
+
+	user, err = ac.userService.UpdateUser(userID, user.Version, changes)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.Header("ETag", userETag(user))
+	c.JSON(http.StatusOK, userResponse(user))
+}
+
+// @Summary Delete a user
+// @Description Soft-delete a user; it can be restored until it is purged. Requires the user's current ETag in If-Match.
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param If-Match header string true "Current ETag of the user"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 412 {object} models.ErrorResponse
+// @Failure 428 {object} models.ErrorResponse
+// @Router /users/{id} [delete]
+func (ac *adminControllerImpl) DeleteUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	if isCurrentUser(c, userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+
+	user, err := ac.userService.GetProfile(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if !checkIfMatch(c, user) {
+		return
+	}
+
+	if err := ac.userService.DeleteUser(userID, user.Version); err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+// @Summary Restore a user
+// @Description Restore a soft-deleted user
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.UserResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse
+// @Router /users/{id}/restore [post]
+func (ac *adminControllerImpl) RestoreUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := ac.userService.RestoreUser(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.Header("ETag", userETag(user))
+	c.JSON(http.StatusOK, userResponse(user))
+}
+
+// @Summary Purge a user
+// @Description Permanently delete a user, whether soft-deleted or not. Requires the user's current ETag in If-Match; a 412 response carries it, for soft-deleted users too.
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param If-Match header string true "Current ETag of the user"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 412 {object} models.ErrorResponse
+// @Failure 428 {object} models.ErrorResponse
+// @Router /users/{id}/purge [delete]
+func (ac *adminControllerImpl) PurgeUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	if isCurrentUser(c, userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot purge your own account"})
+		return
+	}
+
+	user, err := ac.userService.GetUserIncludingDeleted(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if !checkIfMatch(c, user) {
+		return
+	}
+
+	if err := ac.userService.PurgeUser(userID, user.Version); err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User purged successfully"})
+}
+
+// @Summary Unlock a user
+// @Description Clear the failed logins that locked out a user
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/unlock [post]
+func (ac *adminControllerImpl) UnlockUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := ac.userService.UnlockUser(userID); err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked successfully"})
+}
+
+// @Summary Reset a user's two-factor authentication
+// @Description Turn off two-factor authentication and delete the recovery codes of a user who lost access to both
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid ID or two-factor authentication is not enabled"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/2fa [delete]
+func (ac *adminControllerImpl) ResetUserMFA(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := ac.mfaService.ResetMFA(userID); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset successfully"})
+}
+
+// @Summary List a user's sessions
+// @Description List a user's active logins with the device, IP and activity of each
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {array} models.SessionInfoResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/sessions [get]
+func (ac *adminControllerImpl) ListUserSessions(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := ac.userService.GetProfile(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	sessions, err := ac.sessionService.List(user)
+	if err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sessionList(sessions, c.GetString("session_id")))
+}
+
+// @Summary Revoke a user's session
+// @Description Sign out one of a user's logins; its token or cookie stops working right away
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param session path string true "Session ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/sessions/{session} [delete]
+func (ac *adminControllerImpl) RevokeUserSession(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := ac.sessionService.Revoke(userID, c.Param("session")); err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// @Summary Revoke all of a user's sessions
+// @Description Sign out every login of a user, except the admin's own current one
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} models.RevokedSessionsResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/sessions [delete]
+func (ac *adminControllerImpl) RevokeUserSessions(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := ac.userService.GetProfile(userID)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	revoked, err := ac.sessionService.RevokeOthers(user, c.GetString("session_id"))
+	if err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// @Summary List a user's login history
+// @Description List a user's recent login attempts, newest first; suspicious logins carry flags
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param limit query int false "How many events to return (default 50, at most 200)"
+// @Success 200 {array} models.LoginEventResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/logins [get]
+func (ac *adminControllerImpl) ListUserLogins(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+
+	if _, err := ac.userService.GetProfile(userID); err != nil {
+		respondUserError(c, err)
+		return
+	}
+	events, err := ac.loginHistory.List(userID, limit)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, loginEventList(events))
+}
+
+// @Summary List a user's linked identities
+// @Description List the identity provider users linked to a user's account
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {array} models.IdentityResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /users/{id}/identities [get]
+func (ac *adminControllerImpl) ListUserIdentities(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+
+	identities, err := ac.federationService.Identities(userID)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, identityList(identities))
+}
+
+// @Summary Merge a duplicate account into a user
+// @Description Move the linked identities of a duplicate account to this user, then soft-delete the duplicate. The user keeps its own password, email, role and two-factor authentication; the duplicate's logins and tokens stop working, and it can be restored without its identities.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID of the account to keep"
+// @Param merge body models.MergeUsersRequest true "Account to merge"
+// @Success 200 {array} models.IdentityResponse "The user's identities after the merge"
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse "Both accounts are linked to the same provider, or the duplicate's LDAP entry would move onto a local password"
+// @Router /users/{id}/merge [post]
+func (ac *adminControllerImpl) MergeUser(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	var input models.MergeUsersRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.DuplicateID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot merge an account into itself"})
+		return
+	}
+	if isCurrentUser(c, input.DuplicateID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot merge away your own account"})
+		return
+	}
+
+	identities, err := ac.federationService.Merge(userID, input.DuplicateID)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, identityList(identities))
+}
+
+// parseUserID reads the :id path parameter, responding 400 if it is invalid
+func parseUserID(c *gin.Context) (uint, bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil || userID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// isCurrentUser reports whether userID is the user making the request;
+// service accounts aren't any user
+func isCurrentUser(c *gin.Context, userID uint) bool {
+	current, ok := c.Get("user")
+	return ok && current.(*models.User).ID == userID
+}
+
+// respondUserError maps service errors onto HTTP status codes
+func respondUserError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUserConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrVersionConflict):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidFilter):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrDirectoryAccount):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAuthenticatorUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// userResponse renders a user for API responses (see models.UserResponse)
+func userResponse(user *models.User) gin.H {
+	response := gin.H{
+		"id":          user.ID,
+		"username":    user.Username,
+		"email":       user.Email,
+		"role":        user.Role,
+		"created_at":  user.CreatedAt,
+		"mfa_enabled": user.MFAEnabled(),
+	}
+	if user.VerifiedAt != nil {
+		response["verified_at"] = *user.VerifiedAt
+	}
+	if user.DeletedAt.Valid {
+		response["deleted_at"] = user.DeletedAt.Time
+	}
+	return response
+}
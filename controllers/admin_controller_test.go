@@ -0,0 +1,54 @@
+package controllers_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gin-tutorial/controllers"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestPurgeUserRequiresIfMatch(t *testing.T) {
+	ts := newTestServer(t)
+	admin := controllers.NewAdminController(ts.userService, nil, nil, nil, nil)
+	r := gin.New()
+	r.DELETE("/users/:id/purge", admin.PurgeUser)
+	purge := func(userID uint, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/users/%d/purge", userID), nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	alice := createUser(t, ts.userRepo, "alice", "correct horse 1")
+	if err := ts.userRepo.Delete(alice.ID, alice.Version); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if rec := purge(alice.ID, ""); rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("purge without If-Match = %d, want 428", rec.Code)
+	}
+	// The ETag from before the soft delete is stale; the 412 has the current one
+	rec := purge(alice.ID, fmt.Sprintf(`"%d.%d"`, alice.ID, alice.Version))
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get("ETag") == "" {
+		t.Fatalf("purge with a stale ETag = %d %q, want 412 with the current ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+	if _, err := ts.userRepo.FindByIDIncludingDeleted(alice.ID); err != nil {
+		t.Fatalf("refused purge removed the user: %v", err)
+	}
+
+	if rec := purge(alice.ID, rec.Header().Get("ETag")); rec.Code != http.StatusOK {
+		t.Fatalf("purge with the current ETag = %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := ts.userRepo.FindByIDIncludingDeleted(alice.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("user after the purge: got %v, want ErrRecordNotFound", err)
+	}
+}
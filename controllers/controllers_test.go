@@ -0,0 +1,137 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gin-tutorial/controllers"
+	"gin-tutorial/mailer"
+	"gin-tutorial/middleware"
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testJWTSecret = "test-secret"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// Cheap hashes keep the tests fast; the parameters don't matter here
+	models.Passwords = password.MustNewRegistry(password.Options{
+		Argon2: password.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+	})
+	os.Exit(m.Run())
+}
+
+// discardMailer drops every message
+type discardMailer struct{}
+
+func (discardMailer) Send(mailer.Message) error { return nil }
+
+// testServer runs the routes under test over in-memory repositories, wired
+// the way main does
+type testServer struct {
+	// Server's URL is also the issuer
+	*httptest.Server
+	userRepo     repository.UserRepository
+	userService  services.UserService
+	oauthService services.OAuthService
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	// The issuer has to be known before the services are made
+	server := httptest.NewUnstartedServer(nil)
+	issuer := "http://" + server.Listener.Addr().String()
+
+	bus := pubsub.NewLocalBus()
+	hashPool := password.NewPool(2, 10, time.Second)
+	userRepo := repository.NewMemoryUserRepository()
+	attemptRepo := repository.NewMemoryLoginAttemptRepository()
+	loginGuard := services.NewLoginGuard(attemptRepo, services.LockoutPolicy{MaxAccountFailures: 5, Window: time.Minute, Lockout: time.Minute})
+	loginHistory := services.NewLoginHistory(repository.NewMemoryLoginEventRepository(), discardMailer{}, services.LoginHistoryConfig{})
+	userService := services.NewUserService(userRepo, repository.NewMemoryPasswordHistoryRepository(), repository.NewMemoryIdentityRepository(),
+		services.NewTokenService(repository.NewMemoryUserTokenRepository(), testJWTSecret), loginGuard, loginHistory,
+		services.NewRateLimiter(attemptRepo), bus, discardMailer{}, hashPool, services.UserServiceConfig{JWTSecret: testJWTSecret, AppURL: issuer})
+	revocations := services.NewRevocationService(repository.NewMemoryRevokedTokenRepository(), bus)
+	sessions := services.NewSessionService(repository.NewMemorySessionRepository(), revocations, services.SessionConfig{
+		TokenTTL:        time.Hour,
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: time.Hour,
+		ClientTokenTTL:  time.Hour,
+	})
+	mfa := services.NewMFAService(userRepo, repository.NewMemoryRecoveryCodeRepository(), revocations, loginGuard, loginHistory, bus, hashPool,
+		services.MFAServiceConfig{JWTSecret: testJWTSecret, Issuer: "test", ChallengeTTL: time.Minute, RecoveryCodes: 8})
+	accessTokens := services.NewAccessTokenService(repository.NewMemoryAccessTokenRepository(), services.AccessTokenConfig{})
+	serviceAccounts := services.NewServiceAccountService(repository.NewMemoryServiceAccountRepository(), userRepo, revocations,
+		services.ServiceAccountConfig{JWTSecret: testJWTSecret, TokenTTL: time.Hour, TokenEndpoint: issuer + "/oauth/token"})
+	signingKey, err := services.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: %v", err)
+	}
+	oauthClientRepo := repository.NewMemoryOAuthClientRepository()
+	oauthService := services.NewOAuthService(oauthClientRepo, repository.NewMemoryOAuthGrantRepository(oauthClientRepo), userService, sessions, services.OAuthConfig{
+		JWTSecret:       testJWTSecret,
+		CodeTTL:         time.Minute,
+		RefreshTokenTTL: time.Hour,
+		Issuer:          issuer,
+		SigningKey:      signingKey,
+	})
+	cookie := middleware.SessionCookie{Name: "session", SameSite: http.SameSiteLaxMode}
+	oauthController := controllers.NewOAuthController(serviceAccounts, oauthService, userService, mfa, sessions, cookie)
+	oidcController := controllers.NewOIDCController(oauthService, signingKey, issuer)
+
+	r := gin.New()
+	r.GET("/oauth/authorize", oauthController.Authorize)
+	r.POST("/oauth/authorize", oauthController.AuthorizeSubmit)
+	r.POST("/oauth/token", oauthController.Token)
+	r.GET("/.well-known/openid-configuration", oidcController.Configuration)
+	r.GET("/.well-known/jwks.json", oidcController.JWKS)
+	authorized := r.Group("/").Use(middleware.AuthMiddleware(testJWTSecret, revocations, userService, sessions, accessTokens, serviceAccounts, cookie))
+	openID := middleware.RequireScope(models.ScopeOpenID)
+	authorized.GET("/userinfo", openID, oidcController.UserInfo)
+	authorized.POST("/userinfo", openID, oidcController.UserInfo)
+
+	server.Config.Handler = r
+	server.Start()
+	t.Cleanup(server.Close)
+	return &testServer{Server: server, userRepo: userRepo, userService: userService, oauthService: oauthService}
+}
+
+// browser returns a client that keeps cookies and stops at redirects, like
+// a user agent whose redirects the test follows by hand
+func browser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar: %v", err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// createUser stores a verified user with password
+func createUser(t *testing.T, repo repository.UserRepository, name, pass string) *models.User {
+	t.Helper()
+	now := time.Now()
+	user := &models.User{Username: name, Email: name + "@example.com", Password: pass, Role: models.RoleUser, VerifiedAt: &now}
+	if err := user.HashPassword(); err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if err := repo.Create(user); err != nil {
+		t.Fatalf("Create %s: %v", name, err)
+	}
+	return user
+}
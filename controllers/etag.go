@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"fmt"
+	"gin-tutorial/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userETag returns the strong ETag for the current version of user
+func userETag(user *models.User) string {
+	return fmt.Sprintf(`"%d.%d"`, user.ID, user.Version)
+}
+
+// notModified sets the ETag header for user and, if the request's
+// If-None-Match already has it, responds 304 and returns true
+func notModified(c *gin.Context, user *models.User) bool {
+	etag := userETag(user)
+	c.Header("ETag", etag)
+
+	// If-None-Match uses the weak comparison
+	for _, candidate := range etagList(c.GetHeader("If-None-Match")) {
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch requires an If-Match header naming the current version of
+// user. It responds 428 when the header is missing and 412 when it doesn't
+// match, returning false in both cases.
+func checkIfMatch(c *gin.Context, user *models.User) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required"})
+		return false
+	}
+
+	// If-Match uses the strong comparison, so weak ETags never match
+	etag := userETag(user)
+	for _, candidate := range etagList(header) {
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	c.Header("ETag", etag)
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "User has been modified, fetch it again"})
+	return false
+}
+
+// etagList splits a comma-separated If-Match/If-None-Match header
+func etagList(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		if etag = strings.TrimSpace(etag); etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// federatedLoginCookie keeps the state token of a login with an identity
+// provider until its callback. It is only sent to /auth/oidc/ and must be
+// SameSite=Lax at most: the callback is a navigation from the provider.
+const (
+	federatedLoginCookie     = "oidc_login"
+	federatedLoginCookiePath = "/auth/oidc/"
+)
+
+// linkReauthWindow is how recent the login of an account without a password
+// must be to link an identity, since there is no password to confirm
+const linkReauthWindow = 5 * time.Minute
+
+// @Summary List identity providers
+// @Description List the external OpenID Connect providers users can log in with
+// @Tags Auth
+// @Produce json
+// @Success 200 {array} models.IdentityProviderResponse
+// @Router /auth/oidc [get]
+func (uc *userControllerImpl) ListIdentityProviders(c *gin.Context) {
+	providers := uc.federationService.Providers()
+	response := make([]gin.H, len(providers))
+	for i, provider := range providers {
+		response[i] = gin.H{
+			"id":        provider.ID,
+			"name":      provider.Name,
+			"login_url": "/auth/oidc/" + url.PathEscape(provider.ID) + "/login",
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Log in with an identity provider
+// @Description Redirect the browser to an external OpenID Connect provider. After the login there, the provider sends the browser back to /auth/oidc/{provider}/callback.
+// @Tags Auth
+// @Param provider path string true "Provider ID"
+// @Param session query bool false "Start a session cookie instead of returning a JWT"
+// @Success 302 {string} string "Redirect to the provider"
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 502 {object} models.ErrorResponse "The provider is unavailable"
+// @Router /auth/oidc/{provider}/login [get]
+func (uc *userControllerImpl) FederatedLogin(c *gin.Context) {
+	session, _ := strconv.ParseBool(c.Query("session"))
+	authURL, stateToken, err := uc.federationService.Begin(c.Param("provider"), session)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+
+	uc.setFederatedLoginCookie(c, stateToken)
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// @Summary Identity provider callback
+// @Description Where the identity provider sends the browser back to. Logs in the account linked to the provider's user, or the one with the email the provider verified, linking or creating it, and answers like POST /login. When the login was started at POST /profile/identities, links the provider's user to that account instead.
+// @Tags Auth
+// @Produce json
+// @Param provider path string true "Provider ID"
+// @Param code query string false "Authorization code"
+// @Param state query string false "State sent to the provider"
+// @Param error query string false "Error from the provider"
+// @Success 200 {object} models.TokenResponse
+// @Success 201 {object} models.SessionResponse "Session started; the cookie is set"
+// @Success 201 {object} models.IdentityResponse "Identity linked"
+// @Success 202 {object} models.MFARequiredResponse "A second factor is required"
+// @Failure 400 {object} models.ErrorResponse "Invalid or expired login state"
+// @Failure 401 {object} models.ErrorResponse "The provider refused the login, or it didn't check out"
+// @Failure 403 {object} models.ErrorResponse "No verified email, or no account may be used for it"
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse "The identity is linked to another account, or the account to another identity of the provider"
+// @Router /auth/oidc/{provider}/callback [get]
+func (uc *userControllerImpl) FederatedCallback(c *gin.Context) {
+	stateToken, _ := c.Cookie(federatedLoginCookie)
+	// The state token is single use either way
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     federatedLoginCookie,
+		Path:     federatedLoginCookiePath,
+		MaxAge:   -1,
+		Secure:   uc.sessionCookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Header("Cache-Control", "no-store")
+
+	if providerError := c.Query("error"); providerError != "" {
+		logrus.WithFields(logrus.Fields{
+			"provider":    c.Param("provider"),
+			"error":       providerError,
+			"description": c.Query("error_description"),
+		}).Info("Identity provider refused the login")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": services.ErrFederatedLogin.Error()})
+		return
+	}
+
+	login, err := uc.federationService.Complete(c.Request.Context(), c.Param("provider"), stateToken, c.Query("state"), c.Query("code"), loginMeta(c))
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	if login.Linked != nil {
+		c.JSON(http.StatusCreated, identityResponse(login.Linked))
+		return
+	}
+	uc.startLogin(c, login.User, login.Session)
+}
+
+// @Summary List linked identities
+// @Description List the identity provider users linked to the current user's account; logging in with any of them logs in the account
+// @Tags User
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.IdentityResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Router /profile/identities [get]
+func (uc *userControllerImpl) ListIdentities(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	identities, err := uc.federationService.Identities(user.(*models.User).ID)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, identityList(identities))
+}
+
+// @Summary Link an identity
+// @Description Start linking a user of an identity provider to the current user's account. Needs the password, or for accounts without one a login in the last five minutes. Send the browser to the returned URL; the provider sends it back to /auth/oidc/{provider}/callback, which links the identity. The state cookie is set on this response.
+// @Tags User
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param identity body models.LinkIdentityRequest true "Provider and password"
+// @Success 200 {object} models.LinkIdentityResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse "The login is too old; log in again"
+// @Failure 403 {object} models.ErrorResponse "Wrong password"
+// @Failure 404 {object} models.ErrorResponse "Unknown provider"
+// @Failure 429 {object} models.ErrorResponse "Too many recent failures"
+// @Failure 502 {object} models.ErrorResponse "The provider is unavailable"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes (see Retry-After), or the LDAP directory is unreachable"
+// @Router /profile/identities [post]
+func (uc *userControllerImpl) LinkIdentity(c *gin.Context) {
+	var input models.LinkIdentityRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	value, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+	user := value.(*models.User)
+
+	err := uc.userService.ConfirmPassword(user.ID, input.Password, loginMeta(c))
+	if respondBusy(c, err) {
+		return
+	}
+	if errors.Is(err, services.ErrNoPassword) {
+		if time.Since(loginTime(c)) > linkReauthWindow {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in again to link an identity"})
+			return
+		}
+	} else if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+
+	authURL, stateToken, err := uc.federationService.BeginLink(input.Provider, user.ID)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	uc.setFederatedLoginCookie(c, stateToken)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// @Summary Unlink an identity
+// @Description Remove an identity from the current user's account. The last identity of an account without a password can't be removed, nor can the link to an LDAP directory entry.
+// @Tags User
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Identity ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse "It links the account to its LDAP directory entry"
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse "It is the account's only way to log in"
+// @Router /profile/identities/{id} [delete]
+func (uc *userControllerImpl) UnlinkIdentity(c *gin.Context) {
+	identityID, ok := parsePathID(c, "id", "identity")
+	if !ok {
+		return
+	}
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	if err := uc.federationService.Unlink(user.(*models.User).ID, identityID); err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked successfully"})
+}
+
+// setFederatedLoginCookie hands the browser the state token of a login or
+// link with an identity provider
+func (uc *userControllerImpl) setFederatedLoginCookie(c *gin.Context, stateToken string) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     federatedLoginCookie,
+		Value:    stateToken,
+		Path:     federatedLoginCookiePath,
+		MaxAge:   int(uc.federationService.StateTTL().Seconds()),
+		Secure:   uc.sessionCookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginTime returns when the current session or token was issued
+func loginTime(c *gin.Context) time.Time {
+	if session, ok := c.Get("session"); ok {
+		return session.(*models.Session).CreatedAt
+	}
+	if claims, ok := c.Get("claims"); ok {
+		return time.Unix(claims.(*models.Claims).IssuedAt, 0)
+	}
+	return time.Time{}
+}
+
+// identityList renders identities for API responses
+func identityList(identities []models.Identity) []gin.H {
+	response := make([]gin.H, len(identities))
+	for i := range identities {
+		response[i] = identityResponse(&identities[i])
+	}
+	return response
+}
+
+// identityResponse renders an identity for API responses (see
+// models.IdentityResponse)
+func identityResponse(identity *models.Identity) gin.H {
+	response := gin.H{
+		"id":        identity.ID,
+		"provider":  identity.Provider,
+		"subject":   identity.Subject,
+		"linked_at": identity.LinkedAt,
+	}
+	if identity.Email != "" {
+		response["email"] = identity.Email
+	}
+	return response
+}
+
+// respondFederationError maps federated login and identity errors onto HTTP
+// status codes
+func respondFederationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrProviderNotFound), errors.Is(err, services.ErrIdentityNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidLoginState):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrProviderUnavailable):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrFederatedLogin):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUnverifiedEmail), errors.Is(err, services.ErrAccountNotLinkable),
+		errors.Is(err, services.ErrSignupDisabled), errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrIdentityInUse), errors.Is(err, services.ErrProviderAlreadyLinked),
+		errors.Is(err, services.ErrLastLoginMethod), errors.Is(err, services.ErrMergeConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrVersionConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MFAController defines the interface for the two-factor authentication controller
+type MFAController interface {
+	EnrollTOTP(c *gin.Context)
+	ConfirmTOTP(c *gin.Context)
+	DisableTOTP(c *gin.Context)
+	RegenerateRecoveryCodes(c *gin.Context)
+}
+
+// mfaControllerImpl is the concrete implementation of MFAController
+type mfaControllerImpl struct {
+	mfaService services.MFAService
+}
+
+// NewMFAController creates a new MFAController instance
+func NewMFAController(mfaService services.MFAService) MFAController {
+	return &mfaControllerImpl{
+		mfaService: mfaService,
+	}
+}
+
+// @Summary Start TOTP enrollment
+// @Description Create a new TOTP secret for an authenticator app. Two-factor authentication only turns on once a code from it is confirmed; enrolling again replaces an unconfirmed secret.
+// @Tags 2FA
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.TOTPEnrollmentResponse
+// @Failure 409 {object} models.ErrorResponse "Two-factor authentication is already enabled"
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/2fa/totp [post]
+func (mc *mfaControllerImpl) EnrollTOTP(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	enrollment, err := mc.mfaService.EnrollTOTP(user.(*models.User).ID)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(enrollment.QRCode),
+	})
+}
+
+// @Summary Confirm TOTP enrollment
+// @Description Turn on two-factor authentication with a code from the enrolled authenticator. The response lists the recovery codes, which are not shown again.
+// @Tags 2FA
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param code body models.TOTPCodeRequest true "TOTP code"
+// @Success 200 {object} models.RecoveryCodesResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid code, or no enrollment was started"
+// @Failure 409 {object} models.ErrorResponse "Two-factor authentication is already enabled"
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/2fa/totp/confirm [post]
+func (mc *mfaControllerImpl) ConfirmTOTP(c *gin.Context) {
+	var input models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	codes, err := mc.mfaService.ConfirmTOTP(user.(*models.User).ID, input.Code)
+	if errors.Is(err, services.ErrInvalidMFACode) {
+		// Nothing to re-authenticate here, the authenticator is just set up wrong
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// @Summary Disable TOTP
+// @Description Turn off two-factor authentication; needs the password and a TOTP or recovery code
+// @Tags 2FA
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param credentials body models.MFAReauthRequest true "Password and second factor"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse "Two-factor authentication is not enabled"
+// @Failure 403 {object} models.ErrorResponse "Wrong password or code"
+// @Failure 429 {object} models.ErrorResponse "Too many recent failures"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes (see Retry-After), or the LDAP directory is unreachable"
+// @Router /profile/2fa/totp/disable [post]
+func (mc *mfaControllerImpl) DisableTOTP(c *gin.Context) {
+	var input models.MFAReauthRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	err := mc.mfaService.DisableTOTP(user.(*models.User).ID, input.Password, input.Code, loginMeta(c))
+	if respondBusy(c, err) {
+		return
+	}
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// @Summary Regenerate recovery codes
+// @Description Replace every recovery code with new ones; needs the password and a TOTP or recovery code
+// @Tags 2FA
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param credentials body models.MFAReauthRequest true "Password and second factor"
+// @Success 200 {object} models.RecoveryCodesResponse
+// @Failure 400 {object} models.ErrorResponse "Two-factor authentication is not enabled"
+// @Failure 403 {object} models.ErrorResponse "Wrong password or code"
+// @Failure 429 {object} models.ErrorResponse "Too many recent failures"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes (see Retry-After), or the LDAP directory is unreachable"
+// @Router /profile/2fa/recovery-codes [post]
+func (mc *mfaControllerImpl) RegenerateRecoveryCodes(c *gin.Context) {
+	var input models.MFAReauthRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	codes, err := mc.mfaService.RegenerateRecoveryCodes(user.(*models.User).ID, input.Password, input.Code, loginMeta(c))
+	if respondBusy(c, err) {
+		return
+	}
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// respondMFAError maps MFA service errors onto HTTP status codes
+func respondMFAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrMFAAlreadyEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFANotEnabled), errors.Is(err, services.ErrMFANotEnrolled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
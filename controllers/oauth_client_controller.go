@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OAuthClientController defines the interface for admins registering the
+// apps users log in to with OAuth
+type OAuthClientController interface {
+	ListClients(c *gin.Context)
+	CreateClient(c *gin.Context)
+	GetClient(c *gin.Context)
+	UpdateClient(c *gin.Context)
+	DeleteClient(c *gin.Context)
+	RotateSecret(c *gin.Context)
+}
+
+// oauthClientControllerImpl is the concrete implementation of OAuthClientController
+type oauthClientControllerImpl struct {
+	oauthService services.OAuthService
+}
+
+// NewOAuthClientController creates a new OAuthClientController instance
+func NewOAuthClientController(oauthService services.OAuthService) OAuthClientController {
+	return &oauthClientControllerImpl{
+		oauthService: oauthService,
+	}
+}
+
+// @Summary List OAuth clients
+// @Description List every app registered for the authorization code flow
+// @Tags OAuth clients
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.OAuthClientResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /oauth/clients [get]
+func (oc *oauthClientControllerImpl) ListClients(c *gin.Context) {
+	clients, err := oc.oauthService.ListClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list clients"})
+		return
+	}
+	response := make([]gin.H, len(clients))
+	for i := range clients {
+		response[i] = oauthClientResponse(&clients[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Register an OAuth client
+// @Description Register an app that users log in to through /oauth/authorize. Confidential clients get a secret, which is only shown in this response.
+// @Tags OAuth clients
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param client body models.CreateOAuthClientRequest true "Client details"
+// @Success 201 {object} models.CreatedOAuthClientResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input, redirect URI or scope"
+// @Failure 403 {object} models.ErrorResponse
+// @Router /oauth/clients [post]
+func (oc *oauthClientControllerImpl) CreateClient(c *gin.Context) {
+	var input models.CreateOAuthClientRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, client, err := oc.oauthService.CreateClient(services.OAuthClientInput{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+		Trusted:      input.Trusted,
+	})
+	if err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	response := oauthClientResponse(client)
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// @Summary Get an OAuth client
+// @Description Retrieve a registered app
+// @Tags OAuth clients
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Client ID (numeric)"
+// @Success 200 {object} models.OAuthClientResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /oauth/clients/{id} [get]
+func (oc *oauthClientControllerImpl) GetClient(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "client")
+	if !ok {
+		return
+	}
+
+	client, err := oc.oauthService.GetClient(id)
+	if err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, oauthClientResponse(client))
+}
+
+// @Summary Update an OAuth client
+// @Description Change a registered app's name, redirect URIs, scopes or whether it skips the consent page
+// @Tags OAuth clients
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Client ID (numeric)"
+// @Param client body models.PatchOAuthClientRequest true "Fields to change"
+// @Success 200 {object} models.OAuthClientResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input, redirect URI or scope"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /oauth/clients/{id} [patch]
+func (oc *oauthClientControllerImpl) UpdateClient(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "client")
+	if !ok {
+		return
+	}
+
+	var input models.PatchOAuthClientRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	client, err := oc.oauthService.UpdateClient(id, services.OAuthClientChanges{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Trusted:      input.Trusted,
+	})
+	if err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, oauthClientResponse(client))
+}
+
+// @Summary Delete an OAuth client
+// @Description Delete a registered app with its users' consents; its tokens stop working right away
+// @Tags OAuth clients
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Client ID (numeric)"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /oauth/clients/{id} [delete]
+func (oc *oauthClientControllerImpl) DeleteClient(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "client")
+	if !ok {
+		return
+	}
+
+	if err := oc.oauthService.DeleteClient(id); err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted successfully"})
+}
+
+// @Summary Rotate an OAuth client's secret
+// @Description Replace the secret of a confidential app; the old one stops working right away. The new secret is only shown in this response.
+// @Tags OAuth clients
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Client ID (numeric)"
+// @Success 200 {object} models.CreatedOAuthClientResponse
+// @Failure 400 {object} models.ErrorResponse "Public clients have no secret"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /oauth/clients/{id}/secret [post]
+func (oc *oauthClientControllerImpl) RotateSecret(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "client")
+	if !ok {
+		return
+	}
+
+	secret, client, err := oc.oauthService.RotateSecret(id)
+	if err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	response := oauthClientResponse(client)
+	response["client_secret"] = secret
+	c.JSON(http.StatusOK, response)
+}
+
+// respondOAuthClientError maps OAuth client errors onto HTTP status codes
+func respondOAuthClientError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrOAuthClientNotFound), errors.Is(err, services.ErrConsentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidRedirectURI), errors.Is(err, services.ErrInvalidScope),
+		errors.Is(err, services.ErrInvalidClient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
+
+// oauthClientResponse renders an OAuth client for API responses (see
+// models.OAuthClientResponse)
+func oauthClientResponse(client *models.OAuthClient) gin.H {
+	response := gin.H{
+		"id":            client.ID,
+		"client_id":     client.ClientID,
+		"name":          client.Name,
+		"redirect_uris": client.RedirectURIList(),
+		"scopes":        client.ScopeList(),
+		"confidential":  client.Confidential(),
+		"trusted":       client.Trusted,
+		"created_at":    client.CreatedAt,
+		"updated_at":    client.UpdatedAt,
+	}
+	if client.Confidential() {
+		response["secret_hint"] = client.SecretHint
+	}
+	return response
+}
@@ -0,0 +1,618 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"gin-tutorial/middleware"
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/services"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientAssertionType is the only client assertion type the token endpoint
+// accepts (RFC 7523)
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// authorizeParams are the parameters of an authorization request, kept
+// across the login and consent forms
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method", "nonce", "prompt", "max_age"}
+
+// OAuthController defines the interface for the OAuth2 endpoints
+type OAuthController interface {
+	Authorize(c *gin.Context)
+	AuthorizeSubmit(c *gin.Context)
+	Token(c *gin.Context)
+	Revoke(c *gin.Context)
+}
+
+// oauthControllerImpl is the concrete implementation of OAuthController
+type oauthControllerImpl struct {
+	serviceAccountService services.ServiceAccountService
+	oauthService          services.OAuthService
+	userService           services.UserService
+	mfaService            services.MFAService
+	sessionService        services.SessionService
+	sessionCookie         middleware.SessionCookie
+}
+
+// NewOAuthController creates a new OAuthController instance
+func NewOAuthController(serviceAccountService services.ServiceAccountService, oauthService services.OAuthService, userService services.UserService, mfaService services.MFAService, sessionService services.SessionService, sessionCookie middleware.SessionCookie) OAuthController {
+	return &oauthControllerImpl{
+		serviceAccountService: serviceAccountService,
+		oauthService:          oauthService,
+		userService:           userService,
+		mfaService:            mfaService,
+		sessionService:        sessionService,
+		sessionCookie:         sessionCookie,
+	}
+}
+
+// @Summary Authorize an app
+// @Description Authorization endpoint of the OAuth 2.1 authorization code flow. Shows a login page, then a consent page unless the app is trusted or already allowed, and redirects to the app's redirect URI with a code (or an error), the state and iss. PKCE with S256 is required.
+// @Tags OAuth
+// @Produce html
+// @Param response_type query string true "Response type" Enums(code)
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string true "One of the client's registered redirect URIs"
+// @Param scope query string false "Space-separated scopes; all of the client's if left out"
+// @Param state query string false "Opaque value sent back to the app"
+// @Param code_challenge query string true "Base64url SHA-256 hash of the code verifier"
+// @Param code_challenge_method query string true "PKCE method" Enums(S256)
+// @Param nonce query string false "Value copied into the ID token (OpenID Connect)"
+// @Param prompt query string false "Space-separated: none fails instead of showing a page; login and select_account ask the user to log in again; consent asks for consent again" Enums(none, login, consent, select_account)
+// @Param max_age query int false "Seconds since the user logged in after which they must log in again"
+// @Success 200 {string} string "Login or consent page"
+// @Success 302 {string} string "Redirect to the app"
+// @Failure 400 {string} string "Unknown client or redirect URI"
+// @Router /oauth/authorize [get]
+func (oc *oauthControllerImpl) Authorize(c *gin.Context) {
+	authorization, ok := oc.checkAuthorization(c, c.Query)
+	if !ok {
+		return
+	}
+
+	user, session, err := middleware.SessionUser(oc.sessionCookie.Read(c), oc.sessionService, oc.userService)
+	if err != nil || authorization.RequiresLogin(session, time.Now()) {
+		if authorization.HasPrompt("none") {
+			redirectAuthorizeError(c, oc.oauthService, authorization, &services.AuthorizeError{Code: "login_required", Description: "the user isn't logged in"})
+			return
+		}
+		oc.renderSignInPage(c, http.StatusOK, authorizePage{Step: "login", Client: authorization.Client.Name, Params: authorizationParams(c.Query)})
+		return
+	}
+	oc.continueAuthorization(c, authorization, user, session)
+}
+
+// @Summary Submit the authorization forms
+// @Description Receives the login, two-factor and consent forms of the /oauth/authorize pages
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce html
+// @Param action formData string true "Which form was sent" Enums(login, mfa, allow, deny)
+// @Param csrf_token formData string true "Token from the page: of the login CSRF cookie on login and mfa, of the session on allow and deny"
+// @Success 200 {string} string "Next page"
+// @Success 303 {string} string "Redirect to the app"
+// @Failure 400 {string} string "Unknown client or redirect URI"
+// @Failure 401 {string} string "Wrong credentials; the form is shown again"
+// @Failure 403 {string} string "Missing or invalid CSRF token"
+// @Router /oauth/authorize [post]
+func (oc *oauthControllerImpl) AuthorizeSubmit(c *gin.Context) {
+	authorization, ok := oc.checkAuthorization(c, c.PostForm)
+	if !ok {
+		return
+	}
+	page := authorizePage{Client: authorization.Client.Name, Params: authorizationParams(c.PostForm)}
+
+	// Without a session yet, the login and mfa forms carry the login CSRF
+	// cookie's token, so no other site can log the browser into its own
+	// account
+	if action := c.PostForm("action"); (action == "login" || action == "mfa") && !oc.checkLoginCSRF(c) {
+		page.Step = "login"
+		page.Error = "The form has expired, please sign in again."
+		oc.renderSignInPage(c, http.StatusForbidden, page)
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "login":
+		user, err := oc.userService.LoginUser(c.PostForm("email"), c.PostForm("password"), loginMeta(c))
+		if err != nil {
+			page.Step = "login"
+			page.Error = authorizeLoginError(err)
+			oc.renderSignInPage(c, http.StatusUnauthorized, page)
+			return
+		}
+		if user.MFAEnabled() {
+			mfaToken, err := oc.mfaService.IssueChallenge(user)
+			if err != nil {
+				renderAuthorizeError(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+				return
+			}
+			page.Step = "mfa"
+			page.MFAToken = mfaToken
+			oc.renderSignInPage(c, http.StatusOK, page)
+			return
+		}
+		oc.startSession(c, authorization, user)
+	case "mfa":
+		user, err := oc.mfaService.CompleteChallenge(c.PostForm("mfa_token"), c.PostForm("code"), loginMeta(c))
+		switch {
+		case errors.Is(err, services.ErrInvalidMFAToken):
+			page.Step = "login"
+			page.Error = "The sign-in took too long, please try again."
+			oc.renderSignInPage(c, http.StatusUnauthorized, page)
+			return
+		case errors.Is(err, services.ErrInvalidMFACode):
+			page.Step = "mfa"
+			page.MFAToken = c.PostForm("mfa_token")
+			page.Error = "Wrong code."
+			oc.renderSignInPage(c, http.StatusUnauthorized, page)
+			return
+		case err != nil:
+			renderAuthorizeError(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		oc.startSession(c, authorization, user)
+	case "allow", "deny":
+		user, session, err := middleware.SessionUser(oc.sessionCookie.Read(c), oc.sessionService, oc.userService)
+		if err != nil {
+			page.Step = "login"
+			page.Error = "Your session has expired, please sign in again."
+			oc.renderSignInPage(c, http.StatusUnauthorized, page)
+			return
+		}
+		// The consent form is posted with the session cookie, so it needs
+		// the session's CSRF token like any other unsafe request
+		if subtle.ConstantTimeCompare([]byte(c.PostForm("csrf_token")), []byte(session.CSRFToken)) != 1 {
+			renderAuthorizeError(c, http.StatusForbidden, "The form has expired, please go back to the app and try again.")
+			return
+		}
+		if c.PostForm("action") == "deny" {
+			redirectAuthorizeError(c, oc.oauthService, authorization, &services.AuthorizeError{Code: "access_denied", Description: "the user denied the request"})
+			return
+		}
+		oc.issueCode(c, authorization, user, session)
+	default:
+		renderAuthorizeError(c, http.StatusBadRequest, "Invalid form.")
+	}
+}
+
+// checkAuthorization validates the authorization request read with get. Errors
+// are sent to the app when the redirect URI can be trusted, and shown to the
+// user otherwise.
+func (oc *oauthControllerImpl) checkAuthorization(c *gin.Context, get func(string) string) (*services.Authorization, bool) {
+	authorization, err := oc.oauthService.CheckAuthorization(services.AuthorizeRequest{
+		ResponseType:        get("response_type"),
+		ClientID:            get("client_id"),
+		RedirectURI:         get("redirect_uri"),
+		Scope:               get("scope"),
+		State:               get("state"),
+		CodeChallenge:       get("code_challenge"),
+		CodeChallengeMethod: get("code_challenge_method"),
+		Nonce:               get("nonce"),
+		Prompt:              get("prompt"),
+		MaxAge:              get("max_age"),
+	})
+	if err != nil {
+		oc.respondAuthorizeError(c, authorization, err)
+		return nil, false
+	}
+	return authorization, true
+}
+
+// startSession starts a cookie session after a login on the authorize
+// pages, so the user stays logged in for the next app
+func (oc *oauthControllerImpl) startSession(c *gin.Context, authorization *services.Authorization, user *models.User) {
+	token, session, err := oc.sessionService.StartCookieSession(user, loginMeta(c))
+	if err != nil {
+		renderAuthorizeError(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	oc.sessionCookie.Set(c, token, session.ExpiresAt)
+	oc.continueAuthorization(c, authorization, user, session)
+}
+
+// renderSignInPage shows the login or mfa step with the login CSRF token
+func (oc *oauthControllerImpl) renderSignInPage(c *gin.Context, status int, page authorizePage) {
+	token, err := oc.loginCSRFToken(c)
+	if err != nil {
+		renderAuthorizeError(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	page.CSRFToken = token
+	renderAuthorizePage(c, status, page)
+}
+
+// loginCSRFCookie names the cookie of the forms posted before there is a
+// session
+func (oc *oauthControllerImpl) loginCSRFCookie() string {
+	return oc.sessionCookie.Name + "_login_csrf"
+}
+
+// loginCSRFToken returns the token of the login CSRF cookie, setting the
+// cookie first if the browser has none. It lasts as long as the browser
+// session, so forms open in other tabs keep working.
+func (oc *oauthControllerImpl) loginCSRFToken(c *gin.Context) (string, error) {
+	if token, err := c.Cookie(oc.loginCSRFCookie()); err == nil && token != "" {
+		return token, nil
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oc.loginCSRFCookie(),
+		Value:    token,
+		Path:     "/oauth/authorize",
+		Secure:   oc.sessionCookie.Secure,
+		HttpOnly: true,
+		SameSite: oc.sessionCookie.SameSite,
+	})
+	return token, nil
+}
+
+// checkLoginCSRF reports whether the form's csrf_token is the login CSRF
+// cookie's
+func (oc *oauthControllerImpl) checkLoginCSRF(c *gin.Context) bool {
+	cookie, err := c.Cookie(oc.loginCSRFCookie())
+	if err != nil || cookie == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.PostForm("csrf_token")), []byte(cookie)) == 1
+}
+
+// continueAuthorization asks a logged-in user for consent if needed, and
+// otherwise sends the app its code
+func (oc *oauthControllerImpl) continueAuthorization(c *gin.Context, authorization *services.Authorization, user *models.User, session *models.Session) {
+	scopes, needsConsent, err := oc.oauthService.CheckConsent(user, authorization)
+	if err != nil {
+		oc.respondAuthorizeError(c, authorization, err)
+		return
+	}
+	if !needsConsent {
+		oc.issueCode(c, authorization, user, session)
+		return
+	}
+
+	descriptions := make([]scopeDescription, len(scopes))
+	for i, scope := range scopes {
+		info, _ := models.OAuthScope(scope)
+		descriptions[i] = scopeDescription{Name: scope, Description: info.Description}
+	}
+	renderAuthorizePage(c, http.StatusOK, authorizePage{
+		Step:      "consent",
+		Client:    authorization.Client.Name,
+		Params:    authorizationParams(func(name string) string { return authorizationParam(authorization, name) }),
+		Username:  user.Username,
+		Scopes:    descriptions,
+		CSRFToken: session.CSRFToken,
+	})
+}
+
+// issueCode redirects to the app with an authorization code
+func (oc *oauthControllerImpl) issueCode(c *gin.Context, authorization *services.Authorization, user *models.User, session *models.Session) {
+	code, err := oc.oauthService.Authorize(user, session, authorization)
+	if err != nil {
+		oc.respondAuthorizeError(c, authorization, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(redirectStatus(c), oc.oauthService.RedirectURL(authorization, url.Values{"code": {code}}))
+}
+
+// respondAuthorizeError answers an authorization request that failed
+func (oc *oauthControllerImpl) respondAuthorizeError(c *gin.Context, authorization *services.Authorization, err error) {
+	var authorizeErr *services.AuthorizeError
+	switch {
+	case errors.As(err, &authorizeErr) && authorizeErr.Redirect && authorization != nil:
+		redirectAuthorizeError(c, oc.oauthService, authorization, authorizeErr)
+	case errors.As(err, &authorizeErr):
+		renderAuthorizeError(c, http.StatusBadRequest, "The app sent an invalid request: "+authorizeErr.Description+".")
+	default:
+		renderAuthorizeError(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+	}
+}
+
+// redirectAuthorizeError sends an authorization error to the app
+func redirectAuthorizeError(c *gin.Context, oauthService services.OAuthService, authorization *services.Authorization, err *services.AuthorizeError) {
+	params := url.Values{"error": {err.Code}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	c.Redirect(redirectStatus(c), oauthService.RedirectURL(authorization, params))
+}
+
+// redirectStatus is 302 for GET requests and 303 after forms, which makes
+// the browser follow with a GET
+func redirectStatus(c *gin.Context) int {
+	if c.Request.Method == http.MethodGet {
+		return http.StatusFound
+	}
+	return http.StatusSeeOther
+}
+
+// authorizationParams collects the authorization request's parameters for
+// the hidden fields of the forms
+func authorizationParams(get func(string) string) map[string]string {
+	params := make(map[string]string, len(authorizeParams))
+	for _, name := range authorizeParams {
+		if value := get(name); value != "" {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// authorizationParam returns a parameter of a checked authorization request
+func authorizationParam(authorization *services.Authorization, name string) string {
+	switch name {
+	case "response_type":
+		return "code"
+	case "client_id":
+		return authorization.Client.ClientID
+	case "redirect_uri":
+		return authorization.RedirectURI
+	case "scope":
+		return strings.Join(authorization.Scopes, " ")
+	case "state":
+		return authorization.State
+	case "code_challenge":
+		return authorization.CodeChallenge
+	case "code_challenge_method":
+		return "S256"
+	case "nonce":
+		return authorization.Nonce
+	case "prompt":
+		return strings.Join(authorization.Prompt, " ")
+	case "max_age":
+		if authorization.MaxAge == nil {
+			return ""
+		}
+		return strconv.Itoa(int(authorization.MaxAge.Seconds()))
+	default:
+		return ""
+	}
+}
+
+// authorizeLoginError is the message shown for a failed login on the
+// authorize pages
+func authorizeLoginError(err error) string {
+	var busy *password.BusyError
+	switch {
+	case errors.Is(err, services.ErrEmailNotVerified):
+		return "Please verify your email address first."
+	case errors.As(err, &busy):
+		return "The server is busy, please try again in a moment."
+	case errors.Is(err, services.ErrAuthenticatorUnavailable):
+		return "Logins are unavailable right now, please try again later."
+	case errors.Is(err, services.ErrInvalidCredentials):
+		return "Wrong email or password."
+	default:
+		return "Something went wrong, please try again."
+	}
+}
+
+// @Summary Get an OAuth2 access token
+// @Description Token endpoint (RFC 6749). Supports the client_credentials grant for service accounts, which authenticate with their client secret (HTTP Basic or form fields) or a private_key_jwt client assertion, and the authorization_code and refresh_token grants for apps, which authenticate with their client secret or, for public clients, only send their client_id. Refresh tokens are replaced on every use; using one twice revokes it.
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Grant type" Enums(client_credentials, authorization_code, refresh_token)
+// @Param scope formData string false "Space-separated scopes; all of the account's or refresh token's if left out"
+// @Param code formData string false "Authorization code (authorization_code)"
+// @Param redirect_uri formData string false "Redirect URI the code was sent to (authorization_code)"
+// @Param code_verifier formData string false "PKCE code verifier (authorization_code)"
+// @Param refresh_token formData string false "Refresh token (refresh_token)"
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret, unless sent with HTTP Basic"
+// @Param client_assertion_type formData string false "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+// @Param client_assertion formData string false "JWT signed with the client's private key"
+// @Success 200 {object} models.OAuthTokenResponse
+// @Failure 400 {object} models.OAuthErrorResponse
+// @Failure 401 {object} models.OAuthErrorResponse
+// @Router /oauth/token [post]
+func (oc *oauthControllerImpl) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	switch c.PostForm("grant_type") {
+	case "client_credentials":
+		oc.clientCredentials(c)
+	case "authorization_code":
+		oc.authorizationCode(c)
+	case "refresh_token":
+		oc.refreshToken(c)
+	case "":
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		respondOAuthError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// clientCredentials implements the client_credentials grant
+func (oc *oauthControllerImpl) clientCredentials(c *gin.Context) {
+	credentials, ok := clientCredentials(c, true)
+	if !ok {
+		return
+	}
+
+	token, err := oc.serviceAccountService.IssueToken(credentials, c.PostForm("scope"))
+	respondToken(c, token, err)
+}
+
+// authorizationCode implements the authorization_code grant
+func (oc *oauthControllerImpl) authorizationCode(c *gin.Context) {
+	credentials, ok := clientCredentials(c, false)
+	if !ok {
+		return
+	}
+	code, codeVerifier := c.PostForm("code"), c.PostForm("code_verifier")
+	if code == "" || codeVerifier == "" {
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "code and code_verifier are required")
+		return
+	}
+
+	token, err := oc.oauthService.ExchangeCode(credentials, code, c.PostForm("redirect_uri"), codeVerifier, loginMeta(c))
+	respondToken(c, token, err)
+}
+
+// refreshToken implements the refresh_token grant
+func (oc *oauthControllerImpl) refreshToken(c *gin.Context) {
+	credentials, ok := clientCredentials(c, false)
+	if !ok {
+		return
+	}
+	refreshToken := c.PostForm("refresh_token")
+	if refreshToken == "" {
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	token, err := oc.oauthService.Refresh(credentials, refreshToken, c.PostForm("scope"), loginMeta(c))
+	respondToken(c, token, err)
+}
+
+// @Summary Revoke an OAuth2 token
+// @Description Revocation endpoint (RFC 7009) for apps. Revoking a refresh token revokes every refresh token issued with it; revoking an access token ends its session. Unknown tokens are not an error.
+// @Tags OAuth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Access or refresh token"
+// @Param token_type_hint formData string false "Ignored; the token's type is recognized" Enums(access_token, refresh_token)
+// @Param client_id formData string false "Client ID, unless sent with HTTP Basic"
+// @Param client_secret formData string false "Client secret, unless sent with HTTP Basic"
+// @Success 200 "Revoked, or unknown"
+// @Failure 400 {object} models.OAuthErrorResponse
+// @Failure 401 {object} models.OAuthErrorResponse
+// @Router /oauth/revoke [post]
+func (oc *oauthControllerImpl) Revoke(c *gin.Context) {
+	credentials, ok := clientCredentials(c, false)
+	if !ok {
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	err := oc.oauthService.Revoke(credentials, token)
+	switch {
+	case errors.Is(err, services.ErrInvalidClient):
+		respondInvalidClient(c)
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+// respondToken answers a token request with the issued token or an error
+func respondToken(c *gin.Context, token *services.IssuedToken, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidClient):
+		respondInvalidClient(c)
+		return
+	case errors.Is(err, services.ErrInvalidGrant):
+		respondOAuthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	case errors.Is(err, services.ErrInvalidScope):
+		respondOAuthError(c, http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	response := gin.H{
+		"access_token": token.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(token.ExpiresIn.Seconds()),
+		"scope":        strings.Join(token.Scopes, " "),
+	}
+	if token.RefreshToken != "" {
+		response["refresh_token"] = token.RefreshToken
+	}
+	if token.IDToken != "" {
+		response["id_token"] = token.IDToken
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// respondInvalidClient answers 401 invalid_client, with a challenge if the
+// client tried HTTP Basic
+func respondInvalidClient(c *gin.Context) {
+	if _, _, basic := c.Request.BasicAuth(); basic {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	respondOAuthError(c, http.StatusUnauthorized, "invalid_client", "")
+}
+
+// clientCredentials reads how the client authenticates: HTTP Basic, form
+// fields or a client assertion, but only one of them. Public clients have
+// nothing to authenticate with and only send their client_id, which is
+// allowed unless authRequired. It responds with an error if the request is
+// malformed.
+func clientCredentials(c *gin.Context, authRequired bool) (services.ClientCredentials, bool) {
+	credentials := services.ClientCredentials{
+		ClientID:     c.PostForm("client_id"),
+		ClientSecret: c.PostForm("client_secret"),
+	}
+	methods := 0
+	if credentials.ClientSecret != "" {
+		methods++
+	}
+
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		methods++
+		// Basic credentials are form-encoded first (RFC 6749 section 2.3.1)
+		clientID, err1 := url.QueryUnescape(username)
+		secret, err2 := url.QueryUnescape(password)
+		if err1 != nil || err2 != nil || (credentials.ClientID != "" && credentials.ClientID != clientID) {
+			respondOAuthError(c, http.StatusBadRequest, "invalid_request", "malformed client credentials")
+			return credentials, false
+		}
+		credentials.ClientID, credentials.ClientSecret = clientID, secret
+	}
+
+	if assertion := c.PostForm("client_assertion"); assertion != "" {
+		methods++
+		if c.PostForm("client_assertion_type") != clientAssertionType {
+			respondOAuthError(c, http.StatusBadRequest, "invalid_request", "unsupported client_assertion_type")
+			return credentials, false
+		}
+		credentials.Assertion = assertion
+	}
+
+	switch {
+	case methods == 0 && authRequired:
+		respondOAuthError(c, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+		return credentials, false
+	case methods > 1:
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "use only one client authentication method")
+		return credentials, false
+	case credentials.Assertion == "" && credentials.ClientID == "":
+		respondOAuthError(c, http.StatusBadRequest, "invalid_request", "client_id is required")
+		return credentials, false
+	}
+	return credentials, true
+}
+
+// respondOAuthError writes an OAuth2 error response (RFC 6749 section 5.2)
+func respondOAuthError(c *gin.Context, status int, code, description string) {
+	response := gin.H{"error": code}
+	if description != "" {
+		response["error_description"] = description
+	}
+	c.JSON(status, response)
+}
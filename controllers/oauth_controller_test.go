@@ -0,0 +1,54 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+func TestAuthorizeFormsNeedTheLoginCSRFToken(t *testing.T) {
+	server := newTestServer(t)
+	alice := createUser(t, server.userRepo, "alice", "correct horse 1")
+	rp := newRelyingParty(t, server, oidc.ScopeOpenID)
+	authURL, err := url.Parse(rp.config.AuthCodeURL("state-1234", oauth2.S256ChallengeOption(oauth2.GenerateVerifier())))
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	endpoint := server.URL + "/oauth/authorize"
+	signedIn := func(resp *fetched) bool {
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == "session" && cookie.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Another site posting its own credentials has neither cookie nor token
+	form := authURL.Query()
+	form.Set("action", "login")
+	form.Set("email", alice.Email)
+	form.Set("password", "correct horse 1")
+	victim := browser(t)
+	if resp := fetch(t, victim, http.MethodPost, endpoint, form); resp.StatusCode != http.StatusForbidden || signedIn(resp) {
+		t.Errorf("cross-site login: status %d, signed in %v, want 403 without a session", resp.StatusCode, signedIn(resp))
+	}
+
+	// Nor does it know the token of the cookie the login page set
+	if resp := fetch(t, victim, http.MethodGet, authURL.String(), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	form.Set("csrf_token", "guessed")
+	if resp := fetch(t, victim, http.MethodPost, endpoint, form); resp.StatusCode != http.StatusForbidden || signedIn(resp) {
+		t.Errorf("login with a wrong token: status %d, signed in %v, want 403 without a session", resp.StatusCode, signedIn(resp))
+	}
+	form.Set("action", "mfa")
+	form.Set("mfa_token", "token")
+	form.Set("code", "123456")
+	if resp := fetch(t, victim, http.MethodPost, endpoint, form); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("mfa with a wrong token: status %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// authorizePage holds what the /oauth/authorize pages show. Step picks the
+// page: login, mfa, consent or error.
+type authorizePage struct {
+	Step   string
+	Client string
+	Error  string
+	// Params are the authorization request's parameters, posted back with
+	// every form so the request survives the login
+	Params map[string]string
+	// CSRFToken is posted back with every form: the login CSRF cookie's
+	// on the login and mfa steps, the session's on the consent step
+	CSRFToken string
+	// Fields of the mfa step
+	MFAToken string
+	// Fields of the consent step
+	Username string
+	Scopes   []scopeDescription
+}
+
+// scopeDescription is a scope as listed on the consent page
+type scopeDescription struct {
+	Name        string
+	Description string
+}
+
+// authorizeTemplate renders every /oauth/authorize page. It is kept minimal
+// on purpose: apps that want a branded login can build their own on the
+// JSON API.
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Client}}Sign in to {{.Client}}{{else}}Sign in{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 24rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: .25rem 0 1rem; padding: .5rem; }
+button { padding: .6rem; margin-top: .5rem; cursor: pointer; }
+.error { color: #b00020; }
+.actions { display: flex; gap: .5rem; }
+</style>
+</head>
+<body>
+{{define "params"}}{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}{{end}}
+{{if eq .Step "error"}}
+<h1>Can't sign in</h1>
+<p class="error">{{.Error}}</p>
+{{else if eq .Step "login"}}
+<h1>Sign in to {{.Client}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{template "params" .}}<input type="hidden" name="action" value="login">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<label for="email">Email</label>
+<input id="email" name="email" type="email" autocomplete="username" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<button type="submit">Sign in</button>
+</form>
+{{else if eq .Step "mfa"}}
+<h1>Two-factor authentication</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{template "params" .}}<input type="hidden" name="action" value="mfa">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<label for="code">Authentication or recovery code</label>
+<input id="code" name="code" autocomplete="one-time-code" required autofocus>
+<button type="submit">Verify</button>
+</form>
+{{else if eq .Step "consent"}}
+<h1>Allow {{.Client}}?</h1>
+<p>{{.Client}} wants to access your account <strong>{{.Username}}</strong>:</p>
+<ul>
+{{range .Scopes}}<li>{{.Description}} <small>({{.Name}})</small></li>
+{{end}}</ul>
+<form method="post" action="/oauth/authorize">
+{{template "params" .}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<div class="actions">
+<button type="submit" name="action" value="deny">Deny</button>
+<button type="submit" name="action" value="allow">Allow</button>
+</div>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// renderAuthorizePage writes an /oauth/authorize page. The page must not
+// be framed (clickjacking the consent button) nor cached.
+func renderAuthorizePage(c *gin.Context, status int, page authorizePage) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Render(status, render.HTML{Template: authorizeTemplate, Name: "authorize", Data: page})
+}
+
+// renderAuthorizeError shows an error that can't be sent to the app
+func renderAuthorizeError(c *gin.Context, status int, message string) {
+	renderAuthorizePage(c, status, authorizePage{Step: "error", Error: message})
+}
@@ -0,0 +1,272 @@
+package controllers_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// csrfField finds the CSRF token of the login and consent forms
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// oidcRelyingParty is an app signing users in with the server through an
+// off-the-shelf OpenID Connect client library
+type oidcRelyingParty struct {
+	provider *oidc.Provider
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newRelyingParty(t *testing.T, server *testServer, scopes ...string) *oidcRelyingParty {
+	t.Helper()
+	ctx := context.Background()
+	// Discovery fails unless the document's issuer is the URL it came from
+	provider, err := oidc.NewProvider(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("discovery: %v", err)
+	}
+
+	redirectURI := "http://127.0.0.1/callback"
+	secret, client, err := server.oauthService.CreateClient(services.OAuthClientInput{
+		Name:         "Relying party",
+		RedirectURIs: []string{redirectURI},
+		Scopes:       []string{models.ScopeOpenID, models.ScopeProfile, models.ScopeEmail},
+		Confidential: true,
+	})
+	if err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+	return &oidcRelyingParty{
+		provider: provider,
+		config: oauth2.Config{
+			ClientID:     client.ClientID,
+			ClientSecret: secret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURI,
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: client.ClientID}),
+	}
+}
+
+// signIn walks user agent through the login and consent pages and returns
+// the code the app receives
+func (rp *oidcRelyingParty) signIn(t *testing.T, user *http.Client, email, pass string, opts ...oauth2.AuthCodeOption) string {
+	t.Helper()
+	const state = "state-1234"
+	authURL, err := url.Parse(rp.config.AuthCodeURL(state, opts...))
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+
+	resp := fetch(t, user, http.MethodGet, authURL.String(), nil)
+	match := csrfField.FindStringSubmatch(resp.body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.body, `value="login"`) || match == nil {
+		t.Fatalf("authorize: status %d, want the login page:\n%s", resp.StatusCode, resp.body)
+	}
+	form := authURL.Query()
+	form.Set("action", "login")
+	form.Set("csrf_token", match[1])
+	form.Set("email", email)
+	form.Set("password", pass)
+	resp = fetch(t, user, http.MethodPost, authURL.Scheme+"://"+authURL.Host+authURL.Path, form)
+	match = csrfField.FindStringSubmatch(resp.body)
+	if resp.StatusCode != http.StatusOK || match == nil {
+		t.Fatalf("login: status %d, want the consent page:\n%s", resp.StatusCode, resp.body)
+	}
+	form.Del("email")
+	form.Del("password")
+	form.Set("action", "allow")
+	form.Set("csrf_token", match[1])
+	resp = fetch(t, user, http.MethodPost, authURL.Scheme+"://"+authURL.Host+authURL.Path, form)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("consent: status %d, want a redirect to the app:\n%s", resp.StatusCode, resp.body)
+	}
+	return rp.callback(t, resp, state)
+}
+
+// callback checks the redirect to the app and returns its code
+func (rp *oidcRelyingParty) callback(t *testing.T, resp *fetched, state string) string {
+	t.Helper()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("redirect: %v", err)
+	}
+	if got := location.Scheme + "://" + location.Host + location.Path; got != rp.config.RedirectURL {
+		t.Fatalf("redirected to %s, want %s", got, rp.config.RedirectURL)
+	}
+	query := location.Query()
+	if query.Get("state") != state {
+		t.Errorf("state = %q, want %q", query.Get("state"), state)
+	}
+	// RFC 9207, as advertised in the discovery document
+	if query.Get("iss") != strings.TrimSuffix(rp.provider.Endpoint().AuthURL, "/oauth/authorize") {
+		t.Errorf("iss = %q", query.Get("iss"))
+	}
+	if query.Get("code") == "" {
+		t.Fatalf("redirect without a code: %s", location)
+	}
+	return query.Get("code")
+}
+
+type fetched struct {
+	*http.Response
+	body string
+}
+
+func fetch(t *testing.T, client *http.Client, method, target string, form url.Values) *fetched {
+	t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return &fetched{Response: resp, body: string(content)}
+}
+
+func TestOIDCConformance(t *testing.T) {
+	server := newTestServer(t)
+	alice := createUser(t, server.userRepo, "alice", "correct horse 1")
+	rp := newRelyingParty(t, server, oidc.ScopeOpenID, "profile", "email")
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	before := time.Now().Truncate(time.Second)
+	code := rp.signIn(t, browser(t), alice.Email, "correct horse 1",
+		oidc.Nonce("nonce-5678"), oauth2.S256ChallengeOption(verifier))
+	token, err := rp.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	// The library checks the signature against the JWKS, iss, aud and exp
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		t.Fatal("token response has no id_token")
+	}
+	idToken, err := rp.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		t.Fatalf("Verify ID token: %v", err)
+	}
+	if idToken.Nonce != "nonce-5678" {
+		t.Errorf("nonce = %q, want the one sent", idToken.Nonce)
+	}
+	if err := idToken.VerifyAccessToken(token.AccessToken); err != nil {
+		t.Errorf("at_hash: %v", err)
+	}
+	if idToken.Subject != alice.Subject() {
+		t.Errorf("sub = %q, want %q", idToken.Subject, alice.Subject())
+	}
+	var claims struct {
+		AuthTime int64 `json:"auth_time"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		t.Fatalf("Claims: %v", err)
+	}
+	if authTime := time.Unix(claims.AuthTime, 0); authTime.Before(before) || authTime.After(time.Now()) {
+		t.Errorf("auth_time = %v, want the login's time", authTime)
+	}
+
+	userInfo, err := rp.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		t.Fatalf("UserInfo: %v", err)
+	}
+	if userInfo.Subject != idToken.Subject {
+		t.Errorf("userinfo sub = %q, want the ID token's %q", userInfo.Subject, idToken.Subject)
+	}
+	if userInfo.Email != alice.Email || !userInfo.EmailVerified {
+		t.Errorf("userinfo email = %q (verified %v), want %q verified", userInfo.Email, userInfo.EmailVerified, alice.Email)
+	}
+	var profile struct {
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := userInfo.Claims(&profile); err != nil || profile.PreferredUsername != alice.Username {
+		t.Errorf("userinfo preferred_username = %q, %v", profile.PreferredUsername, err)
+	}
+
+	// A refreshed ID token is about the same login
+	refreshed, err := rp.config.TokenSource(ctx, &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if raw, ok := refreshed.Extra("id_token").(string); ok {
+		again, err := rp.verifier.Verify(ctx, raw)
+		if err != nil {
+			t.Fatalf("Verify refreshed ID token: %v", err)
+		}
+		var againClaims struct {
+			AuthTime int64 `json:"auth_time"`
+		}
+		if err := again.Claims(&againClaims); err != nil || againClaims.AuthTime != claims.AuthTime {
+			t.Errorf("refreshed auth_time = %d, want %d", againClaims.AuthTime, claims.AuthTime)
+		}
+	}
+}
+
+func TestOIDCScopesLimitClaims(t *testing.T) {
+	server := newTestServer(t)
+	alice := createUser(t, server.userRepo, "alice", "correct horse 1")
+	rp := newRelyingParty(t, server, oidc.ScopeOpenID)
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	code := rp.signIn(t, browser(t), alice.Email, "correct horse 1", oauth2.S256ChallengeOption(verifier))
+	token, err := rp.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	userInfo, err := rp.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		t.Fatalf("UserInfo: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := userInfo.Claims(&claims); err != nil {
+		t.Fatalf("Claims: %v", err)
+	}
+	for _, claim := range []string{"email", "email_verified", "preferred_username", "name"} {
+		if _, ok := claims[claim]; ok {
+			t.Errorf("userinfo has %s without its scope: %v", claim, claims)
+		}
+	}
+
+	// Tokens without the openid scope get no ID token and can't read userinfo
+	plain := newRelyingParty(t, server, "profile")
+	verifier = oauth2.GenerateVerifier()
+	code = plain.signIn(t, browser(t), alice.Email, "correct horse 1", oauth2.S256ChallengeOption(verifier))
+	token, err = plain.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, ok := token.Extra("id_token").(string); ok {
+		t.Error("an ID token was issued without the openid scope")
+	}
+	if _, err := plain.provider.UserInfo(ctx, oauth2.StaticTokenSource(token)); err == nil {
+		t.Error("userinfo answered a token without the openid scope")
+	}
+}
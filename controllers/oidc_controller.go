@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OIDCController defines the interface for the OpenID Connect endpoints
+// that apps discover this server and verify its ID tokens with
+type OIDCController interface {
+	Configuration(c *gin.Context)
+	JWKS(c *gin.Context)
+	UserInfo(c *gin.Context)
+}
+
+// oidcControllerImpl is the concrete implementation of OIDCController
+type oidcControllerImpl struct {
+	oauthService services.OAuthService
+	signingKey   *services.SigningKey
+	issuer       string
+}
+
+// NewOIDCController creates a new OIDCController instance; issuer is the
+// server's base URL
+func NewOIDCController(oauthService services.OAuthService, signingKey *services.SigningKey, issuer string) OIDCController {
+	return &oidcControllerImpl{
+		oauthService: oauthService,
+		signingKey:   signingKey,
+		issuer:       issuer,
+	}
+}
+
+// @Summary OpenID Connect discovery
+// @Description Describes this server's OpenID Connect endpoints and what they support (OpenID Connect Discovery 1.0)
+// @Tags OpenID Connect
+// @Produce json
+// @Success 200 {object} models.OpenIDConfigurationResponse
+// @Router /.well-known/openid-configuration [get]
+func (oc *oidcControllerImpl) Configuration(c *gin.Context) {
+	scopes := make([]string, 0, len(models.OIDCScopes)+len(models.Scopes))
+	for scope := range models.OIDCScopes {
+		scopes = append(scopes, scope)
+	}
+	for scope := range models.Scopes {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                         oc.issuer,
+		"authorization_endpoint":                         oc.issuer + "/oauth/authorize",
+		"token_endpoint":                                 oc.issuer + "/oauth/token",
+		"userinfo_endpoint":                              oc.issuer + "/userinfo",
+		"revocation_endpoint":                            oc.issuer + "/oauth/revoke",
+		"jwks_uri":                                       oc.issuer + "/.well-known/jwks.json",
+		"scopes_supported":                               scopes,
+		"response_types_supported":                       []string{"code"},
+		"response_modes_supported":                       []string{"query"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"claims_supported":                               []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "preferred_username", "name", "updated_at", "email", "email_verified"},
+		"prompt_values_supported":                        []string{"none", "login", "consent", "select_account"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// @Summary ID token signing keys
+// @Description The public keys ID tokens are signed with, as a JSON Web Key Set (RFC 7517)
+// @Tags OpenID Connect
+// @Produce json
+// @Success 200 {object} models.JWKSResponse
+// @Router /.well-known/jwks.json [get]
+func (oc *oidcControllerImpl) JWKS(c *gin.Context) {
+	n, e := oc.signingKey.PublicComponents()
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{
+		"keys": []gin.H{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": oc.signingKey.KeyID,
+			"n":   n,
+			"e":   e,
+		}},
+	})
+}
+
+// @Summary Get the user's claims
+// @Description OpenID Connect userinfo endpoint. Returns the claims about the logged-in user that the profile and email scopes granted to the app allow. Access tokens of apps need the openid scope; logins get every claim.
+// @Tags OpenID Connect
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.UserInfoResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse "Token lacks the openid scope"
+// @Router /userinfo [get]
+// @Router /userinfo [post]
+func (oc *oidcControllerImpl) UserInfo(c *gin.Context) {
+	user, ok := c.Get("user")
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This route needs a user"})
+		return
+	}
+	var scopes []string
+	if granted, ok := c.Get("scopes"); ok {
+		scopes = granted.([]string)
+	}
+
+	claims, err := oc.oauthService.UserInfo(user.(*models.User).ID, scopes)
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, claims)
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// samlLoginCookie keeps the state token of a login with a SAML identity
+// provider until its response. It is only sent to /auth/saml/. The response
+// is posted by the provider's page, a cross-site request Lax cookies aren't
+// sent with, so the cookie is SameSite=None where it can be: browsers only
+// accept that on Secure cookies.
+const (
+	samlLoginCookie     = "saml_login"
+	samlLoginCookiePath = "/auth/saml/"
+)
+
+// samlPostScript submits the AuthnRequest form of the POST binding as soon
+// as the page loads; the page's CSP only allows this script
+const samlPostScript = `document.getElementById("saml-request").submit();`
+
+var samlPostScriptHash = func() string {
+	sum := sha256.Sum256([]byte(samlPostScript))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}()
+
+// samlPostTemplate renders the page that posts an AuthnRequest to the
+// identity provider. The button is for browsers without JavaScript.
+var samlPostTemplate = template.Must(template.New("saml-post").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Signing in</title>
+</head>
+<body>
+<form id="saml-request" method="post" action="{{.URL}}">
+{{range $name, $value := .Form}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<noscript><button type="submit">Continue to sign in</button></noscript>
+</form>
+<script>` + samlPostScript + `</script>
+</body>
+</html>
+`))
+
+// @Summary List SAML identity providers
+// @Description List the external SAML 2.0 identity providers users can log in with
+// @Tags Auth
+// @Produce json
+// @Success 200 {array} models.SAMLProviderResponse
+// @Router /auth/saml [get]
+func (uc *userControllerImpl) ListSAMLProviders(c *gin.Context) {
+	providers := uc.samlService.Providers()
+	response := make([]gin.H, len(providers))
+	for i, provider := range providers {
+		base := "/auth/saml/" + url.PathEscape(provider.ID)
+		response[i] = gin.H{
+			"id":           provider.ID,
+			"name":         provider.Name,
+			"login_url":    base + "/login",
+			"metadata_url": base + "/metadata",
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary SAML service provider metadata
+// @Description Our service provider metadata for an identity provider: the entity ID, the assertion consumer service URL and, if configured, our certificate. Register it with the identity provider.
+// @Tags Auth
+// @Produce xml
+// @Param provider path string true "Provider ID"
+// @Success 200 {string} string "SAML metadata (EntityDescriptor)"
+// @Failure 404 {object} models.ErrorResponse
+// @Router /auth/saml/{provider}/metadata [get]
+func (uc *userControllerImpl) SAMLMetadata(c *gin.Context) {
+	metadata, err := uc.samlService.Metadata(c.Param("provider"))
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// @Summary Log in with a SAML identity provider
+// @Description Send the browser to an external SAML identity provider with an AuthnRequest: redirected to it (HTTP-Redirect binding), or with a page that posts it there (HTTP-POST binding). After the login there, the provider posts its response to /auth/saml/{provider}/acs.
+// @Tags Auth
+// @Produce html
+// @Param provider path string true "Provider ID"
+// @Param session query bool false "Start a session cookie instead of returning a JWT"
+// @Success 200 {string} string "Page posting the AuthnRequest to the provider"
+// @Success 302 {string} string "Redirect to the provider"
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 502 {object} models.ErrorResponse "The provider is unavailable"
+// @Router /auth/saml/{provider}/login [get]
+func (uc *userControllerImpl) SAMLLogin(c *gin.Context) {
+	session, _ := strconv.ParseBool(c.Query("session"))
+	request, stateToken, err := uc.samlService.Begin(c.Param("provider"), session)
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+
+	uc.setSAMLLoginCookie(c, stateToken, int(uc.samlService.StateTTL().Seconds()))
+	c.Header("Cache-Control", "no-store")
+	if request.Form == nil {
+		c.Redirect(http.StatusFound, request.URL)
+		return
+	}
+	c.Header("Content-Security-Policy", "default-src 'none'; script-src "+samlPostScriptHash+"; frame-ancestors 'none'")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Render(http.StatusOK, render.HTML{Template: samlPostTemplate, Name: "saml-post", Data: request})
+}
+
+// @Summary SAML assertion consumer service
+// @Description Where the identity provider posts its response (HTTP-POST binding). Checks its signature, audience, recipient and validity period, and that it answers the login this browser started, unless the provider may start logins itself. Logs in the account linked to the provider's user, or the one with its email, linking or creating it, and answers like POST /login.
+// @Tags Auth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param provider path string true "Provider ID"
+// @Param SAMLResponse formData string true "Base64 encoded SAML response"
+// @Param RelayState formData string false "Relay state sent with the AuthnRequest"
+// @Success 200 {object} models.TokenResponse
+// @Success 201 {object} models.SessionResponse "Session started; the cookie is set"
+// @Success 202 {object} models.MFARequiredResponse "A second factor is required"
+// @Failure 400 {object} models.ErrorResponse "Invalid or expired login state"
+// @Failure 401 {object} models.ErrorResponse "The provider refused the login, or the response didn't check out"
+// @Failure 403 {object} models.ErrorResponse "No email, or no account may be used for it"
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 502 {object} models.ErrorResponse "The provider is unavailable"
+// @Router /auth/saml/{provider}/acs [post]
+func (uc *userControllerImpl) SAMLAssertionConsumer(c *gin.Context) {
+	stateToken, _ := c.Cookie(samlLoginCookie)
+	// The state token is single use either way
+	uc.setSAMLLoginCookie(c, "", -1)
+	c.Header("Cache-Control", "no-store")
+
+	login, err := uc.samlService.Complete(c.Request.Context(), c.Param("provider"), stateToken, c.PostForm("SAMLResponse"), c.PostForm("RelayState"), loginMeta(c))
+	if err != nil {
+		respondFederationError(c, err)
+		return
+	}
+	uc.startLogin(c, login.User, login.Session)
+}
+
+// setSAMLLoginCookie hands the browser the state token of a login with a
+// SAML identity provider, or deletes it with a negative maxAge
+func (uc *userControllerImpl) setSAMLLoginCookie(c *gin.Context, stateToken string, maxAge int) {
+	sameSite := http.SameSiteLaxMode
+	if uc.sessionCookie.Secure {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     samlLoginCookie,
+		Value:    stateToken,
+		Path:     samlLoginCookiePath,
+		MaxAge:   maxAge,
+		Secure:   uc.sessionCookie.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceAccountController defines the interface for admins managing
+// service accounts
+type ServiceAccountController interface {
+	ListServiceAccounts(c *gin.Context)
+	CreateServiceAccount(c *gin.Context)
+	GetServiceAccount(c *gin.Context)
+	UpdateServiceAccount(c *gin.Context)
+	DeleteServiceAccount(c *gin.Context)
+	AddSecret(c *gin.Context)
+	AddPublicKey(c *gin.Context)
+	RemoveCredential(c *gin.Context)
+}
+
+// serviceAccountControllerImpl is the concrete implementation of ServiceAccountController
+type serviceAccountControllerImpl struct {
+	serviceAccountService services.ServiceAccountService
+}
+
+// NewServiceAccountController creates a new ServiceAccountController instance
+func NewServiceAccountController(serviceAccountService services.ServiceAccountService) ServiceAccountController {
+	return &serviceAccountControllerImpl{
+		serviceAccountService: serviceAccountService,
+	}
+}
+
+// @Summary List service accounts
+// @Description List every service account with its credentials
+// @Tags Service accounts
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.ServiceAccountResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /service-accounts [get]
+func (sc *serviceAccountControllerImpl) ListServiceAccounts(c *gin.Context) {
+	accounts, err := sc.serviceAccountService.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list service accounts"})
+		return
+	}
+	response := make([]gin.H, len(accounts))
+	for i := range accounts {
+		response[i] = serviceAccountResponse(&accounts[i])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Create a service account
+// @Description Create a service account owned by the current admin. It needs a secret or public key before it can get tokens at /oauth/token.
+// @Tags Service accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param account body models.CreateServiceAccountRequest true "Service account details"
+// @Success 201 {object} models.ServiceAccountResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input or scope"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse "Name already taken"
+// @Router /service-accounts [post]
+func (sc *serviceAccountControllerImpl) CreateServiceAccount(c *gin.Context) {
+	var input models.CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	account, err := sc.serviceAccountService.Create(user.(*models.User), services.ServiceAccountInput{
+		Name:        input.Name,
+		Description: input.Description,
+		Role:        input.Role,
+		Scopes:      input.Scopes,
+	})
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, serviceAccountResponse(account))
+}
+
+// @Summary Get a service account
+// @Description Retrieve a service account with its credentials
+// @Tags Service accounts
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Success 200 {object} models.ServiceAccountResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /service-accounts/{id} [get]
+func (sc *serviceAccountControllerImpl) GetServiceAccount(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+
+	account, err := sc.serviceAccountService.Get(id)
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, serviceAccountResponse(account))
+}
+
+// @Summary Update a service account
+// @Description Change a service account's details, owner, role or scopes, or disable it
+// @Tags Service accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Param account body models.PatchServiceAccountRequest true "Fields to change"
+// @Success 200 {object} models.ServiceAccountResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid input, scope or owner"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse "Name already taken"
+// @Router /service-accounts/{id} [patch]
+func (sc *serviceAccountControllerImpl) UpdateServiceAccount(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+
+	var input models.PatchServiceAccountRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := sc.serviceAccountService.Update(id, services.ServiceAccountChanges{
+		Name:        input.Name,
+		Description: input.Description,
+		OwnerID:     input.OwnerID,
+		Role:        input.Role,
+		Scopes:      input.Scopes,
+		Disabled:    input.Disabled,
+	})
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, serviceAccountResponse(account))
+}
+
+// @Summary Delete a service account
+// @Description Delete a service account and its credentials; its tokens stop working right away
+// @Tags Service accounts
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /service-accounts/{id} [delete]
+func (sc *serviceAccountControllerImpl) DeleteServiceAccount(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+
+	if err := sc.serviceAccountService.Delete(id); err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deleted successfully"})
+}
+
+// @Summary Add a client secret
+// @Description Generate a client secret for a service account. The response holds the secret, which is not shown again.
+// @Tags Service accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Param secret body models.AddSecretRequest false "Secret options"
+// @Success 201 {object} models.CreatedSecretResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid expiry"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /service-accounts/{id}/secrets [post]
+func (sc *serviceAccountControllerImpl) AddSecret(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+
+	var input models.AddSecretRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	secret, credential, err := sc.serviceAccountService.AddSecret(id, input.ExpiresAt)
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	response := credentialResponse(credential)
+	response["client_secret"] = secret
+	c.JSON(http.StatusCreated, response)
+}
+
+// @Summary Add a public key
+// @Description Register a public key for a service account, which then authenticates with JWT assertions signed by the private key (private_key_jwt)
+// @Tags Service accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Param key body models.AddPublicKeyRequest true "Public key"
+// @Success 201 {object} models.CredentialResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid key or expiry"
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /service-accounts/{id}/keys [post]
+func (sc *serviceAccountControllerImpl) AddPublicKey(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+
+	var input models.AddPublicKeyRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	credential, err := sc.serviceAccountService.AddPublicKey(id, input.PublicKey, input.ExpiresAt)
+	if err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, credentialResponse(credential))
+}
+
+// @Summary Remove a credential
+// @Description Delete a secret or public key of a service account; tokens issued for it stop working right away
+// @Tags Service accounts
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Service account ID"
+// @Param credential path int true "Credential ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Router /service-accounts/{id}/credentials/{credential} [delete]
+func (sc *serviceAccountControllerImpl) RemoveCredential(c *gin.Context) {
+	id, ok := parsePathID(c, "id", "service account")
+	if !ok {
+		return
+	}
+	credentialID, ok := parsePathID(c, "credential", "credential")
+	if !ok {
+		return
+	}
+
+	if err := sc.serviceAccountService.RemoveCredential(id, credentialID); err != nil {
+		respondServiceAccountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credential removed successfully"})
+}
+
+// parsePathID reads a numeric path parameter, responding 400 if it is invalid
+func parsePathID(c *gin.Context, param, what string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(param), 10, 0)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + what + " ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// respondServiceAccountError maps service account errors onto HTTP status codes
+func respondServiceAccountError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrServiceAccountNotFound), errors.Is(err, services.ErrCredentialNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrServiceAccountConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidScope), errors.Is(err, services.ErrInvalidExpiry),
+		errors.Is(err, services.ErrInvalidPublicKey), errors.Is(err, services.ErrInvalidOwner):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
+
+// serviceAccountResponse renders a service account for API responses (see
+// models.ServiceAccountResponse)
+func serviceAccountResponse(account *models.ServiceAccount) gin.H {
+	credentials := make([]gin.H, len(account.Credentials))
+	for i := range account.Credentials {
+		credentials[i] = credentialResponse(&account.Credentials[i])
+	}
+	return gin.H{
+		"id":          account.ID,
+		"client_id":   account.ClientID,
+		"name":        account.Name,
+		"description": account.Description,
+		"owner_id":    account.OwnerID,
+		"role":        account.Role,
+		"scopes":      account.ScopeList(),
+		"disabled":    account.DisabledAt != nil,
+		"credentials": credentials,
+		"created_at":  account.CreatedAt,
+		"updated_at":  account.UpdatedAt,
+	}
+}
+
+// credentialResponse renders a credential for API responses (see
+// models.CredentialResponse)
+func credentialResponse(credential *models.ServiceAccountCredential) gin.H {
+	response := gin.H{
+		"id":           credential.ID,
+		"kind":         credential.Kind,
+		"hint":         credential.Hint,
+		"expires_at":   credential.ExpiresAt,
+		"last_used_at": credential.LastUsedAt,
+		"created_at":   credential.CreatedAt,
+	}
+	if credential.PublicKey != "" {
+		response["public_key"] = credential.PublicKey
+	}
+	return response
+}
@@ -0,0 +1,266 @@
+package controllers
+
+import (
+	"errors"
+	"gin-tutorial/models"
+	"gin-tutorial/services"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionController defines the interface for users managing their own
+// sessions and the apps they allowed, and reviewing their login history
+type SessionController interface {
+	ListSessions(c *gin.Context)
+	RevokeSession(c *gin.Context)
+	RevokeOtherSessions(c *gin.Context)
+	ListLogins(c *gin.Context)
+	ListApps(c *gin.Context)
+	RevokeApp(c *gin.Context)
+}
+
+// sessionControllerImpl is the concrete implementation of SessionController
+type sessionControllerImpl struct {
+	sessionService services.SessionService
+	loginHistory   services.LoginHistory
+	oauthService   services.OAuthService
+}
+
+// NewSessionController creates a new SessionController instance
+func NewSessionController(sessionService services.SessionService, loginHistory services.LoginHistory, oauthService services.OAuthService) SessionController {
+	return &sessionControllerImpl{
+		sessionService: sessionService,
+		loginHistory:   loginHistory,
+		oauthService:   oauthService,
+	}
+}
+
+// @Summary List sessions
+// @Description List the current user's active logins with the device, IP and activity of each
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.SessionInfoResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/sessions [get]
+func (sc *sessionControllerImpl) ListSessions(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	sessions, err := sc.sessionService.List(user.(*models.User))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, sessionList(sessions, c.GetString("session_id")))
+}
+
+// @Summary Revoke a session
+// @Description Sign out one of the current user's logins; its token or cookie stops working right away
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Session ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/sessions/{id} [delete]
+func (sc *sessionControllerImpl) RevokeSession(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	if err := sc.sessionService.Revoke(user.(*models.User).ID, c.Param("id")); err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// @Summary Sign out everywhere else
+// @Description Revoke every login of the current user except the one making the request
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.RevokedSessionsResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/sessions [delete]
+func (sc *sessionControllerImpl) RevokeOtherSessions(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	revoked, err := sc.sessionService.RevokeOthers(user.(*models.User), c.GetString("session_id"))
+	if err != nil {
+		respondSessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// @Summary List login history
+// @Description List the current user's recent login attempts, newest first; suspicious logins carry flags
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "How many events to return (default 50, at most 200)"
+// @Success 200 {array} models.LoginEventResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/logins [get]
+func (sc *sessionControllerImpl) ListLogins(c *gin.Context) {
+	limit, ok := parseLimit(c)
+	if !ok {
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	events, err := sc.loginHistory.List(user.(*models.User).ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list logins"})
+		return
+	}
+	c.JSON(http.StatusOK, loginEventList(events))
+}
+
+// @Summary List authorized apps
+// @Description List the apps the current user allowed to act on their behalf, with the scopes they were granted
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} models.AuthorizedAppResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/apps [get]
+func (sc *sessionControllerImpl) ListApps(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	consents, err := sc.oauthService.ListConsents(user.(*models.User).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list apps"})
+		return
+	}
+	response := make([]gin.H, len(consents))
+	for i, consent := range consents {
+		response[i] = gin.H{
+			"client_id":  consent.Client.ClientID,
+			"name":       consent.Client.Name,
+			"scopes":     consent.ScopeList(),
+			"created_at": consent.CreatedAt,
+			"updated_at": consent.UpdatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Revoke an app
+// @Description Withdraw the current user's consent for an app; the app's tokens for the user stop working right away and it has to ask again
+// @Tags Sessions
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "The app's client ID"
+// @Success 200 {object} models.MessageResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /profile/apps/{client_id} [delete]
+func (sc *sessionControllerImpl) RevokeApp(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	if err := sc.oauthService.RevokeConsent(user.(*models.User).ID, c.Param("client_id")); err != nil {
+		respondOAuthClientError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "App access revoked successfully"})
+}
+
+// respondSessionError maps session service errors onto HTTP status codes
+func respondSessionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
+
+// sessionList renders sessions for API responses (see
+// models.SessionInfoResponse), marking the one with currentID
+func sessionList(sessions []models.Session, currentID string) []gin.H {
+	response := make([]gin.H, len(sessions))
+	for i, session := range sessions {
+		response[i] = gin.H{
+			"id":           session.ID,
+			"kind":         session.Kind,
+			"device":       session.Device,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID == currentID,
+		}
+		if session.ClientID != "" {
+			response[i]["client_id"] = session.ClientID
+		}
+	}
+	return response
+}
+
+// parseLimit reads the limit query parameter of login history listings,
+// responding 400 if it is invalid
+func parseLimit(c *gin.Context) (int, bool) {
+	raw := c.DefaultQuery("limit", "50")
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return 0, false
+	}
+	return min(limit, 200), true
+}
+
+// loginEventList renders login events for API responses (see
+// models.LoginEventResponse)
+func loginEventList(events []models.LoginEvent) []gin.H {
+	response := make([]gin.H, len(events))
+	for i, event := range events {
+		flags := []string{}
+		if event.Flags != "" {
+			flags = strings.Split(event.Flags, ",")
+		}
+		response[i] = gin.H{
+			"id":         event.ID,
+			"email":      event.Email,
+			"success":    event.Success,
+			"reason":     event.Reason,
+			"provider":   event.Provider,
+			"ip":         event.IP,
+			"user_agent": event.UserAgent,
+			"device":     event.Device,
+			"flags":      flags,
+			"created_at": event.CreatedAt,
+		}
+	}
+	return response
+}
@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"errors"
+	"gin-tutorial/middleware"
 	"gin-tutorial/models"
+	"gin-tutorial/password"
 	"gin-tutorial/services"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,18 +17,48 @@ import (
 type UserController interface {
 	RegisterUser(c *gin.Context)
 	Login(c *gin.Context)
+	Logout(c *gin.Context)
 	GetProfile(c *gin.Context)
+	ChangePassword(c *gin.Context)
+	VerifyEmail(c *gin.Context)
+	ResendVerification(c *gin.Context)
+	ForgotPassword(c *gin.Context)
+	ResetPassword(c *gin.Context)
+	LoginMFA(c *gin.Context)
+	GetSession(c *gin.Context)
+	ListIdentityProviders(c *gin.Context)
+	FederatedLogin(c *gin.Context)
+	FederatedCallback(c *gin.Context)
+	ListIdentities(c *gin.Context)
+	LinkIdentity(c *gin.Context)
+	UnlinkIdentity(c *gin.Context)
+	ListSAMLProviders(c *gin.Context)
+	SAMLMetadata(c *gin.Context)
+	SAMLLogin(c *gin.Context)
+	SAMLAssertionConsumer(c *gin.Context)
 }
 
 // userControllerImpl is the concrete implementation of UserController
 type userControllerImpl struct {
-	userService services.UserService
+	userService       services.UserService
+	mfaService        services.MFAService
+	revocationService services.RevocationService
+	sessionService    services.SessionService
+	federationService services.FederationService
+	samlService       services.SAMLService
+	sessionCookie     middleware.SessionCookie
 }
 
 // NewUserController creates a new UserController instance
-func NewUserController(userService services.UserService) UserController {
+func NewUserController(userService services.UserService, mfaService services.MFAService, revocationService services.RevocationService, sessionService services.SessionService, federationService services.FederationService, samlService services.SAMLService, sessionCookie middleware.SessionCookie) UserController {
 	return &userControllerImpl{
-		userService: userService,
+		userService:       userService,
+		mfaService:        mfaService,
+		revocationService: revocationService,
+		sessionService:    sessionService,
+		federationService: federationService,
+		samlService:       samlService,
+		sessionCookie:     sessionCookie,
 	}
 }
 
@@ -34,8 +69,10 @@ func NewUserController(userService services.UserService) UserController {
 // @Produce json
 // @Param user body models.RegisterUserRequest true "User registration details"
 // @Success 200 {object} models.MessageResponse
-// @Failure 400 {object} models.ErrorResponse
+// @Success 202 {object} models.MessageResponse "Private registration mode: the outcome is sent by email"
+// @Failure 400 {object} models.PasswordPolicyErrorResponse "Invalid input or the password breaks the policy"
 // @Failure 500 {object} models.ErrorResponse
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes; see Retry-After"
 // @Router /register [post]
 func (uc *userControllerImpl) RegisterUser(c *gin.Context) {
 	var input models.RegisterUserRequest
@@ -46,10 +83,18 @@ func (uc *userControllerImpl) RegisterUser(c *gin.Context) {
 	}
 
 	user, err := uc.userService.RegisterUser(input.Username, input.Email, input.Password)
+	if respondBusy(c, err) || respondPolicy(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if user == nil {
+		// Private registration: same answer whether or not the email was taken
+		c.JSON(http.StatusAccepted, gin.H{"message": "Registration received, please check your email"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "User registered successfully",
@@ -62,14 +107,18 @@ func (uc *userControllerImpl) RegisterUser(c *gin.Context) {
 }
 
 // @Summary Login a user
-// @Description Authenticate a user and return a JWT token
+// @Description Authenticate a user and return a JWT token, or with "session": true set a session cookie instead. Users with two-factor authentication get an MFA token instead, to exchange at /login/mfa. The password is checked by the configured authenticators in turn, e.g. the stored password, then LDAP.
 // @Tags Auth
 // @Accept json
 // @Produce json
 // @Param credentials body models.LoginRequest true "User login credentials"
 // @Success 200 {object} models.TokenResponse
+// @Success 201 {object} models.SessionResponse "Session started; the cookie is set"
+// @Success 202 {object} models.MFARequiredResponse "A second factor is required"
 // @Failure 400 {object} models.ErrorResponse
 // @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse "Email address not verified (when required)"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes (see Retry-After), or the directory is unreachable"
 // @Router /login [post]
 func (uc *userControllerImpl) Login(c *gin.Context) {
 	var input models.LoginRequest
@@ -79,13 +128,98 @@ func (uc *userControllerImpl) Login(c *gin.Context) {
 		return
 	}
 
-	user, err := uc.userService.LoginUser(input.Email, input.Password)
+	user, err := uc.userService.LoginUser(input.Email, input.Password, loginMeta(c))
+	if respondBusy(c, err) {
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrAuthenticatorUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
 
-	token, err := uc.userService.GenerateJWT(user.Username)
+	uc.startLogin(c, user, input.Session)
+}
+
+// @Summary Complete a two-factor login
+// @Description Exchange the MFA token from /login and a TOTP or recovery code for a JWT token. Wrong codes count as failed logins.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param credentials body models.MFALoginRequest true "MFA token and code"
+// @Success 200 {object} models.TokenResponse
+// @Success 201 {object} models.SessionResponse "Session started; the cookie is set"
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse "Invalid, expired or used MFA token, or wrong code"
+// @Router /login/mfa [post]
+func (uc *userControllerImpl) LoginMFA(c *gin.Context) {
+	var input models.MFALoginRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := uc.mfaService.CompleteChallenge(input.MFAToken, input.Code, loginMeta(c))
+	switch {
+	case errors.Is(err, services.ErrInvalidMFAToken), errors.Is(err, services.ErrInvalidMFACode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+
+	uc.completeLogin(c, user, input.Session)
+}
+
+// startLogin answers a login whose first factor was right: with an MFA
+// token for users with two-factor authentication, and otherwise like
+// completeLogin
+func (uc *userControllerImpl) startLogin(c *gin.Context, user *models.User, session bool) {
+	if user.MFAEnabled() {
+		mfaToken, err := uc.mfaService.IssueChallenge(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(uc.mfaService.ChallengeTTL().Seconds()),
+		})
+		return
+	}
+
+	uc.completeLogin(c, user, session)
+}
+
+// completeLogin answers a successful login with a JWT, or with a session
+// cookie when asked to
+func (uc *userControllerImpl) completeLogin(c *gin.Context, user *models.User, session bool) {
+	if session {
+		token, session, err := uc.sessionService.StartCookieSession(user, loginMeta(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+			return
+		}
+		uc.sessionCookie.Set(c, token, session.ExpiresAt)
+		c.JSON(http.StatusCreated, uc.sessionResponse(session))
+		return
+	}
+
+	tokenSession, err := uc.sessionService.StartTokenSession(user, loginMeta(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+		return
+	}
+	token, err := uc.userService.GenerateJWT(user, tokenSession)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -94,12 +228,74 @@ func (uc *userControllerImpl) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
+// @Summary Current session
+// @Description Describe the cookie session the request is made with, including its CSRF token, e.g. after a page reload
+// @Tags Auth
+// @Produce json
+// @Success 200 {object} models.SessionResponse
+// @Failure 400 {object} models.ErrorResponse "The request is not made with a session cookie"
+// @Failure 401 {object} models.ErrorResponse
+// @Router /session [get]
+func (uc *userControllerImpl) GetSession(c *gin.Context) {
+	session, exists := c.Get("session")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not logged in with a session cookie"})
+		return
+	}
+	c.JSON(http.StatusOK, uc.sessionResponse(session.(*models.Session)))
+}
+
+// sessionResponse renders a session (see models.SessionResponse)
+func (uc *userControllerImpl) sessionResponse(session *models.Session) gin.H {
+	return gin.H{
+		"csrf_token":      session.CSRFToken,
+		"expires_at":      session.ExpiresAt,
+		"idle_expires_at": uc.sessionService.IdleExpiry(session),
+	}
+}
+
+// @Summary Logout
+// @Description Revoke the current JWT on every instance, or end the current cookie session
+// @Tags Auth
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} models.MessageResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /logout [post]
+func (uc *userControllerImpl) Logout(c *gin.Context) {
+	user, userExists := c.Get("user")
+	sessionID, sessionExists := c.Get("session_id")
+	if !userExists || !sessionExists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve session from context"})
+		return
+	}
+
+	err := uc.sessionService.Revoke(user.(*models.User).ID, sessionID.(string))
+	if errors.Is(err, services.ErrSessionNotFound) {
+		// A token from before sessions were recorded
+		if claims, ok := c.Get("claims"); ok {
+			err = uc.revocationService.Revoke(claims.(*models.Claims))
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+
+	if _, ok := c.Get("session"); ok {
+		uc.sessionCookie.Clear(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
 // @Summary Get user profile
-// @Description Retrieve the currently authenticated user's profile
+// @Description Retrieve the currently authenticated user's profile; the response carries its ETag
 // @Tags User
 // @Produce json
 // @Security BearerAuth
-// @Success 200 {object} models.ProfileResponse
+// @Param If-None-Match header string false "ETag from a previous response"
+// @Success 200 {object} models.UserResponse
+// @Success 304 "Not Modified"
 // @Failure 500 {object} models.ErrorResponse
 // @Router /profile [get]
 func (uc *userControllerImpl) GetProfile(c *gin.Context) {
@@ -108,6 +304,217 @@ func (uc *userControllerImpl) GetProfile(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
 		return
 	}
+	if notModified(c, user.(*models.User)) {
+		return
+	}
+
+	c.JSON(http.StatusOK, userResponse(user.(*models.User)))
+}
+
+// @Summary Change password
+// @Description Change the current user's password; the new one must meet the password policy and not be a recent one
+// @Tags User
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param passwords body models.ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.PasswordPolicyErrorResponse "Invalid input or the password breaks the policy"
+// @Failure 403 {object} models.ErrorResponse "Current password is incorrect, or the password is managed by the LDAP directory"
+// @Failure 409 {object} models.ErrorResponse "The account changed concurrently"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes; see Retry-After"
+// @Router /profile/password [put]
+func (uc *userControllerImpl) ChangePassword(c *gin.Context) {
+	var input models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user from context"})
+		return
+	}
+
+	err := uc.userService.ChangePassword(user.(*models.User).ID, input.CurrentPassword, input.NewPassword)
+	if respondBusy(c, err) || respondPolicy(c, err) {
+		return
+	}
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+	case errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrVersionConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		respondUserError(c, err)
+	}
+}
+
+// @Summary Verify email address
+// @Description Confirm an email address with the token from the verification email; each token works once
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param token body models.VerifyEmailRequest true "Verification token"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse "Invalid, expired or used token"
+// @Failure 500 {object} models.ErrorResponse
+// @Router /verify-email [post]
+func (uc *userControllerImpl) VerifyEmail(c *gin.Context) {
+	var input models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := uc.userService.VerifyEmail(input.Token)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+	case errors.Is(err, services.ErrInvalidToken):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+	}
+}
+
+// @Summary Resend verification email
+// @Description Send a new verification link, invalidating earlier ones. The response is the same whether or not the email is registered, already verified or was sent a link too recently.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param email body models.ResendVerificationRequest true "Email address"
+// @Success 202 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /verify-email/resend [post]
+func (uc *userControllerImpl) ResendVerification(c *gin.Context) {
+	var input models.ResendVerificationRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := uc.userService.ResendVerification(input.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resend verification email"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address needs verifying, a new link is on its way"})
+}
+
+// @Summary Forgot password
+// @Description Email a single-use password reset link, or for accounts of the LDAP directory a note to reset the password there. The response is the same whether or not the email is registered.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param email body models.ForgotPasswordRequest true "Email address"
+// @Success 202 {object} models.MessageResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse "Too many requests for this email or from this IP; see Retry-After"
+// @Failure 500 {object} models.ErrorResponse
+// @Router /password/forgot [post]
+func (uc *userControllerImpl) ForgotPassword(c *gin.Context) {
+	var input models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusOK, user)
+	err := uc.userService.ForgotPassword(input.Email, c.ClientIP())
+	if respondRateLimited(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send password reset email"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address is registered, a reset link is on its way"})
+}
+
+// @Summary Reset password
+// @Description Set a new password with the token from the reset email. The password policy applies, and every existing session and personal access token of the user is revoked.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param reset body models.ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} models.MessageResponse
+// @Failure 400 {object} models.PasswordPolicyErrorResponse "Invalid, expired or used token, or the password breaks the policy"
+// @Failure 403 {object} models.ErrorResponse "The password is managed by the LDAP directory"
+// @Failure 409 {object} models.ErrorResponse "The account changed concurrently"
+// @Failure 429 {object} models.ErrorResponse "Too many requests from this IP; see Retry-After"
+// @Failure 503 {object} models.ErrorResponse "Too many concurrent password hashes; see Retry-After"
+// @Router /password/reset [post]
+func (uc *userControllerImpl) ResetPassword(c *gin.Context) {
+	var input models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := uc.userService.ResetPassword(input.Token, input.NewPassword, c.ClientIP())
+	if respondRateLimited(c, err) || respondBusy(c, err) || respondPolicy(c, err) {
+		return
+	}
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Password has been reset, please log in again"})
+	case errors.Is(err, services.ErrInvalidToken):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrDirectoryAccount):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrVersionConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+	}
+}
+
+// loginMeta describes the client making the request
+func loginMeta(c *gin.Context) services.LoginMeta {
+	return services.LoginMeta{
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// respondBusy answers 503 with Retry-After if err means the password hashing
+// pool is saturated, and reports whether it did
+func respondBusy(c *gin.Context, err error) bool {
+	var busy *password.BusyError
+	if !errors.As(err, &busy) {
+		return false
+	}
+	seconds := int((busy.RetryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": busy.Error()})
+	return true
+}
+
+// respondRateLimited answers 429 with Retry-After if err means a rate limit
+// was hit, and reports whether it did
+func respondRateLimited(c *gin.Context, err error) bool {
+	var limited *services.RateLimitedError
+	if !errors.As(err, &limited) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(limited.RetryAfter.Seconds())))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": limited.Error()})
+	return true
+}
+
+// respondPolicy answers 400 listing the problems if err means a password
+// breaks the policy, and reports whether it did
+func respondPolicy(c *gin.Context, err error) bool {
+	var policyErr *password.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":    "Password does not meet the policy",
+		"problems": policyErr.Problems,
+	})
+	return true
 }
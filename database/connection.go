@@ -1,24 +1,53 @@
 package database
 
 import (
-    "gin-tutorial/models"
-    "log"
+	"log"
 
-    "gorm.io/driver/postgres"
-    "gorm.io/gorm"
+	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
+// ConnectDatabase opens the database named by dsn, picking the driver
+// (Postgres, MySQL or SQLite) from its scheme. RunMigrations migrates it:
+// it needs to see the schema as it was to backfill new columns.
 func ConnectDatabase(dsn string) {
-    var err error
-    DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
-    if err != nil {
-        log.Fatal("Failed to connect to database:", err)
-    }
-
-    err = DB.AutoMigrate(&models.User{})
-    if err != nil {
-        log.Fatal("Failed to migrate database:", err)
-    }
+	var err error
+	DB, err = Open(dsn)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+}
+
+// Open opens the database named by dsn without migrating it
+func Open(dsn string) (*gorm.DB, error) {
+	dialector, err := dialectorFor(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
+		// Report unique violations as gorm.ErrDuplicatedKey on every dialect,
+		// like the in-memory repository
+		TranslateError: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if Dialect(db) == DialectSQLite {
+		// SQLite allows a single writer, and every connection to :memory:
+		// would otherwise get its own empty database
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// Dialect returns the name of the SQL dialect db is connected with
+func Dialect(db *gorm.DB) string {
+	return db.Dialector.Name()
 }
@@ -1,41 +1,163 @@
 package database
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"log"
+	"os"
+	"time"
 
 	"gin-tutorial/models"
+	"gin-tutorial/repository"
 
 	"gorm.io/gorm"
 )
 
-// RunMigrations runs all database migrations and seed data
+// RunMigrations runs all database migrations
 func RunMigrations(db *gorm.DB) {
 	log.Println("Running migrations...")
 
+	// Sessions used to be keyed by their cookie hash; those rows can't be
+	// found any more, so they are dropped and the browsers log in again
+	dropOldSessions := db.Migrator().HasTable(&models.Session{}) &&
+		!db.Migrator().HasColumn(&models.Session{}, "token_hash")
+	if dropOldSessions {
+		if err := db.Migrator().DropTable(&models.Session{}); err != nil {
+			log.Fatalf("Error dropping old sessions: %v", err)
+		}
+	}
+
+	// Accounts that predate email verification count as verified
+	backfillVerified := !db.Migrator().HasColumn(&models.User{}, "verified_at")
+	// The admin account predates roles
+	backfillRole := db.Migrator().HasTable(&models.User{}) &&
+		!db.Migrator().HasColumn(&models.User{}, "role")
+
 	// Automatically migrate User model
 	err := db.AutoMigrate(
 		&models.User{}, // Add your models here
+		&models.RevokedToken{},
+		&models.LoginAttempt{},
+		&models.PasswordHistory{},
+		&models.UserToken{},
+		&models.RecoveryCode{},
+		&models.Session{},
+		&models.LoginEvent{},
+		&models.AccessToken{},
+		&models.ServiceAccount{},
+		&models.ServiceAccountCredential{},
+		&models.OAuthClient{},
+		&models.OAuthConsent{},
+		&models.OAuthAuthorizationCode{},
+		&models.OAuthRefreshToken{},
+		&models.Identity{},
 		// Add additional models here, e.g., &models.Product{}, &models.Order{}
 	)
 	if err != nil {
 		log.Fatalf("Error running migrations: %v", err)
 	}
 
+	if err := migrateUserIndexes(db); err != nil {
+		log.Fatalf("Error migrating user indexes: %v", err)
+	}
+
+	if backfillVerified {
+		err = db.Unscoped().Model(&models.User{}).
+			Where("verified_at IS NULL").
+			Update("verified_at", gorm.Expr("created_at")).Error
+		if err != nil {
+			log.Fatalf("Error backfilling verified emails: %v", err)
+		}
+	}
+
+	if backfillRole {
+		// The role column was just added and every user got "user"; the
+		// seeded admin existed before roles did and becomes admin, once
+		err = db.Model(&models.User{}).
+			Where("email = ? AND username = ?", "admin@example.com", "admin").
+			Update("role", models.RoleAdmin).Error
+		if err != nil {
+			log.Fatalf("Error backfilling admin role: %v", err)
+		}
+	}
+
 	log.Println("Database migration completed successfully")
+}
+
+// migrateUserIndexes replaces the plain unique indexes on email and username
+// with ones that ignore soft-deleted rows, so a deleted account doesn't block
+// re-registration. Postgres and SQLite support partial indexes; MySQL gets a
+// functional index that is NULL (and thus never conflicts) for deleted rows,
+// which needs MySQL 8.0.13 or later.
+func migrateUserIndexes(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, column := range []string{"email", "username"} {
+		legacyIndex := "idx_users_" + column
+		if migrator.HasIndex(&models.User{}, legacyIndex) {
+			if err := migrator.DropIndex(&models.User{}, legacyIndex); err != nil {
+				return err
+			}
+		}
 
-	// Seed data
-	seedData(db)
+		index := "idx_users_" + column + "_active"
+		if migrator.HasIndex(&models.User{}, index) {
+			continue
+		}
+
+		var statement string
+		switch Dialect(db) {
+		case DialectMySQL:
+			statement = "CREATE UNIQUE INDEX " + index + " ON users ((CAST(IF(deleted_at IS NULL, " + column + ", NULL) AS CHAR(255))))"
+		default:
+			statement = "CREATE UNIQUE INDEX " + index + " ON users (" + column + ") WHERE deleted_at IS NULL"
+		}
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// seedData seeds the database with initial data
-func seedData(db *gorm.DB) {
+// SeedData seeds the user repository with initial data. It works against any
+// UserRepository so the in-memory storage gets the same seed as Postgres.
+// Only an empty repository is seeded: an admin who was deleted, or changed
+// their email, is not recreated on the next start.
+// The admin gets adminPassword, or a random password that is written to
+// passwordFile, readable by the owner only; it is never logged.
+func SeedData(userRepo repository.UserRepository, adminPassword, passwordFile string) {
 	log.Println("Seeding data...")
 
+	// Deleted users count, so deleting the admin doesn't bring it back
+	users, err := userRepo.List(repository.ListOptions{Deleted: repository.IncludeDeleted})
+	if err != nil {
+		log.Fatalf("Failed to list users: %v", err)
+	}
+	if len(users) > 0 {
+		log.Println("Seeding data completed")
+		return
+	}
+
+	if adminPassword == "" {
+		secret := make([]byte, 18)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate admin password: %v", err)
+		}
+		adminPassword = base64.RawURLEncoding.EncodeToString(secret)
+		if err := writeSecretFile(passwordFile, adminPassword+"\n"); err != nil {
+			log.Fatalf("Failed to save the generated admin password: %v", err)
+		}
+		log.Printf("Generated a password for admin@example.com in %s (set ADMIN_PASSWORD to choose one)", passwordFile)
+	}
+
 	// Create an admin user with a hashed password
+	now := time.Now()
 	admin := models.User{
-		Username: "admin",
-		Email:    "admin@example.com",
-		Password: "password123", // Plain text password
+		Username:   "admin",
+		Email:      "admin@example.com",
+		Password:   adminPassword, // Plain text password
+		Role:       models.RoleAdmin,
+		VerifiedAt: &now,
 	}
 
 	// Hash the password
@@ -43,8 +165,32 @@ func seedData(db *gorm.DB) {
 		log.Fatalf("Failed to hash password: %v", err)
 	}
 
-	// Save the admin user if not exists
-	db.FirstOrCreate(&admin, models.User{Email: "admin@example.com"})
+	err = userRepo.Create(&admin)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// Another instance seeded it first
+		log.Println("Seeding data completed")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to seed admin user: %v", err)
+	}
 
 	log.Println("Seeding data completed")
 }
+
+// writeSecretFile writes content to a new file at path that only its owner
+// can read, replacing any file already there
+func writeSecretFile(path, content string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
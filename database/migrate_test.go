@@ -0,0 +1,121 @@
+package database
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+)
+
+// TestRunMigrationsBackfillsOnce migrates a users table from before roles
+// and email verification, then checks the backfills don't run again
+func TestRunMigrationsBackfillsOnce(t *testing.T) {
+	db, err := Open("sqlite::memory:")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	err = db.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME, updated_at DATETIME, deleted_at DATETIME,
+		username TEXT, email TEXT, password TEXT)`).Error
+	if err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	err = db.Exec(`INSERT INTO users (created_at, updated_at, username, email, password) VALUES
+		(CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'admin', 'admin@example.com', 'hash'),
+		(CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'mallory', 'mallory@example.com', 'hash')`).Error
+	if err != nil {
+		t.Fatalf("insert legacy users: %v", err)
+	}
+
+	RunMigrations(db)
+
+	role := func(email string) string {
+		t.Helper()
+		var user models.User
+		if err := db.Unscoped().Where("email = ?", email).Order("id DESC").First(&user).Error; err != nil {
+			t.Fatalf("find %s: %v", email, err)
+		}
+		if user.VerifiedAt == nil {
+			t.Errorf("%s predates email verification but isn't verified", email)
+		}
+		return user.Role
+	}
+	if got := role("admin@example.com"); got != models.RoleAdmin {
+		t.Errorf("seeded admin has role %q, want %q", got, models.RoleAdmin)
+	}
+	if got := role("mallory@example.com"); got != models.RoleUser {
+		t.Errorf("mallory has role %q, want %q", got, models.RoleUser)
+	}
+
+	// Once roles exist, the address alone grants nothing: a demoted admin,
+	// or whoever registers the address after the admin is deleted, stays a
+	// user across restarts
+	if err := db.Model(&models.User{}).Where("email = ?", "admin@example.com").Update("role", models.RoleUser).Error; err != nil {
+		t.Fatalf("demote admin: %v", err)
+	}
+	RunMigrations(db)
+	if got := role("admin@example.com"); got != models.RoleUser {
+		t.Errorf("demoted admin has role %q after a restart, want %q", got, models.RoleUser)
+	}
+}
+
+// TestSeedDataKeepsGeneratedPasswordOutOfLogs checks a generated admin
+// password only ends up in the owner-only file
+func TestSeedDataKeepsGeneratedPasswordOutOfLogs(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	userRepo := repository.NewMemoryUserRepository()
+	passwordFile := filepath.Join(t.TempDir(), "admin-password.txt")
+	SeedData(userRepo, "", passwordFile)
+
+	info, err := os.Stat(passwordFile)
+	if err != nil {
+		t.Fatalf("password file: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("password file mode = %o, want 600", mode)
+	}
+	content, err := os.ReadFile(passwordFile)
+	if err != nil {
+		t.Fatalf("read password file: %v", err)
+	}
+	password := strings.TrimSpace(string(content))
+
+	admin, err := userRepo.FindByEmail("admin@example.com")
+	if err != nil {
+		t.Fatalf("admin wasn't seeded: %v", err)
+	}
+	if !admin.CheckPassword(password) {
+		t.Error("the password in the file doesn't log in the admin")
+	}
+	if strings.Contains(logged.String(), password) {
+		t.Error("the generated password was logged")
+	}
+}
+
+// TestSeedDataLeavesDeletedAdminDeleted checks a restart doesn't seed a new
+// admin once the seeded one was deleted
+func TestSeedDataLeavesDeletedAdminDeleted(t *testing.T) {
+	userRepo := repository.NewMemoryUserRepository()
+	SeedData(userRepo, "admin password 1", filepath.Join(t.TempDir(), "admin-password.txt"))
+	admin, err := userRepo.FindByEmail("admin@example.com")
+	if err != nil {
+		t.Fatalf("admin wasn't seeded: %v", err)
+	}
+	if err := userRepo.Delete(admin.ID, admin.Version); err != nil {
+		t.Fatalf("delete admin: %v", err)
+	}
+
+	SeedData(userRepo, "admin password 1", filepath.Join(t.TempDir(), "admin-password.txt"))
+	if users, _ := userRepo.List(repository.ListOptions{}); len(users) != 0 {
+		t.Errorf("active users after a restart = %+v, want none", users)
+	}
+}
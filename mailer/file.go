@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileMailer writes every email as an .eml file into an outbox directory,
+// for tests and local development without an SMTP server
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer creates a Mailer that writes emails into dir
+func NewFileMailer(dir, from string) (Mailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileMailer{dir: dir, from: from}, nil
+}
+
+// Send writes msg to <dir>/<timestamp>-<recipient>.eml
+func (fm *fileMailer) Send(msg Message) error {
+	if err := validAddress(msg.To); err != nil {
+		return err
+	}
+	data, err := encode(fm.from, msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), filepath.Base(msg.To))
+	// Write under a temporary name so readers never see a partial file
+	tmp, err := os.CreateTemp(fm.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(fm.dir, name))
+}
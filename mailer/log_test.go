@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLogMailerRedactsTokens(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	body := "Open http://localhost:8080/reset-password?token=s3cret-reset&lang=en " +
+		"or http://localhost:8080/verify-email?token=s3cret-verify\n"
+	if err := NewLogMailer().Send(Message{To: "alice@example.com", Subject: "Reset", Body: body}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("nothing was logged")
+	}
+	logged := entry.Data["body"].(string)
+	for _, secret := range []string{"s3cret-reset", "s3cret-verify"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("logged body holds the token %s: %q", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "/reset-password?token=REDACTED&lang=en") {
+		t.Errorf("logged body = %q, want the link with its token redacted", logged)
+	}
+}
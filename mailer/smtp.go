@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPConfig describes the SMTP server to send through
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string // no authentication when empty
+	Password string
+	From     string
+	Timeout  time.Duration
+}
+
+// smtpMailer sends emails through an SMTP server, upgrading to TLS with
+// STARTTLS when the server offers it
+type smtpMailer struct {
+	config SMTPConfig
+	// sender is the bare address of From, for the SMTP envelope
+	sender string
+}
+
+// NewSMTPMailer creates a Mailer that delivers through an SMTP server. From
+// may include a display name ("App <no-reply@example.com>").
+func NewSMTPMailer(config SMTPConfig) (Mailer, error) {
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", config.From, err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &smtpMailer{config: config, sender: from.Address}, nil
+}
+
+// Send delivers msg, giving up after the configured timeout
+func (sm *smtpMailer) Send(msg Message) error {
+	if err := validAddress(msg.To); err != nil {
+		return err
+	}
+	data, err := encode(sm.config.From, msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(sm.config.Host, strconv.Itoa(sm.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, sm.config.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sm.config.Timeout))
+
+	client, err := smtp.NewClient(conn, sm.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: sm.config.Host}); err != nil {
+			return err
+		}
+	}
+	if sm.config.Username != "" {
+		auth := smtp.PlainAuth("", sm.config.Username, sm.config.Password, sm.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(sm.sender); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
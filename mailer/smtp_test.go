@@ -0,0 +1,155 @@
+package mailer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPDelivery is what the fake SMTP server received in one session
+type fakeSMTPDelivery struct {
+	auth string // decoded AUTH PLAIN response
+	from string
+	to   []string
+	data string
+}
+
+// startFakeSMTP runs a minimal SMTP server on a local port that accepts one
+// session and sends what it received to the returned channel
+func startFakeSMTP(t *testing.T) (int, <-chan fakeSMTPDelivery) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	deliveries := make(chan fakeSMTPDelivery, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+		var delivery fakeSMTPDelivery
+		reply("220 localhost fake SMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case verb == "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(strings.ToUpper(line), "AUTH PLAIN"):
+				decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[len("AUTH PLAIN"):]))
+				delivery.auth = string(decoded)
+				reply("235 authenticated")
+			case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+				delivery.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				reply("250 ok")
+			case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+				delivery.to = append(delivery.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				reply("250 ok")
+			case verb == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				delivery.data = data.String()
+				reply("250 queued")
+			case verb == "QUIT":
+				reply("221 bye")
+				deliveries <- delivery
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, deliveries
+}
+
+func TestSMTPMailerDelivers(t *testing.T) {
+	port, deliveries := startFakeSMTP(t)
+	mailer, err := NewSMTPMailer(SMTPConfig{
+		Host:     "localhost",
+		Port:     port,
+		Username: "app",
+		Password: "smtp-secret",
+		From:     "Gin Tutorial <no-reply@example.com>",
+	})
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+
+	body := "Hi alice,\n\nPlease confirm your email address by opening this link:\n\n" +
+		"http://localhost:8080/verify-email?token=abc123\n"
+	err = mailer.Send(Message{To: "alice@example.com", Subject: "Confirm your email – Gin Tutorial", Body: body})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	delivery := <-deliveries
+	if delivery.auth != "\x00app\x00smtp-secret" {
+		t.Errorf("AUTH PLAIN = %q", delivery.auth)
+	}
+	if delivery.from != "no-reply@example.com" {
+		t.Errorf("MAIL FROM = %q, want the bare sender address", delivery.from)
+	}
+	if len(delivery.to) != 1 || delivery.to[0] != "alice@example.com" {
+		t.Errorf("RCPT TO = %v", delivery.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(delivery.data))
+	if err != nil {
+		t.Fatalf("parse delivered message: %v", err)
+	}
+	if got := msg.Header.Get("To"); got != "alice@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Confirm your email – Gin Tutorial" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if got := strings.ReplaceAll(string(decoded), "\r\n", "\n"); got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	mailer, err := NewSMTPMailer(SMTPConfig{Host: "localhost", Port: 1, From: "no-reply@example.com"})
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+	for _, to := range []string{"alice@example.com\r\nBcc: mallory@example.com", "Alice <alice@example.com>", "not an address"} {
+		if err := mailer.Send(Message{To: to, Subject: "Hi", Body: "Hi"}); err == nil || !strings.Contains(err.Error(), "invalid email address") {
+			t.Errorf("Send to %s: got %v, want an invalid address error", strconv.Quote(to), err)
+		}
+	}
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"gin-tutorial/cache"
 	"gin-tutorial/config"
 	"gin-tutorial/controllers"
 	"gin-tutorial/database"
 	"gin-tutorial/docs"
+	"gin-tutorial/mailer"
 	"gin-tutorial/middleware"
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
 	"gin-tutorial/repository"
 	"gin-tutorial/services"
 
@@ -25,22 +41,379 @@ import (
 func main() {
 	cfg := config.LoadConfig()
 
+	// --storage=memory runs without a database, e.g. for quick demos
+	flag.StringVar(&cfg.Storage, "storage", cfg.Storage, "storage backend: database or memory")
+	flag.Parse()
+
 	// Configure logging
 	config.ConfigureLogger()
 
-	// Connect to database
-	database.ConnectDatabase(cfg.DatabaseURL)
-
-	// Run migrations
-	database.RunMigrations(database.DB)
+	// Set before anything hashes a password (seeding, the login dummy hash)
+	if cfg.Argon2Parallelism < 1 || cfg.Argon2Parallelism > 255 {
+		log.Fatalf("ARGON2_PARALLELISM must be between 1 and 255")
+	}
+	passwords, err := password.NewRegistry(password.Options{
+		Algorithm:  cfg.PasswordAlgorithm,
+		BcryptCost: cfg.BcryptCost,
+		Argon2: password.Argon2Params{
+			Memory:      uint32(cfg.Argon2Memory),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		},
+		Pepper:         cfg.PasswordPepper,
+		PepperID:       cfg.PasswordPepperID,
+		RetiredPeppers: cfg.RetiredPeppers,
+	})
+	if err != nil {
+		log.Fatalf("Invalid password hashing settings: %v", err)
+	}
+	models.Passwords = passwords
 
 	// Initialize dependencies
-	userRepo := repository.NewUserRepository(database.DB) // Returns the UserRepository interface
-	userService := services.NewUserService(userRepo)
-	userController := controllers.NewUserController(userService)
+	var userRepo repository.UserRepository // Holds the UserRepository interface
+	var revokedTokenRepo repository.RevokedTokenRepository
+	var loginAttemptRepo repository.LoginAttemptRepository
+	var passwordHistoryRepo repository.PasswordHistoryRepository
+	var userTokenRepo repository.UserTokenRepository
+	var recoveryCodeRepo repository.RecoveryCodeRepository
+	var sessionRepo repository.SessionRepository
+	var loginEventRepo repository.LoginEventRepository
+	var accessTokenRepo repository.AccessTokenRepository
+	var serviceAccountRepo repository.ServiceAccountRepository
+	var oauthClientRepo repository.OAuthClientRepository
+	var oauthGrantRepo repository.OAuthGrantRepository
+	var identityRepo repository.IdentityRepository
+	bus := pubsub.NewLocalBus()
+	switch cfg.Storage {
+	case "database":
+		// Connect to database
+		database.ConnectDatabase(cfg.DatabaseURL)
+
+		// Run migrations
+		database.RunMigrations(database.DB)
+
+		userRepo = repository.NewUserRepository(database.DB)
+		revokedTokenRepo = repository.NewRevokedTokenRepository(database.DB)
+		loginAttemptRepo = repository.NewLoginAttemptRepository(database.DB)
+		passwordHistoryRepo = repository.NewPasswordHistoryRepository(database.DB)
+		userTokenRepo = repository.NewUserTokenRepository(database.DB)
+		recoveryCodeRepo = repository.NewRecoveryCodeRepository(database.DB)
+		sessionRepo = repository.NewSessionRepository(database.DB)
+		loginEventRepo = repository.NewLoginEventRepository(database.DB)
+		accessTokenRepo = repository.NewAccessTokenRepository(database.DB)
+		serviceAccountRepo = repository.NewServiceAccountRepository(database.DB)
+		oauthClientRepo = repository.NewOAuthClientRepository(database.DB)
+		oauthGrantRepo = repository.NewOAuthGrantRepository(database.DB)
+		identityRepo = repository.NewIdentityRepository(database.DB)
+
+		// Broadcast invalidations to the other replicas
+		if database.Dialect(database.DB) == database.DialectPostgres {
+			sqlDB, err := database.DB.DB()
+			if err != nil {
+				log.Fatalf("Failed to get database handle: %v", err)
+			}
+			bus = pubsub.NewPostgresBus(context.Background(), sqlDB, "gin_tutorial_events")
+		} else {
+			// Nothing to broadcast through: other instances sharing the
+			// database keep what they hold in memory
+			stale := "revoked tokens until they restart"
+			if cfg.CacheBackend == "memory" {
+				stale += fmt.Sprintf(", and changed users (revoked sessions included) for up to CACHE_TTL (%s)", cfg.CacheTTL)
+			}
+			log.Printf("Warning: no cross-instance event bus on %s; other instances miss %s", database.Dialect(database.DB), stale)
+		}
+	case "memory":
+		log.Println("Using in-memory storage, data will be lost on exit")
+		userRepo = repository.NewMemoryUserRepository()
+		revokedTokenRepo = repository.NewMemoryRevokedTokenRepository()
+		loginAttemptRepo = repository.NewMemoryLoginAttemptRepository()
+		passwordHistoryRepo = repository.NewMemoryPasswordHistoryRepository()
+		userTokenRepo = repository.NewMemoryUserTokenRepository()
+		recoveryCodeRepo = repository.NewMemoryRecoveryCodeRepository()
+		sessionRepo = repository.NewMemorySessionRepository()
+		loginEventRepo = repository.NewMemoryLoginEventRepository()
+		accessTokenRepo = repository.NewMemoryAccessTokenRepository()
+		serviceAccountRepo = repository.NewMemoryServiceAccountRepository()
+		oauthClientRepo = repository.NewMemoryOAuthClientRepository()
+		oauthGrantRepo = repository.NewMemoryOAuthGrantRepository(oauthClientRepo)
+		identityRepo = repository.NewMemoryIdentityRepository()
+	default:
+		log.Fatalf("Unknown storage backend %q", cfg.Storage)
+	}
+
+	// Cache user lookups
+	switch cfg.CacheBackend {
+	case "none":
+	case "memory":
+		userRepo = repository.NewCachedUserRepository(userRepo, cache.NewLRU(cfg.CacheSize), cfg.CacheTTL, cfg.CacheNegativeTTL)
+	case "redis":
+		redisCache, err := cache.NewRedis(cfg.RedisURL, "gin-tutorial:")
+		if err != nil {
+			log.Fatalf("Failed to connect to redis: %v", err)
+		}
+		userRepo = repository.NewCachedUserRepository(userRepo, redisCache, cfg.CacheTTL, cfg.CacheNegativeTTL)
+	default:
+		log.Fatalf("Unknown cache backend %q", cfg.CacheBackend)
+	}
+
+	repository.InvalidateOnEvents(userRepo, bus)
+
+	// Seed data
+	database.SeedData(userRepo, cfg.AdminPassword, cfg.AdminPasswordFile)
+
+	loginGuard := services.NewLoginGuard(loginAttemptRepo, services.LockoutPolicy{
+		MaxAccountFailures: cfg.LoginMaxFailures,
+		MaxIPFailures:      cfg.LoginIPMaxFailures,
+		Window:             cfg.LoginFailureWindow,
+		Lockout:            cfg.LoginLockout,
+		BaseDelay:          cfg.LoginBaseDelay,
+	})
+	passwordPolicy := password.Policy{
+		MinLength:  cfg.PasswordMinLength,
+		MaxBytes:   cfg.PasswordMaxBytes,
+		MinClasses: cfg.PasswordMinClasses,
+		MinScore:   cfg.PasswordMinScore,
+	}
+	if cfg.BreachedPasswords != "" {
+		breached, err := password.NewHIBPList(cfg.BreachedPasswords)
+		if err != nil {
+			log.Fatalf("Failed to open breached password list: %v", err)
+		}
+		passwordPolicy.Breached = breached
+	}
+	if cfg.Mailer == "" && cfg.Storage == "memory" {
+		cfg.Mailer = "log"
+	}
+	var mail mailer.Mailer
+	switch cfg.Mailer {
+	case "":
+		log.Fatal("MAILER must be set to smtp, file or log")
+	case "log":
+		mail = mailer.NewLogMailer()
+	case "smtp":
+		mail, err = mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		})
+		if err != nil {
+			log.Fatalf("Invalid SMTP settings: %v", err)
+		}
+	case "file":
+		mail, err = mailer.NewFileMailer(cfg.MailOutboxDir, cfg.MailFrom)
+		if err != nil {
+			log.Fatalf("Failed to create mail outbox: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown mailer %q", cfg.Mailer)
+	}
+
+	loginHistory := services.NewLoginHistory(loginEventRepo, mail, services.LoginHistoryConfig{
+		Alerts:        cfg.LoginAlerts,
+		FailureBurst:  cfg.LoginAlertFailures,
+		FailureWindow: cfg.LoginFailureWindow,
+	})
+
+	hashPool := password.NewPool(cfg.HashWorkers, cfg.HashQueueSize, cfg.HashQueueTimeout)
+	var authenticators []services.Authenticator
+	for _, name := range cfg.LoginAuthenticators {
+		switch name {
+		case "local":
+			authenticators = append(authenticators, services.NewLocalAuthenticator(userRepo, bus, hashPool))
+		case "ldap":
+			tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+			if cfg.LDAPCAFile != "" {
+				caPEM, err := os.ReadFile(cfg.LDAPCAFile)
+				if err != nil {
+					log.Fatalf("Failed to read LDAP_CA_FILE: %v", err)
+				}
+				tlsConfig.RootCAs = x509.NewCertPool()
+				if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+					log.Fatal("LDAP_CA_FILE contains no certificates")
+				}
+			}
+			ldapAuthenticator, err := services.NewLDAPAuthenticator(userRepo, identityRepo, bus, services.LDAPConfig{
+				URL:               cfg.LDAPURL,
+				StartTLS:          cfg.LDAPStartTLS,
+				TLSConfig:         tlsConfig,
+				BindDN:            cfg.LDAPBindDN,
+				BindPassword:      cfg.LDAPBindPassword,
+				BaseDN:            cfg.LDAPBaseDN,
+				UserFilter:        cfg.LDAPUserFilter,
+				EmailAttribute:    cfg.LDAPEmailAttribute,
+				UsernameAttribute: cfg.LDAPUsernameAttribute,
+				GroupBaseDN:       cfg.LDAPGroupBaseDN,
+				GroupFilter:       cfg.LDAPGroupFilter,
+				AdminGroups:       cfg.LDAPAdminGroups,
+				AllowSignup:       cfg.LDAPSignup,
+				Timeout:           cfg.LDAPTimeout,
+			})
+			if err != nil {
+				log.Fatalf("Invalid LDAP settings: %v", err)
+			}
+			authenticators = append(authenticators, ldapAuthenticator)
+		default:
+			log.Fatalf("Unknown login authenticator %q", name)
+		}
+	}
+	tokenService := services.NewTokenService(userTokenRepo, cfg.JWTSecret)
+	userService := services.NewUserService(userRepo, passwordHistoryRepo, identityRepo, tokenService, loginGuard, loginHistory, services.NewRateLimiter(loginAttemptRepo), bus, mail, hashPool, services.UserServiceConfig{
+		JWTSecret:           cfg.JWTSecret,
+		PrivateRegistration: cfg.PrivateRegistration,
+		PasswordPolicy:      passwordPolicy,
+		PasswordHistory:     cfg.PasswordHistory,
+
+		RequireVerifiedEmail:       cfg.RequireVerifiedEmail,
+		VerificationTTL:            cfg.VerificationTTL,
+		VerificationResendInterval: cfg.VerificationResendInterval,
+		AppURL:                     cfg.AppURL,
+
+		PasswordResetTTL: cfg.PasswordResetTTL,
+		ResetEmailLimit:  services.RateLimit{Limit: cfg.ResetEmailLimit, Window: cfg.ResetLimitWindow},
+		ResetIPLimit:     services.RateLimit{Limit: cfg.ResetIPLimit, Window: cfg.ResetLimitWindow},
+
+		Authenticators: authenticators,
+	})
+	revocationService := services.NewRevocationService(revokedTokenRepo, bus)
+	sessionService := services.NewSessionService(sessionRepo, revocationService, services.SessionConfig{
+		TokenTTL:        24 * time.Hour,
+		IdleTimeout:     cfg.SessionIdleTimeout,
+		AbsoluteTimeout: cfg.SessionAbsoluteTimeout,
+		ClientTokenTTL:  cfg.OAuthAccessTokenTTL,
+	})
+	mfaService := services.NewMFAService(userRepo, recoveryCodeRepo, revocationService, loginGuard, loginHistory, bus, hashPool, services.MFAServiceConfig{
+		JWTSecret:     cfg.JWTSecret,
+		Issuer:        cfg.MFAIssuer,
+		ChallengeTTL:  cfg.MFAChallengeTTL,
+		RecoveryCodes: cfg.MFARecoveryCodes,
+
+		Authenticators: authenticators,
+	})
+	accessTokenService := services.NewAccessTokenService(accessTokenRepo, services.AccessTokenConfig{
+		MaxPerUser: cfg.AccessTokenLimit,
+	})
+	serviceAccountService := services.NewServiceAccountService(serviceAccountRepo, userRepo, revocationService, services.ServiceAccountConfig{
+		JWTSecret:     cfg.JWTSecret,
+		TokenTTL:      cfg.ServiceTokenTTL,
+		TokenEndpoint: cfg.AppURL + "/oauth/token",
+	})
+	var signingKey *services.SigningKey
+	if cfg.OIDCSigningKeyFile != "" {
+		signingKey, err = services.LoadSigningKey(cfg.OIDCSigningKeyFile)
+	} else {
+		log.Println("No OIDC_SIGNING_KEY_FILE set, ID tokens are signed with a temporary key")
+		signingKey, err = services.GenerateSigningKey()
+	}
+	if err != nil {
+		log.Fatalf("Failed to load the ID token signing key: %v", err)
+	}
+	oauthService := services.NewOAuthService(oauthClientRepo, oauthGrantRepo, userService, sessionService, services.OAuthConfig{
+		JWTSecret:       cfg.JWTSecret,
+		CodeTTL:         cfg.OAuthCodeTTL,
+		RefreshTokenTTL: cfg.OAuthRefreshTokenTTL,
+		Issuer:          cfg.AppURL,
+		SigningKey:      signingKey,
+	})
+	sameSite, ok := middleware.ParseSameSite(cfg.SessionCookieSameSite)
+	if !ok {
+		log.Fatalf("Invalid SESSION_COOKIE_SAMESITE %q", cfg.SessionCookieSameSite)
+	}
+	if sameSite == http.SameSiteNoneMode && !cfg.SessionCookieSecure {
+		log.Fatal("SESSION_COOKIE_SAMESITE=none needs SESSION_COOKIE_SECURE")
+	}
+	sessionCookie := middleware.SessionCookie{
+		Name:     cfg.SessionCookieName,
+		Domain:   cfg.SessionCookieDomain,
+		Secure:   cfg.SessionCookieSecure,
+		SameSite: sameSite,
+	}
+	providers := make([]services.FederationProvider, len(cfg.OIDCProviders))
+	for i, provider := range cfg.OIDCProviders {
+		providers[i] = services.FederationProvider{
+			ID:           provider.ID,
+			Name:         provider.Name,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			Scopes:       provider.Scopes,
+			AllowSignup:  provider.Signup,
+		}
+	}
+	federationService := services.NewFederationService(userRepo, identityRepo, loginHistory, bus, providers, services.FederationConfig{
+		JWTSecret: cfg.JWTSecret,
+		AppURL:    cfg.AppURL,
+		StateTTL:  cfg.OIDCLoginTTL,
+	})
+	samlProviders := make([]services.SAMLProvider, len(cfg.SAMLProviders))
+	for i, provider := range cfg.SAMLProviders {
+		for _, oidcProvider := range cfg.OIDCProviders {
+			if oidcProvider.ID == provider.ID {
+				log.Fatalf("%q is both an OIDC and a SAML provider", provider.ID)
+			}
+		}
+		var metadata []byte
+		if provider.MetadataFile != "" {
+			if metadata, err = os.ReadFile(provider.MetadataFile); err != nil {
+				log.Fatalf("Failed to read the metadata of SAML provider %s: %v", provider.ID, err)
+			}
+		}
+		samlProviders[i] = services.SAMLProvider{
+			ID:                provider.ID,
+			Name:              provider.Name,
+			MetadataURL:       provider.MetadataURL,
+			Metadata:          metadata,
+			Binding:           provider.Binding,
+			NameIDFormat:      provider.NameIDFormat,
+			SubjectAttribute:  provider.SubjectAttribute,
+			EmailAttribute:    provider.EmailAttribute,
+			UsernameAttribute: provider.UsernameAttribute,
+			RoleAttribute:     provider.RoleAttribute,
+			AdminRoles:        provider.AdminRoles,
+			AllowSignup:       provider.Signup,
+			AllowIDPInitiated: provider.IDPInitiated,
+		}
+	}
+	samlConfig := services.SAMLConfig{
+		JWTSecret: cfg.JWTSecret,
+		AppURL:    cfg.AppURL,
+		StateTTL:  cfg.SAMLLoginTTL,
+	}
+	if cfg.SAMLCertFile != "" || cfg.SAMLKeyFile != "" {
+		samlConfig.Key, samlConfig.Certificate, err = services.LoadSAMLKeyPair(cfg.SAMLCertFile, cfg.SAMLKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the SAML key pair: %v", err)
+		}
+	}
+	samlService, err := services.NewSAMLService(userRepo, identityRepo, loginHistory, revocationService, bus, samlProviders, samlConfig)
+	if err != nil {
+		log.Fatalf("Invalid SAML settings: %v", err)
+	}
+	userController := controllers.NewUserController(userService, mfaService, revocationService, sessionService, federationService, samlService, sessionCookie)
+	adminController := controllers.NewAdminController(userService, mfaService, sessionService, loginHistory, federationService)
+	mfaController := controllers.NewMFAController(mfaService)
+	sessionController := controllers.NewSessionController(sessionService, loginHistory, oauthService)
+	accessTokenController := controllers.NewAccessTokenController(accessTokenService)
+	serviceAccountController := controllers.NewServiceAccountController(serviceAccountService)
+	oauthController := controllers.NewOAuthController(serviceAccountService, oauthService, userService, mfaService, sessionService, sessionCookie)
+	oauthClientController := controllers.NewOAuthClientController(oauthService)
+	oidcController := controllers.NewOIDCController(oauthService, signingKey, cfg.AppURL)
+
+	// Purge soft-deleted users after the retention period
+	if cfg.UserRetention > 0 {
+		go services.SchedulePurge(context.Background(), userService, cfg.PurgeInterval, cfg.UserRetention)
+	}
+	go services.ScheduleSessionCleanup(context.Background(), sessionService, cfg.PurgeInterval)
+	go services.ScheduleOAuthCleanup(context.Background(), oauthService, cfg.PurgeInterval)
 
 	r := gin.Default()
 
+	// Only trust X-Forwarded-For from known proxies, or clients could pick their own IP
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Apply the Correlation Middleware
 	r.Use(middleware.MiddlewareCorrelationID())
 	// Middleware
@@ -54,9 +427,96 @@ func main() {
 	// Routes
 	r.POST("/register", userController.RegisterUser)
 	r.POST("/login", userController.Login)
+	r.POST("/login/mfa", userController.LoginMFA)
+	r.POST("/verify-email", userController.VerifyEmail)
+	r.POST("/verify-email/resend", userController.ResendVerification)
+	r.POST("/password/forgot", userController.ForgotPassword)
+	r.POST("/password/reset", userController.ResetPassword)
+	r.GET("/auth/oidc", userController.ListIdentityProviders)
+	r.GET("/auth/oidc/:provider/login", userController.FederatedLogin)
+	r.GET("/auth/oidc/:provider/callback", userController.FederatedCallback)
+	r.GET("/auth/saml", userController.ListSAMLProviders)
+	r.GET("/auth/saml/:provider/metadata", userController.SAMLMetadata)
+	r.GET("/auth/saml/:provider/login", userController.SAMLLogin)
+	r.POST("/auth/saml/:provider/acs", userController.SAMLAssertionConsumer)
+	r.GET("/oauth/authorize", oauthController.Authorize)
+	r.POST("/oauth/authorize", oauthController.AuthorizeSubmit)
+	r.POST("/oauth/token", oauthController.Token)
+	r.POST("/oauth/revoke", oauthController.Revoke)
+	r.GET("/.well-known/openid-configuration", oidcController.Configuration)
+	r.GET("/.well-known/jwks.json", oidcController.JWKS)
+
+	authMiddleware := middleware.AuthMiddleware(cfg.JWTSecret, revocationService, userService, sessionService, accessTokenService, serviceAccountService, sessionCookie)
+	// Personal access tokens and service accounts only reach routes with a
+	// scope they were granted
+	userLogin := middleware.RequireUserLogin()
+	profileRead := middleware.RequireScope(models.ScopeProfileRead)
+	authorized := r.Group("/").Use(authMiddleware)
+	authorized.POST("/logout", userLogin, userController.Logout)
+	authorized.GET("/session", userLogin, userController.GetSession)
+	authorized.GET("/profile/sessions", profileRead, sessionController.ListSessions)
+	authorized.DELETE("/profile/sessions", userLogin, sessionController.RevokeOtherSessions)
+	authorized.DELETE("/profile/sessions/:id", userLogin, sessionController.RevokeSession)
+	authorized.GET("/profile/logins", profileRead, sessionController.ListLogins)
+	authorized.GET("/profile", profileRead, userController.GetProfile)
+	openID := middleware.RequireScope(models.ScopeOpenID)
+	authorized.GET("/userinfo", openID, oidcController.UserInfo)
+	authorized.POST("/userinfo", openID, oidcController.UserInfo)
+	authorized.PUT("/profile/password", userLogin, userController.ChangePassword)
+	authorized.POST("/profile/2fa/totp", userLogin, mfaController.EnrollTOTP)
+	authorized.POST("/profile/2fa/totp/confirm", userLogin, mfaController.ConfirmTOTP)
+	authorized.POST("/profile/2fa/totp/disable", userLogin, mfaController.DisableTOTP)
+	authorized.POST("/profile/2fa/recovery-codes", userLogin, mfaController.RegenerateRecoveryCodes)
+	authorized.GET("/profile/tokens", userLogin, accessTokenController.ListTokens)
+	authorized.POST("/profile/tokens", userLogin, accessTokenController.CreateToken)
+	authorized.GET("/profile/tokens/:id", userLogin, accessTokenController.GetToken)
+	authorized.PATCH("/profile/tokens/:id", userLogin, accessTokenController.UpdateToken)
+	authorized.DELETE("/profile/tokens/:id", userLogin, accessTokenController.RevokeToken)
+	authorized.GET("/profile/apps", userLogin, sessionController.ListApps)
+	authorized.DELETE("/profile/apps/:client_id", userLogin, sessionController.RevokeApp)
+	authorized.GET("/profile/identities", userLogin, userController.ListIdentities)
+	authorized.POST("/profile/identities", userLogin, userController.LinkIdentity)
+	authorized.DELETE("/profile/identities/:id", userLogin, userController.UnlinkIdentity)
+
+	usersRead := middleware.RequireScope(models.ScopeUsersRead)
+	usersWrite := middleware.RequireScope(models.ScopeUsersWrite)
+	admin := r.Group("/users").Use(authMiddleware, middleware.RequireRole(models.RoleAdmin))
+	admin.GET("", usersRead, adminController.ListUsers)
+	admin.GET("/:id", usersRead, adminController.GetUser)
+	admin.PUT("/:id", usersWrite, adminController.UpdateUser)
+	admin.PATCH("/:id", usersWrite, adminController.PatchUser)
+	admin.DELETE("/:id", usersWrite, adminController.DeleteUser)
+	admin.POST("/:id/restore", usersWrite, adminController.RestoreUser)
+	admin.DELETE("/:id/purge", usersWrite, adminController.PurgeUser)
+	admin.POST("/:id/unlock", usersWrite, adminController.UnlockUser)
+	admin.DELETE("/:id/2fa", usersWrite, adminController.ResetUserMFA)
+	admin.GET("/:id/sessions", usersRead, adminController.ListUserSessions)
+	admin.DELETE("/:id/sessions", usersWrite, adminController.RevokeUserSessions)
+	admin.DELETE("/:id/sessions/:session", usersWrite, adminController.RevokeUserSession)
+	admin.GET("/:id/logins", usersRead, adminController.ListUserLogins)
+	admin.GET("/:id/identities", usersRead, adminController.ListUserIdentities)
+	admin.POST("/:id/merge", usersWrite, adminController.MergeUser)
+
+	// Metrics (cache hit/miss counters etc.)
+	r.GET("/debug/vars", authMiddleware, middleware.RequireRole(models.RoleAdmin), usersRead, gin.WrapH(expvar.Handler()))
+
+	serviceAccounts := r.Group("/service-accounts").Use(authMiddleware, userLogin, middleware.RequireRole(models.RoleAdmin))
+	serviceAccounts.GET("", serviceAccountController.ListServiceAccounts)
+	serviceAccounts.POST("", serviceAccountController.CreateServiceAccount)
+	serviceAccounts.GET("/:id", serviceAccountController.GetServiceAccount)
+	serviceAccounts.PATCH("/:id", serviceAccountController.UpdateServiceAccount)
+	serviceAccounts.DELETE("/:id", serviceAccountController.DeleteServiceAccount)
+	serviceAccounts.POST("/:id/secrets", serviceAccountController.AddSecret)
+	serviceAccounts.POST("/:id/keys", serviceAccountController.AddPublicKey)
+	serviceAccounts.DELETE("/:id/credentials/:credential", serviceAccountController.RemoveCredential)
 
-	authorized := r.Group("/").Use(middleware.AuthMiddleware(cfg.JWTSecret))
-	authorized.GET("/profile", userController.GetProfile)
+	oauthClients := r.Group("/oauth/clients").Use(authMiddleware, userLogin, middleware.RequireRole(models.RoleAdmin))
+	oauthClients.GET("", oauthClientController.ListClients)
+	oauthClients.POST("", oauthClientController.CreateClient)
+	oauthClients.GET("/:id", oauthClientController.GetClient)
+	oauthClients.PATCH("/:id", oauthClientController.UpdateClient)
+	oauthClients.DELETE("/:id", oauthClientController.DeleteClient)
+	oauthClients.POST("/:id/secret", oauthClientController.RotateSecret)
 
 	r.Run(":" + cfg.Port)
 }
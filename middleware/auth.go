@@ -1,18 +1,36 @@
 package middleware
 
 import (
+    "crypto/subtle"
+    "errors"
     "gin-tutorial/models"
+    "gin-tutorial/services"
     "net/http"
+    "slices"
     "strings"
 
     "github.com/gin-gonic/gin"
     "github.com/golang-jwt/jwt/v4"
 )
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// AuthMiddleware accepts requests carrying a valid, unrevoked bearer JWT,
+// personal access token or session cookie of a user that still exists, and
+// stores that user in the context. The bearer token wins when a request has
+// both. JWTs of service accounts store the account instead.
+//
+// Personal access tokens, service accounts and tokens issued to OAuth
+// clients are limited to scopes, which
+// are stored in the context as well; every route must run RequireScope or
+// RequireUserLogin. The principal (the token's subject) is stored for the
+// request log.
+func AuthMiddleware(jwtSecret string, revocations services.RevocationService, userService services.UserService, sessions services.SessionService, accessTokens services.AccessTokenService, serviceAccounts services.ServiceAccountService, cookie SessionCookie) gin.HandlerFunc {
     return func(c *gin.Context) {
         authHeader := c.GetHeader("Authorization")
         if authHeader == "" {
+            if sessionToken := cookie.Read(c); sessionToken != "" {
+                authenticateSession(c, sessionToken, sessions, userService)
+                return
+            }
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
             c.Abort()
             return
@@ -25,18 +43,206 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
             return
         }
 
+        if strings.HasPrefix(tokenString, models.AccessTokenPrefix) {
+            authenticateAccessToken(c, tokenString, accessTokens, userService)
+            return
+        }
+
         claims := &models.Claims{}
         token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
             return []byte(jwtSecret), nil
         })
 
-        if err != nil || !token.Valid {
+        // MFA pending tokens only work at POST /login/mfa
+        if err != nil || !token.Valid || claims.Purpose != "" {
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
             c.Abort()
             return
         }
 
-        c.Set("user", claims.Username)
+        if revocations.IsRevoked(claims.Id) {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+            c.Abort()
+            return
+        }
+
+        if strings.HasPrefix(claims.Subject, models.SubjectServiceAccountPrefix) {
+            authenticateServiceAccount(c, claims, serviceAccounts)
+            return
+        }
+
+        user, err := userService.GetProfile(claims.UserID)
+        if err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+            c.Abort()
+            return
+        }
+
+        // iat only has second precision, so a token from the same second as
+        // the revocation counts as revoked
+        if user.SessionsRevokedAt != nil && claims.IssuedAt <= user.SessionsRevokedAt.Unix() {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+            c.Abort()
+            return
+        }
+
+        // Tokens from before sessions were recorded have no session row;
+        // touching it is then a no-op
+        sessions.Seen(claims.Id)
+
+        c.Set("user", user)
+        c.Set("claims", claims)
+        c.Set("session_id", claims.Id)
+        c.Set("principal", user.Subject())
+        if claims.ClientID != "" {
+            c.Set("scopes", claims.ScopeList())
+        }
+        c.Next()
+    }
+}
+
+// authenticateSession is AuthMiddleware for requests with a session cookie.
+// Unsafe methods also need the session's CSRF token in CSRFHeader: other
+// sites can make the browser send the cookie, but can't read the token.
+func authenticateSession(c *gin.Context, token string, sessions services.SessionService, userService services.UserService) {
+    user, session, err := SessionUser(token, sessions, userService)
+    if err != nil {
+        message := "Session has expired"
+        if errors.Is(err, services.ErrUserNotFound) {
+            message = "User no longer exists"
+        }
+        c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+        c.Abort()
+        return
+    }
+
+    if !safeMethod(c.Request.Method) {
+        csrfToken := c.GetHeader(CSRFHeader)
+        if subtle.ConstantTimeCompare([]byte(csrfToken), []byte(session.CSRFToken)) != 1 {
+            c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+            c.Abort()
+            return
+        }
+    }
+
+    c.Set("user", user)
+    c.Set("session", session)
+    c.Set("session_id", session.ID)
+    c.Set("principal", user.Subject())
+    c.Next()
+}
+
+// SessionUser returns the live cookie session a session cookie value
+// belongs to, and its user. It fails with services.ErrInvalidSession, or
+// services.ErrUserNotFound when the user is gone. Pages that offer a login
+// form instead of refusing requests use it directly.
+func SessionUser(token string, sessions services.SessionService, userService services.UserService) (*models.User, *models.Session, error) {
+    session, err := sessions.Authenticate(token)
+    if err != nil {
+        return nil, nil, services.ErrInvalidSession
+    }
+
+    user, err := userService.GetProfile(session.UserID)
+    if err != nil {
+        return nil, nil, services.ErrUserNotFound
+    }
+
+    if user.SessionsRevokedAt != nil && !session.CreatedAt.After(*user.SessionsRevokedAt) {
+        return nil, nil, services.ErrInvalidSession
+    }
+    return user, session, nil
+}
+
+// authenticateAccessToken is AuthMiddleware for requests with a personal
+// access token
+func authenticateAccessToken(c *gin.Context, token string, accessTokens services.AccessTokenService, userService services.UserService) {
+    accessToken, err := accessTokens.Authenticate(token, c.ClientIP())
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+        c.Abort()
+        return
+    }
+
+    user, err := userService.GetProfile(accessToken.UserID)
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+        c.Abort()
+        return
+    }
+
+    // A password reset revokes personal access tokens like sessions
+    if user.SessionsRevokedAt != nil && !accessToken.CreatedAt.After(*user.SessionsRevokedAt) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+        c.Abort()
+        return
+    }
+
+    c.Set("user", user)
+    c.Set("access_token", accessToken)
+    c.Set("scopes", accessToken.ScopeList())
+    c.Set("principal", user.Subject())
+    c.Next()
+}
+
+// authenticateServiceAccount is AuthMiddleware for JWTs of service accounts
+func authenticateServiceAccount(c *gin.Context, claims *models.Claims, serviceAccounts services.ServiceAccountService) {
+    account, scopes, err := serviceAccounts.Authenticate(claims)
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+        c.Abort()
+        return
+    }
+
+    c.Set("service_account", account)
+    c.Set("claims", claims)
+    c.Set("scopes", scopes)
+    c.Set("principal", account.Subject())
+    c.Next()
+}
+
+// RequireScope only lets through personal access tokens, service accounts
+// and OAuth clients granted scope; logins can do anything their role
+// allows. It must run after AuthMiddleware.
+func RequireScope(scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if scopes, ok := c.Get("scopes"); ok && !slices.Contains(scopes.([]string), scope) {
+            c.JSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// RequireUserLogin keeps personal access tokens, service accounts and OAuth
+// clients out of routes that need a user's own login, e.g. to manage
+// credentials. It must run after AuthMiddleware.
+func RequireUserLogin() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if _, ok := c.Get("scopes"); ok {
+            c.JSON(http.StatusForbidden, gin.H{"error": "This route needs a user login"})
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// RequireRole only lets through users and service accounts with the given
+// role. It must run after AuthMiddleware.
+func RequireRole(role string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        var current string
+        if user, ok := c.Get("user"); ok {
+            current = user.(*models.User).Role
+        } else if account, ok := c.Get("service_account"); ok {
+            current = account.(*models.ServiceAccount).Role
+        }
+        if current != role {
+            c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+            c.Abort()
+            return
+        }
         c.Next()
     }
 }
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newUserService returns a user service over userRepo, and the revocation
+// service sessions need
+func newUserService(userRepo repository.UserRepository) (services.UserService, services.RevocationService) {
+	bus := pubsub.NewLocalBus()
+	attemptRepo := repository.NewMemoryLoginAttemptRepository()
+	userTokenRepo := repository.NewMemoryUserTokenRepository()
+	userService := services.NewUserService(userRepo, repository.NewMemoryPasswordHistoryRepository(), repository.NewMemoryIdentityRepository(),
+		services.NewTokenService(userTokenRepo, "test-secret"),
+		services.NewLoginGuard(attemptRepo, services.LockoutPolicy{}),
+		services.NewLoginHistory(repository.NewMemoryLoginEventRepository(), nil, services.LoginHistoryConfig{}),
+		services.NewRateLimiter(attemptRepo), bus, nil, password.NewPool(1, 1, time.Second),
+		services.UserServiceConfig{JWTSecret: "test-secret"})
+	return userService, services.NewRevocationService(repository.NewMemoryRevokedTokenRepository(), bus)
+}
+
+func TestAuthMiddlewareRevokesAccessTokensWithSessions(t *testing.T) {
+	userRepo := repository.NewMemoryUserRepository()
+	userService, revocations := newUserService(userRepo)
+	sessions := services.NewSessionService(repository.NewMemorySessionRepository(), revocations, services.SessionConfig{TokenTTL: time.Hour})
+	accessTokens := services.NewAccessTokenService(repository.NewMemoryAccessTokenRepository(), services.AccessTokenConfig{})
+
+	r := gin.New()
+	r.GET("/profile", AuthMiddleware("test-secret", revocations, userService, sessions, accessTokens, nil, SessionCookie{Name: "session"}),
+		func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	user := &models.User{Username: "alice", Email: "alice@example.com", Role: models.RoleUser}
+	if err := userRepo.Create(user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	before, _, err := accessTokens.Create(user, "before", []string{models.ScopeProfileRead}, nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	if code := get(before); code != http.StatusNoContent {
+		t.Fatalf("fresh token: status %d", code)
+	}
+
+	// What a password reset does
+	time.Sleep(time.Millisecond)
+	now := time.Now()
+	user.SessionsRevokedAt = &now
+	if err := userRepo.Update(user, user.Version); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if code := get(before); code != http.StatusUnauthorized {
+		t.Errorf("token from before the revocation: status %d, want 401", code)
+	}
+
+	time.Sleep(time.Millisecond)
+	after, _, err := accessTokens.Create(user, "after", []string{models.ScopeProfileRead}, nil)
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	if code := get(after); code != http.StatusNoContent {
+		t.Errorf("token from after the revocation: status %d, want 204", code)
+	}
+}
+
+func TestAuthMiddlewareChecksCookieSessions(t *testing.T) {
+	userRepo := repository.NewMemoryUserRepository()
+	userService, revocations := newUserService(userRepo)
+	sessionRepo := repository.NewMemorySessionRepository()
+	sessions := services.NewSessionService(sessionRepo, revocations, services.SessionConfig{
+		TokenTTL:        time.Hour,
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 2 * time.Hour,
+	})
+	cookie := SessionCookie{Name: "session"}
+	handler := AuthMiddleware("test-secret", revocations, userService, sessions, nil, nil, cookie)
+	r := gin.New()
+	r.GET("/profile", handler, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.POST("/profile", handler, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	send := func(method, token, csrfToken string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/profile", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: token})
+		if csrfToken != "" {
+			req.Header.Set(CSRFHeader, csrfToken)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	user := &models.User{Username: "alice", Email: "alice@example.com", Role: models.RoleUser}
+	if err := userRepo.Create(user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token, session, err := sessions.StartCookieSession(user, services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("StartCookieSession: %v", err)
+	}
+
+	if code := send(http.MethodGet, token, ""); code != http.StatusNoContent {
+		t.Errorf("GET with the cookie: status %d, want 204", code)
+	}
+	// Other sites can make the browser send the cookie, but not the token
+	if code := send(http.MethodPost, token, ""); code != http.StatusForbidden {
+		t.Errorf("POST without a CSRF token: status %d, want 403", code)
+	}
+	if code := send(http.MethodPost, token, "guessed"); code != http.StatusForbidden {
+		t.Errorf("POST with a wrong CSRF token: status %d, want 403", code)
+	}
+	if code := send(http.MethodPost, token, session.CSRFToken); code != http.StatusNoContent {
+		t.Errorf("POST with the CSRF token: status %d, want 204", code)
+	}
+
+	// Idle for longer than the idle timeout
+	if err := sessionRepo.Touch(session.ID, time.Now().Add(-time.Hour-time.Minute)); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	if code := send(http.MethodGet, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("idle session: status %d, want 401", code)
+	}
+
+	// Busy, but past the absolute timeout
+	short := services.NewSessionService(sessionRepo, revocations, services.SessionConfig{
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 50 * time.Millisecond,
+	})
+	token, _, err = short.StartCookieSession(user, services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("StartCookieSession: %v", err)
+	}
+	if code := send(http.MethodGet, token, ""); code != http.StatusNoContent {
+		t.Errorf("fresh session: status %d, want 204", code)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if code := send(http.MethodGet, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("session past its absolute timeout: status %d, want 401", code)
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	cookie := SessionCookie{Name: "session", Domain: "example.com", Secure: true, SameSite: http.SameSiteStrictMode}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	cookie.Set(c, "token", time.Now().Add(time.Hour))
+	cookie.Clear(c)
+
+	set := w.Result().Cookies()
+	if len(set) != 2 {
+		t.Fatalf("got %d cookies, want a set and a clear", len(set))
+	}
+	for _, got := range set {
+		if got.Name != "session" || got.Path != "/" || got.Domain != "example.com" || !got.HttpOnly || !got.Secure ||
+			got.SameSite != http.SameSiteStrictMode {
+			t.Errorf("cookie = %+v, want HttpOnly, Secure and SameSite=Strict for / on example.com", got)
+		}
+	}
+	if set[0].Value != "token" || set[0].MaxAge <= 0 || set[0].MaxAge > 3600 {
+		t.Errorf("set cookie = %+v, want the token for an hour", set[0])
+	}
+	if set[1].Value != "" || set[1].MaxAge >= 0 {
+		t.Errorf("cleared cookie = %+v, want it expired", set[1])
+	}
+}
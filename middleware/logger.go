@@ -97,6 +97,7 @@ func LoggerAndErrorHandlerMiddleware() gin.HandlerFunc {
 			"duration":   duration,
 			"ip":         c.ClientIP(),
 			"user_agent": c.Request.UserAgent(),
+			"principal":  c.GetString("principal"),
 		})
 
 		// Log based on status code
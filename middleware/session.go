@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSRFHeader carries a session's CSRF token on unsafe requests
+const CSRFHeader = "X-CSRF-Token"
+
+// SessionCookie describes the cookie holding a session
+type SessionCookie struct {
+	Name     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// ParseSameSite maps "strict", "lax" or "none" onto http.SameSite
+func ParseSameSite(value string) (http.SameSite, bool) {
+	switch value {
+	case "strict":
+		return http.SameSiteStrictMode, true
+	case "lax":
+		return http.SameSiteLaxMode, true
+	case "none":
+		return http.SameSiteNoneMode, true
+	default:
+		return 0, false
+	}
+}
+
+// Set stores a session cookie that lasts until expires. It is HttpOnly, so
+// scripts (and anything injected into the page) can't read it.
+func (sc SessionCookie) Set(c *gin.Context, value string, expires time.Time) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sc.Name,
+		Value:    value,
+		Path:     "/",
+		Domain:   sc.Domain,
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   sc.Secure,
+		HttpOnly: true,
+		SameSite: sc.SameSite,
+	})
+}
+
+// Clear tells the browser to drop the session cookie
+func (sc SessionCookie) Clear(c *gin.Context) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sc.Name,
+		Value:    "",
+		Path:     "/",
+		Domain:   sc.Domain,
+		MaxAge:   -1,
+		Secure:   sc.Secure,
+		HttpOnly: true,
+		SameSite: sc.SameSite,
+	})
+}
+
+// Read returns the session cookie's value, or "" without one
+func (sc SessionCookie) Read(c *gin.Context) string {
+	value, err := c.Cookie(sc.Name)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// safeMethod reports whether method can't change anything and so needs no
+// CSRF token
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// AccessTokenPrefix starts every personal access token, so that secret
+// scanners can spot leaked ones
+const AccessTokenPrefix = "gtp_"
+
+// Access token scopes
+const (
+	// ScopeProfileRead reads the owner's profile, sessions and login history
+	ScopeProfileRead = "profile:read"
+	// ScopeUsersRead reads user accounts (admins only)
+	ScopeUsersRead = "users:read"
+	// ScopeUsersWrite manages user accounts (admins only)
+	ScopeUsersWrite = "users:write"
+)
+
+// Scope describes who can be granted a scope
+type Scope struct {
+	// Description tells users what they allow an app on the consent page
+	Description string
+	// Role is the role needed to grant the scope, if any
+	Role string
+	// Personal scopes act on the caller's own account, so only tokens of
+	// users can have them
+	Personal bool
+}
+
+// Scopes lists every scope
+var Scopes = map[string]Scope{
+	ScopeProfileRead: {Description: "Read your profile, sessions and login history", Personal: true},
+	ScopeUsersRead:   {Description: "Read user accounts", Role: RoleAdmin},
+	ScopeUsersWrite:  {Description: "Manage user accounts", Role: RoleAdmin},
+}
+
+// AccessToken is a long-lived personal access token for scripts. Only the
+// SHA-256 hash of the token is stored; it is shown to its owner once.
+type AccessToken struct {
+	ID     uint   `gorm:"primaryKey"`
+	UserID uint   `gorm:"not null;index"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Name   string `gorm:"not null;size:100"`
+	Hash   string `gorm:"not null;uniqueIndex;size:64"`
+	// Hint is the start of the token, to tell tokens apart in listings
+	Hint string `gorm:"size:16"`
+	// Scopes is the space-separated list of granted scopes
+	Scopes     string `gorm:"not null;size:255"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string `gorm:"size:45"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// ScopeList returns the granted scopes
+func (t *AccessToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// Expired reports whether the token has expired at now
+func (t *AccessToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
@@ -1,9 +1,101 @@
 package models
 
-import "github.com/golang-jwt/jwt/v4"
+import (
+	"strings"
 
-// Claims defines custom claims for JWT
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ClaimsPurposeMFA marks the short-lived token a login gets while the
+// second factor is pending; it only works at POST /login/mfa
+const ClaimsPurposeMFA = "mfa"
+
+// ClaimsPurposeFederatedLogin marks the token kept in a cookie while the
+// user logs in with an external identity provider
+const ClaimsPurposeFederatedLogin = "federated_login"
+
+// ClaimsPurposeSAMLLogin marks the token kept in a cookie while the user
+// logs in with a SAML identity provider
+const ClaimsPurposeSAMLLogin = "saml_login"
+
+// Claims defines custom claims for JWT. The token ID (jti) is what gets
+// revoked on logout. The subject tells whose token it is: a user
+// (SubjectUserPrefix) or a service account (SubjectServiceAccountPrefix),
+// whose tokens have no UserID but a Scope.
 type Claims struct {
-	Username string `json:"username"`
+	UserID   uint   `json:"uid,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Purpose is empty for access tokens
+	Purpose string `json:"purpose,omitempty"`
+	// Scope is the space-separated list of scopes of a service account
+	// token or of a token issued to an OAuth client
+	Scope string `json:"scope,omitempty"`
+	// ClientID is the OAuth client a user's token was issued to
+	ClientID string `json:"client_id,omitempty"`
+	// CredentialID is the service account credential the token was issued
+	// for; removing the credential invalidates the token
+	CredentialID uint `json:"cid,omitempty"`
+	jwt.StandardClaims
+}
+
+// Subject (sub) namespaces, so that audits can tell people from machines
+const (
+	SubjectUserPrefix           = "user:"
+	SubjectServiceAccountPrefix = "svc:"
+)
+
+// ScopeList returns the scopes a service account or OAuth client token was
+// issued with
+func (c *Claims) ScopeList() []string {
+	return strings.Fields(c.Scope)
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token, which tells
+// an app who logged in. Unlike Claims they are signed with the RS256 key
+// published at /.well-known/jwks.json, so that apps can verify them.
+type IDTokenClaims struct {
+	// AuthTime is when the user logged in, in Unix seconds
+	AuthTime int64 `json:"auth_time"`
+	// Nonce is the value the app sent with its authorization request
+	Nonce string `json:"nonce,omitempty"`
+	// AtHash binds the ID token to the access token issued with it
+	AtHash string `json:"at_hash,omitempty"`
+	jwt.StandardClaims
+}
+
+// FederatedLoginClaims are kept in a cookie while the user logs in with an
+// external identity provider. They tie the provider's callback to the
+// browser that started the login, and keep the PKCE verifier out of the
+// URLs the provider sees.
+type FederatedLoginClaims struct {
+	// Purpose is ClaimsPurposeFederatedLogin, which access tokens can't have
+	Purpose      string `json:"purpose"`
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	// Session asks for a session cookie instead of a JWT, as at POST /login
+	Session bool `json:"session,omitempty"`
+	// LinkUserID is set when a logged-in user links the provider's user to
+	// their account instead of logging in
+	LinkUserID uint `json:"link_uid,omitempty"`
+	jwt.StandardClaims
+}
+
+// SAMLLoginClaims are kept in a cookie while the user logs in with a SAML
+// identity provider. They tie the provider's response to the browser and
+// the AuthnRequest it answers.
+type SAMLLoginClaims struct {
+	// Purpose is ClaimsPurposeSAMLLogin, which access tokens can't have
+	Purpose  string `json:"purpose"`
+	Provider string `json:"provider"`
+	// RelayState is sent along with the AuthnRequest and must come back
+	// with the response
+	RelayState string `json:"relay_state"`
+	// RequestID is the ID of the AuthnRequest, which the response's
+	// InResponseTo must match
+	RequestID string `json:"request_id"`
+	// Session asks for a session cookie instead of a JWT, as at POST /login
+	Session bool `json:"session,omitempty"`
 	jwt.StandardClaims
 }
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// Identity links an account to a user of an external identity provider, so
+// that logging in there logs in the account. A provider's user is linked to
+// one account at most, and an account to one user of each provider.
+type Identity struct {
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"not null;uniqueIndex:idx_identities_user_provider"`
+	User     *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Provider string `gorm:"not null;size:64;uniqueIndex:idx_identities_provider_subject;uniqueIndex:idx_identities_user_provider"`
+	// Subject is the provider's sub claim, which never changes for a user
+	// of the provider, unlike their email
+	Subject string `gorm:"not null;size:255;uniqueIndex:idx_identities_provider_subject"`
+	// Email is the email the provider gave at the last login; accounts are
+	// not matched by it
+	Email    string `gorm:"size:255"`
+	LinkedAt time.Time
+}
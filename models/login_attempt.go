@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Login attempt scopes, plus the rate limit counters kept in the same table
+const (
+	AttemptScopeAccount = "account"
+	AttemptScopeIP      = "ip"
+
+	RateScopeResetEmail = "reset_email"
+	RateScopeResetIP    = "reset_ip"
+)
+
+// LoginAttempt counts recent failed logins for an account (identified by
+// email, whether or not it is registered) or for a client IP. Kept in the database
+// so counters survive restarts and are shared by all replicas.
+type LoginAttempt struct {
+	Scope         string    `gorm:"primaryKey;size:16" json:"scope"`
+	Identifier    string    `gorm:"primaryKey;size:255" json:"identifier"`
+	Failures      int       `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Login event outcomes that aren't a plain success
+const (
+	LoginReasonUnknownEmail     = "unknown_email"
+	LoginReasonWrongPassword    = "wrong_password"
+	LoginReasonLockedOut        = "locked_out"
+	LoginReasonEmailNotVerified = "email_not_verified"
+	LoginReasonMFAPending       = "mfa_pending"
+	LoginReasonWrongMFACode     = "wrong_mfa_code"
+)
+
+// Suspicious login flags
+const (
+	LoginFlagNewDevice    = "new_device"
+	LoginFlagNewNetwork   = "new_network"
+	LoginFlagFailureBurst = "failure_burst"
+)
+
+// LoginEvent is one login attempt. The table is append-only. Attempts on
+// unknown emails have no user and keep the email that was tried instead.
+type LoginEvent struct {
+	ID     uint   `gorm:"primaryKey"`
+	UserID *uint  `gorm:"index:idx_login_events_user_created"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Email  string `gorm:"size:255"`
+	// Success is set only for logins that went through. Right credentials
+	// that stopped short aren't successes: an unverified email
+	// (email_not_verified), or a first factor waiting for the second
+	// (mfa_pending), which records its own event.
+	Success bool   `gorm:"not null"`
+	Reason  string `gorm:"size:32"`
+	// Provider is the identity provider of a federated login; empty for
+	// passwords
+	Provider  string `gorm:"size:64"`
+	IP        string `gorm:"size:45"`
+	UserAgent string `gorm:"size:512"`
+	Device    string `gorm:"size:128"`
+	// Network is the IP's /24 (IPv4) or /48 (IPv6) block
+	Network string `gorm:"size:64"`
+	// Flags lists, comma-separated, why a successful login looked suspicious
+	Flags     string    `gorm:"size:128"`
+	CreatedAt time.Time `gorm:"index:idx_login_events_user_created"`
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Prefixes of OAuth secrets, so that secret scanners can spot leaked ones
+const (
+	OAuthClientSecretPrefix = "gtc_"
+	RefreshTokenPrefix      = "gtr_"
+)
+
+// OpenID Connect scopes. Unlike the API scopes in Scopes they don't give
+// access to any route; they pick the claims an app gets about the user in
+// the ID token and from /userinfo.
+const (
+	// ScopeOpenID asks for an ID token
+	ScopeOpenID = "openid"
+	// ScopeProfile adds the username (preferred_username and name) and
+	// when the account last changed (updated_at)
+	ScopeProfile = "profile"
+	// ScopeEmail adds the email address and whether it is verified
+	ScopeEmail = "email"
+)
+
+// OIDCScopes lists the OpenID Connect scopes
+var OIDCScopes = map[string]Scope{
+	ScopeOpenID:  {Description: "Sign you in with your account"},
+	ScopeProfile: {Description: "See your username"},
+	ScopeEmail:   {Description: "See your email address"},
+}
+
+// OAuthScope looks up a scope apps can request: an API scope or an OpenID
+// Connect scope
+func OAuthScope(name string) (Scope, bool) {
+	if scope, ok := Scopes[name]; ok {
+		return scope, true
+	}
+	scope, ok := OIDCScopes[name]
+	return scope, ok
+}
+
+// OAuthClient is an application that users log in to through this service
+// with the authorization code flow
+type OAuthClient struct {
+	ID       uint   `gorm:"primaryKey"`
+	ClientID string `gorm:"not null;uniqueIndex;size:64"`
+	Name     string `gorm:"not null;size:100"`
+	// SecretHash is the hash of the client secret of confidential clients;
+	// public clients (e.g. single-page apps) can't keep one and rely on
+	// PKCE alone
+	SecretHash *string `gorm:"uniqueIndex;size:64"`
+	SecretHint string  `gorm:"size:16"`
+	// RedirectURIs is the newline-separated list of allowed redirect URIs,
+	// which must match exactly
+	RedirectURIs string `gorm:"type:text"`
+	// Scopes is the space-separated list of scopes the client may request
+	Scopes string `gorm:"not null;size:255"`
+	// Trusted clients are first-party apps that skip the consent page
+	Trusted   bool `gorm:"not null;default:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Confidential reports whether the client has a secret to authenticate with
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != nil
+}
+
+// RedirectURIList returns the allowed redirect URIs
+func (c *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// AllowsRedirect reports whether uri is one of the allowed redirect URIs
+func (c *OAuthClient) AllowsRedirect(uri string) bool {
+	return slices.Contains(c.RedirectURIList(), uri)
+}
+
+// ScopeList returns the scopes the client may request
+func (c *OAuthClient) ScopeList() []string {
+	return strings.Fields(c.Scopes)
+}
+
+// OAuthConsent records the scopes a user allowed a client, so they aren't
+// asked again
+type OAuthConsent struct {
+	ID       uint         `gorm:"primaryKey"`
+	UserID   uint         `gorm:"not null;uniqueIndex:idx_oauth_consents_user_client"`
+	User     *User        `gorm:"constraint:OnDelete:CASCADE"`
+	ClientID uint         `gorm:"not null;uniqueIndex:idx_oauth_consents_user_client"`
+	Client   *OAuthClient `gorm:"constraint:OnDelete:CASCADE"`
+	Scopes   string       `gorm:"not null;size:255"`
+	// CreatedAt is when the user first allowed the client
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ScopeList returns the allowed scopes
+func (c *OAuthConsent) ScopeList() []string {
+	return strings.Fields(c.Scopes)
+}
+
+// OAuthAuthorizationCode is a single-use code handed to a client's redirect
+// URI, to be exchanged for tokens together with the PKCE code verifier.
+// Only the SHA-256 hash of the code is stored.
+type OAuthAuthorizationCode struct {
+	// ID is the hash of the code
+	ID          string       `gorm:"primaryKey;size:64"`
+	ClientID    uint         `gorm:"not null;index"`
+	Client      *OAuthClient `gorm:"constraint:OnDelete:CASCADE"`
+	UserID      uint         `gorm:"not null;index"`
+	User        *User        `gorm:"constraint:OnDelete:CASCADE"`
+	RedirectURI string       `gorm:"type:text"`
+	Scopes      string       `gorm:"size:255"`
+	// CodeChallenge is the S256 PKCE challenge
+	CodeChallenge string `gorm:"not null;size:64"`
+	// Nonce is copied into the ID token, so the app can tie it to its
+	// request
+	Nonce string `gorm:"size:255"`
+	// AuthTime is when the user logged in
+	AuthTime  time.Time
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+	// FamilyID is the refresh token family issued for the code, revoked if
+	// the code is replayed
+	FamilyID  string `gorm:"size:64"`
+	CreatedAt time.Time
+}
+
+// OAuthRefreshToken lets a client get new access tokens. Every use replaces
+// it with a new one of the same family; using a replaced token again
+// revokes the family, since the token must have been stolen. Only the
+// SHA-256 hash of the token is stored.
+type OAuthRefreshToken struct {
+	// ID is the hash of the token
+	ID       string       `gorm:"primaryKey;size:64"`
+	FamilyID string       `gorm:"not null;index;size:64"`
+	ClientID uint         `gorm:"not null;index"`
+	Client   *OAuthClient `gorm:"constraint:OnDelete:CASCADE"`
+	UserID   uint         `gorm:"not null;index"`
+	User     *User        `gorm:"constraint:OnDelete:CASCADE"`
+	Scopes   string       `gorm:"size:255"`
+	// AuthTime is when the user logged in to grant the family; the family
+	// dies when the user's sessions are revoked after that
+	AuthTime  time.Time
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// ScopeList returns the scopes of the token
+func (t *OAuthRefreshToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
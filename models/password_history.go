@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// PasswordHistory is a hash of a password a user has had, kept so the user
+// can't go back to a recent one. Rows go away with the user.
+type PasswordHistory struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    uint      `gorm:"not null;index" json:"-"`
+	User      *User     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Hash      string    `gorm:"not null" json:"-"`
+	CreatedAt time.Time `json:"-"`
+}
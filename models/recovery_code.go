@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only a SHA-256 hash of it is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"-"`
+	UserID    uint       `gorm:"not null;index" json:"-"`
+	User      *User      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Hash      string     `gorm:"not null;size:64" json:"-"`
+	UsedAt    *time.Time `json:"-"`
+	CreatedAt time.Time  `json:"-"`
+}
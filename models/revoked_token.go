@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// RevokedToken records a JWT (by its ID) that must no longer be accepted.
+// Rows are kept until the token would have expired anyway.
+type RevokedToken struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
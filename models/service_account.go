@@ -0,0 +1,79 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// ServiceAccountSecretPrefix starts every service account client secret, so
+// that secret scanners can spot leaked ones
+const ServiceAccountSecretPrefix = "gts_"
+
+// Service account credential kinds
+const (
+	// CredentialKindSecret is a client secret generated by the server
+	CredentialKindSecret = "secret"
+	// CredentialKindPublicKey is the public half of a key pair; the client
+	// signs JWT assertions with the private half (private_key_jwt)
+	CredentialKindPublicKey = "public_key"
+)
+
+// ServiceAccount is a non-human principal for other backends. It gets
+// tokens through the OAuth2 client_credentials grant, acts with its role and
+// is limited to its scopes.
+type ServiceAccount struct {
+	ID uint `gorm:"primaryKey"`
+	// ClientID identifies the account at the token endpoint
+	ClientID    string `gorm:"not null;uniqueIndex;size:64"`
+	Name        string `gorm:"not null;uniqueIndex;size:100"`
+	Description string `gorm:"size:255"`
+	// OwnerID is the admin responsible for the account; nil once that
+	// admin's account is purged. The account stops working while its owner
+	// is missing, deleted or no longer an admin.
+	OwnerID *uint  `gorm:"index"`
+	Owner   *User  `gorm:"constraint:OnDelete:SET NULL"`
+	Role    string `gorm:"not null;size:20;default:user"`
+	// Scopes is the space-separated list of scopes the account may request
+	Scopes     string `gorm:"not null;size:255"`
+	DisabledAt *time.Time
+	// TokensRevokedAt invalidates every token issued up to then, e.g. when a
+	// credential is removed
+	TokensRevokedAt *time.Time
+	Credentials     []ServiceAccountCredential
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// ScopeList returns the scopes the account may request
+func (sa *ServiceAccount) ScopeList() []string {
+	return strings.Fields(sa.Scopes)
+}
+
+// Subject is the sub claim of the account's tokens
+func (sa *ServiceAccount) Subject() string {
+	return SubjectServiceAccountPrefix + sa.ClientID
+}
+
+// ServiceAccountCredential is a secret or public key a service account
+// authenticates with. Secrets are only stored as a SHA-256 hash and shown
+// once; accounts can hold several credentials to rotate them.
+type ServiceAccountCredential struct {
+	ID               uint            `gorm:"primaryKey"`
+	ServiceAccountID uint            `gorm:"not null;index"`
+	ServiceAccount   *ServiceAccount `gorm:"constraint:OnDelete:CASCADE"`
+	Kind             string          `gorm:"not null;size:16"`
+	// SecretHash is the hash of a client secret; nil for public keys
+	SecretHash *string `gorm:"uniqueIndex;size:64"`
+	// Hint is the start of a secret, or the key's fingerprint
+	Hint string `gorm:"size:32"`
+	// PublicKey is a PEM encoded RSA, ECDSA or Ed25519 public key
+	PublicKey  string `gorm:"type:text"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// Expired reports whether the credential has expired at now
+func (c *ServiceAccountCredential) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
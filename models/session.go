@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Session kinds
+const (
+	// SessionKindToken is a login that was handed a JWT
+	SessionKindToken = "token"
+	// SessionKindCookie is a browser login holding a session cookie
+	SessionKindCookie = "cookie"
+	// SessionKindOAuth is an access token issued to an OAuth client on the
+	// user's behalf
+	SessionKindOAuth = "oauth"
+)
+
+// Session is one login of a user, with the device it came from. Token and
+// OAuth sessions share their ID with the JWT's jti; cookie sessions are
+// looked up by the SHA-256 hash of the cookie value, so they can't be taken
+// over from the table alone.
+type Session struct {
+	ID     string `gorm:"primaryKey;size:64"`
+	UserID uint   `gorm:"not null;index"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Kind   string `gorm:"not null;size:16;default:cookie"`
+	// TokenHash is the hash of the cookie value; nil for token sessions
+	TokenHash *string `gorm:"uniqueIndex;size:64"`
+	// CSRFToken must be sent back in a header with every unsafe request
+	// made with a cookie session (synchronizer token pattern)
+	CSRFToken string `gorm:"size:64"`
+	IP        string `gorm:"size:45"`
+	UserAgent string `gorm:"size:512"`
+	// Device summarizes UserAgent, e.g. "Firefox on Linux"; for OAuth
+	// sessions it is the client's name
+	Device string `gorm:"size:128"`
+	// ClientID is the OAuth client of an OAuth session, and Scopes the
+	// space-separated scopes its token is limited to
+	ClientID   string `gorm:"index;size:64"`
+	Scopes     string `gorm:"size:255"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ExpiresAt is the absolute timeout; cookie sessions also have an idle
+	// timeout that runs from LastSeenAt
+	ExpiresAt time.Time `gorm:"index"`
+}
@@ -1,16 +1,61 @@
 package models
 
+import "time"
+
 // RegisterUserRequest defines the request body for user registration
 type RegisterUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required"`
+}
+
+// UpdateUserRequest defines the request body for replacing a user (PUT)
+type UpdateUserRequest struct {
+	Username string `json:"username" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
+	Role     string `json:"role" binding:"required,oneof=user admin"`
+}
+
+// PatchUserRequest defines the request body for partially updating a user (PATCH)
+type PatchUserRequest struct {
+	Username *string `json:"username" binding:"omitempty,min=1"`
+	Email    *string `json:"email" binding:"omitempty,email"`
+	Role     *string `json:"role" binding:"omitempty,oneof=user admin"`
 }
 
 // LoginRequest defines the request body for user login
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
+	// Session logs in with a session cookie instead of returning a JWT
+	Session bool `json:"session"`
+}
+
+// ChangePasswordRequest defines the request body for changing one's password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// VerifyEmailRequest defines the request body for verifying an email address
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ResendVerificationRequest defines the request body for resending the verification email
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPasswordRequest defines the request body for asking for a password reset link
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest defines the request body for resetting a password
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
 }
 
 // TokenResponse defines the response body containing the JWT token
@@ -18,9 +63,379 @@ type TokenResponse struct {
 	Token string `json:"token"`
 }
 
-// ProfileResponse defines the response body for user profile
-type ProfileResponse struct {
-	User string `json:"user"`
+// SessionResponse describes the session a cookie login started. The CSRF
+// token must be sent in the X-CSRF-Token header of unsafe requests.
+type SessionResponse struct {
+	CSRFToken     string    `json:"csrf_token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	IdleExpiresAt time.Time `json:"idle_expires_at"`
+}
+
+// SessionInfoResponse describes one login of a user
+type SessionInfoResponse struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind" enums:"token,cookie,oauth"`
+	Device string `json:"device" example:"Firefox on Linux"`
+	// ClientID is the app an oauth session's token was issued to
+	ClientID   string    `json:"client_id,omitempty"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session the request was made with
+	Current bool `json:"current"`
+}
+
+// RevokedSessionsResponse says how many sessions were revoked
+type RevokedSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// LoginEventResponse describes one login attempt on an account
+type LoginEventResponse struct {
+	ID      uint   `json:"id"`
+	Email   string `json:"email"`
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty" enums:"unknown_email,wrong_password,locked_out,email_not_verified,mfa_pending,wrong_mfa_code"`
+	// Provider is the identity provider of a federated login; empty for
+	// passwords
+	Provider  string `json:"provider,omitempty" example:"corp"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Device    string `json:"device" example:"Firefox on Linux"`
+	// Flags say why a successful login looked suspicious
+	Flags     []string  `json:"flags" enums:"new_device,new_network,failure_burst"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateAccessTokenRequest defines the request body for creating a personal access token
+type CreateAccessTokenRequest struct {
+	Name   string   `json:"name" binding:"required,max=100" example:"CI deploys"`
+	Scopes []string `json:"scopes" binding:"required,min=1" enums:"profile:read,users:read,users:write"`
+	// ExpiresAt is optional; tokens without it don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// UpdateAccessTokenRequest defines the request body for changing a personal access token
+type UpdateAccessTokenRequest struct {
+	Name   *string  `json:"name" binding:"omitempty,min=1,max=100"`
+	Scopes []string `json:"scopes" binding:"omitempty,min=1" enums:"profile:read,users:read,users:write"`
+}
+
+// AccessTokenResponse describes a personal access token
+type AccessTokenResponse struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	// Hint is the start of the token
+	Hint       string     `json:"hint" example:"gtp_Xk3q"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreatedAccessTokenResponse is AccessTokenResponse plus the token itself,
+// returned once on creation
+type CreatedAccessTokenResponse struct {
+	AccessTokenResponse
+	Token string `json:"token" example:"gtp_Xk3q..."`
+}
+
+// CreateServiceAccountRequest defines the request body for creating a service account
+type CreateServiceAccountRequest struct {
+	Name        string   `json:"name" binding:"required,max=100" example:"billing-backend"`
+	Description string   `json:"description" binding:"max=255"`
+	Role        string   `json:"role" binding:"required,oneof=user admin"`
+	Scopes      []string `json:"scopes" binding:"required,min=1" enums:"users:read,users:write"`
+}
+
+// PatchServiceAccountRequest defines the request body for changing a service account
+type PatchServiceAccountRequest struct {
+	Name        *string  `json:"name" binding:"omitempty,min=1,max=100"`
+	Description *string  `json:"description" binding:"omitempty,max=255"`
+	OwnerID     *uint    `json:"owner_id"`
+	Role        *string  `json:"role" binding:"omitempty,oneof=user admin"`
+	Scopes      []string `json:"scopes" binding:"omitempty,min=1" enums:"users:read,users:write"`
+	// Disabled stops the account from getting tokens and revokes its
+	// current ones
+	Disabled *bool `json:"disabled"`
+}
+
+// AddSecretRequest defines the request body for adding a client secret
+type AddSecretRequest struct {
+	// ExpiresAt is optional; secrets without it don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// AddPublicKeyRequest defines the request body for adding a public key
+type AddPublicKeyRequest struct {
+	// PublicKey is a PEM encoded ("PUBLIC KEY") RSA, ECDSA or Ed25519 key
+	PublicKey string `json:"public_key" binding:"required"`
+	// ExpiresAt is optional; keys without it don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CredentialResponse describes a service account credential
+type CredentialResponse struct {
+	ID   uint   `json:"id"`
+	Kind string `json:"kind" enums:"secret,public_key"`
+	// Hint is the start of a secret, or the fingerprint of a key
+	Hint       string     `json:"hint" example:"gts_Xk3q"`
+	PublicKey  string     `json:"public_key,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreatedSecretResponse is CredentialResponse plus the client secret,
+// returned once on creation
+type CreatedSecretResponse struct {
+	CredentialResponse
+	ClientSecret string `json:"client_secret" example:"gts_Xk3q..."`
+}
+
+// ServiceAccountResponse describes a service account. The account can't get
+// or use tokens while its owner is missing, deleted or no longer an admin;
+// giving it a new owner brings it back.
+type ServiceAccountResponse struct {
+	ID          uint                 `json:"id"`
+	ClientID    string               `json:"client_id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	OwnerID     *uint                `json:"owner_id"`
+	Role        string               `json:"role"`
+	Scopes      []string             `json:"scopes"`
+	Disabled    bool                 `json:"disabled"`
+	Credentials []CredentialResponse `json:"credentials"`
+	CreatedAt   time.Time            `json:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+}
+
+// OAuthTokenResponse is a successful token endpoint response (RFC 6749)
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type" example:"Bearer"`
+	ExpiresIn   int    `json:"expires_in" example:"3600"`
+	Scope       string `json:"scope" example:"users:read"`
+	// RefreshToken is only issued to apps users logged in to
+	RefreshToken string `json:"refresh_token,omitempty" example:"gtr_Xk3q..."`
+	// IDToken is only issued with the openid scope
+	IDToken string `json:"id_token,omitempty"`
+}
+
+// OAuthErrorResponse is a failed token endpoint response (RFC 6749)
+type OAuthErrorResponse struct {
+	Error            string `json:"error" enums:"invalid_request,invalid_client,invalid_grant,invalid_scope,unsupported_grant_type,unsupported_token_type"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// CreateOAuthClientRequest defines the request body for registering an OAuth client
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name" binding:"required,max=100" example:"Wiki"`
+	RedirectURIs []string `json:"redirect_uris" binding:"required,min=1" example:"https://wiki.example.com/oauth/callback"`
+	Scopes       []string `json:"scopes" binding:"required,min=1" enums:"profile:read,users:read,users:write,openid,profile,email"`
+	// Confidential clients get a secret; public clients (e.g. single-page
+	// or mobile apps) can't keep one and rely on PKCE alone
+	Confidential bool `json:"confidential"`
+	// Trusted clients are first-party apps that skip the consent page
+	Trusted bool `json:"trusted"`
+}
+
+// PatchOAuthClientRequest defines the request body for changing an OAuth client
+type PatchOAuthClientRequest struct {
+	Name         *string  `json:"name" binding:"omitempty,min=1,max=100"`
+	RedirectURIs []string `json:"redirect_uris" binding:"omitempty,min=1"`
+	Scopes       []string `json:"scopes" binding:"omitempty,min=1" enums:"profile:read,users:read,users:write,openid,profile,email"`
+	Trusted      *bool    `json:"trusted"`
+}
+
+// OAuthClientResponse describes an OAuth client
+type OAuthClientResponse struct {
+	ID           uint     `json:"id"`
+	ClientID     string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Confidential bool     `json:"confidential"`
+	// SecretHint is the start of a confidential client's secret
+	SecretHint string    `json:"secret_hint,omitempty" example:"gtc_Xk3q"`
+	Trusted    bool      `json:"trusted"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// CreatedOAuthClientResponse is OAuthClientResponse plus the client secret
+// of a confidential client, returned once on creation or rotation
+type CreatedOAuthClientResponse struct {
+	OAuthClientResponse
+	ClientSecret string `json:"client_secret,omitempty" example:"gtc_Xk3q..."`
+}
+
+// AuthorizedAppResponse describes an app the user allowed to act on their
+// behalf
+type AuthorizedAppResponse struct {
+	ClientID string   `json:"client_id"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	// CreatedAt is when the user first allowed the app
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserInfoResponse holds the OpenID Connect claims about a user; apps only
+// get the claims of the scopes the user granted them
+type UserInfoResponse struct {
+	Subject string `json:"sub" example:"user:1"`
+	// Claims of the profile scope
+	PreferredUsername string `json:"preferred_username,omitempty" example:"alice"`
+	Name              string `json:"name,omitempty" example:"alice"`
+	UpdatedAt         int64  `json:"updated_at,omitempty" example:"1700000000"`
+	// Claims of the email scope
+	Email         string `json:"email,omitempty" example:"alice@example.com"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty" example:"RSA"`
+	Use       string `json:"use" example:"sig"`
+	Algorithm string `json:"alg" example:"RS256"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e" example:"AQAB"`
+}
+
+// JWKSResponse is the set of keys ID tokens are signed with
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
+
+// OpenIDConfigurationResponse is the OpenID Connect discovery document
+type OpenIDConfigurationResponse struct {
+	Issuer                                     string   `json:"issuer" example:"https://auth.example.com"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	ResponseModesSupported                     []string `json:"response_modes_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	PromptValuesSupported                      []string `json:"prompt_values_supported"`
+	AuthorizationResponseIssParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+// IdentityProviderResponse describes an external identity provider users
+// can log in with
+type IdentityProviderResponse struct {
+	ID   string `json:"id" example:"corp"`
+	Name string `json:"name" example:"Corporate SSO"`
+	// LoginURL starts the login; send the browser there
+	LoginURL string `json:"login_url" example:"/auth/oidc/corp/login"`
+}
+
+// SAMLProviderResponse describes an external SAML identity provider users
+// can log in with
+type SAMLProviderResponse struct {
+	ID   string `json:"id" example:"corp"`
+	Name string `json:"name" example:"Corporate SSO"`
+	// LoginURL starts the login; send the browser there
+	LoginURL string `json:"login_url" example:"/auth/saml/corp/login"`
+	// MetadataURL is our service provider metadata to register with the
+	// identity provider
+	MetadataURL string `json:"metadata_url" example:"/auth/saml/corp/metadata"`
+}
+
+// IdentityResponse describes a provider's user linked to an account
+type IdentityResponse struct {
+	ID       uint      `json:"id"`
+	Provider string    `json:"provider" example:"corp"`
+	Subject  string    `json:"subject"`
+	Email    string    `json:"email,omitempty"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// LinkIdentityRequest defines the request body for linking an identity
+type LinkIdentityRequest struct {
+	Provider string `json:"provider" binding:"required" example:"corp"`
+	// Password re-authenticates accounts that have one; accounts without
+	// one must have logged in recently instead
+	Password string `json:"password"`
+}
+
+// LinkIdentityResponse tells where to send the browser to link an identity
+type LinkIdentityResponse struct {
+	// AuthorizationURL is the provider's login page; the provider sends
+	// the browser back to /auth/oidc/{provider}/callback
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// MergeUsersRequest defines the request body for merging a duplicate account
+type MergeUsersRequest struct {
+	// DuplicateID is the account to merge and delete
+	DuplicateID uint `json:"duplicate_id" binding:"required"`
+}
+
+// MFARequiredResponse is the login response for users with 2FA enabled
+type MFARequiredResponse struct {
+	MFARequired bool `json:"mfa_required" example:"true"`
+	// MFAToken is exchanged at POST /login/mfa for the real token
+	MFAToken  string `json:"mfa_token"`
+	ExpiresIn int    `json:"expires_in" example:"300"`
+}
+
+// MFALoginRequest defines the request body for completing a 2FA login
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	// Code is a TOTP code or a recovery code
+	Code string `json:"code" binding:"required"`
+	// Session logs in with a session cookie instead of returning a JWT
+	Session bool `json:"session"`
+}
+
+// TOTPEnrollmentResponse describes a new TOTP secret for an authenticator app
+type TOTPEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+	// QRCode is a PNG of the URI as a data: URI
+	QRCode string `json:"qr_code"`
+}
+
+// TOTPCodeRequest defines the request body carrying a TOTP code
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MFAReauthRequest defines the request body re-authenticating a 2FA user
+type MFAReauthRequest struct {
+	Password string `json:"password" binding:"required"`
+	// Code is a TOTP code or a recovery code
+	Code string `json:"code" binding:"required"`
+}
+
+// RecoveryCodesResponse lists new recovery codes; they are only shown once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// UserResponse defines the response body describing a user
+type UserResponse struct {
+	ID         uint       `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	CreatedAt  time.Time  `json:"created_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	MFAEnabled bool       `json:"mfa_enabled"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
 }
 
 // MessageResponse is a generic message response
@@ -32,3 +447,9 @@ type MessageResponse struct {
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
+
+// PasswordPolicyErrorResponse is returned when a new password breaks the policy
+type PasswordPolicyErrorResponse struct {
+	Error    string   `json:"error"`
+	Problems []string `json:"problems"`
+}
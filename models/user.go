@@ -1,29 +1,89 @@
 package models
 
 import (
-	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"time"
+
+	"gin-tutorial/password"
+
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Passwords hashes and verifies user passwords; main replaces it with one
+// built from the configuration
+var Passwords = password.MustNewRegistry(password.Options{})
+
+// User is an account. Email and username are unique among users that
+// haven't been deleted; the partial unique indexes are created by the
+// migrations since they differ per dialect.
 type User struct {
 	gorm.Model
-	Username string `gorm:"uniqueIndex" json:"username"`
-	Email    string `gorm:"uniqueIndex" json:"email"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
 	Password string `json:"-"`
+	Role     string `gorm:"not null;default:user" json:"role"`
+	// Version is bumped on every write and used for optimistic concurrency (ETag)
+	Version uint `gorm:"not null;default:1" json:"-"`
+	// VerifiedAt is when the user proved they own Email; nil until then
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// SessionsRevokedAt invalidates every token, session and personal
+	// access token issued up to then, e.g. after a password reset
+	SessionsRevokedAt *time.Time `json:"-"`
+	// TOTPSecret is the base32 TOTP secret, set on enrollment; it is only
+	// required at login once TOTPEnabledAt is set by confirming a code
+	TOTPSecret    string     `gorm:"size:64" json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	// TOTPLastStep is the time step of the last accepted code, so a code
+	// can't be used twice
+	TOTPLastStep int64 `gorm:"not null;default:0" json:"-"`
+}
+
+// MFAEnabled reports whether logins need a second factor
+func (u *User) MFAEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// Subject is the sub claim of the user's tokens
+func (u *User) Subject() string {
+	return SubjectUserPrefix + strconv.FormatUint(uint64(u.ID), 10)
+}
+
+// HasPassword reports whether the user can log in with a password;
+// accounts created by a federated login have none until it is reset
+func (u *User) HasPassword() bool {
+	return u.Password != ""
 }
 
 // HashPassword hashes the password before saving it to the database
 func (u *User) HashPassword() error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	hashedPassword, err := Passwords.Hash(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashedPassword)
+	u.Password = hashedPassword
 	return nil
 }
 
 // CheckPassword verifies the given password with the hashed password
 func (u *User) CheckPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	return err == nil
+	ok, _ := u.VerifyPassword(password)
+	return ok
+}
+
+// VerifyPassword is CheckPassword that also reports whether the stored hash
+// is outdated (older algorithm, parameters or pepper) and should be redone
+func (u *User) VerifyPassword(password string) (ok, needsRehash bool) {
+	ok, needsRehash, err := Passwords.Verify(password, u.Password)
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", u.ID).Warn("Unusable password hash")
+		return false, false
+	}
+	return ok, needsRehash
 }
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// User token purposes
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is a single-use token mailed to a user, e.g. to verify their
+// email address. Only a SHA-256 hash of its random part is stored, and the
+// token handed out also carries a signature, so tokens can't be recovered or
+// forged from the table alone.
+type UserToken struct {
+	// ID is the hash of the random part of the token
+	ID      string `gorm:"primaryKey;size:64"`
+	UserID  uint   `gorm:"not null;index:idx_user_tokens_user_purpose"`
+	User    *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Purpose string `gorm:"not null;size:32;index:idx_user_tokens_user_purpose"`
+	// Email is the address the token was sent to
+	Email     string `gorm:"not null;size:255"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,146 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedList tells whether a password is known from data breaches
+type BreachedList interface {
+	Contains(password string) (bool, error)
+}
+
+// NewHIBPList opens a local copy of the Have I Been Pwned password list,
+// as produced by the haveibeenpwned-downloader. path is either
+//   - a directory of range files, one per 5-character SHA-1 prefix (e.g.
+//     "21BD1" or "21BD1.txt"), each line "<35-char suffix>:<count>", or
+//   - a single file of "<40-char SHA-1>:<count>" lines sorted by hash,
+//     which is binary searched in place since it is tens of gigabytes.
+//
+// Nothing is sent over the network.
+func NewHIBPList(path string) (BreachedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return hibpDirectory(path), nil
+	}
+	return &hibpFile{path: path, size: info.Size()}, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// hibpDirectory is a directory of range files
+type hibpDirectory string
+
+func (d hibpDirectory) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+	prefix, suffix := hash[:5], hash[5:]
+
+	data, err := os.ReadFile(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = os.ReadFile(filepath.Join(string(d), prefix))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		candidate, _, _ := bytes.Cut(line, []byte(":"))
+		if strings.EqualFold(string(bytes.TrimSpace(candidate)), suffix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hibpFile is one sorted file of full hashes
+type hibpFile struct {
+	path string
+	size int64
+}
+
+func (hf *hibpFile) Contains(password string) (bool, error) {
+	target := sha1Hex(password)
+
+	f, err := os.Open(hf.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Binary search over byte offsets, comparing the first line that starts
+	// after each offset. The target line, if any, always starts in [lo, hi].
+	lo, hi := int64(0), hf.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, next, err := hibpLineAfter(f, mid)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case hash == "" || target < hash:
+			hi = mid
+		case target > hash:
+			lo = next
+		default:
+			return true, nil
+		}
+	}
+
+	// Only the line starting at lo is left to look at
+	hash, _, err := hibpLineAfter(f, lo-1)
+	return err == nil && hash == target, err
+}
+
+// hibpLineAfter reads the hash of the first line starting after offset
+// (the first line of the file for -1), and the offset following that line.
+// It returns an empty hash at end of file.
+func hibpLineAfter(f *os.File, offset int64) (string, int64, error) {
+	buf := make([]byte, 256)
+	var start int64
+	if offset >= 0 {
+		// Skip the rest of the line offset is in
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", 0, err
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			return "", 0, nil
+		}
+		start = offset + int64(i) + 1
+	}
+
+	n, err := f.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", 0, err
+	}
+	line := buf[:n]
+	end := bytes.IndexByte(line, '\n')
+	if end >= 0 {
+		line = line[:end]
+	}
+	if len(line) == 0 {
+		return "", 0, nil
+	}
+	hash, _, _ := bytes.Cut(bytes.TrimSpace(line), []byte(":"))
+	if len(hash) != sha1.Size*2 {
+		return "", 0, fmt.Errorf("malformed line at offset %d of breached password list", start)
+	}
+	return strings.ToUpper(string(hash)), start + int64(len(line)) + 1, nil
+}
@@ -0,0 +1,337 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithm identifiers, as they appear in the stored hashes
+const (
+	Argon2id     = "argon2id"
+	Bcrypt       = "bcrypt"
+	Scrypt       = "scrypt"
+	PBKDF2SHA256 = "pbkdf2-sha256"
+	PBKDF2SHA512 = "pbkdf2-sha512"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+// ErrPepperUnsupported is returned when asked to record a pepper in a hash
+// format that has no room for it
+var ErrPepperUnsupported = errors.New("hash format can't record a pepper")
+
+// Hasher is one password hashing algorithm
+type Hasher interface {
+	// ID is the algorithm identifier its hashes start with
+	ID() string
+	// Hash hashes password. keyID names the pepper already applied to
+	// password ("" for none) and is recorded in the hash.
+	Hash(password []byte, keyID string) (string, error)
+	// Verify checks password against one of this hasher's hashes
+	Verify(password []byte, encoded string) (bool, error)
+	// Current reports whether encoded was made with the parameters Hash uses
+	Current(encoded string) bool
+}
+
+// Argon2Params are the cost parameters of argon2id
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2Params is the second recommended option of RFC 9106, for
+// when 2 GiB per hash is too much
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 4}
+
+type argon2Hasher struct {
+	params Argon2Params
+}
+
+// NewArgon2Hasher creates an argon2id Hasher producing
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+func NewArgon2Hasher(params Argon2Params) Hasher {
+	return &argon2Hasher{params: params}
+}
+
+func (ah *argon2Hasher) ID() string { return Argon2id }
+
+func (ah *argon2Hasher) Hash(password []byte, keyID string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	p := ah.params
+	h := &phcHash{
+		id:      Argon2id,
+		version: argon2.Version,
+		params: []phcParam{
+			{"m", strconv.FormatUint(uint64(p.Memory), 10)},
+			{"t", strconv.FormatUint(uint64(p.Iterations), 10)},
+			{"p", strconv.FormatUint(uint64(p.Parallelism), 10)},
+		},
+		salt: salt,
+		hash: argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, keyLength),
+	}
+	return h.withKeyID(keyID).String(), nil
+}
+
+func (ah *argon2Hasher) Verify(password []byte, encoded string) (bool, error) {
+	h, params, err := parseArgon2(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey(password, h.salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(h.hash)))
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+func (ah *argon2Hasher) Current(encoded string) bool {
+	h, params, err := parseArgon2(encoded)
+	return err == nil && params == ah.params && len(h.hash) == keyLength
+}
+
+func parseArgon2(encoded string) (*phcHash, Argon2Params, error) {
+	h, err := parsePHC(encoded)
+	if err != nil {
+		return nil, Argon2Params{}, err
+	}
+	if h.id != Argon2id || h.version != argon2.Version {
+		return nil, Argon2Params{}, fmt.Errorf("%w: not an argon2id v19 hash", ErrMalformedHash)
+	}
+	m, err := h.intParam("m")
+	if err != nil {
+		return nil, Argon2Params{}, err
+	}
+	t, err := h.intParam("t")
+	if err != nil {
+		return nil, Argon2Params{}, err
+	}
+	p, err := h.intParam("p")
+	if err != nil || p > 255 {
+		return nil, Argon2Params{}, fmt.Errorf("%w: bad p parameter", ErrMalformedHash)
+	}
+	return h, Argon2Params{Memory: uint32(m), Iterations: uint32(t), Parallelism: uint8(p)}, nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher creates a bcrypt Hasher. Its hashes keep bcrypt's own
+// $2a$/$2b$ format, which can't record a pepper.
+func NewBcryptHasher(cost int) (Hasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return &bcryptHasher{cost: cost}, nil
+}
+
+func (bh *bcryptHasher) ID() string { return Bcrypt }
+
+func (bh *bcryptHasher) Hash(password []byte, keyID string) (string, error) {
+	if keyID != "" {
+		return "", ErrPepperUnsupported
+	}
+	hashed, err := bcrypt.GenerateFromPassword(password, bh.cost)
+	return string(hashed), err
+}
+
+func (bh *bcryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (bh *bcryptHasher) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == bh.cost
+}
+
+// isBcrypt reports whether encoded is in bcrypt's own format
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// ScryptParams are the cost parameters of scrypt; N is 2^LogN
+type ScryptParams struct {
+	LogN        int
+	BlockSize   int
+	Parallelism int
+}
+
+// DefaultScryptParams are the parameters recommended for interactive logins
+var DefaultScryptParams = ScryptParams{LogN: 15, BlockSize: 8, Parallelism: 1}
+
+type scryptHasher struct {
+	params ScryptParams
+}
+
+// NewScryptHasher creates a scrypt Hasher producing
+// $scrypt$ln=<log2 N>,r=<block size>,p=<parallelism>$<salt>$<hash>
+func NewScryptHasher(params ScryptParams) Hasher {
+	return &scryptHasher{params: params}
+}
+
+func (sh *scryptHasher) ID() string { return Scrypt }
+
+func (sh *scryptHasher) Hash(password []byte, keyID string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	p := sh.params
+	key, err := scrypt.Key(password, salt, 1<<p.LogN, p.BlockSize, p.Parallelism, keyLength)
+	if err != nil {
+		return "", err
+	}
+	h := &phcHash{
+		id: Scrypt,
+		params: []phcParam{
+			{"ln", strconv.Itoa(p.LogN)},
+			{"r", strconv.Itoa(p.BlockSize)},
+			{"p", strconv.Itoa(p.Parallelism)},
+		},
+		salt: salt,
+		hash: key,
+	}
+	return h.withKeyID(keyID).String(), nil
+}
+
+func (sh *scryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	h, params, err := parseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key(password, h.salt, 1<<params.LogN, params.BlockSize, params.Parallelism, len(h.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+func (sh *scryptHasher) Current(encoded string) bool {
+	h, params, err := parseScrypt(encoded)
+	return err == nil && params == sh.params && len(h.hash) == keyLength
+}
+
+func parseScrypt(encoded string) (*phcHash, ScryptParams, error) {
+	h, err := parsePHC(encoded)
+	if err != nil {
+		return nil, ScryptParams{}, err
+	}
+	if h.id != Scrypt {
+		return nil, ScryptParams{}, fmt.Errorf("%w: not a scrypt hash", ErrMalformedHash)
+	}
+	var params ScryptParams
+	if params.LogN, err = h.intParam("ln"); err != nil {
+		return nil, ScryptParams{}, err
+	}
+	if params.BlockSize, err = h.intParam("r"); err != nil {
+		return nil, ScryptParams{}, err
+	}
+	if params.Parallelism, err = h.intParam("p"); err != nil {
+		return nil, ScryptParams{}, err
+	}
+	if params.LogN > 30 {
+		return nil, ScryptParams{}, fmt.Errorf("%w: bad ln parameter", ErrMalformedHash)
+	}
+	return h, params, nil
+}
+
+// DefaultPBKDF2Iterations follows OWASP's recommendation for PBKDF2-SHA256
+const DefaultPBKDF2Iterations = 600000
+
+type pbkdf2Hasher struct {
+	id         string
+	newHash    func() hash.Hash
+	iterations int
+}
+
+// NewPBKDF2Hasher creates a PBKDF2 Hasher for id (PBKDF2SHA256 or
+// PBKDF2SHA512) producing $<id>$i=<iterations>$<salt>$<hash>. It exists
+// mainly to verify accounts imported from other systems until they are
+// rehashed, and also reads passlib's $<id>$<iterations>$<salt>$<hash>.
+func NewPBKDF2Hasher(id string, iterations int) (Hasher, error) {
+	switch id {
+	case PBKDF2SHA256:
+		return &pbkdf2Hasher{id: id, newHash: sha256.New, iterations: iterations}, nil
+	case PBKDF2SHA512:
+		return &pbkdf2Hasher{id: id, newHash: sha512.New, iterations: iterations}, nil
+	default:
+		return nil, fmt.Errorf("unknown PBKDF2 variant %q", id)
+	}
+}
+
+func (ph *pbkdf2Hasher) ID() string { return ph.id }
+
+func (ph *pbkdf2Hasher) Hash(password []byte, keyID string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	h := &phcHash{
+		id:     ph.id,
+		params: []phcParam{{"i", strconv.Itoa(ph.iterations)}},
+		salt:   salt,
+		hash:   pbkdf2.Key(password, salt, ph.iterations, keyLength, ph.newHash),
+	}
+	return h.withKeyID(keyID).String(), nil
+}
+
+func (ph *pbkdf2Hasher) Verify(password []byte, encoded string) (bool, error) {
+	h, iterations, err := ph.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2.Key(password, h.salt, iterations, len(h.hash), ph.newHash)
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+func (ph *pbkdf2Hasher) Current(encoded string) bool {
+	h, iterations, err := ph.parse(encoded)
+	return err == nil && iterations == ph.iterations && len(h.hash) == keyLength
+}
+
+func (ph *pbkdf2Hasher) parse(encoded string) (*phcHash, int, error) {
+	h, err := parsePHC(encoded)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.id != ph.id {
+		return nil, 0, fmt.Errorf("%w: not a %s hash", ErrMalformedHash, ph.id)
+	}
+	iterations, err := h.intParam("i")
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, iterations, nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
@@ -0,0 +1,138 @@
+package password
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrMalformedHash is returned for stored hashes that can't be parsed
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// phcParam is one name=value parameter of a PHC string
+type phcParam struct {
+	name  string
+	value string
+}
+
+// phcHash is a parsed PHC string:
+//
+//	$<id>[$v=<version>][$<param>=<value>(,<param>=<value>)*]$<salt>$<hash>
+//
+// with the salt and hash in unpadded base64.
+type phcHash struct {
+	id      string
+	version int // 0 when absent
+	params  []phcParam
+	salt    []byte
+	hash    []byte
+}
+
+func parsePHC(encoded string) (*phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 4 || fields[0] != "" || fields[1] == "" {
+		return nil, ErrMalformedHash
+	}
+	h := &phcHash{id: fields[1]}
+	fields = fields[2:]
+
+	// passlib writes the PBKDF2 iteration count bare: $pbkdf2-sha256$29000$...
+	if strings.HasPrefix(h.id, "pbkdf2-") && isDigits(fields[0]) {
+		fields[0] = "i=" + fields[0]
+	}
+
+	if strings.HasPrefix(fields[0], "v=") {
+		version, err := strconv.Atoi(strings.TrimPrefix(fields[0], "v="))
+		if err != nil {
+			return nil, ErrMalformedHash
+		}
+		h.version = version
+		fields = fields[1:]
+	}
+	if len(fields) == 3 {
+		for _, pair := range strings.Split(fields[0], ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" {
+				return nil, ErrMalformedHash
+			}
+			h.params = append(h.params, phcParam{name: name, value: value})
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return nil, ErrMalformedHash
+	}
+
+	var err error
+	if h.salt, err = decodeBase64(fields[0]); err != nil {
+		return nil, ErrMalformedHash
+	}
+	if h.hash, err = decodeBase64(fields[1]); err != nil || len(h.hash) == 0 {
+		return nil, ErrMalformedHash
+	}
+	return h, nil
+}
+
+func (h *phcHash) String() string {
+	var b strings.Builder
+	b.WriteString("$" + h.id)
+	if h.version != 0 {
+		fmt.Fprintf(&b, "$v=%d", h.version)
+	}
+	for i, p := range h.params {
+		if i == 0 {
+			b.WriteString("$")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(p.name + "=" + p.value)
+	}
+	b.WriteString("$" + base64.RawStdEncoding.EncodeToString(h.salt))
+	b.WriteString("$" + base64.RawStdEncoding.EncodeToString(h.hash))
+	return b.String()
+}
+
+// param returns the value of a parameter, or "" when absent
+func (h *phcHash) param(name string) string {
+	for _, p := range h.params {
+		if p.name == name {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// intParam returns a required positive integer parameter
+func (h *phcHash) intParam(name string) (int, error) {
+	value, err := strconv.Atoi(h.param(name))
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%w: bad %s parameter", ErrMalformedHash, name)
+	}
+	return value, nil
+}
+
+// withKeyID records the pepper a hash was made with
+func (h *phcHash) withKeyID(keyID string) *phcHash {
+	if keyID != "" {
+		h.params = append(h.params, phcParam{name: "keyid", value: keyID})
+	}
+	return h
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// decodeBase64 accepts unpadded standard base64 as well as the "adapted"
+// variant (. instead of +) passlib uses, so imported hashes verify
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.ReplaceAll(s, ".", "+"), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
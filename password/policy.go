@@ -0,0 +1,104 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nbutton23/zxcvbn-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Policy is what a new password must satisfy
+type Policy struct {
+	MinLength int // in characters
+	// MaxBytes keeps passwords within what the hash can use; bcrypt ignores
+	// (and newer versions reject) anything past 72 bytes
+	MaxBytes int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols
+	// must appear
+	MinClasses int
+	// MinScore is the lowest acceptable zxcvbn score, from 0 (guessable in
+	// seconds) to 4 (very unguessable); 0 disables the check
+	MinScore int
+	// Breached, if set, rejects passwords that appear in known breaches
+	Breached BreachedList
+}
+
+// PolicyError lists every way a password falls short of the policy
+type PolicyError struct {
+	Problems []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Problems, "; ")
+}
+
+// Check returns a *PolicyError if password breaks the policy. userInputs
+// (username, email...) count against its strength.
+func (p Policy) Check(password string, userInputs ...string) error {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", p.MaxBytes))
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+	if p.MinScore > 0 && !p.tooLongToScore(password) {
+		if zxcvbn.PasswordStrength(password, userInputs).Score < p.MinScore {
+			problems = append(problems, "is too easy to guess")
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			// Fail open: an unreadable list shouldn't block every signup
+			logrus.WithError(err).Warn("Breached password check failed")
+		}
+		if breached {
+			problems = append(problems, "has appeared in a data breach")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &PolicyError{Problems: problems}
+	}
+	return nil
+}
+
+// tooLongToScore skips zxcvbn for passwords already rejected as too long,
+// since its matching gets slow on long inputs
+func (p Policy) tooLongToScore(password string) bool {
+	return p.MaxBytes > 0 && len(password) > p.MaxBytes
+}
+
+// characterClasses counts which of lowercase, uppercase, digits and
+// everything else appear in password
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
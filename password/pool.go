@@ -0,0 +1,116 @@
+package password
+
+import (
+	"errors"
+	"expvar"
+	"time"
+)
+
+// ErrBusy matches the errors returned when the pool can't take more work:
+// its queue is full or the work waited longer than the queue timeout
+var ErrBusy = errors.New("server is busy, try again later")
+
+// BusyError is the error returned by Pool.Do when it is busy. It matches
+// ErrBusy and suggests how long clients should wait before retrying.
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return ErrBusy.Error()
+}
+
+// Is makes errors.Is(err, ErrBusy) match
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+// poolMetrics exposes queue depth and hash latency under /debug/vars
+var poolMetrics = expvar.NewMap("password_hashing")
+
+// latencyBuckets are the upper bounds of the hash latency histogram
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Pool runs CPU-heavy password hashing on a bounded number of workers, so a
+// flood of logins can't take every CPU away from other requests. Work beyond
+// the workers waits in a bounded queue for at most the queue timeout.
+type Pool struct {
+	workers      chan struct{}
+	admitted     chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewPool creates a Pool running at most workers hashes at once, with up
+// to queueSize more waiting for at most queueTimeout each
+func NewPool(workers, queueSize int, queueTimeout time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		workers:      make(chan struct{}, workers),
+		admitted:     make(chan struct{}, workers+queueSize),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Do runs fn on a worker, or returns a *BusyError without running it
+func (p *Pool) Do(fn func()) error {
+	// Admission: reject straight away when the queue is full
+	select {
+	case p.admitted <- struct{}{}:
+	default:
+		poolMetrics.Add("rejected_queue_full", 1)
+		return p.busy()
+	}
+	defer func() { <-p.admitted }()
+
+	poolMetrics.Add("queue_depth", 1)
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.workers <- struct{}{}:
+		poolMetrics.Add("queue_depth", -1)
+	case <-timer.C:
+		poolMetrics.Add("queue_depth", -1)
+		poolMetrics.Add("rejected_timeout", 1)
+		return p.busy()
+	}
+	defer func() { <-p.workers }()
+
+	poolMetrics.Add("in_flight", 1)
+	start := time.Now()
+	fn()
+	observeLatency(time.Since(start))
+	poolMetrics.Add("in_flight", -1)
+	return nil
+}
+
+// busy suggests retrying once a queue timeout has passed
+func (p *Pool) busy() error {
+	return &BusyError{RetryAfter: max(p.queueTimeout, time.Second)}
+}
+
+func observeLatency(latency time.Duration) {
+	poolMetrics.Add("completed", 1)
+	poolMetrics.Add("latency_total_ms", latency.Milliseconds())
+
+	bucket := "latency_le_inf"
+	for _, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = "latency_le_" + bound.String()
+			break
+		}
+	}
+	poolMetrics.Add(bucket, 1)
+}
@@ -0,0 +1,172 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+)
+
+// Options configures a Registry
+type Options struct {
+	// Algorithm new hashes are made with: Argon2id (default), Bcrypt or Scrypt.
+	// PBKDF2 is only accepted for verifying imported hashes.
+	Algorithm  string
+	BcryptCost int // 0 means bcrypt.DefaultCost
+	Argon2     Argon2Params
+	Scrypt     ScryptParams
+
+	// Pepper, when set, is a server-side secret mixed into every new hash
+	// (HMAC-SHA256) and recorded in it as PepperID, so it can't be cracked
+	// from a database dump alone
+	Pepper   string
+	PepperID string
+	// RetiredPeppers are earlier peppers by ID. Hashes made with one still
+	// verify and are flagged for a rehash with the current pepper, so a
+	// pepper can be rotated or removed without locking anyone out.
+	RetiredPeppers map[string]string
+}
+
+// validPepperID keeps pepper IDs safe inside PHC parameters
+var validPepperID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Registry hashes passwords with the configured algorithm and verifies hashes
+// made by any registered one, so stored hashes can be upgraded over time
+type Registry struct {
+	current  Hasher
+	hashers  map[string]Hasher
+	pepperID string
+	// peppers holds the current pepper and the retired ones by ID
+	peppers map[string][]byte
+}
+
+// NewRegistry creates a Registry with every built-in Hasher registered
+func NewRegistry(opts Options) (*Registry, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = Argon2id
+	}
+	if opts.BcryptCost == 0 {
+		opts.BcryptCost = 10
+	}
+	if opts.Argon2 == (Argon2Params{}) {
+		opts.Argon2 = DefaultArgon2Params
+	}
+	if opts.Scrypt == (ScryptParams{}) {
+		opts.Scrypt = DefaultScryptParams
+	}
+
+	bcryptHasher, err := NewBcryptHasher(opts.BcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	pbkdf2SHA256, _ := NewPBKDF2Hasher(PBKDF2SHA256, DefaultPBKDF2Iterations)
+	pbkdf2SHA512, _ := NewPBKDF2Hasher(PBKDF2SHA512, DefaultPBKDF2Iterations)
+
+	r := &Registry{hashers: make(map[string]Hasher), peppers: make(map[string][]byte)}
+	for _, h := range []Hasher{
+		NewArgon2Hasher(opts.Argon2),
+		bcryptHasher,
+		NewScryptHasher(opts.Scrypt),
+		pbkdf2SHA256,
+		pbkdf2SHA512,
+	} {
+		r.Register(h)
+	}
+
+	switch opts.Algorithm {
+	case Argon2id, Bcrypt, Scrypt:
+		r.current = r.hashers[opts.Algorithm]
+	default:
+		return nil, fmt.Errorf("unsupported password algorithm %q", opts.Algorithm)
+	}
+
+	if opts.Pepper != "" {
+		if opts.Algorithm == Bcrypt {
+			return nil, fmt.Errorf("a pepper needs a PHC algorithm, not %s", Bcrypt)
+		}
+		if !validPepperID.MatchString(opts.PepperID) {
+			return nil, fmt.Errorf("invalid pepper ID %q", opts.PepperID)
+		}
+		r.pepperID = opts.PepperID
+		r.peppers[opts.PepperID] = []byte(opts.Pepper)
+	}
+	for id, pepper := range opts.RetiredPeppers {
+		if !validPepperID.MatchString(id) {
+			return nil, fmt.Errorf("invalid pepper ID %q", id)
+		}
+		if _, exists := r.peppers[id]; exists {
+			return nil, fmt.Errorf("retired pepper %q is the current one", id)
+		}
+		if pepper == "" {
+			return nil, fmt.Errorf("retired pepper %q is empty", id)
+		}
+		r.peppers[id] = []byte(pepper)
+	}
+	return r, nil
+}
+
+// MustNewRegistry is like NewRegistry but panics on invalid options
+func MustNewRegistry(opts Options) *Registry {
+	r, err := NewRegistry(opts)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Register adds a Hasher, replacing any other with the same ID
+func (r *Registry) Register(h Hasher) {
+	r.hashers[h.ID()] = h
+}
+
+// Hash hashes password with the current algorithm and pepper
+func (r *Registry) Hash(password string) (string, error) {
+	return r.current.Hash(r.applyPepper(password, r.pepperID), r.pepperID)
+}
+
+// Verify checks password against encoded. needsRehash is set when the
+// password matched but encoded wasn't made the way Hash would make it now.
+func (r *Registry) Verify(password, encoded string) (ok, needsRehash bool, err error) {
+	hasher, keyID, err := r.identify(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	if _, known := r.peppers[keyID]; keyID != "" && !known {
+		return false, false, fmt.Errorf("hash uses unknown pepper %q", keyID)
+	}
+
+	ok, err = hasher.Verify(r.applyPepper(password, keyID), encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	needsRehash = hasher != r.current || keyID != r.pepperID || !hasher.Current(encoded)
+	return true, needsRehash, nil
+}
+
+// identify finds the Hasher that made encoded and the pepper it recorded
+func (r *Registry) identify(encoded string) (Hasher, string, error) {
+	if isBcrypt(encoded) {
+		return r.hashers[Bcrypt], "", nil
+	}
+	h, err := parsePHC(encoded)
+	if err != nil {
+		return nil, "", err
+	}
+	hasher, ok := r.hashers[h.id]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown password algorithm %q", h.id)
+	}
+	return hasher, h.param("keyid"), nil
+}
+
+// applyPepper mixes the pepper named keyID into password. The HMAC is base64
+// encoded so it stays printable and within bcrypt's 72-byte limit.
+func (r *Registry) applyPepper(password, keyID string) []byte {
+	if keyID == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, r.peppers[keyID])
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
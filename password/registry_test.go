@@ -0,0 +1,102 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+// cheapArgon2 keeps the tests fast; the parameters don't matter here
+var cheapArgon2 = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func mustRegistry(t *testing.T, opts Options) *Registry {
+	t.Helper()
+	opts.Argon2 = cheapArgon2
+	r, err := NewRegistry(opts)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	return r
+}
+
+func TestRegistryVerifiesRetiredPeppers(t *testing.T) {
+	old := mustRegistry(t, Options{Pepper: "first-secret", PepperID: "1"})
+	encoded, err := old.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.Contains(encoded, "keyid=1") {
+		t.Fatalf("hash %q doesn't record its pepper", encoded)
+	}
+
+	tests := []struct {
+		name      string
+		opts      Options
+		wantKeyID string
+	}{
+		{"rotated", Options{Pepper: "second-secret", PepperID: "2", RetiredPeppers: map[string]string{"1": "first-secret"}}, "keyid=2"},
+		{"removed", Options{RetiredPeppers: map[string]string{"1": "first-secret"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mustRegistry(t, tt.opts)
+
+			ok, needsRehash, err := r.Verify("correct horse", encoded)
+			if err != nil || !ok {
+				t.Fatalf("Verify with the retired pepper = %v, %v, want a match", ok, err)
+			}
+			if !needsRehash {
+				t.Error("a hash with a retired pepper isn't flagged for a rehash")
+			}
+			if ok, _, _ := r.Verify("wrong horse", encoded); ok {
+				t.Error("a wrong password matched")
+			}
+
+			rehashed, err := r.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if tt.wantKeyID != "" && !strings.Contains(rehashed, tt.wantKeyID) {
+				t.Errorf("rehash %q lacks %s", rehashed, tt.wantKeyID)
+			}
+			if tt.wantKeyID == "" && strings.Contains(rehashed, "keyid=") {
+				t.Errorf("rehash %q still uses a pepper", rehashed)
+			}
+			ok, needsRehash, err = r.Verify("correct horse", rehashed)
+			if err != nil || !ok || needsRehash {
+				t.Errorf("Verify rehash = %v, %v, %v, want a current match", ok, needsRehash, err)
+			}
+		})
+	}
+}
+
+func TestRegistryRejectsUnknownPeppers(t *testing.T) {
+	old := mustRegistry(t, Options{Pepper: "first-secret", PepperID: "1"})
+	encoded, err := old.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	r := mustRegistry(t, Options{Pepper: "second-secret", PepperID: "2"})
+	if _, _, err := r.Verify("correct horse", encoded); err == nil {
+		t.Error("a hash with an unconfigured pepper verified")
+	}
+
+	// A retired pepper under the right ID but with the wrong secret doesn't match
+	r = mustRegistry(t, Options{Pepper: "second-secret", PepperID: "2", RetiredPeppers: map[string]string{"1": "not-it"}})
+	if ok, _, err := r.Verify("correct horse", encoded); ok || err != nil {
+		t.Errorf("Verify with the wrong retired secret = %v, %v, want no match", ok, err)
+	}
+}
+
+func TestNewRegistryChecksRetiredPeppers(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"invalid ID":     {RetiredPeppers: map[string]string{"bad id": "secret"}},
+		"current ID":     {Pepper: "secret", PepperID: "1", RetiredPeppers: map[string]string{"1": "other"}},
+		"empty secret":   {RetiredPeppers: map[string]string{"1": ""}},
+		"bcrypt current": {Algorithm: Bcrypt, Pepper: "secret", PepperID: "1"},
+	} {
+		if _, err := NewRegistry(opts); err == nil {
+			t.Errorf("%s: NewRegistry accepted %+v", name, opts)
+		}
+	}
+}
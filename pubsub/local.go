@@ -0,0 +1,37 @@
+package pubsub
+
+import "sync"
+
+// localBus delivers events to subscribers in this process only. It is used
+// when there is a single instance or no Postgres to broadcast through.
+type localBus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+// NewLocalBus creates an in-process Bus
+func NewLocalBus() Bus {
+	return &localBus{}
+}
+
+// Publish delivers event to local subscribers
+func (lb *localBus) Publish(event Event) error {
+	event.Origin = instanceID
+	lb.dispatch(event)
+	return nil
+}
+
+// Subscribe registers handler for every event
+func (lb *localBus) Subscribe(handler Handler) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.handlers = append(lb.handlers, handler)
+}
+
+func (lb *localBus) dispatch(event Event) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, handler := range lb.handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pingInterval bounds how long a dead listener connection goes unnoticed
+	pingInterval = 30 * time.Second
+
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// postgresBus broadcasts events with NOTIFY and receives them by holding a
+// pgx connection from the database pool in LISTEN mode
+type postgresBus struct {
+	localBus
+	db      *sql.DB
+	channel string
+}
+
+// NewPostgresBus creates a Bus on top of the pgx connections in db, using
+// channel as the NOTIFY channel. It listens until ctx is cancelled,
+// reconnecting as needed and delivering Resync after each reconnect.
+func NewPostgresBus(ctx context.Context, db *sql.DB, channel string) Bus {
+	pb := &postgresBus{db: db, channel: channel}
+	go pb.listen(ctx, pb.listenOnce)
+	return pb
+}
+
+// Publish delivers event to local subscribers and broadcasts it with NOTIFY
+func (pb *postgresBus) Publish(event Event) error {
+	event.Origin = instanceID
+	pb.dispatch(event)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = pb.db.Exec("SELECT pg_notify($1, $2)", pb.channel, string(payload))
+	return err
+}
+
+// listen keeps a LISTEN connection open with listenOnce until ctx is
+// cancelled
+func (pb *postgresBus) listen(ctx context.Context, listenOnce func(ctx context.Context, onListening func()) error) {
+	delay := minReconnectDelay
+	reconnecting := false
+
+	for ctx.Err() == nil {
+		err := listenOnce(ctx, func() {
+			logrus.WithField("channel", pb.channel).Info("Listening for events")
+			delay = minReconnectDelay
+			if reconnecting {
+				// Anything published while we were away is lost
+				pb.dispatch(Event{Type: Resync})
+			}
+			reconnecting = true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).WithField("retry_in", delay.String()).Warn("Event listener disconnected")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// listenOnce takes a connection from the pool, LISTENs on it and dispatches
+// notifications until the connection fails
+func (pb *postgresBus) listenOnce(ctx context.Context, onListening func()) error {
+	conn, err := pb.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		pgxConn := stdlibConn.Conn()
+
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+pgx.Identifier{pb.channel}.Sanitize()); err != nil {
+			return err
+		}
+		// Don't hand a listening connection back to the pool
+		defer pgxConn.Exec(context.Background(), "UNLISTEN *")
+
+		onListening()
+
+		for {
+			waitCtx, cancel := context.WithTimeout(ctx, pingInterval)
+			notification, err := pgxConn.WaitForNotification(waitCtx)
+			cancel()
+
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				// Nothing arrived; make sure the connection is still alive
+				if err := pgxConn.Ping(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			pb.receive(notification.Payload)
+		}
+	})
+}
+
+// receive dispatches the event of a notification, unless this instance
+// published it (and so dispatched it already)
+func (pb *postgresBus) receive(payload string) {
+	var event Event
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		logrus.WithError(err).Warn("Ignoring malformed event")
+		return
+	}
+	if event.Origin == instanceID || event.Type == Resync {
+		return
+	}
+	pb.dispatch(event)
+}
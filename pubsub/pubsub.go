@@ -0,0 +1,42 @@
+package pubsub
+
+import "github.com/google/uuid"
+
+// Event types broadcast between instances
+const (
+	UserCreated     = "user.created"
+	UserUpdated     = "user.updated"
+	UserDeleted     = "user.deleted"
+	UserRoleChanged = "user.role_changed"
+	TokenRevoked    = "token.revoked"
+
+	// Resync is delivered locally (never broadcast) after the bus reconnects,
+	// since events published while it was down are lost. Subscribers should
+	// drop or reload everything they keep locally.
+	Resync = "resync"
+)
+
+// Event describes a change other instances have to react to
+type Event struct {
+	Type      string `json:"type"`
+	UserID    uint   `json:"user_id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	TokenID   string `json:"token_id,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	// Origin identifies the publishing instance
+	Origin string `json:"origin,omitempty"`
+}
+
+// Handler reacts to an event. Handlers run on the bus goroutine and must not block.
+type Handler func(Event)
+
+// Bus delivers events to subscribers on this and every other instance
+type Bus interface {
+	// Publish delivers event to local subscribers and broadcasts it
+	Publish(event Event) error
+	// Subscribe registers handler for every event, including Resync
+	Subscribe(handler Handler)
+}
+
+// instanceID tells this process's events apart from other instances'
+var instanceID = uuid.New().String()
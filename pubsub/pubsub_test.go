@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// record subscribes to bus and returns the events it delivers
+func record(bus Bus) *[]Event {
+	var events []Event
+	bus.Subscribe(func(event Event) { events = append(events, event) })
+	return &events
+}
+
+func TestLocalBusDeliversToEverySubscriber(t *testing.T) {
+	bus := NewLocalBus()
+	first, second := record(bus), record(bus)
+
+	if err := bus.Publish(Event{Type: UserUpdated, UserID: 7}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, events := range []*[]Event{first, second} {
+		if len(*events) != 1 || (*events)[0].Type != UserUpdated || (*events)[0].UserID != 7 || (*events)[0].Origin != instanceID {
+			t.Errorf("delivered %+v, want the event from this instance", *events)
+		}
+	}
+}
+
+func TestPostgresBusSkipsItsOwnEvents(t *testing.T) {
+	pb := &postgresBus{channel: "events"}
+	events := record(pb)
+	notify := func(event Event) {
+		t.Helper()
+		payload, err := json.Marshal(event)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		pb.receive(string(payload))
+	}
+
+	// Published here, so already dispatched by Publish
+	notify(Event{Type: UserDeleted, UserID: 1, Origin: instanceID})
+	// Resync is only ever local
+	notify(Event{Type: Resync, Origin: "other"})
+	pb.receive("not json")
+	if len(*events) != 0 {
+		t.Fatalf("delivered %+v, want nothing", *events)
+	}
+
+	notify(Event{Type: UserDeleted, UserID: 2, Origin: "other"})
+	if len(*events) != 1 || (*events)[0].UserID != 2 {
+		t.Errorf("delivered %+v, want the other instance's event", *events)
+	}
+}
+
+func TestPostgresBusResyncsAfterReconnecting(t *testing.T) {
+	pb := &postgresBus{channel: "events"}
+	events := record(pb)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connections := 0
+	pb.listen(ctx, func(ctx context.Context, onListening func()) error {
+		connections++
+		onListening()
+		if connections == 1 {
+			if len(*events) != 0 {
+				t.Errorf("first connection delivered %+v, want nothing", *events)
+			}
+			return errors.New("connection reset")
+		}
+		cancel()
+		return ctx.Err()
+	})
+
+	if connections != 2 {
+		t.Fatalf("listened %d times, want a reconnect", connections)
+	}
+	if len(*events) != 1 || (*events)[0].Type != Resync {
+		t.Errorf("delivered %+v, want one Resync after the reconnect", *events)
+	}
+}
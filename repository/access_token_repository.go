@@ -0,0 +1,210 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// AccessTokenRepository defines the methods for personal access tokens
+type AccessTokenRepository interface {
+	Create(token *models.AccessToken) error
+	// Find returns one of the user's tokens, or fails with
+	// gorm.ErrRecordNotFound
+	Find(userID, id uint) (*models.AccessToken, error)
+	// FindByHash returns the token with the given hash, or fails with
+	// gorm.ErrRecordNotFound
+	FindByHash(hash string) (*models.AccessToken, error)
+	// ListByUser returns the user's tokens, newest first
+	ListByUser(userID uint) ([]models.AccessToken, error)
+	// Update saves the name and scopes of a token
+	Update(token *models.AccessToken) error
+	// Touch records a use of a token
+	Touch(id uint, now time.Time, ip string) error
+	// Delete removes one of the user's tokens, or fails with
+	// gorm.ErrRecordNotFound
+	Delete(userID, id uint) error
+}
+
+// accessTokenRepositoryImpl is the gorm implementation of AccessTokenRepository
+type accessTokenRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewAccessTokenRepository creates a new instance of AccessTokenRepository
+func NewAccessTokenRepository(db *gorm.DB) AccessTokenRepository {
+	return &accessTokenRepositoryImpl{db: db}
+}
+
+// Create saves a new token
+func (ar *accessTokenRepositoryImpl) Create(token *models.AccessToken) error {
+	return ar.db.Create(token).Error
+}
+
+// Find returns one of the user's tokens
+func (ar *accessTokenRepositoryImpl) Find(userID, id uint) (*models.AccessToken, error) {
+	var token models.AccessToken
+	if err := ar.db.First(&token, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// FindByHash returns a token by its hash
+func (ar *accessTokenRepositoryImpl) FindByHash(hash string) (*models.AccessToken, error) {
+	var token models.AccessToken
+	if err := ar.db.First(&token, "hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListByUser returns the user's tokens, newest first
+func (ar *accessTokenRepositoryImpl) ListByUser(userID uint) ([]models.AccessToken, error) {
+	var tokens []models.AccessToken
+	err := ar.db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// Update saves the name and scopes of a token
+func (ar *accessTokenRepositoryImpl) Update(token *models.AccessToken) error {
+	return ar.db.Model(token).Select("name", "scopes", "updated_at").Updates(token).Error
+}
+
+// Touch records a use of a token
+func (ar *accessTokenRepositoryImpl) Touch(id uint, now time.Time, ip string) error {
+	return ar.db.Model(&models.AccessToken{}).Where("id = ?", id).
+		UpdateColumns(map[string]interface{}{"last_used_at": now, "last_used_ip": ip}).Error
+}
+
+// Delete removes one of the user's tokens
+func (ar *accessTokenRepositoryImpl) Delete(userID, id uint) error {
+	result := ar.db.Delete(&models.AccessToken{}, "id = ? AND user_id = ?", id, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// memoryAccessTokenRepository is an in-memory implementation of AccessTokenRepository
+type memoryAccessTokenRepository struct {
+	mu     sync.RWMutex
+	tokens map[uint]models.AccessToken
+	nextID uint
+}
+
+// NewMemoryAccessTokenRepository creates a new, empty in-memory AccessTokenRepository
+func NewMemoryAccessTokenRepository() AccessTokenRepository {
+	return &memoryAccessTokenRepository{tokens: make(map[uint]models.AccessToken), nextID: 1}
+}
+
+// Create saves a new token
+func (mr *memoryAccessTokenRepository) Create(token *models.AccessToken) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, existing := range mr.tokens {
+		if existing.Hash == token.Hash {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	now := time.Now()
+	token.ID = mr.nextID
+	token.CreatedAt = now
+	token.UpdatedAt = now
+	mr.nextID++
+	mr.tokens[token.ID] = *token
+	return nil
+}
+
+// Find returns one of the user's tokens
+func (mr *memoryAccessTokenRepository) Find(userID, id uint) (*models.AccessToken, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	token, ok := mr.tokens[id]
+	if !ok || token.UserID != userID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &token, nil
+}
+
+// FindByHash returns a token by its hash
+func (mr *memoryAccessTokenRepository) FindByHash(hash string) (*models.AccessToken, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, token := range mr.tokens {
+		if token.Hash == hash {
+			return &token, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// ListByUser returns the user's tokens, newest first
+func (mr *memoryAccessTokenRepository) ListByUser(userID uint) ([]models.AccessToken, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var tokens []models.AccessToken
+	for _, token := range mr.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, nil
+}
+
+// Update saves the name and scopes of a token
+func (mr *memoryAccessTokenRepository) Update(token *models.AccessToken) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.tokens[token.ID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	stored.Name = token.Name
+	stored.Scopes = token.Scopes
+	stored.UpdatedAt = time.Now()
+	token.UpdatedAt = stored.UpdatedAt
+	mr.tokens[token.ID] = stored
+	return nil
+}
+
+// Touch records a use of a token
+func (mr *memoryAccessTokenRepository) Touch(id uint, now time.Time, ip string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if token, ok := mr.tokens[id]; ok {
+		token.LastUsedAt = &now
+		token.LastUsedIP = ip
+		mr.tokens[id] = token
+	}
+	return nil
+}
+
+// Delete removes one of the user's tokens
+func (mr *memoryAccessTokenRepository) Delete(userID, id uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	token, ok := mr.tokens[id]
+	if !ok || token.UserID != userID {
+		return gorm.ErrRecordNotFound
+	}
+	delete(mr.tokens, id)
+	return nil
+}
@@ -0,0 +1,197 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// IdentityRepository defines the methods for identities linked to accounts
+type IdentityRepository interface {
+	// Create links a new identity; it fails with gorm.ErrDuplicatedKey if
+	// the provider's user is linked already, or the account is linked to
+	// another user of the provider
+	Create(identity *models.Identity) error
+	// FindBySubject returns the identity of a provider's user, or fails
+	// with gorm.ErrRecordNotFound
+	FindBySubject(provider, subject string) (*models.Identity, error)
+	// ListByUser returns the user's identities, oldest first
+	ListByUser(userID uint) ([]models.Identity, error)
+	// UpdateEmail records the email the provider gave at a login
+	UpdateEmail(id uint, email string) error
+	// Delete removes one of the user's identities, or fails with
+	// gorm.ErrRecordNotFound
+	Delete(userID, id uint) error
+	// Reassign moves every identity of one user to another, or none: it
+	// fails with gorm.ErrDuplicatedKey if both have an identity of the same
+	// provider
+	Reassign(fromUserID, toUserID uint) error
+}
+
+// identityRepositoryImpl is the gorm implementation of IdentityRepository
+type identityRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewIdentityRepository creates a new instance of IdentityRepository
+func NewIdentityRepository(db *gorm.DB) IdentityRepository {
+	return &identityRepositoryImpl{db: db}
+}
+
+// Create links a new identity
+func (ir *identityRepositoryImpl) Create(identity *models.Identity) error {
+	return ir.db.Create(identity).Error
+}
+
+// FindBySubject returns the identity of a provider's user
+func (ir *identityRepositoryImpl) FindBySubject(provider, subject string) (*models.Identity, error) {
+	var identity models.Identity
+	if err := ir.db.First(&identity, "provider = ? AND subject = ?", provider, subject).Error; err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// ListByUser returns the user's identities, oldest first
+func (ir *identityRepositoryImpl) ListByUser(userID uint) ([]models.Identity, error) {
+	var identities []models.Identity
+	err := ir.db.Where("user_id = ?", userID).Order("linked_at, id").Find(&identities).Error
+	return identities, err
+}
+
+// UpdateEmail records the email the provider gave at a login
+func (ir *identityRepositoryImpl) UpdateEmail(id uint, email string) error {
+	return ir.db.Model(&models.Identity{}).Where("id = ?", id).UpdateColumn("email", email).Error
+}
+
+// Delete removes one of the user's identities
+func (ir *identityRepositoryImpl) Delete(userID, id uint) error {
+	result := ir.db.Delete(&models.Identity{}, "id = ? AND user_id = ?", id, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Reassign moves every identity of one user to another
+func (ir *identityRepositoryImpl) Reassign(fromUserID, toUserID uint) error {
+	return ir.db.Model(&models.Identity{}).Where("user_id = ?", fromUserID).UpdateColumn("user_id", toUserID).Error
+}
+
+// memoryIdentityRepository is an in-memory implementation of IdentityRepository
+type memoryIdentityRepository struct {
+	mu         sync.RWMutex
+	identities map[uint]models.Identity
+	nextID     uint
+}
+
+// NewMemoryIdentityRepository creates a new, empty in-memory IdentityRepository
+func NewMemoryIdentityRepository() IdentityRepository {
+	return &memoryIdentityRepository{identities: make(map[uint]models.Identity), nextID: 1}
+}
+
+// Create links a new identity
+func (mr *memoryIdentityRepository) Create(identity *models.Identity) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, existing := range mr.identities {
+		if existing.Provider == identity.Provider &&
+			(existing.Subject == identity.Subject || existing.UserID == identity.UserID) {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	if identity.LinkedAt.IsZero() {
+		identity.LinkedAt = time.Now()
+	}
+	identity.ID = mr.nextID
+	mr.nextID++
+	mr.identities[identity.ID] = *identity
+	return nil
+}
+
+// FindBySubject returns the identity of a provider's user
+func (mr *memoryIdentityRepository) FindBySubject(provider, subject string) (*models.Identity, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, identity := range mr.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// ListByUser returns the user's identities, oldest first
+func (mr *memoryIdentityRepository) ListByUser(userID uint) ([]models.Identity, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var identities []models.Identity
+	for _, identity := range mr.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].ID < identities[j].ID
+	})
+	return identities, nil
+}
+
+// UpdateEmail records the email the provider gave at a login
+func (mr *memoryIdentityRepository) UpdateEmail(id uint, email string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if identity, ok := mr.identities[id]; ok {
+		identity.Email = email
+		mr.identities[id] = identity
+	}
+	return nil
+}
+
+// Delete removes one of the user's identities
+func (mr *memoryIdentityRepository) Delete(userID, id uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	identity, ok := mr.identities[id]
+	if !ok || identity.UserID != userID {
+		return gorm.ErrRecordNotFound
+	}
+	delete(mr.identities, id)
+	return nil
+}
+
+// Reassign moves every identity of one user to another
+func (mr *memoryIdentityRepository) Reassign(fromUserID, toUserID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, identity := range mr.identities {
+		if identity.UserID != fromUserID {
+			continue
+		}
+		for _, other := range mr.identities {
+			if other.UserID == toUserID && other.Provider == identity.Provider {
+				return gorm.ErrDuplicatedKey
+			}
+		}
+	}
+	for id, identity := range mr.identities {
+		if identity.UserID == fromUserID {
+			identity.UserID = toUserID
+			mr.identities[id] = identity
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginAttemptRepository defines the methods for failed-login counters
+type LoginAttemptRepository interface {
+	Find(scope, identifier string) (*models.LoginAttempt, error)
+	// RecordFailure counts a failure at now, restarting the count if the
+	// previous failure is older than window, and returns the updated counter
+	RecordFailure(scope, identifier string, now time.Time, window time.Duration) (*models.LoginAttempt, error)
+	Reset(scope, identifier string) error
+}
+
+// loginAttemptRepositoryImpl is the gorm implementation of LoginAttemptRepository
+type loginAttemptRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewLoginAttemptRepository creates a new instance of LoginAttemptRepository
+func NewLoginAttemptRepository(db *gorm.DB) LoginAttemptRepository {
+	return &loginAttemptRepositoryImpl{db: db}
+}
+
+// Find returns the counter for scope and identifier
+func (lr *loginAttemptRepositoryImpl) Find(scope, identifier string) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	if err := lr.db.Where("scope = ? AND identifier = ?", scope, identifier).First(&attempt).Error; err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// RecordFailure atomically increments the counter with an upsert
+func (lr *loginAttemptRepositoryImpl) RecordFailure(scope, identifier string, now time.Time, window time.Duration) (*models.LoginAttempt, error) {
+	attempt := models.LoginAttempt{Scope: scope, Identifier: identifier, Failures: 1, LastFailureAt: now}
+	err := lr.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "scope"}, {Name: "identifier"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "failures"}, Value: gorm.Expr(
+				"CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END",
+				now.Add(-window),
+			)},
+			{Column: clause.Column{Name: "last_failure_at"}, Value: now},
+		},
+	}).Create(&attempt).Error
+	if err != nil {
+		return nil, err
+	}
+	return lr.Find(scope, identifier)
+}
+
+// Reset clears the counter for scope and identifier
+func (lr *loginAttemptRepositoryImpl) Reset(scope, identifier string) error {
+	return lr.db.Where("scope = ? AND identifier = ?", scope, identifier).Delete(&models.LoginAttempt{}).Error
+}
+
+// memoryLoginAttemptRepository is an in-memory implementation of LoginAttemptRepository
+type memoryLoginAttemptRepository struct {
+	mu       sync.Mutex
+	attempts map[string]models.LoginAttempt
+}
+
+// NewMemoryLoginAttemptRepository creates a new, empty in-memory LoginAttemptRepository
+func NewMemoryLoginAttemptRepository() LoginAttemptRepository {
+	return &memoryLoginAttemptRepository{attempts: make(map[string]models.LoginAttempt)}
+}
+
+// Find returns the counter for scope and identifier
+func (mr *memoryLoginAttemptRepository) Find(scope, identifier string) (*models.LoginAttempt, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	attempt, ok := mr.attempts[scope+"\x00"+identifier]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &attempt, nil
+}
+
+// RecordFailure increments the counter
+func (mr *memoryLoginAttemptRepository) RecordFailure(scope, identifier string, now time.Time, window time.Duration) (*models.LoginAttempt, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	attempt, ok := mr.attempts[scope+"\x00"+identifier]
+	if !ok || attempt.LastFailureAt.Before(now.Add(-window)) {
+		attempt = models.LoginAttempt{Scope: scope, Identifier: identifier}
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	mr.attempts[scope+"\x00"+identifier] = attempt
+	return &attempt, nil
+}
+
+// Reset clears the counter for scope and identifier
+func (mr *memoryLoginAttemptRepository) Reset(scope, identifier string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.attempts, scope+"\x00"+identifier)
+	return nil
+}
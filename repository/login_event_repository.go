@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// LoginEventRepository defines the methods for the append-only login history
+type LoginEventRepository interface {
+	Create(event *models.LoginEvent) error
+	// ListByUser returns the user's newest limit events, newest first
+	ListByUser(userID uint, limit int) ([]models.LoginEvent, error)
+	// LastSuccess returns when the user last logged in successfully, or
+	// nil if never
+	LastSuccess(userID uint) (*time.Time, error)
+	// HasSucceededFrom reports whether the user has logged in successfully
+	// from device, and from network
+	HasSucceededFrom(userID uint, device, network string) (knownDevice, knownNetwork bool, err error)
+	// CountFailuresSince counts the user's failed logins after since; right
+	// credentials that stopped short (mfa_pending, email_not_verified) don't
+	// count
+	CountFailuresSince(userID uint, since time.Time) (int, error)
+}
+
+// stoppedShort are the reasons of failed logins whose credentials were
+// right, which CountFailuresSince leaves out
+var stoppedShort = []string{models.LoginReasonMFAPending, models.LoginReasonEmailNotVerified}
+
+// loginEventRepositoryImpl is the gorm implementation of LoginEventRepository
+type loginEventRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewLoginEventRepository creates a new instance of LoginEventRepository
+func NewLoginEventRepository(db *gorm.DB) LoginEventRepository {
+	return &loginEventRepositoryImpl{db: db}
+}
+
+// Create appends an event
+func (lr *loginEventRepositoryImpl) Create(event *models.LoginEvent) error {
+	return lr.db.Create(event).Error
+}
+
+// ListByUser returns the user's newest events
+func (lr *loginEventRepositoryImpl) ListByUser(userID uint, limit int) ([]models.LoginEvent, error) {
+	var events []models.LoginEvent
+	err := lr.db.Where("user_id = ?", userID).
+		Order("created_at DESC, id DESC").Limit(limit).
+		Find(&events).Error
+	return events, err
+}
+
+// LastSuccess returns when the user last logged in successfully
+func (lr *loginEventRepositoryImpl) LastSuccess(userID uint) (*time.Time, error) {
+	var events []models.LoginEvent
+	err := lr.db.Where("user_id = ? AND success = ?", userID, true).
+		Order("created_at DESC, id DESC").Limit(1).
+		Find(&events).Error
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[0].CreatedAt, nil
+}
+
+// HasSucceededFrom reports whether the user has logged in from device and network
+func (lr *loginEventRepositoryImpl) HasSucceededFrom(userID uint, device, network string) (bool, bool, error) {
+	var devices, networks int64
+	err := lr.db.Model(&models.LoginEvent{}).
+		Where("user_id = ? AND success = ? AND device = ?", userID, true, device).
+		Count(&devices).Error
+	if err != nil {
+		return false, false, err
+	}
+	err = lr.db.Model(&models.LoginEvent{}).
+		Where("user_id = ? AND success = ? AND network = ?", userID, true, network).
+		Count(&networks).Error
+	if err != nil {
+		return false, false, err
+	}
+	return devices > 0, networks > 0, nil
+}
+
+// CountFailuresSince counts the user's failed logins after since
+func (lr *loginEventRepositoryImpl) CountFailuresSince(userID uint, since time.Time) (int, error) {
+	var count int64
+	err := lr.db.Model(&models.LoginEvent{}).
+		Where("user_id = ? AND success = ? AND reason NOT IN ? AND created_at > ?", userID, false, stoppedShort, since).
+		Count(&count).Error
+	return int(count), err
+}
+
+// memoryLoginEventRepository is an in-memory implementation of LoginEventRepository
+type memoryLoginEventRepository struct {
+	mu     sync.RWMutex
+	events []models.LoginEvent // oldest first
+}
+
+// NewMemoryLoginEventRepository creates a new, empty in-memory LoginEventRepository
+func NewMemoryLoginEventRepository() LoginEventRepository {
+	return &memoryLoginEventRepository{}
+}
+
+// Create appends an event
+func (mr *memoryLoginEventRepository) Create(event *models.LoginEvent) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	event.ID = uint(len(mr.events) + 1)
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	mr.events = append(mr.events, *event)
+	return nil
+}
+
+// ListByUser returns the user's newest events
+func (mr *memoryLoginEventRepository) ListByUser(userID uint, limit int) ([]models.LoginEvent, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var events []models.LoginEvent
+	for i := len(mr.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if mr.belongsTo(&mr.events[i], userID) {
+			events = append(events, mr.events[i])
+		}
+	}
+	return events, nil
+}
+
+// LastSuccess returns when the user last logged in successfully
+func (mr *memoryLoginEventRepository) LastSuccess(userID uint) (*time.Time, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for i := len(mr.events) - 1; i >= 0; i-- {
+		if event := mr.events[i]; mr.belongsTo(&event, userID) && event.Success {
+			return &event.CreatedAt, nil
+		}
+	}
+	return nil, nil
+}
+
+// HasSucceededFrom reports whether the user has logged in from device and network
+func (mr *memoryLoginEventRepository) HasSucceededFrom(userID uint, device, network string) (bool, bool, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var knownDevice, knownNetwork bool
+	for i := range mr.events {
+		event := &mr.events[i]
+		if mr.belongsTo(event, userID) && event.Success {
+			knownDevice = knownDevice || event.Device == device
+			knownNetwork = knownNetwork || event.Network == network
+		}
+	}
+	return knownDevice, knownNetwork, nil
+}
+
+// CountFailuresSince counts the user's failed logins after since
+func (mr *memoryLoginEventRepository) CountFailuresSince(userID uint, since time.Time) (int, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	count := 0
+	for i := range mr.events {
+		event := &mr.events[i]
+		if mr.belongsTo(event, userID) && !event.Success && !slices.Contains(stoppedShort, event.Reason) && event.CreatedAt.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (mr *memoryLoginEventRepository) belongsTo(event *models.LoginEvent, userID uint) bool {
+	return event.UserID != nil && *event.UserID == userID
+}
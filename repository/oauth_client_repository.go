@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// OAuthClientRepository defines the methods for registered OAuth clients
+type OAuthClientRepository interface {
+	Create(client *models.OAuthClient) error
+	// Find returns a client by ID, or fails with gorm.ErrRecordNotFound
+	Find(id uint) (*models.OAuthClient, error)
+	// FindByClientID returns a client by client ID, or fails with
+	// gorm.ErrRecordNotFound
+	FindByClientID(clientID string) (*models.OAuthClient, error)
+	// List returns every client, by name
+	List() ([]models.OAuthClient, error)
+	Update(client *models.OAuthClient) error
+	Delete(id uint) error
+}
+
+// oauthClientRepositoryImpl is the gorm implementation of OAuthClientRepository
+type oauthClientRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewOAuthClientRepository creates a new instance of OAuthClientRepository
+func NewOAuthClientRepository(db *gorm.DB) OAuthClientRepository {
+	return &oauthClientRepositoryImpl{db: db}
+}
+
+// Create saves a new client
+func (or *oauthClientRepositoryImpl) Create(client *models.OAuthClient) error {
+	return or.db.Create(client).Error
+}
+
+// Find returns a client by ID
+func (or *oauthClientRepositoryImpl) Find(id uint) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	if err := or.db.First(&client, id).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// FindByClientID returns a client by client ID
+func (or *oauthClientRepositoryImpl) FindByClientID(clientID string) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	if err := or.db.First(&client, "client_id = ?", clientID).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// List returns every client, by name
+func (or *oauthClientRepositoryImpl) List() ([]models.OAuthClient, error) {
+	var clients []models.OAuthClient
+	err := or.db.Order("name, id").Find(&clients).Error
+	return clients, err
+}
+
+// Update saves a client
+func (or *oauthClientRepositoryImpl) Update(client *models.OAuthClient) error {
+	return or.db.Model(client).
+		Select("name", "secret_hash", "secret_hint", "redirect_uris", "scopes", "trusted", "updated_at").
+		Updates(client).Error
+}
+
+// Delete removes a client; its consents, codes and refresh tokens go with it
+func (or *oauthClientRepositoryImpl) Delete(id uint) error {
+	return or.db.Delete(&models.OAuthClient{}, id).Error
+}
+
+// memoryOAuthClientRepository is an in-memory implementation of OAuthClientRepository
+type memoryOAuthClientRepository struct {
+	mu      sync.RWMutex
+	clients map[uint]models.OAuthClient
+	nextID  uint
+}
+
+// NewMemoryOAuthClientRepository creates a new, empty in-memory OAuthClientRepository
+func NewMemoryOAuthClientRepository() OAuthClientRepository {
+	return &memoryOAuthClientRepository{clients: make(map[uint]models.OAuthClient), nextID: 1}
+}
+
+// Create saves a new client
+func (mr *memoryOAuthClientRepository) Create(client *models.OAuthClient) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, existing := range mr.clients {
+		if existing.ClientID == client.ClientID {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	now := time.Now()
+	client.ID = mr.nextID
+	client.CreatedAt = now
+	client.UpdatedAt = now
+	mr.nextID++
+	mr.clients[client.ID] = *client
+	return nil
+}
+
+// Find returns a client by ID
+func (mr *memoryOAuthClientRepository) Find(id uint) (*models.OAuthClient, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	client, ok := mr.clients[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &client, nil
+}
+
+// FindByClientID returns a client by client ID
+func (mr *memoryOAuthClientRepository) FindByClientID(clientID string) (*models.OAuthClient, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, client := range mr.clients {
+		if client.ClientID == clientID {
+			return &client, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// List returns every client, by name
+func (mr *memoryOAuthClientRepository) List() ([]models.OAuthClient, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	clients := make([]models.OAuthClient, 0, len(mr.clients))
+	for _, client := range mr.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Name != clients[j].Name {
+			return clients[i].Name < clients[j].Name
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, nil
+}
+
+// Update saves a client
+func (mr *memoryOAuthClientRepository) Update(client *models.OAuthClient) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.clients[client.ID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	client.UpdatedAt = time.Now()
+	mr.clients[client.ID] = *client
+	return nil
+}
+
+// Delete removes a client
+func (mr *memoryOAuthClientRepository) Delete(id uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.clients, id)
+	return nil
+}
@@ -0,0 +1,453 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OAuthGrantRepository defines the methods for what users granted OAuth
+// clients: consents, authorization codes and refresh tokens
+type OAuthGrantRepository interface {
+	// SaveConsent creates the user's consent for the client, or replaces
+	// its scopes
+	SaveConsent(consent *models.OAuthConsent) error
+	// FindConsent returns the user's consent for a client, or fails with
+	// gorm.ErrRecordNotFound
+	FindConsent(userID, clientID uint) (*models.OAuthConsent, error)
+	// ListConsents returns the user's consents with their clients, newest
+	// first
+	ListConsents(userID uint) ([]models.OAuthConsent, error)
+	// DeleteConsent removes the user's consent for a client, or fails with
+	// gorm.ErrRecordNotFound
+	DeleteConsent(userID, clientID uint) error
+
+	CreateCode(code *models.OAuthAuthorizationCode) error
+	// UseCode marks a code as used and returns it, reporting whether this
+	// call used it; fails with gorm.ErrRecordNotFound for unknown codes
+	UseCode(id string, now time.Time) (*models.OAuthAuthorizationCode, bool, error)
+	// SetCodeFamily records the refresh token family issued for a code
+	SetCodeFamily(id, familyID string) error
+
+	CreateRefreshToken(token *models.OAuthRefreshToken) error
+	// FindRefreshToken returns a refresh token, or fails with
+	// gorm.ErrRecordNotFound
+	FindRefreshToken(id string) (*models.OAuthRefreshToken, error)
+	// UseRefreshToken marks a refresh token as used and returns it,
+	// reporting whether this call used it; fails with
+	// gorm.ErrRecordNotFound for unknown tokens
+	UseRefreshToken(id string, now time.Time) (*models.OAuthRefreshToken, bool, error)
+	// DeleteFamily removes every refresh token of a family
+	DeleteFamily(familyID string) error
+
+	// DeleteGrants removes the codes and refresh tokens the user granted
+	// a client
+	DeleteGrants(userID, clientID uint) error
+	// DeleteByClient removes everything granted to a client
+	DeleteByClient(clientID uint) error
+	// DeleteExpired removes expired codes and refresh tokens
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+// oauthGrantRepositoryImpl is the gorm implementation of OAuthGrantRepository
+type oauthGrantRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewOAuthGrantRepository creates a new instance of OAuthGrantRepository
+func NewOAuthGrantRepository(db *gorm.DB) OAuthGrantRepository {
+	return &oauthGrantRepositoryImpl{db: db}
+}
+
+// SaveConsent upserts the user's consent for a client
+func (or *oauthGrantRepositoryImpl) SaveConsent(consent *models.OAuthConsent) error {
+	return or.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+	}).Create(consent).Error
+}
+
+// FindConsent returns the user's consent for a client
+func (or *oauthGrantRepositoryImpl) FindConsent(userID, clientID uint) (*models.OAuthConsent, error) {
+	var consent models.OAuthConsent
+	if err := or.db.First(&consent, "user_id = ? AND client_id = ?", userID, clientID).Error; err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// ListConsents returns the user's consents, newest first
+func (or *oauthGrantRepositoryImpl) ListConsents(userID uint) ([]models.OAuthConsent, error) {
+	var consents []models.OAuthConsent
+	err := or.db.Preload("Client").Where("user_id = ?", userID).
+		Order("updated_at DESC, id DESC").Find(&consents).Error
+	return consents, err
+}
+
+// DeleteConsent removes the user's consent for a client
+func (or *oauthGrantRepositoryImpl) DeleteConsent(userID, clientID uint) error {
+	result := or.db.Delete(&models.OAuthConsent{}, "user_id = ? AND client_id = ?", userID, clientID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// CreateCode saves a new authorization code
+func (or *oauthGrantRepositoryImpl) CreateCode(code *models.OAuthAuthorizationCode) error {
+	return or.db.Create(code).Error
+}
+
+// UseCode marks a code as used. The conditional update makes sure two
+// concurrent requests can't both redeem it.
+func (or *oauthGrantRepositoryImpl) UseCode(id string, now time.Time) (*models.OAuthAuthorizationCode, bool, error) {
+	var code models.OAuthAuthorizationCode
+	if err := or.db.First(&code, "id = ?", id).Error; err != nil {
+		return nil, false, err
+	}
+	result := or.db.Model(&models.OAuthAuthorizationCode{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return &code, result.RowsAffected > 0, nil
+}
+
+// SetCodeFamily records the refresh token family issued for a code
+func (or *oauthGrantRepositoryImpl) SetCodeFamily(id, familyID string) error {
+	return or.db.Model(&models.OAuthAuthorizationCode{}).Where("id = ?", id).Update("family_id", familyID).Error
+}
+
+// CreateRefreshToken saves a new refresh token
+func (or *oauthGrantRepositoryImpl) CreateRefreshToken(token *models.OAuthRefreshToken) error {
+	return or.db.Create(token).Error
+}
+
+// FindRefreshToken returns a refresh token
+func (or *oauthGrantRepositoryImpl) FindRefreshToken(id string) (*models.OAuthRefreshToken, error) {
+	var token models.OAuthRefreshToken
+	if err := or.db.First(&token, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UseRefreshToken marks a refresh token as used, like UseCode
+func (or *oauthGrantRepositoryImpl) UseRefreshToken(id string, now time.Time) (*models.OAuthRefreshToken, bool, error) {
+	token, err := or.FindRefreshToken(id)
+	if err != nil {
+		return nil, false, err
+	}
+	result := or.db.Model(&models.OAuthRefreshToken{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	return token, result.RowsAffected > 0, nil
+}
+
+// DeleteFamily removes every refresh token of a family
+func (or *oauthGrantRepositoryImpl) DeleteFamily(familyID string) error {
+	return or.db.Delete(&models.OAuthRefreshToken{}, "family_id = ?", familyID).Error
+}
+
+// DeleteGrants removes the codes and refresh tokens the user granted a client
+func (or *oauthGrantRepositoryImpl) DeleteGrants(userID, clientID uint) error {
+	return or.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&models.OAuthAuthorizationCode{}, "user_id = ? AND client_id = ?", userID, clientID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.OAuthRefreshToken{}, "user_id = ? AND client_id = ?", userID, clientID).Error
+	})
+}
+
+// DeleteByClient removes everything granted to a client
+func (or *oauthGrantRepositoryImpl) DeleteByClient(clientID uint) error {
+	return or.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&models.OAuthAuthorizationCode{}, &models.OAuthRefreshToken{}, &models.OAuthConsent{}} {
+			if err := tx.Delete(model, "client_id = ?", clientID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteExpired removes expired codes and refresh tokens
+func (or *oauthGrantRepositoryImpl) DeleteExpired(now time.Time) (int64, error) {
+	var deleted int64
+	err := or.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&models.OAuthAuthorizationCode{}, &models.OAuthRefreshToken{}} {
+			result := tx.Where("expires_at <= ?", now).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+			deleted += result.RowsAffected
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// memoryOAuthGrantRepository is an in-memory implementation of OAuthGrantRepository
+type memoryOAuthGrantRepository struct {
+	mu            sync.Mutex
+	consents      map[[2]uint]models.OAuthConsent
+	codes         map[string]models.OAuthAuthorizationCode
+	refreshTokens map[string]models.OAuthRefreshToken
+	clients       OAuthClientRepository
+	nextID        uint
+}
+
+// NewMemoryOAuthGrantRepository creates a new, empty in-memory
+// OAuthGrantRepository; clients are looked up in clients
+func NewMemoryOAuthGrantRepository(clients OAuthClientRepository) OAuthGrantRepository {
+	return &memoryOAuthGrantRepository{
+		consents:      make(map[[2]uint]models.OAuthConsent),
+		codes:         make(map[string]models.OAuthAuthorizationCode),
+		refreshTokens: make(map[string]models.OAuthRefreshToken),
+		clients:       clients,
+		nextID:        1,
+	}
+}
+
+// SaveConsent upserts the user's consent for a client
+func (mr *memoryOAuthGrantRepository) SaveConsent(consent *models.OAuthConsent) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	key := [2]uint{consent.UserID, consent.ClientID}
+	now := time.Now()
+	if existing, ok := mr.consents[key]; ok {
+		existing.Scopes = consent.Scopes
+		existing.UpdatedAt = now
+		mr.consents[key] = existing
+		*consent = existing
+		return nil
+	}
+	consent.ID = mr.nextID
+	consent.CreatedAt = now
+	consent.UpdatedAt = now
+	mr.nextID++
+	mr.consents[key] = *consent
+	return nil
+}
+
+// FindConsent returns the user's consent for a client
+func (mr *memoryOAuthGrantRepository) FindConsent(userID, clientID uint) (*models.OAuthConsent, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	consent, ok := mr.consents[[2]uint{userID, clientID}]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &consent, nil
+}
+
+// ListConsents returns the user's consents, newest first
+func (mr *memoryOAuthGrantRepository) ListConsents(userID uint) ([]models.OAuthConsent, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var consents []models.OAuthConsent
+	for _, consent := range mr.consents {
+		if consent.UserID != userID {
+			continue
+		}
+		client, err := mr.clients.Find(consent.ClientID)
+		if err != nil {
+			continue
+		}
+		consent.Client = client
+		consents = append(consents, consent)
+	}
+	sort.Slice(consents, func(i, j int) bool {
+		return consents[i].UpdatedAt.After(consents[j].UpdatedAt)
+	})
+	return consents, nil
+}
+
+// DeleteConsent removes the user's consent for a client
+func (mr *memoryOAuthGrantRepository) DeleteConsent(userID, clientID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	key := [2]uint{userID, clientID}
+	if _, ok := mr.consents[key]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(mr.consents, key)
+	return nil
+}
+
+// CreateCode saves a new authorization code
+func (mr *memoryOAuthGrantRepository) CreateCode(code *models.OAuthAuthorizationCode) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.codes[code.ID]; exists {
+		return gorm.ErrDuplicatedKey
+	}
+	code.CreatedAt = time.Now()
+	mr.codes[code.ID] = *code
+	return nil
+}
+
+// UseCode marks a code as used
+func (mr *memoryOAuthGrantRepository) UseCode(id string, now time.Time) (*models.OAuthAuthorizationCode, bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	code, ok := mr.codes[id]
+	if !ok {
+		return nil, false, gorm.ErrRecordNotFound
+	}
+	if code.UsedAt != nil {
+		return &code, false, nil
+	}
+	result := code
+	code.UsedAt = &now
+	mr.codes[id] = code
+	return &result, true, nil
+}
+
+// SetCodeFamily records the refresh token family issued for a code
+func (mr *memoryOAuthGrantRepository) SetCodeFamily(id, familyID string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if code, ok := mr.codes[id]; ok {
+		code.FamilyID = familyID
+		mr.codes[id] = code
+	}
+	return nil
+}
+
+// CreateRefreshToken saves a new refresh token
+func (mr *memoryOAuthGrantRepository) CreateRefreshToken(token *models.OAuthRefreshToken) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.refreshTokens[token.ID]; exists {
+		return gorm.ErrDuplicatedKey
+	}
+	token.CreatedAt = time.Now()
+	mr.refreshTokens[token.ID] = *token
+	return nil
+}
+
+// FindRefreshToken returns a refresh token
+func (mr *memoryOAuthGrantRepository) FindRefreshToken(id string) (*models.OAuthRefreshToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	token, ok := mr.refreshTokens[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &token, nil
+}
+
+// UseRefreshToken marks a refresh token as used
+func (mr *memoryOAuthGrantRepository) UseRefreshToken(id string, now time.Time) (*models.OAuthRefreshToken, bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	token, ok := mr.refreshTokens[id]
+	if !ok {
+		return nil, false, gorm.ErrRecordNotFound
+	}
+	if token.UsedAt != nil {
+		return &token, false, nil
+	}
+	result := token
+	token.UsedAt = &now
+	mr.refreshTokens[id] = token
+	return &result, true, nil
+}
+
+// DeleteFamily removes every refresh token of a family
+func (mr *memoryOAuthGrantRepository) DeleteFamily(familyID string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, token := range mr.refreshTokens {
+		if token.FamilyID == familyID {
+			delete(mr.refreshTokens, id)
+		}
+	}
+	return nil
+}
+
+// DeleteGrants removes the codes and refresh tokens the user granted a client
+func (mr *memoryOAuthGrantRepository) DeleteGrants(userID, clientID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, code := range mr.codes {
+		if code.UserID == userID && code.ClientID == clientID {
+			delete(mr.codes, id)
+		}
+	}
+	for id, token := range mr.refreshTokens {
+		if token.UserID == userID && token.ClientID == clientID {
+			delete(mr.refreshTokens, id)
+		}
+	}
+	return nil
+}
+
+// DeleteByClient removes everything granted to a client
+func (mr *memoryOAuthGrantRepository) DeleteByClient(clientID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, code := range mr.codes {
+		if code.ClientID == clientID {
+			delete(mr.codes, id)
+		}
+	}
+	for id, token := range mr.refreshTokens {
+		if token.ClientID == clientID {
+			delete(mr.refreshTokens, id)
+		}
+	}
+	for key, consent := range mr.consents {
+		if consent.ClientID == clientID {
+			delete(mr.consents, key)
+		}
+	}
+	return nil
+}
+
+// DeleteExpired removes expired codes and refresh tokens
+func (mr *memoryOAuthGrantRepository) DeleteExpired(now time.Time) (int64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var deleted int64
+	for id, code := range mr.codes {
+		if !code.ExpiresAt.After(now) {
+			delete(mr.codes, id)
+			deleted++
+		}
+	}
+	for id, token := range mr.refreshTokens {
+		if !token.ExpiresAt.After(now) {
+			delete(mr.refreshTokens, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"sync"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// PasswordHistoryRepository defines the methods for past password hashes
+type PasswordHistoryRepository interface {
+	// Add records a hash and forgets all but the user's keep newest ones
+	Add(userID uint, hash string, keep int) error
+	// Recent returns the user's newest n hashes, newest first
+	Recent(userID uint, n int) ([]string, error)
+}
+
+// passwordHistoryRepositoryImpl is the gorm implementation of PasswordHistoryRepository
+type passwordHistoryRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewPasswordHistoryRepository creates a new instance of PasswordHistoryRepository
+func NewPasswordHistoryRepository(db *gorm.DB) PasswordHistoryRepository {
+	return &passwordHistoryRepositoryImpl{db: db}
+}
+
+// Add records a hash and trims the user's history to keep entries
+func (pr *passwordHistoryRepositoryImpl) Add(userID uint, hash string, keep int) error {
+	return pr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+			return err
+		}
+
+		var kept []uint
+		err := tx.Model(&models.PasswordHistory{}).
+			Where("user_id = ?", userID).
+			Order("id DESC").Limit(keep).
+			Pluck("id", &kept).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? AND id NOT IN ?", userID, kept).Delete(&models.PasswordHistory{}).Error
+	})
+}
+
+// Recent returns the user's newest n hashes, newest first
+func (pr *passwordHistoryRepositoryImpl) Recent(userID uint, n int) ([]string, error) {
+	var hashes []string
+	err := pr.db.Model(&models.PasswordHistory{}).
+		Where("user_id = ?", userID).
+		Order("id DESC").Limit(n).
+		Pluck("hash", &hashes).Error
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// memoryPasswordHistoryRepository is an in-memory implementation of PasswordHistoryRepository
+type memoryPasswordHistoryRepository struct {
+	mu     sync.RWMutex
+	hashes map[uint][]string // newest first
+}
+
+// NewMemoryPasswordHistoryRepository creates a new, empty in-memory PasswordHistoryRepository
+func NewMemoryPasswordHistoryRepository() PasswordHistoryRepository {
+	return &memoryPasswordHistoryRepository{hashes: make(map[uint][]string)}
+}
+
+// Add records a hash and trims the user's history to keep entries
+func (mr *memoryPasswordHistoryRepository) Add(userID uint, hash string, keep int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	hashes := append([]string{hash}, mr.hashes[userID]...)
+	if len(hashes) > keep {
+		hashes = hashes[:keep]
+	}
+	mr.hashes[userID] = hashes
+	return nil
+}
+
+// Recent returns the user's newest n hashes, newest first
+func (mr *memoryPasswordHistoryRepository) Recent(userID uint, n int) ([]string, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	hashes := mr.hashes[userID]
+	if len(hashes) > n {
+		hashes = hashes[:n]
+	}
+	return append([]string(nil), hashes...), nil
+}
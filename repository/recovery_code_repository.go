@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCodeRepository defines the methods for hashed MFA recovery codes
+type RecoveryCodeRepository interface {
+	// Replace swaps the user's codes for new ones
+	Replace(userID uint, hashes []string) error
+	// Use marks an unused code as used, reporting whether there was one
+	Use(userID uint, hash string, now time.Time) (bool, error)
+	// Remaining counts the user's unused codes
+	Remaining(userID uint) (int, error)
+	// DeleteAll removes every code of the user
+	DeleteAll(userID uint) error
+}
+
+// recoveryCodeRepositoryImpl is the gorm implementation of RecoveryCodeRepository
+type recoveryCodeRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewRecoveryCodeRepository creates a new instance of RecoveryCodeRepository
+func NewRecoveryCodeRepository(db *gorm.DB) RecoveryCodeRepository {
+	return &recoveryCodeRepositoryImpl{db: db}
+}
+
+// Replace swaps the user's codes for new ones in one transaction
+func (rr *recoveryCodeRepositoryImpl) Replace(userID uint, hashes []string) error {
+	return rr.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]models.RecoveryCode, len(hashes))
+		for i, hash := range hashes {
+			codes[i] = models.RecoveryCode{UserID: userID, Hash: hash}
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// Use marks an unused code as used. The conditional update makes sure two
+// concurrent requests can't both spend the same code.
+func (rr *recoveryCodeRepositoryImpl) Use(userID uint, hash string, now time.Time) (bool, error) {
+	result := rr.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// Remaining counts the user's unused codes
+func (rr *recoveryCodeRepositoryImpl) Remaining(userID uint) (int, error) {
+	var count int64
+	err := rr.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).Error
+	return int(count), err
+}
+
+// DeleteAll removes every code of the user
+func (rr *recoveryCodeRepositoryImpl) DeleteAll(userID uint) error {
+	return rr.db.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+}
+
+// memoryRecoveryCodeRepository is an in-memory implementation of RecoveryCodeRepository
+type memoryRecoveryCodeRepository struct {
+	mu    sync.Mutex
+	codes map[uint]map[string]bool // user ID -> hash -> used
+}
+
+// NewMemoryRecoveryCodeRepository creates a new, empty in-memory RecoveryCodeRepository
+func NewMemoryRecoveryCodeRepository() RecoveryCodeRepository {
+	return &memoryRecoveryCodeRepository{codes: make(map[uint]map[string]bool)}
+}
+
+// Replace swaps the user's codes for new ones
+func (mr *memoryRecoveryCodeRepository) Replace(userID uint, hashes []string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	mr.codes[userID] = codes
+	return nil
+}
+
+// Use marks an unused code as used
+func (mr *memoryRecoveryCodeRepository) Use(userID uint, hash string, now time.Time) (bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	used, ok := mr.codes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	mr.codes[userID][hash] = true
+	return true, nil
+}
+
+// Remaining counts the user's unused codes
+func (mr *memoryRecoveryCodeRepository) Remaining(userID uint) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	remaining := 0
+	for _, used := range mr.codes[userID] {
+		if !used {
+			remaining++
+		}
+	}
+	return remaining, nil
+}
+
+// DeleteAll removes every code of the user
+func (mr *memoryRecoveryCodeRepository) DeleteAll(userID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.codes, userID)
+	return nil
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// RevokedTokenRepository defines the methods for the token denylist
+type RevokedTokenRepository interface {
+	Create(token *models.RevokedToken) error
+	FindActive(now time.Time) ([]models.RevokedToken, error)
+	DeleteExpired(now time.Time) error
+}
+
+// revokedTokenRepositoryImpl is the gorm implementation of RevokedTokenRepository
+type revokedTokenRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewRevokedTokenRepository creates a new instance of RevokedTokenRepository
+func NewRevokedTokenRepository(db *gorm.DB) RevokedTokenRepository {
+	return &revokedTokenRepositoryImpl{db: db}
+}
+
+// Create records a revoked token; revoking the same token twice is not an error
+func (rr *revokedTokenRepositoryImpl) Create(token *models.RevokedToken) error {
+	err := rr.db.Create(token).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil
+	}
+	return err
+}
+
+// FindActive returns the revoked tokens that haven't expired yet
+func (rr *revokedTokenRepositoryImpl) FindActive(now time.Time) ([]models.RevokedToken, error) {
+	var tokens []models.RevokedToken
+	if err := rr.db.Where("expires_at > ?", now).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// DeleteExpired removes revoked tokens that have expired anyway
+func (rr *revokedTokenRepositoryImpl) DeleteExpired(now time.Time) error {
+	return rr.db.Where("expires_at <= ?", now).Delete(&models.RevokedToken{}).Error
+}
+
+// memoryRevokedTokenRepository is an in-memory implementation of RevokedTokenRepository
+type memoryRevokedTokenRepository struct {
+	mu     sync.RWMutex
+	tokens map[string]models.RevokedToken
+}
+
+// NewMemoryRevokedTokenRepository creates a new, empty in-memory RevokedTokenRepository
+func NewMemoryRevokedTokenRepository() RevokedTokenRepository {
+	return &memoryRevokedTokenRepository{tokens: make(map[string]models.RevokedToken)}
+}
+
+// Create records a revoked token
+func (mr *memoryRevokedTokenRepository) Create(token *models.RevokedToken) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.tokens[token.ID]; exists {
+		return nil
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	mr.tokens[token.ID] = *token
+	return nil
+}
+
+// FindActive returns the revoked tokens that haven't expired yet
+func (mr *memoryRevokedTokenRepository) FindActive(now time.Time) ([]models.RevokedToken, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var tokens []models.RevokedToken
+	for _, token := range mr.tokens {
+		if token.ExpiresAt.After(now) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// DeleteExpired removes revoked tokens that have expired anyway
+func (mr *memoryRevokedTokenRepository) DeleteExpired(now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, token := range mr.tokens {
+		if !token.ExpiresAt.After(now) {
+			delete(mr.tokens, id)
+		}
+	}
+	return nil
+}
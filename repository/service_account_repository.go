@@ -0,0 +1,304 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// ServiceAccountRepository defines the methods for service accounts and
+// their credentials. Accounts are returned with their credentials.
+type ServiceAccountRepository interface {
+	Create(account *models.ServiceAccount) error
+	// Find returns an account by ID, or fails with gorm.ErrRecordNotFound
+	Find(id uint) (*models.ServiceAccount, error)
+	// FindByClientID returns an account by client ID, or fails with
+	// gorm.ErrRecordNotFound
+	FindByClientID(clientID string) (*models.ServiceAccount, error)
+	// FindBySecretHash returns the account holding the secret with the
+	// given hash, or fails with gorm.ErrRecordNotFound
+	FindBySecretHash(hash string) (*models.ServiceAccount, error)
+	// List returns every account, by name
+	List() ([]models.ServiceAccount, error)
+	// Update saves the account's own fields, not its credentials
+	Update(account *models.ServiceAccount) error
+	Delete(id uint) error
+	AddCredential(credential *models.ServiceAccountCredential) error
+	// DeleteCredential removes one of the account's credentials, or fails
+	// with gorm.ErrRecordNotFound
+	DeleteCredential(accountID, id uint) error
+	// TouchCredential records a use of a credential
+	TouchCredential(id uint, now time.Time) error
+}
+
+// serviceAccountRepositoryImpl is the gorm implementation of ServiceAccountRepository
+type serviceAccountRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewServiceAccountRepository creates a new instance of ServiceAccountRepository
+func NewServiceAccountRepository(db *gorm.DB) ServiceAccountRepository {
+	return &serviceAccountRepositoryImpl{db: db}
+}
+
+// Create saves a new account
+func (sr *serviceAccountRepositoryImpl) Create(account *models.ServiceAccount) error {
+	return sr.db.Omit("Credentials").Create(account).Error
+}
+
+// Find returns an account by ID
+func (sr *serviceAccountRepositoryImpl) Find(id uint) (*models.ServiceAccount, error) {
+	return sr.first("id = ?", id)
+}
+
+// FindByClientID returns an account by client ID
+func (sr *serviceAccountRepositoryImpl) FindByClientID(clientID string) (*models.ServiceAccount, error) {
+	return sr.first("client_id = ?", clientID)
+}
+
+// FindBySecretHash returns the account holding a secret
+func (sr *serviceAccountRepositoryImpl) FindBySecretHash(hash string) (*models.ServiceAccount, error) {
+	return sr.first("id = (?)", sr.db.Model(&models.ServiceAccountCredential{}).
+		Select("service_account_id").Where("secret_hash = ?", hash))
+}
+
+// first returns the first account matching query, with its credentials
+func (sr *serviceAccountRepositoryImpl) first(query interface{}, args ...interface{}) (*models.ServiceAccount, error) {
+	var account models.ServiceAccount
+	err := sr.db.Preload("Credentials", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where(query, args...).First(&account).Error
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// List returns every account, by name
+func (sr *serviceAccountRepositoryImpl) List() ([]models.ServiceAccount, error) {
+	var accounts []models.ServiceAccount
+	err := sr.db.Preload("Credentials", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Order("name").Find(&accounts).Error
+	return accounts, err
+}
+
+// Update saves the account's own fields
+func (sr *serviceAccountRepositoryImpl) Update(account *models.ServiceAccount) error {
+	return sr.db.Model(account).
+		Select("name", "description", "owner_id", "role", "scopes", "disabled_at", "tokens_revoked_at", "updated_at").
+		Updates(account).Error
+}
+
+// Delete removes an account; its credentials go with it
+func (sr *serviceAccountRepositoryImpl) Delete(id uint) error {
+	return sr.db.Delete(&models.ServiceAccount{}, id).Error
+}
+
+// AddCredential saves a new credential
+func (sr *serviceAccountRepositoryImpl) AddCredential(credential *models.ServiceAccountCredential) error {
+	return sr.db.Create(credential).Error
+}
+
+// DeleteCredential removes one of the account's credentials
+func (sr *serviceAccountRepositoryImpl) DeleteCredential(accountID, id uint) error {
+	result := sr.db.Delete(&models.ServiceAccountCredential{}, "id = ? AND service_account_id = ?", id, accountID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// TouchCredential records a use of a credential
+func (sr *serviceAccountRepositoryImpl) TouchCredential(id uint, now time.Time) error {
+	return sr.db.Model(&models.ServiceAccountCredential{}).Where("id = ?", id).UpdateColumn("last_used_at", now).Error
+}
+
+// memoryServiceAccountRepository is an in-memory implementation of ServiceAccountRepository
+type memoryServiceAccountRepository struct {
+	mu               sync.RWMutex
+	accounts         map[uint]models.ServiceAccount
+	credentials      map[uint]models.ServiceAccountCredential
+	nextID           uint
+	nextCredentialID uint
+}
+
+// NewMemoryServiceAccountRepository creates a new, empty in-memory ServiceAccountRepository
+func NewMemoryServiceAccountRepository() ServiceAccountRepository {
+	return &memoryServiceAccountRepository{
+		accounts:         make(map[uint]models.ServiceAccount),
+		credentials:      make(map[uint]models.ServiceAccountCredential),
+		nextID:           1,
+		nextCredentialID: 1,
+	}
+}
+
+// Create saves a new account
+func (mr *memoryServiceAccountRepository) Create(account *models.ServiceAccount) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, existing := range mr.accounts {
+		if existing.Name == account.Name || existing.ClientID == account.ClientID {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	now := time.Now()
+	account.ID = mr.nextID
+	account.CreatedAt = now
+	account.UpdatedAt = now
+	mr.nextID++
+	stored := *account
+	stored.Credentials = nil
+	mr.accounts[account.ID] = stored
+	return nil
+}
+
+// Find returns an account by ID
+func (mr *memoryServiceAccountRepository) Find(id uint) (*models.ServiceAccount, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	account, ok := mr.accounts[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return mr.withCredentials(account), nil
+}
+
+// FindByClientID returns an account by client ID
+func (mr *memoryServiceAccountRepository) FindByClientID(clientID string) (*models.ServiceAccount, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, account := range mr.accounts {
+		if account.ClientID == clientID {
+			return mr.withCredentials(account), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// FindBySecretHash returns the account holding a secret
+func (mr *memoryServiceAccountRepository) FindBySecretHash(hash string) (*models.ServiceAccount, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, credential := range mr.credentials {
+		if credential.SecretHash != nil && *credential.SecretHash == hash {
+			return mr.withCredentials(mr.accounts[credential.ServiceAccountID]), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// withCredentials returns a copy of account with its credentials; the
+// caller must hold the lock
+func (mr *memoryServiceAccountRepository) withCredentials(account models.ServiceAccount) *models.ServiceAccount {
+	account.Credentials = nil
+	for _, credential := range mr.credentials {
+		if credential.ServiceAccountID == account.ID {
+			account.Credentials = append(account.Credentials, credential)
+		}
+	}
+	sort.Slice(account.Credentials, func(i, j int) bool {
+		return account.Credentials[i].ID < account.Credentials[j].ID
+	})
+	return &account
+}
+
+// List returns every account, by name
+func (mr *memoryServiceAccountRepository) List() ([]models.ServiceAccount, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	accounts := make([]models.ServiceAccount, 0, len(mr.accounts))
+	for _, account := range mr.accounts {
+		accounts = append(accounts, *mr.withCredentials(account))
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+	return accounts, nil
+}
+
+// Update saves the account's own fields
+func (mr *memoryServiceAccountRepository) Update(account *models.ServiceAccount) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.accounts[account.ID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	for id, existing := range mr.accounts {
+		if id != account.ID && existing.Name == account.Name {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	account.UpdatedAt = time.Now()
+	stored := *account
+	stored.Credentials = nil
+	mr.accounts[account.ID] = stored
+	return nil
+}
+
+// Delete removes an account and its credentials
+func (mr *memoryServiceAccountRepository) Delete(id uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.accounts, id)
+	for credentialID, credential := range mr.credentials {
+		if credential.ServiceAccountID == id {
+			delete(mr.credentials, credentialID)
+		}
+	}
+	return nil
+}
+
+// AddCredential saves a new credential
+func (mr *memoryServiceAccountRepository) AddCredential(credential *models.ServiceAccountCredential) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.accounts[credential.ServiceAccountID]; !ok {
+		return gorm.ErrForeignKeyViolated
+	}
+	credential.ID = mr.nextCredentialID
+	credential.CreatedAt = time.Now()
+	mr.nextCredentialID++
+	mr.credentials[credential.ID] = *credential
+	return nil
+}
+
+// DeleteCredential removes one of the account's credentials
+func (mr *memoryServiceAccountRepository) DeleteCredential(accountID, id uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	credential, ok := mr.credentials[id]
+	if !ok || credential.ServiceAccountID != accountID {
+		return gorm.ErrRecordNotFound
+	}
+	delete(mr.credentials, id)
+	return nil
+}
+
+// TouchCredential records a use of a credential
+func (mr *memoryServiceAccountRepository) TouchCredential(id uint, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if credential, ok := mr.credentials[id]; ok {
+		credential.LastUsedAt = &now
+		mr.credentials[id] = credential
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// SessionRepository defines the methods for login sessions
+type SessionRepository interface {
+	Create(session *models.Session) error
+	// Find returns a session by ID, or fails with gorm.ErrRecordNotFound
+	Find(id string) (*models.Session, error)
+	// FindByTokenHash returns the cookie session with the given cookie hash,
+	// or fails with gorm.ErrRecordNotFound
+	FindByTokenHash(hash string) (*models.Session, error)
+	// ListByUser returns the user's unexpired sessions, newest first
+	ListByUser(userID uint, now time.Time) ([]models.Session, error)
+	// ListByClient returns the unexpired sessions of an OAuth client
+	ListByClient(clientID string, now time.Time) ([]models.Session, error)
+	// Touch records activity on a session
+	Touch(id string, now time.Time) error
+	Delete(id string) error
+	// DeleteExpired removes sessions past their absolute timeout, and cookie
+	// sessions idle since before idleCutoff
+	DeleteExpired(now, idleCutoff time.Time) (int64, error)
+}
+
+// sessionRepositoryImpl is the gorm implementation of SessionRepository
+type sessionRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewSessionRepository creates a new instance of SessionRepository
+func NewSessionRepository(db *gorm.DB) SessionRepository {
+	return &sessionRepositoryImpl{db: db}
+}
+
+// Create saves a new session
+func (sr *sessionRepositoryImpl) Create(session *models.Session) error {
+	return sr.db.Create(session).Error
+}
+
+// Find returns a session by ID
+func (sr *sessionRepositoryImpl) Find(id string) (*models.Session, error) {
+	var session models.Session
+	if err := sr.db.First(&session, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// FindByTokenHash returns a cookie session by the hash of its cookie
+func (sr *sessionRepositoryImpl) FindByTokenHash(hash string) (*models.Session, error) {
+	var session models.Session
+	if err := sr.db.First(&session, "token_hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListByUser returns the user's unexpired sessions, newest first
+func (sr *sessionRepositoryImpl) ListByUser(userID uint, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := sr.db.Where("user_id = ? AND expires_at > ?", userID, now).
+		Order("created_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// ListByClient returns the unexpired sessions of an OAuth client
+func (sr *sessionRepositoryImpl) ListByClient(clientID string, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := sr.db.Where("kind = ? AND client_id = ? AND expires_at > ?", models.SessionKindOAuth, clientID, now).
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Touch records activity on a session
+func (sr *sessionRepositoryImpl) Touch(id string, now time.Time) error {
+	return sr.db.Model(&models.Session{}).Where("id = ?", id).Update("last_seen_at", now).Error
+}
+
+// Delete removes a session
+func (sr *sessionRepositoryImpl) Delete(id string) error {
+	return sr.db.Delete(&models.Session{}, "id = ?", id).Error
+}
+
+// DeleteExpired removes expired and idle sessions
+func (sr *sessionRepositoryImpl) DeleteExpired(now, idleCutoff time.Time) (int64, error) {
+	result := sr.db.
+		Where("expires_at <= ? OR (kind = ? AND last_seen_at <= ?)", now, models.SessionKindCookie, idleCutoff).
+		Delete(&models.Session{})
+	return result.RowsAffected, result.Error
+}
+
+// memorySessionRepository is an in-memory implementation of SessionRepository
+type memorySessionRepository struct {
+	mu       sync.RWMutex
+	sessions map[string]models.Session
+}
+
+// NewMemorySessionRepository creates a new, empty in-memory SessionRepository
+func NewMemorySessionRepository() SessionRepository {
+	return &memorySessionRepository{sessions: make(map[string]models.Session)}
+}
+
+// Create saves a new session
+func (mr *memorySessionRepository) Create(session *models.Session) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.sessions[session.ID]; exists {
+		return gorm.ErrDuplicatedKey
+	}
+	mr.sessions[session.ID] = *session
+	return nil
+}
+
+// Find returns a session by ID
+func (mr *memorySessionRepository) Find(id string) (*models.Session, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	session, ok := mr.sessions[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &session, nil
+}
+
+// FindByTokenHash returns a cookie session by the hash of its cookie
+func (mr *memorySessionRepository) FindByTokenHash(hash string) (*models.Session, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, session := range mr.sessions {
+		if session.TokenHash != nil && *session.TokenHash == hash {
+			return &session, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// ListByUser returns the user's unexpired sessions, newest first
+func (mr *memorySessionRepository) ListByUser(userID uint, now time.Time) ([]models.Session, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var sessions []models.Session
+	for _, session := range mr.sessions {
+		if session.UserID == userID && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// ListByClient returns the unexpired sessions of an OAuth client
+func (mr *memorySessionRepository) ListByClient(clientID string, now time.Time) ([]models.Session, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	var sessions []models.Session
+	for _, session := range mr.sessions {
+		if session.Kind == models.SessionKindOAuth && session.ClientID == clientID && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// Touch records activity on a session
+func (mr *memorySessionRepository) Touch(id string, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if session, ok := mr.sessions[id]; ok {
+		session.LastSeenAt = now
+		mr.sessions[id] = session
+	}
+	return nil
+}
+
+// Delete removes a session
+func (mr *memorySessionRepository) Delete(id string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.sessions, id)
+	return nil
+}
+
+// DeleteExpired removes expired and idle sessions
+func (mr *memorySessionRepository) DeleteExpired(now, idleCutoff time.Time) (int64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var deleted int64
+	for id, session := range mr.sessions {
+		idle := session.Kind == models.SessionKindCookie && !session.LastSeenAt.After(idleCutoff)
+		if !session.ExpiresAt.After(now) || idle {
+			delete(mr.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
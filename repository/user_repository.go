@@ -1,16 +1,55 @@
 package repository
 
 import (
+	"errors"
+	"time"
+
 	"gin-tutorial/models"
 
 	"gorm.io/gorm"
 )
 
-// UserRepository defines the methods for user-related database operations
+// DeletedFilter selects users by soft-delete state in List
+type DeletedFilter string
+
+const (
+	// ExcludeDeleted lists only active users (the default)
+	ExcludeDeleted DeletedFilter = ""
+	// IncludeDeleted lists active and soft-deleted users
+	IncludeDeleted DeletedFilter = "include"
+	// OnlyDeleted lists only soft-deleted users (the trash)
+	OnlyDeleted DeletedFilter = "only"
+)
+
+// ErrVersionConflict is returned by writes whose expected version is no
+// longer the user's current version
+var ErrVersionConflict = errors.New("user has been modified by someone else")
+
+// ListOptions filters the users returned by List
+type ListOptions struct {
+	Deleted DeletedFilter
+}
+
+// UserRepository defines the methods for user-related database operations.
+// Lookups ignore soft-deleted users unless stated otherwise. Every write
+// bumps the user's version; Update and Delete only apply when the user is
+// still at expectedVersion and fail with ErrVersionConflict otherwise.
 type UserRepository interface {
 	FindByEmail(email string) (*models.User, error)
 	FindByID(userID uint) (*models.User, error)
+	// FindByIDIncludingDeleted is FindByID that finds soft-deleted users too
+	FindByIDIncludingDeleted(userID uint) (*models.User, error)
+	// FindProfile is FindByID without the credentials (password hash and
+	// TOTP secret); unlike the other lookups, it may be served from a cache.
+	// Its result must not be written back with Update.
+	FindProfile(userID uint) (*models.User, error)
+	List(opts ListOptions) ([]models.User, error)
 	Create(user *models.User) error
+	Update(user *models.User, expectedVersion uint) error
+	Delete(userID uint, expectedVersion uint) error
+	Restore(userID uint) error
+	Purge(userID uint, expectedVersion uint) error
+	PurgeDeletedBefore(cutoff time.Time) (int64, error)
 }
 
 // userRepositoryImpl is the concrete implementation of UserRepository
@@ -41,7 +80,154 @@ func (ur *userRepositoryImpl) FindByID(userID uint) (*models.User, error) {
 	return &user, nil
 }
 
+// FindByIDIncludingDeleted finds a user by ID, whether soft-deleted or not
+func (ur *userRepositoryImpl) FindByIDIncludingDeleted(userID uint) (*models.User, error) {
+	var user models.User
+	if err := ur.db.Unscoped().First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindProfile finds a user by ID, leaving out its credentials
+func (ur *userRepositoryImpl) FindProfile(userID uint) (*models.User, error) {
+	user, err := ur.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return withoutCredentials(user), nil
+}
+
+// List returns the users matching opts, ordered by ID
+func (ur *userRepositoryImpl) List(opts ListOptions) ([]models.User, error) {
+	query := ur.db.Order("id")
+	switch opts.Deleted {
+	case IncludeDeleted:
+		query = query.Unscoped()
+	case OnlyDeleted:
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+
+	var users []models.User
+	if err := query.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // Create saves a new user in the database
 func (ur *userRepositoryImpl) Create(user *models.User) error {
+	if user.Version == 0 {
+		user.Version = 1
+	}
 	return ur.db.Create(user).Error
 }
+
+// Update saves the user's username, email, role, password, verification,
+// session revocation and TOTP settings
+func (ur *userRepositoryImpl) Update(user *models.User, expectedVersion uint) error {
+	result := ur.db.Model(&models.User{}).
+		Where("id = ? AND version = ?", user.ID, expectedVersion).
+		Updates(map[string]interface{}{
+			"username":            user.Username,
+			"email":               user.Email,
+			"role":                user.Role,
+			"password":            user.Password,
+			"verified_at":         user.VerifiedAt,
+			"sessions_revoked_at": user.SessionsRevokedAt,
+			"totp_secret":         user.TOTPSecret,
+			"totp_enabled_at":     user.TOTPEnabledAt,
+			"totp_last_step":      user.TOTPLastStep,
+			"version":             gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ur.writeConflict(user.ID)
+	}
+	user.Version = expectedVersion + 1
+	return nil
+}
+
+// Delete soft-deletes a user
+func (ur *userRepositoryImpl) Delete(userID uint, expectedVersion uint) error {
+	result := ur.db.Model(&models.User{}).
+		Where("id = ? AND version = ?", userID, expectedVersion).
+		Updates(map[string]interface{}{
+			"deleted_at": time.Now(),
+			"version":    gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ur.writeConflict(userID)
+	}
+	return nil
+}
+
+// Restore brings back a soft-deleted user. It fails with
+// gorm.ErrDuplicatedKey if the email or username has been taken since.
+func (ur *userRepositoryImpl) Restore(userID uint) error {
+	result := ur.db.Unscoped().Model(&models.User{}).
+		Where("id = ? AND deleted_at IS NOT NULL", userID).
+		Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"version":    gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Purge permanently deletes a user, whether soft-deleted or not
+func (ur *userRepositoryImpl) Purge(userID uint, expectedVersion uint) error {
+	result := ur.db.Unscoped().
+		Where("id = ? AND version = ?", userID, expectedVersion).
+		Delete(&models.User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := ur.FindByIDIncludingDeleted(userID); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// PurgeDeletedBefore permanently deletes users soft-deleted before cutoff
+// and returns how many were removed
+func (ur *userRepositoryImpl) PurgeDeletedBefore(cutoff time.Time) (int64, error) {
+	result := ur.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+		Delete(&models.User{})
+	return result.RowsAffected, result.Error
+}
+
+// writeConflict explains why a versioned write to userID matched no rows
+func (ur *userRepositoryImpl) writeConflict(userID uint) error {
+	var count int64
+	if err := ur.db.Model(&models.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return ErrVersionConflict
+}
+
+// withoutCredentials returns a copy of user without its password hash and
+// TOTP secret
+func withoutCredentials(user *models.User) *models.User {
+	profile := *user
+	profile.Password = ""
+	profile.TOTPSecret = ""
+	return &profile
+}
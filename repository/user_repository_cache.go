@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gin-tutorial/cache"
+	"gin-tutorial/models"
+	"gin-tutorial/pubsub"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+)
+
+// userCacheMetrics exposes hit/miss counters under /debug/vars
+var userCacheMetrics = expvar.NewMap("user_repository_cache")
+
+// cachedUserRepository is a read-through caching decorator for UserRepository.
+// Profiles are cached by ID and by email; misses are cached too (for a
+// shorter TTL) and concurrent misses for the same key share a single lookup.
+// Credentials are never cached, since the cache may be a shared Redis: cached
+// entries leave them out, so FindByID and FindByEmail, which return them, only
+// use the cache to answer misses.
+type cachedUserRepository struct {
+	next        UserRepository
+	cache       cache.Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	group       singleflight.Group
+	// generation is bumped by every write so a lookup that raced with it
+	// doesn't put the pre-write result back into the cache
+	generation atomic.Uint64
+}
+
+// NewCachedUserRepository wraps next with a cache. Found users are kept for
+// ttl and lookups that miss for negativeTTL (zero disables negative caching).
+func NewCachedUserRepository(next UserRepository, c cache.Cache, ttl, negativeTTL time.Duration) UserRepository {
+	return &cachedUserRepository{
+		next:        next,
+		cache:       c,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// FindByEmail finds a user by email, with its credentials
+func (cr *cachedUserRepository) FindByEmail(email string) (*models.User, error) {
+	return cr.load(userEmailKey(email), true, func() (*models.User, error) {
+		return cr.next.FindByEmail(email)
+	})
+}
+
+// FindByID finds a user by ID, with its credentials
+func (cr *cachedUserRepository) FindByID(userID uint) (*models.User, error) {
+	return cr.load(userIDKey(userID), true, func() (*models.User, error) {
+		return cr.next.FindByID(userID)
+	})
+}
+
+// FindByIDIncludingDeleted is passed through: soft-deleted users are never
+// cached
+func (cr *cachedUserRepository) FindByIDIncludingDeleted(userID uint) (*models.User, error) {
+	return cr.next.FindByIDIncludingDeleted(userID)
+}
+
+// FindProfile finds a user by ID without its credentials, from the cache
+// when it can
+func (cr *cachedUserRepository) FindProfile(userID uint) (*models.User, error) {
+	return cr.load(userIDKey(userID), false, func() (*models.User, error) {
+		return cr.next.FindByID(userID)
+	})
+}
+
+// Create saves a new user and drops any cached miss for it
+func (cr *cachedUserRepository) Create(user *models.User) error {
+	if err := cr.next.Create(user); err != nil {
+		return err
+	}
+	cr.invalidate(user)
+	return nil
+}
+
+// List is not cached
+func (cr *cachedUserRepository) List(opts ListOptions) ([]models.User, error) {
+	return cr.next.List(opts)
+}
+
+// Update saves a user and drops the cached entries for its old and new email
+func (cr *cachedUserRepository) Update(user *models.User, expectedVersion uint) error {
+	previous, err := cr.next.FindByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := cr.next.Update(user, expectedVersion); err != nil {
+		return err
+	}
+	cr.invalidate(previous)
+	cr.invalidate(user)
+	return nil
+}
+
+// Delete soft-deletes a user and drops its cached entries
+func (cr *cachedUserRepository) Delete(userID uint, expectedVersion uint) error {
+	user, err := cr.next.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := cr.next.Delete(userID, expectedVersion); err != nil {
+		return err
+	}
+	cr.invalidate(user)
+	return nil
+}
+
+// Restore brings back a soft-deleted user and drops any cached miss for it
+func (cr *cachedUserRepository) Restore(userID uint) error {
+	if err := cr.next.Restore(userID); err != nil {
+		return err
+	}
+
+	user, err := cr.next.FindByID(userID)
+	if err != nil {
+		user = &models.User{Model: gorm.Model{ID: userID}}
+	}
+	cr.invalidate(user)
+	return nil
+}
+
+// Purge permanently deletes a user and drops its cached entries
+func (cr *cachedUserRepository) Purge(userID uint, expectedVersion uint) error {
+	// Soft-deleted users were already dropped when they were deleted
+	user, err := cr.next.FindByID(userID)
+	if err != nil {
+		user = &models.User{Model: gorm.Model{ID: userID}}
+	}
+	if err := cr.next.Purge(userID, expectedVersion); err != nil {
+		return err
+	}
+	cr.invalidate(user)
+	return nil
+}
+
+// PurgeDeletedBefore is passed through: soft-deleted users are never cached
+func (cr *cachedUserRepository) PurgeDeletedBefore(cutoff time.Time) (int64, error) {
+	return cr.next.PurgeDeletedBefore(cutoff)
+}
+
+// InvalidateOnEvents keeps a cached UserRepository in step with writes made
+// by other instances. It does nothing if userRepo isn't cached.
+func InvalidateOnEvents(userRepo UserRepository, bus pubsub.Bus) {
+	cr, ok := userRepo.(*cachedUserRepository)
+	if !ok {
+		return
+	}
+
+	bus.Subscribe(func(event pubsub.Event) {
+		switch event.Type {
+		case pubsub.UserCreated, pubsub.UserUpdated, pubsub.UserDeleted, pubsub.UserRoleChanged:
+			cr.invalidate(&models.User{Model: gorm.Model{ID: event.UserID}, Email: event.Email})
+		case pubsub.Resync:
+			cr.invalidateAll()
+		}
+	})
+}
+
+// load serves key from the cache, falling back to fetch on a miss. With
+// credentials, only cached misses are served: the entries leave them out.
+func (cr *cachedUserRepository) load(key string, credentials bool, fetch func() (*models.User, error)) (*models.User, error) {
+	value, found, err := cr.cache.Get(key)
+	if err != nil {
+		userCacheMetrics.Add("errors", 1)
+		logrus.WithError(err).WithField("key", key).Warn("User cache read failed")
+	}
+	if found {
+		if len(value) == 0 {
+			userCacheMetrics.Add("negative_hits", 1)
+			return nil, gorm.ErrRecordNotFound
+		}
+		if credentials {
+			userCacheMetrics.Add("credential_lookups", 1)
+		} else if user, err := decodeUser(value); err == nil {
+			userCacheMetrics.Add("hits", 1)
+			return user, nil
+		} else {
+			userCacheMetrics.Add("errors", 1)
+		}
+	}
+	if !found {
+		userCacheMetrics.Add("misses", 1)
+	}
+
+	// Lookups with and without credentials mustn't share results
+	flightKey := key
+	if credentials {
+		flightKey += "#credentials"
+	}
+	result, err, _ := cr.group.Do(flightKey, func() (interface{}, error) {
+		generation := cr.generation.Load()
+		user, err := fetch()
+		stale := generation != cr.generation.Load()
+		if errors.Is(err, gorm.ErrRecordNotFound) && cr.negativeTTL > 0 && !stale {
+			cr.store(key, nil, cr.negativeTTL)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		profile := withoutCredentials(user)
+		encoded, err := encodeUser(profile)
+		if err == nil && !stale {
+			cr.store(userIDKey(user.ID), encoded, cr.ttl)
+			cr.store(userEmailKey(user.Email), encoded, cr.ttl)
+		}
+		if credentials {
+			return user, nil
+		}
+		return profile, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Callers sharing a singleflight result must not share the struct
+	user := *result.(*models.User)
+	return &user, nil
+}
+
+// store writes value to the cache, logging rather than failing on errors
+func (cr *cachedUserRepository) store(key string, value []byte, ttl time.Duration) {
+	if err := cr.cache.Set(key, value, ttl); err != nil {
+		userCacheMetrics.Add("errors", 1)
+		logrus.WithError(err).WithField("key", key).Warn("User cache write failed")
+	}
+}
+
+// invalidate drops every cached entry (including misses) for user
+func (cr *cachedUserRepository) invalidate(user *models.User) {
+	cr.generation.Add(1)
+	for _, key := range []string{userIDKey(user.ID), userEmailKey(user.Email)} {
+		cr.group.Forget(key)
+		cr.group.Forget(key + "#credentials")
+	}
+	if err := cr.cache.Delete(userIDKey(user.ID), userEmailKey(user.Email)); err != nil {
+		userCacheMetrics.Add("errors", 1)
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("User cache invalidation failed")
+	}
+	userCacheMetrics.Add("invalidations", 1)
+}
+
+// invalidateAll drops every cached entry
+func (cr *cachedUserRepository) invalidateAll() {
+	cr.generation.Add(1)
+	if err := cr.cache.Clear(); err != nil {
+		userCacheMetrics.Add("errors", 1)
+		logrus.WithError(err).Warn("User cache clear failed")
+	}
+	userCacheMetrics.Add("invalidations", 1)
+}
+
+func userIDKey(userID uint) string {
+	return fmt.Sprintf("user:id:%d", userID)
+}
+
+func userEmailKey(email string) string {
+	return "user:email:" + email
+}
+
+// encodeUser serializes a user with gob, which unlike the JSON tags on
+// models.User keeps every field; callers strip the credentials first
+func encodeUser(user *models.User) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(user); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeUser(value []byte) (*models.User, error) {
+	var user models.User
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
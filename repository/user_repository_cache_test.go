@@ -0,0 +1,200 @@
+package repository_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gin-tutorial/cache"
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/alicebob/miniredis/v2"
+	"gorm.io/gorm"
+)
+
+// countingUserRepository counts the lookups that reach the wrapped
+// repository, optionally slowing them down
+type countingUserRepository struct {
+	repository.UserRepository
+	lookups atomic.Int64
+	delay   time.Duration
+}
+
+func (cr *countingUserRepository) FindByID(userID uint) (*models.User, error) {
+	cr.lookups.Add(1)
+	time.Sleep(cr.delay)
+	return cr.UserRepository.FindByID(userID)
+}
+
+func (cr *countingUserRepository) FindByEmail(email string) (*models.User, error) {
+	cr.lookups.Add(1)
+	time.Sleep(cr.delay)
+	return cr.UserRepository.FindByEmail(email)
+}
+
+// newRedisUserRepository returns a cached repository backed by a local
+// Redis stand-in, the stand-in and the wrapped repository
+func newRedisUserRepository(t *testing.T) (repository.UserRepository, *miniredis.Miniredis, *countingUserRepository) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisCache, err := cache.NewRedis("redis://"+server.Addr()+"/0", "test:")
+	if err != nil {
+		t.Fatalf("connect to miniredis: %v", err)
+	}
+	backend := &countingUserRepository{UserRepository: repository.NewMemoryUserRepository()}
+	return repository.NewCachedUserRepository(backend, redisCache, time.Minute, time.Minute), server, backend
+}
+
+func TestCachedUserRepositoryServesProfilesFromRedis(t *testing.T) {
+	repo, server, backend := newRedisUserRepository(t)
+	user := createUser(t, repo, "alice")
+
+	for i := 0; i < 3; i++ {
+		profile, err := repo.FindProfile(user.ID)
+		if err != nil {
+			t.Fatalf("FindProfile: %v", err)
+		}
+		if profile.Username != "alice" {
+			t.Errorf("profile = %+v, want alice", profile)
+		}
+	}
+	if lookups := backend.lookups.Load(); lookups != 1 {
+		t.Errorf("%d lookups reached the database, want 1", lookups)
+	}
+	if !server.Exists(fmt.Sprintf("test:user:id:%d", user.ID)) || !server.Exists("test:user:email:alice@example.com") {
+		t.Errorf("profile not cached by ID and email; keys: %v", server.Keys())
+	}
+}
+
+func TestCachedUserRepositoryKeepsCredentialsOutOfRedis(t *testing.T) {
+	repo, server, backend := newRedisUserRepository(t)
+	user := &models.User{Username: "alice", Email: "alice@example.com", Password: "$argon2id$secret-hash", TOTPSecret: "TOTPSECRETBASE32"}
+	if err := repo.Create(user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Credential lookups fill the cache too, but always reach the database
+	for i := 0; i < 2; i++ {
+		found, err := repo.FindByEmail("alice@example.com")
+		if err != nil {
+			t.Fatalf("FindByEmail: %v", err)
+		}
+		if found.Password != user.Password || found.TOTPSecret != user.TOTPSecret {
+			t.Errorf("FindByEmail lost the credentials: %+v", found)
+		}
+	}
+	if lookups := backend.lookups.Load(); lookups != 2 {
+		t.Errorf("%d credential lookups reached the database, want 2", lookups)
+	}
+
+	if len(server.Keys()) == 0 {
+		t.Fatal("nothing was cached")
+	}
+	for _, key := range server.Keys() {
+		value, err := server.Get(key)
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		for _, secret := range []string{user.Password, user.TOTPSecret} {
+			if bytes.Contains([]byte(value), []byte(secret)) {
+				t.Errorf("%s holds a credential", key)
+			}
+		}
+	}
+}
+
+func TestCachedUserRepositoryCachesMisses(t *testing.T) {
+	repo, server, backend := newRedisUserRepository(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := repo.FindByEmail("nobody@example.com")
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("FindByEmail: got %v, want gorm.ErrRecordNotFound", err)
+		}
+	}
+	if lookups := backend.lookups.Load(); lookups != 1 {
+		t.Errorf("%d lookups reached the database, want 1", lookups)
+	}
+
+	// Creating the user drops the cached miss
+	createUser(t, repo, "nobody")
+	if _, err := repo.FindByEmail("nobody@example.com"); err != nil {
+		t.Fatalf("FindByEmail after create: %v", err)
+	}
+
+	// Misses expire after the negative TTL
+	if _, err := repo.FindProfile(12345); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("FindProfile: got %v, want gorm.ErrRecordNotFound", err)
+	}
+	if !server.Exists("test:user:id:12345") {
+		t.Fatal("the miss wasn't cached")
+	}
+	server.FastForward(2 * time.Minute)
+	if server.Exists("test:user:id:12345") {
+		t.Error("the cached miss outlived the negative TTL")
+	}
+}
+
+func TestCachedUserRepositoryInvalidatesOnWrites(t *testing.T) {
+	repo, server, _ := newRedisUserRepository(t)
+	user := createUser(t, repo, "alice")
+	if _, err := repo.FindProfile(user.ID); err != nil {
+		t.Fatalf("FindProfile: %v", err)
+	}
+
+	user.Email = "alice@example.org"
+	user.Role = models.RoleAdmin
+	if err := repo.Update(user, user.Version); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if server.Exists("test:user:email:alice@example.com") {
+		t.Error("the old email is still cached after the update")
+	}
+	profile, err := repo.FindProfile(user.ID)
+	if err != nil {
+		t.Fatalf("FindProfile: %v", err)
+	}
+	if profile.Email != "alice@example.org" || profile.Role != models.RoleAdmin {
+		t.Errorf("profile after update = %+v", profile)
+	}
+
+	if err := repo.Delete(user.ID, profile.Version); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := repo.FindProfile(user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("FindProfile after delete: got %v, want gorm.ErrRecordNotFound", err)
+	}
+	if err := repo.Restore(user.ID); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if _, err := repo.FindProfile(user.ID); err != nil {
+		t.Errorf("FindProfile after restore: %v", err)
+	}
+}
+
+func TestCachedUserRepositoryCollapsesConcurrentMisses(t *testing.T) {
+	repo, _, backend := newRedisUserRepository(t)
+	user := createUser(t, repo, "alice")
+	backend.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.FindProfile(user.ID); err != nil {
+				t.Errorf("FindProfile: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if lookups := backend.lookups.Load(); lookups != 1 {
+		t.Errorf("%d concurrent misses reached the database, want 1", lookups)
+	}
+}
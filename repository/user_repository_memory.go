@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// memoryUserRepository is an in-memory implementation of UserRepository.
+// It mirrors the gorm implementation closely enough to be used in tests and
+// demo mode: lookups miss with gorm.ErrRecordNotFound, and email and username
+// are unique among users that aren't soft-deleted (gorm.ErrDuplicatedKey).
+type memoryUserRepository struct {
+	mu     sync.RWMutex
+	nextID uint
+	users  map[uint]models.User
+	// byEmail and byUsername index active users only, like the partial
+	// unique indexes
+	byEmail    map[string]uint
+	byUsername map[string]uint
+}
+
+// NewMemoryUserRepository creates a new, empty in-memory UserRepository
+func NewMemoryUserRepository() UserRepository {
+	return &memoryUserRepository{
+		users:      make(map[uint]models.User),
+		byEmail:    make(map[string]uint),
+		byUsername: make(map[string]uint),
+	}
+}
+
+// FindByEmail finds a user by email
+func (mr *memoryUserRepository) FindByEmail(email string) (*models.User, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	id, ok := mr.byEmail[email]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	user := mr.users[id]
+	return &user, nil
+}
+
+// FindByID finds a user by ID
+func (mr *memoryUserRepository) FindByID(userID uint) (*models.User, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	user, ok := mr.users[userID]
+	if !ok || user.DeletedAt.Valid {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+// FindByIDIncludingDeleted finds a user by ID, whether soft-deleted or not
+func (mr *memoryUserRepository) FindByIDIncludingDeleted(userID uint) (*models.User, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	user, ok := mr.users[userID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+// FindProfile finds a user by ID, leaving out its credentials
+func (mr *memoryUserRepository) FindProfile(userID uint) (*models.User, error) {
+	user, err := mr.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return withoutCredentials(user), nil
+}
+
+// List returns the users matching opts, ordered by ID
+func (mr *memoryUserRepository) List(opts ListOptions) ([]models.User, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	users := []models.User{}
+	for _, user := range mr.users {
+		deleted := user.DeletedAt.Valid
+		switch {
+		case opts.Deleted == OnlyDeleted && !deleted:
+			continue
+		case opts.Deleted == ExcludeDeleted && deleted:
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Create saves a new user in memory, assigning its ID and timestamps
+func (mr *memoryUserRepository) Create(user *models.User) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.users[user.ID]; exists && user.ID != 0 {
+		return gorm.ErrDuplicatedKey
+	}
+	if mr.conflicts(user) {
+		return gorm.ErrDuplicatedKey
+	}
+
+	if user.ID == 0 {
+		mr.nextID++
+		user.ID = mr.nextID
+	} else if user.ID > mr.nextID {
+		mr.nextID = user.ID
+	}
+
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = now
+	}
+	if user.Role == "" {
+		user.Role = models.RoleUser
+	}
+	if user.Version == 0 {
+		user.Version = 1
+	}
+
+	mr.users[user.ID] = *user
+	mr.index(user)
+	return nil
+}
+
+// Update saves the user's username, email, role, password, verification,
+// session revocation and TOTP settings
+func (mr *memoryUserRepository) Update(user *models.User, expectedVersion uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	current, ok := mr.users[user.ID]
+	if !ok || current.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	if current.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	mr.unindex(&current)
+	if mr.conflicts(user) {
+		mr.index(&current)
+		return gorm.ErrDuplicatedKey
+	}
+
+	current.Username = user.Username
+	current.Email = user.Email
+	current.Role = user.Role
+	current.Password = user.Password
+	current.VerifiedAt = user.VerifiedAt
+	current.SessionsRevokedAt = user.SessionsRevokedAt
+	current.TOTPSecret = user.TOTPSecret
+	current.TOTPEnabledAt = user.TOTPEnabledAt
+	current.TOTPLastStep = user.TOTPLastStep
+	current.Version++
+	current.UpdatedAt = time.Now()
+	mr.users[user.ID] = current
+	mr.index(&current)
+
+	user.Version = current.Version
+	return nil
+}
+
+// Delete soft-deletes a user
+func (mr *memoryUserRepository) Delete(userID uint, expectedVersion uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	user, ok := mr.users[userID]
+	if !ok || user.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	if user.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	user.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	user.Version++
+	mr.users[userID] = user
+	mr.unindex(&user)
+	return nil
+}
+
+// Restore brings back a soft-deleted user
+func (mr *memoryUserRepository) Restore(userID uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	user, ok := mr.users[userID]
+	if !ok || !user.DeletedAt.Valid {
+		return gorm.ErrRecordNotFound
+	}
+	if mr.conflicts(&user) {
+		return gorm.ErrDuplicatedKey
+	}
+
+	user.DeletedAt = gorm.DeletedAt{}
+	user.Version++
+	mr.users[userID] = user
+	mr.index(&user)
+	return nil
+}
+
+// Purge permanently deletes a user, whether soft-deleted or not
+func (mr *memoryUserRepository) Purge(userID uint, expectedVersion uint) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	user, ok := mr.users[userID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if user.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	delete(mr.users, userID)
+	if !user.DeletedAt.Valid {
+		mr.unindex(&user)
+	}
+	return nil
+}
+
+// PurgeDeletedBefore permanently deletes users soft-deleted before cutoff
+func (mr *memoryUserRepository) PurgeDeletedBefore(cutoff time.Time) (int64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var purged int64
+	for id, user := range mr.users {
+		if user.DeletedAt.Valid && user.DeletedAt.Time.Before(cutoff) {
+			delete(mr.users, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// conflicts reports whether an active user already has user's email or username
+func (mr *memoryUserRepository) conflicts(user *models.User) bool {
+	if _, exists := mr.byEmail[user.Email]; exists {
+		return true
+	}
+	_, exists := mr.byUsername[user.Username]
+	return exists
+}
+
+func (mr *memoryUserRepository) index(user *models.User) {
+	mr.byEmail[user.Email] = user.ID
+	mr.byUsername[user.Username] = user.ID
+}
+
+func (mr *memoryUserRepository) unindex(user *models.User) {
+	delete(mr.byEmail, user.Email)
+	delete(mr.byUsername, user.Username)
+}
@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+
+	"gorm.io/gorm"
+)
+
+// UserTokenRepository defines the methods for single-use user tokens
+type UserTokenRepository interface {
+	Create(token *models.UserToken) error
+	// Consume marks an unused, unexpired token as used and returns it, or
+	// fails with gorm.ErrRecordNotFound. Only one caller can consume a token.
+	Consume(id, purpose string, now time.Time) (*models.UserToken, error)
+	// FindActive returns an unused, unexpired token without using it up
+	FindActive(id, purpose string, now time.Time) (*models.UserToken, error)
+	// Latest returns the user's newest token for purpose
+	Latest(userID uint, purpose string) (*models.UserToken, error)
+	// Invalidate uses up all of the user's outstanding tokens for purpose
+	Invalidate(userID uint, purpose string, now time.Time) error
+	DeleteExpired(now time.Time) error
+}
+
+// userTokenRepositoryImpl is the gorm implementation of UserTokenRepository
+type userTokenRepositoryImpl struct {
+	db *gorm.DB
+}
+
+// NewUserTokenRepository creates a new instance of UserTokenRepository
+func NewUserTokenRepository(db *gorm.DB) UserTokenRepository {
+	return &userTokenRepositoryImpl{db: db}
+}
+
+// Create saves a new token
+func (tr *userTokenRepositoryImpl) Create(token *models.UserToken) error {
+	return tr.db.Create(token).Error
+}
+
+// Consume marks a token as used, unless it already is or has expired
+func (tr *userTokenRepositoryImpl) Consume(id, purpose string, now time.Time) (*models.UserToken, error) {
+	result := tr.db.Model(&models.UserToken{}).
+		Where("id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", id, purpose, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var token models.UserToken
+	if err := tr.db.First(&token, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// FindActive returns an unused, unexpired token without using it up
+func (tr *userTokenRepositoryImpl) FindActive(id, purpose string, now time.Time) (*models.UserToken, error) {
+	var token models.UserToken
+	err := tr.db.Where("id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", id, purpose, now).
+		First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Latest returns the user's newest token for purpose
+func (tr *userTokenRepositoryImpl) Latest(userID uint, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	err := tr.db.Where("user_id = ? AND purpose = ?", userID, purpose).
+		Order("created_at DESC").
+		First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Invalidate uses up all of the user's outstanding tokens for purpose
+func (tr *userTokenRepositoryImpl) Invalidate(userID uint, purpose string, now time.Time) error {
+	return tr.db.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", now).Error
+}
+
+// DeleteExpired removes tokens that can't be used anymore
+func (tr *userTokenRepositoryImpl) DeleteExpired(now time.Time) error {
+	return tr.db.Where("expires_at <= ?", now).Delete(&models.UserToken{}).Error
+}
+
+// memoryUserTokenRepository is an in-memory implementation of UserTokenRepository
+type memoryUserTokenRepository struct {
+	mu     sync.Mutex
+	tokens map[string]models.UserToken
+}
+
+// NewMemoryUserTokenRepository creates a new, empty in-memory UserTokenRepository
+func NewMemoryUserTokenRepository() UserTokenRepository {
+	return &memoryUserTokenRepository{tokens: make(map[string]models.UserToken)}
+}
+
+// Create saves a new token
+func (mr *memoryUserTokenRepository) Create(token *models.UserToken) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, exists := mr.tokens[token.ID]; exists {
+		return gorm.ErrDuplicatedKey
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	mr.tokens[token.ID] = *token
+	return nil
+}
+
+// Consume marks a token as used, unless it already is or has expired
+func (mr *memoryUserTokenRepository) Consume(id, purpose string, now time.Time) (*models.UserToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	token, ok := mr.tokens[id]
+	if !ok || token.Purpose != purpose || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	token.UsedAt = &now
+	mr.tokens[id] = token
+	return &token, nil
+}
+
+// FindActive returns an unused, unexpired token without using it up
+func (mr *memoryUserTokenRepository) FindActive(id, purpose string, now time.Time) (*models.UserToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	token, ok := mr.tokens[id]
+	if !ok || token.Purpose != purpose || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &token, nil
+}
+
+// Latest returns the user's newest token for purpose
+func (mr *memoryUserTokenRepository) Latest(userID uint, purpose string) (*models.UserToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var latest *models.UserToken
+	for _, token := range mr.tokens {
+		if token.UserID == userID && token.Purpose == purpose &&
+			(latest == nil || token.CreatedAt.After(latest.CreatedAt)) {
+			latest = &token
+		}
+	}
+	if latest == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return latest, nil
+}
+
+// Invalidate uses up all of the user's outstanding tokens for purpose
+func (mr *memoryUserTokenRepository) Invalidate(userID uint, purpose string, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, token := range mr.tokens {
+		if token.UserID == userID && token.Purpose == purpose && token.UsedAt == nil {
+			token.UsedAt = &now
+			mr.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+// DeleteExpired removes tokens that can't be used anymore
+func (mr *memoryUserTokenRepository) DeleteExpired(now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for id, token := range mr.tokens {
+		if !token.ExpiresAt.After(now) {
+			delete(mr.tokens, id)
+		}
+	}
+	return nil
+}
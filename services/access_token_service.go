@@ -0,0 +1,213 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidAccessToken is returned for personal access tokens that are
+	// unknown or expired
+	ErrInvalidAccessToken = errors.New("invalid or expired access token")
+	// ErrAccessTokenNotFound is returned when the user has no such token
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	// ErrInvalidScope is returned for unknown scopes, or scopes the user's
+	// role can't grant
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrInvalidExpiry is returned for expiry times in the past
+	ErrInvalidExpiry = errors.New("expiry must be in the future")
+	// ErrTooManyAccessTokens is returned when a user already has as many
+	// tokens as allowed
+	ErrTooManyAccessTokens = errors.New("too many access tokens, revoke one first")
+)
+
+// AccessTokenConfig holds the limits of personal access tokens
+type AccessTokenConfig struct {
+	// MaxPerUser caps how many tokens a user can have; 0 means no limit
+	MaxPerUser int
+}
+
+// AccessTokenChanges holds the fields of a token to change; nil fields are
+// left alone
+type AccessTokenChanges struct {
+	Name   *string
+	Scopes []string
+}
+
+// AccessTokenService manages personal access tokens: long-lived bearer
+// tokens for scripts, limited to a set of scopes
+type AccessTokenService interface {
+	// Create makes a token for user and returns it; it can't be retrieved
+	// again. A nil expiresAt means the token doesn't expire.
+	Create(user *models.User, name string, scopes []string, expiresAt *time.Time) (string, *models.AccessToken, error)
+	// List returns the user's tokens, newest first
+	List(userID uint) ([]models.AccessToken, error)
+	// Get returns one of the user's tokens
+	Get(userID, id uint) (*models.AccessToken, error)
+	// Update renames a token or changes its scopes
+	Update(user *models.User, id uint, changes AccessTokenChanges) (*models.AccessToken, error)
+	// Revoke deletes one of the user's tokens
+	Revoke(userID, id uint) error
+	// Authenticate returns the live token a bearer token belongs to and
+	// records the use
+	Authenticate(token, ip string) (*models.AccessToken, error)
+}
+
+// accessTokenServiceImpl is the concrete implementation of AccessTokenService
+type accessTokenServiceImpl struct {
+	tokenRepo repository.AccessTokenRepository
+	config    AccessTokenConfig
+}
+
+// NewAccessTokenService creates a new AccessTokenService instance
+func NewAccessTokenService(tokenRepo repository.AccessTokenRepository, config AccessTokenConfig) AccessTokenService {
+	return &accessTokenServiceImpl{tokenRepo: tokenRepo, config: config}
+}
+
+// Create makes and stores a new token
+func (as *accessTokenServiceImpl) Create(user *models.User, name string, scopes []string, expiresAt *time.Time) (string, *models.AccessToken, error) {
+	scopes, err := normalizeScopes(user.Role, true, scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", nil, ErrInvalidExpiry
+	}
+	if as.config.MaxPerUser > 0 {
+		existing, err := as.tokenRepo.ListByUser(user.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(existing) >= as.config.MaxPerUser {
+			return "", nil, ErrTooManyAccessTokens
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	token := models.AccessTokenPrefix + secret
+	record := &models.AccessToken{
+		UserID:    user.ID,
+		Name:      strings.TrimSpace(name),
+		Hash:      hashSessionToken(token),
+		Hint:      token[:len(models.AccessTokenPrefix)+4],
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+	if err := as.tokenRepo.Create(record); err != nil {
+		return "", nil, err
+	}
+	return token, record, nil
+}
+
+// List returns the user's tokens
+func (as *accessTokenServiceImpl) List(userID uint) ([]models.AccessToken, error) {
+	return as.tokenRepo.ListByUser(userID)
+}
+
+// Get returns one of the user's tokens
+func (as *accessTokenServiceImpl) Get(userID, id uint) (*models.AccessToken, error) {
+	token, err := as.tokenRepo.Find(userID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccessTokenNotFound
+	}
+	return token, err
+}
+
+// Update renames a token or changes its scopes
+func (as *accessTokenServiceImpl) Update(user *models.User, id uint, changes AccessTokenChanges) (*models.AccessToken, error) {
+	token, err := as.Get(user.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	if changes.Name != nil {
+		token.Name = strings.TrimSpace(*changes.Name)
+	}
+	if changes.Scopes != nil {
+		scopes, err := normalizeScopes(user.Role, true, changes.Scopes)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Join(scopes, " ")
+	}
+	if err := as.tokenRepo.Update(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Revoke deletes one of the user's tokens
+func (as *accessTokenServiceImpl) Revoke(userID, id uint) error {
+	err := as.tokenRepo.Delete(userID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrAccessTokenNotFound
+	}
+	return err
+}
+
+// Authenticate looks a token up by its hash. Uses are only written every
+// so often, so that a busy script doesn't cost a database write per request.
+func (as *accessTokenServiceImpl) Authenticate(token, ip string) (*models.AccessToken, error) {
+	if !strings.HasPrefix(token, models.AccessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+	record, err := as.tokenRepo.FindByHash(hashSessionToken(token))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAccessToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if record.Expired(now) {
+		return nil, ErrInvalidAccessToken
+	}
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) >= time.Minute || record.LastUsedIP != ip {
+		if err := as.tokenRepo.Touch(record.ID, now, ip); err != nil {
+			return nil, err
+		}
+		record.LastUsedAt = &now
+		record.LastUsedIP = ip
+	}
+	return record, nil
+}
+
+// normalizeScopes checks that a principal with role may hold every scope,
+// personal ones only if personal is set, and returns them sorted and without
+// duplicates
+func normalizeScopes(role string, personal bool, scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is needed", ErrInvalidScope)
+	}
+	seen := make(map[string]bool, len(scopes))
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		info, known := models.Scopes[scope]
+		if !known {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+		if info.Role != "" && role != info.Role {
+			return nil, fmt.Errorf("%w: %q needs the %s role", ErrInvalidScope, scope, info.Role)
+		}
+		if info.Personal && !personal {
+			return nil, fmt.Errorf("%w: %q is only for users", ErrInvalidScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrAccountNotFound is returned by an authenticator that has no
+	// account for the email, so that the next one in the chain is tried
+	ErrAccountNotFound = errors.New("account not found")
+	// ErrAuthenticatorUnavailable is returned by LoginUser (and whatever
+	// else checks a password) when no authenticator accepted the
+	// credentials and one of them couldn't be reached, so wrong credentials
+	// can't be told from an outage
+	ErrAuthenticatorUnavailable = errors.New("the login service is unavailable, please try again later")
+)
+
+// Authenticator checks the email and password of a login against one source
+// of accounts. UserService.LoginUser asks each authenticator of its chain in
+// turn until one knows the email; throttling, lockouts, second factors and
+// the login history are handled there for all of them.
+type Authenticator interface {
+	// Name identifies the authenticator in logs and the login history;
+	// "local" for the password stored with the account
+	Name() string
+	// Authenticate returns the account of the credentials. It fails with
+	// ErrAccountNotFound when it doesn't know the email, and with
+	// ErrInvalidCredentials when the password is wrong. On failures it may
+	// still return the account the email belongs to, for the login
+	// history.
+	Authenticate(email, password string) (*models.User, error)
+}
+
+// usernameInvalidChars are the characters dropped from usernames derived
+// from what an external source knows about a user
+var usernameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// localAuthenticator checks the password hash stored with the account
+type localAuthenticator struct {
+	userRepo repository.UserRepository
+	bus      pubsub.Bus
+	hashPool *password.Pool
+}
+
+// NewLocalAuthenticator creates the Authenticator for passwords stored with
+// accounts. Accounts without a password, like those created by a federated
+// login or the LDAP authenticator, are left to the next authenticator.
+func NewLocalAuthenticator(userRepo repository.UserRepository, bus pubsub.Bus, hashPool *password.Pool) Authenticator {
+	// Hash up front so the first unknown-email login isn't slower than the rest
+	dummyPasswordHash()
+
+	return &localAuthenticator{userRepo: userRepo, bus: bus, hashPool: hashPool}
+}
+
+// Name is "local"
+func (la *localAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate checks the password against the account's hash. It runs
+// exactly one password check (against a dummy hash when there is no usable
+// account), so response times don't reveal which emails are registered.
+func (la *localAuthenticator) Authenticate(email, password string) (*models.User, error) {
+	user, _ := la.userRepo.FindByEmail(email)
+
+	candidate := &models.User{Password: dummyPasswordHash()}
+	if user != nil && user.HasPassword() {
+		candidate = user
+	}
+	var passwordOK, rehashed bool
+	err := la.hashPool.Do(func() {
+		var needsRehash bool
+		passwordOK, needsRehash = candidate.VerifyPassword(password)
+		if passwordOK && needsRehash && candidate == user {
+			// Upgrade the stored hash while we know the plaintext
+			rehashed = la.rehash(user, password)
+		}
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case user == nil || !user.HasPassword():
+		return user, ErrAccountNotFound
+	case !passwordOK:
+		return user, ErrInvalidCredentials
+	}
+
+	if rehashed {
+		publishUserEvent(la.bus, pubsub.UserUpdated, user)
+	}
+	return user, nil
+}
+
+// rehash stores password hashed with the current algorithm in place of the
+// user's outdated hash. Failures are only logged: the old hash still works.
+func (la *localAuthenticator) rehash(user *models.User, password string) bool {
+	upgraded := *user
+	upgraded.Password = password
+	if err := upgraded.HashPassword(); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to rehash password")
+		return false
+	}
+	if err := la.userRepo.Update(&upgraded, user.Version); err != nil {
+		// Most likely a concurrent change; the next login tries again
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to store rehashed password")
+		return false
+	}
+	*user = upgraded
+	logrus.WithField("user_id", user.ID).Info("Upgraded password hash")
+	return true
+}
+
+// authenticateChain asks each authenticator in turn until one knows the
+// email, and returns the account with the name of that authenticator. It
+// fails with ErrAccountNotFound when none knows the email, and with
+// ErrAuthenticatorUnavailable when none accepted the credentials and one
+// couldn't be reached. On failures it may still return the account the
+// email belongs to.
+func authenticateChain(authenticators []Authenticator, email, password string) (*models.User, string, error) {
+	var user *models.User
+	var unavailable error
+	for _, authenticator := range authenticators {
+		found, err := authenticator.Authenticate(email, password)
+		if found != nil {
+			user = found
+		}
+		switch {
+		case hashPoolBusy(err):
+			return nil, "", err
+		case errors.Is(err, ErrAccountNotFound):
+			continue
+		case err != nil && !errors.Is(err, ErrInvalidCredentials):
+			logrus.WithError(err).WithField("authenticator", authenticator.Name()).Error("Authenticator failed")
+			unavailable = err
+			continue
+		}
+		return user, authenticator.Name(), err
+	}
+	if unavailable != nil {
+		return user, "", ErrAuthenticatorUnavailable
+	}
+	return user, "", ErrAccountNotFound
+}
+
+// hashPoolBusy reports whether err means the password hashing pool is
+// saturated, which the caller is told to retry rather than treated as an
+// outage
+func hashPoolBusy(err error) bool {
+	var busy *password.BusyError
+	return errors.As(err, &busy)
+}
+
+// provisionUser creates the account of a user an external source vouches
+// for, trying variations of the username until one is free. If a concurrent
+// login created the account for the email first, that one is returned with
+// created false.
+func provisionUser(userRepo repository.UserRepository, bus pubsub.Bus, user *models.User) (*models.User, bool, error) {
+	base := user.Username
+	for attempt := 1; ; attempt++ {
+		switch {
+		case attempt > 5:
+			user.Username = fmt.Sprintf("%s-%s", base, strings.ReplaceAll(uuid.New().String(), "-", "")[:8])
+		case attempt > 1:
+			user.Username = fmt.Sprintf("%s-%d", base, attempt)
+		}
+		err := userRepo.Create(user)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) || attempt > 5 {
+			return nil, false, err
+		}
+		// The username is taken, unless a concurrent login created the
+		// account
+		if existing, err := userRepo.FindByEmail(user.Email); err == nil {
+			return existing, false, nil
+		}
+		user.ID = 0
+	}
+
+	// Other instances may have cached that this email didn't exist
+	publishUserEvent(bus, pubsub.UserCreated, user)
+	return user, true, nil
+}
+
+// updateRole gives an account the role an external source maps its user
+// onto
+func updateRole(userRepo repository.UserRepository, bus pubsub.Bus, user *models.User, role string) (*models.User, error) {
+	updated := *user
+	updated.Role = role
+	if err := userRepo.Update(&updated, user.Version); err != nil {
+		return nil, translateRepoError(err)
+	}
+	publishUserEvent(bus, pubsub.UserRoleChanged, &updated)
+	return &updated, nil
+}
+
+// deriveUsername picks a username for a new account from the one an
+// external source prefers, or the email's local part
+func deriveUsername(preferred, email string) string {
+	username := preferred
+	if username == "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+	username = usernameInvalidChars.ReplaceAllString(username, "")
+	if len(username) > 40 {
+		username = username[:40]
+	}
+	if username == "" {
+		username = "user"
+	}
+	return username
+}
@@ -0,0 +1,555 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrProviderNotFound is returned for an identity provider that isn't
+	// configured
+	ErrProviderNotFound = errors.New("identity provider not found")
+	// ErrProviderUnavailable is returned when a provider's discovery
+	// document can't be fetched
+	ErrProviderUnavailable = errors.New("identity provider unavailable")
+	// ErrInvalidLoginState is returned when a provider's callback doesn't
+	// belong to a login this browser started, or the login took too long
+	ErrInvalidLoginState = errors.New("invalid or expired login, please start again")
+	// ErrFederatedLogin is returned when the provider refused the login or
+	// its answer didn't check out; the details are only logged
+	ErrFederatedLogin = errors.New("login with the identity provider failed")
+	// ErrUnverifiedEmail is returned when the provider doesn't vouch for the
+	// user's email, which accounts are matched by
+	ErrUnverifiedEmail = errors.New("the identity provider did not return a verified email address")
+	// ErrAccountNotLinkable is returned when the email belongs to an
+	// account that never verified it, so whoever registered it may not own
+	// the address
+	ErrAccountNotLinkable = errors.New("an account with this email exists, but has not verified it; verify it or log in with the password")
+	// ErrSignupDisabled is returned for an unknown email when the provider
+	// may not create accounts
+	ErrSignupDisabled = errors.New("no account with this email exists")
+	// ErrIdentityNotFound is returned for an identity the user hasn't linked
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrIdentityInUse is returned when the provider's user is linked to
+	// another account
+	ErrIdentityInUse = errors.New("this identity is linked to another account")
+	// ErrProviderAlreadyLinked is returned when the account is linked to
+	// another user of the provider
+	ErrProviderAlreadyLinked = errors.New("the account is linked to another identity of this provider; unlink it first")
+	// ErrLastLoginMethod is returned when unlinking an identity would leave
+	// the account without a way to log in
+	ErrLastLoginMethod = errors.New("this is the only way to log in to the account; set a password or link another identity first")
+	// ErrMergeConflict is returned when both accounts of a merge are linked
+	// to the same provider, or the duplicate's directory entry would join
+	// the local password of the account kept
+	ErrMergeConflict = errors.New("the accounts can't be merged: both are linked to the same provider, or the duplicate's directory entry would replace a local password")
+)
+
+// FederationProvider is an external OpenID Connect provider users can log
+// in with
+type FederationProvider struct {
+	// ID names the provider in URLs, e.g. /auth/oidc/{id}/login
+	ID   string
+	Name string
+	// Issuer is the provider's issuer URL; its discovery document is at
+	// Issuer + /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// AllowSignup creates an account on the first login of an email that
+	// has none
+	AllowSignup bool
+}
+
+// FederationConfig holds the settings of federated login
+type FederationConfig struct {
+	JWTSecret string
+	// AppURL is the base of the callback URLs registered with providers
+	AppURL string
+	// StateTTL is how long the user has to log in at the provider
+	StateTTL time.Duration
+	// HTTPClient talks to the providers
+	HTTPClient *http.Client
+}
+
+// FederatedLogin is the outcome of a login with an identity provider
+type FederatedLogin struct {
+	User *models.User
+	// Session asks for a session cookie instead of a JWT
+	Session bool
+	// Created is set when the login created the account
+	Created bool
+	// Linked is set instead of logging in when a logged-in user linked the
+	// provider's user to their account
+	Linked *models.Identity
+}
+
+// FederationService lets users log in with external OpenID Connect
+// providers. Accounts are matched by the identity linked to them, then by
+// the email the provider verified, and created on the first login if the
+// provider allows it.
+type FederationService interface {
+	// Providers lists the configured providers
+	Providers() []FederationProvider
+	// Begin starts a login with a provider. It returns the provider URL to
+	// send the browser to and a state token for the browser to keep until
+	// the callback.
+	Begin(providerID string, session bool) (string, string, error)
+	// BeginLink is Begin for linking the provider's user to an account; the
+	// caller re-authenticates the account's user first
+	BeginLink(providerID string, userID uint) (string, string, error)
+	// Complete finishes a login at the provider's callback with the state
+	// token kept by the browser and the callback's state and code
+	Complete(ctx context.Context, providerID, stateToken, state, code string, meta LoginMeta) (*FederatedLogin, error)
+	// Identities lists the identities linked to the user's account
+	Identities(userID uint) ([]models.Identity, error)
+	// Unlink removes an identity from the user's account, unless the
+	// account has no password or other identity to log in with
+	Unlink(userID, identityID uint) error
+	// Merge soft-deletes a duplicate account and moves its identities to
+	// the one kept; if the move fails, the duplicate is restored. It
+	// returns the identities of the account kept.
+	Merge(userID, duplicateID uint) ([]models.Identity, error)
+	// CallbackURL is the redirect URI to register with the provider
+	CallbackURL(providerID string) string
+	// StateTTL is how long state tokens work
+	StateTTL() time.Duration
+}
+
+// federatedAccounts finds, links and creates the accounts of users who log
+// in with an external identity provider, be it OpenID Connect or SAML
+type federatedAccounts struct {
+	userRepo     repository.UserRepository
+	identityRepo repository.IdentityRepository
+	history      LoginHistory
+	bus          pubsub.Bus
+}
+
+// federationServiceImpl is the concrete implementation of FederationService
+type federationServiceImpl struct {
+	federatedAccounts
+	providers []*remoteProvider
+	config    FederationConfig
+	jwtSecret []byte
+}
+
+// NewFederationService creates a new FederationService instance
+func NewFederationService(userRepo repository.UserRepository, identityRepo repository.IdentityRepository, history LoginHistory, bus pubsub.Bus, providers []FederationProvider, config FederationConfig) FederationService {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	remote := make([]*remoteProvider, len(providers))
+	for i, provider := range providers {
+		remote[i] = newRemoteProvider(provider, config.HTTPClient)
+	}
+	return &federationServiceImpl{
+		federatedAccounts: federatedAccounts{
+			userRepo:     userRepo,
+			identityRepo: identityRepo,
+			history:      history,
+			bus:          bus,
+		},
+		providers: remote,
+		config:    config,
+		jwtSecret: []byte(config.JWTSecret),
+	}
+}
+
+// Providers lists the configured providers
+func (fs *federationServiceImpl) Providers() []FederationProvider {
+	providers := make([]FederationProvider, len(fs.providers))
+	for i, provider := range fs.providers {
+		providers[i] = provider.config
+	}
+	return providers
+}
+
+// CallbackURL is the redirect URI of a provider
+func (fs *federationServiceImpl) CallbackURL(providerID string) string {
+	return fs.config.AppURL + "/auth/oidc/" + url.PathEscape(providerID) + "/callback"
+}
+
+// StateTTL is how long state tokens work
+func (fs *federationServiceImpl) StateTTL() time.Duration {
+	return fs.config.StateTTL
+}
+
+// Begin starts a login with a provider
+func (fs *federationServiceImpl) Begin(providerID string, session bool) (string, string, error) {
+	return fs.begin(providerID, session, 0)
+}
+
+// BeginLink starts linking a provider's user to the account of userID
+func (fs *federationServiceImpl) BeginLink(providerID string, userID uint) (string, string, error) {
+	return fs.begin(providerID, false, userID)
+}
+
+// begin builds the provider's authorization URL, with PKCE, and signs the
+// state, nonce and code verifier into the state token
+func (fs *federationServiceImpl) begin(providerID string, session bool, linkUserID uint) (string, string, error) {
+	provider := fs.provider(providerID)
+	if provider == nil {
+		return "", "", ErrProviderNotFound
+	}
+	metadata, err := provider.discover(context.Background())
+	if err != nil {
+		logrus.WithError(err).WithField("provider", providerID).Error("Identity provider unavailable")
+		return "", "", ErrProviderUnavailable
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		if secrets[i], err = randomToken(); err != nil {
+			return "", "", err
+		}
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+	now := time.Now()
+	stateToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &models.FederatedLoginClaims{
+		Purpose:      models.ClaimsPurposeFederatedLogin,
+		Provider:     providerID,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Session:      session,
+		LinkUserID:   linkUserID,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(fs.config.StateTTL).Unix(),
+		},
+	}).SignedString(fs.jwtSecret)
+	if err != nil {
+		return "", "", err
+	}
+
+	target, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := target.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.config.ClientID)
+	query.Set("redirect_uri", fs.CallbackURL(providerID))
+	query.Set("scope", strings.Join(provider.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	target.RawQuery = query.Encode()
+	return target.String(), stateToken, nil
+}
+
+// Complete checks the callback against the state token, redeems the code
+// and logs in the account of the ID token's user, or links them to the
+// account that started the link
+func (fs *federationServiceImpl) Complete(ctx context.Context, providerID, stateToken, state, code string, meta LoginMeta) (*FederatedLogin, error) {
+	provider := fs.provider(providerID)
+	if provider == nil {
+		return nil, ErrProviderNotFound
+	}
+	pending := &models.FederatedLoginClaims{}
+	parsed, err := jwt.ParseWithClaims(stateToken, pending, func(token *jwt.Token) (interface{}, error) {
+		return fs.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !parsed.Valid || pending.Purpose != models.ClaimsPurposeFederatedLogin ||
+		pending.Provider != providerID || pending.State == "" || pending.State != state {
+		return nil, ErrInvalidLoginState
+	}
+	log := logrus.WithField("provider", providerID)
+
+	tokens, err := provider.exchange(ctx, code, pending.CodeVerifier, fs.CallbackURL(providerID))
+	if err != nil {
+		log.WithError(err).Warn("Federated login failed")
+		return nil, ErrFederatedLogin
+	}
+	claims, err := provider.verify(ctx, tokens.IDToken, pending.Nonce)
+	if err != nil {
+		log.WithError(err).Warn("Federated login failed")
+		return nil, ErrFederatedLogin
+	}
+	if claims.Email == "" {
+		if err := provider.userInfo(ctx, tokens.AccessToken, claims); err != nil {
+			log.WithError(err).Warn("Federated login failed")
+			return nil, ErrFederatedLogin
+		}
+	}
+	if pending.LinkUserID != 0 {
+		identity, err := fs.link(pending.LinkUserID, providerID, claims)
+		if err != nil {
+			return nil, err
+		}
+		return &FederatedLogin{Linked: identity}, nil
+	}
+
+	user, created, err := fs.login(providerID, provider.config.AllowSignup, claims, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &FederatedLogin{User: user, Session: pending.Session, Created: created}, nil
+}
+
+// login logs in the account of the provider's user and records the
+// outcome in the login history
+func (fa *federatedAccounts) login(providerID string, allowSignup bool, claims *providerClaims, meta LoginMeta) (*models.User, bool, error) {
+	log := logrus.WithField("provider", providerID)
+	user, created, err := fa.resolveUser(providerID, allowSignup, claims)
+	record := LoginRecord{User: user, Email: claims.Email, Provider: providerID, Meta: meta}
+	switch {
+	case errors.Is(err, ErrUnverifiedEmail):
+		log.WithField("subject", claims.Subject).Warn("Federated login without a verified email")
+		return nil, false, err
+	case errors.Is(err, ErrAccountNotLinkable):
+		record.Reason = models.LoginReasonEmailNotVerified
+		fa.history.Record(record)
+		return nil, false, err
+	case errors.Is(err, ErrSignupDisabled):
+		record.Reason = models.LoginReasonUnknownEmail
+		fa.history.Record(record)
+		return nil, false, err
+	case err != nil:
+		return nil, false, err
+	}
+
+	if user.MFAEnabled() {
+		// CompleteChallenge records the success, and judges it
+		record.Reason = models.LoginReasonMFAPending
+	} else {
+		record.Success = true
+	}
+	fa.history.Record(record)
+	log.WithFields(logrus.Fields{"user_id": user.ID, "subject": claims.Subject}).Info("Federated login")
+	return user, created, nil
+}
+
+// resolveUser finds the account linked to the provider's user. Failing
+// that, it links the account with the verified email, or creates one. An
+// existing account is only matched if it verified the email itself:
+// otherwise whoever registered it, maybe before its real owner, would share
+// it with the provider's user. On an error the account found, if any, is
+// still returned for the login history.
+func (fa *federatedAccounts) resolveUser(providerID string, allowSignup bool, claims *providerClaims) (*models.User, bool, error) {
+	identity, err := fa.identityRepo.FindBySubject(providerID, claims.Subject)
+	if err == nil {
+		user, err := fa.userRepo.FindByID(identity.UserID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logrus.WithFields(logrus.Fields{"user_id": identity.UserID, "provider": providerID}).
+				Warn("Federated login to a deleted account")
+			return nil, false, ErrFederatedLogin
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if claims.Email != "" && claims.Email != identity.Email {
+			if err := fa.identityRepo.UpdateEmail(identity.ID, claims.Email); err != nil {
+				logrus.WithError(err).WithField("identity_id", identity.ID).Warn("Failed to update identity email")
+			}
+		}
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return nil, false, ErrUnverifiedEmail
+	}
+
+	user, err := fa.userRepo.FindByEmail(claims.Email)
+	if err == nil {
+		if user.VerifiedAt == nil {
+			return user, false, ErrAccountNotLinkable
+		}
+		if _, err := fa.createIdentity(user.ID, providerID, claims); err != nil {
+			return user, false, err
+		}
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+	if !allowSignup {
+		return nil, false, ErrSignupDisabled
+	}
+
+	now := time.Now()
+	user, created, err := provisionUser(fa.userRepo, fa.bus, &models.User{
+		Username:   deriveUsername(claims.PreferredUsername, claims.Email),
+		Email:      claims.Email,
+		Role:       models.RoleUser,
+		VerifiedAt: &now,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "provider": providerID}).Info("Account created by federated login")
+	}
+	if _, err := fa.createIdentity(user.ID, providerID, claims); err != nil {
+		return user, created, err
+	}
+	return user, created, nil
+}
+
+// link links the provider's user to the account of userID
+func (fa *federatedAccounts) link(userID uint, providerID string, claims *providerClaims) (*models.Identity, error) {
+	if _, err := fa.userRepo.FindByID(userID); err != nil {
+		return nil, translateRepoError(err)
+	}
+	identity, err := fa.createIdentity(userID, providerID, claims)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "provider": providerID, "subject": claims.Subject}).Info("Identity linked")
+	return identity, nil
+}
+
+// createIdentity links the provider's user to the account of userID. It
+// succeeds if they are linked already.
+func (fa *federatedAccounts) createIdentity(userID uint, providerID string, claims *providerClaims) (*models.Identity, error) {
+	identity := &models.Identity{
+		UserID:   userID,
+		Provider: providerID,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	}
+	err := fa.identityRepo.Create(identity)
+	if err == nil {
+		return identity, nil
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, err
+	}
+	existing, findErr := fa.identityRepo.FindBySubject(providerID, claims.Subject)
+	switch {
+	case findErr == nil && existing.UserID == userID:
+		return existing, nil
+	case findErr == nil:
+		return nil, ErrIdentityInUse
+	default:
+		return nil, ErrProviderAlreadyLinked
+	}
+}
+
+// Identities lists the identities linked to the user's account
+func (fs *federationServiceImpl) Identities(userID uint) ([]models.Identity, error) {
+	if _, err := fs.userRepo.FindByID(userID); err != nil {
+		return nil, translateRepoError(err)
+	}
+	return fs.identityRepo.ListByUser(userID)
+}
+
+// Unlink removes an identity from the user's account
+func (fs *federationServiceImpl) Unlink(userID, identityID uint) error {
+	user, err := fs.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	identities, err := fs.identityRepo.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(identities, func(identity models.Identity) bool { return identity.ID == identityID }) {
+		return ErrIdentityNotFound
+	}
+	// A directory entry is a way to log in too, so it counts below, but it
+	// can't be unlinked: the account could then get a local password the
+	// directory knows nothing about
+	for _, identity := range identities {
+		if identity.ID == identityID && identity.Provider == LDAPProvider {
+			return ErrDirectoryAccount
+		}
+	}
+	if !user.HasPassword() && len(identities) == 1 {
+		return ErrLastLoginMethod
+	}
+
+	if err := fs.identityRepo.Delete(userID, identityID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrIdentityNotFound
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": userID, "identity_id": identityID}).Info("Identity unlinked")
+	return nil
+}
+
+// Merge moves the identities of a duplicate account to the one kept and
+// soft-deletes the duplicate, which can still be restored. Only the
+// identities move: the account kept keeps its own password, email, role and
+// second factor, and the duplicate's tokens stop working with it. An LDAP
+// entry only moves onto an account without a local password.
+func (fs *federationServiceImpl) Merge(userID, duplicateID uint) ([]models.Identity, error) {
+	user, err := fs.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	duplicate, err := fs.userRepo.FindByID(duplicateID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	kept, err := fs.identityRepo.ListByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := fs.identityRepo.ListByUser(duplicateID)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range moved {
+		if slices.ContainsFunc(kept, func(other models.Identity) bool { return other.Provider == identity.Provider }) {
+			return nil, ErrMergeConflict
+		}
+		// A directory entry's password replaces the local one, which would
+		// otherwise keep working, unchangeable, alongside it
+		if identity.Provider == LDAPProvider && user.HasPassword() {
+			return nil, ErrMergeConflict
+		}
+	}
+
+	// The repositories share no transaction, so delete the duplicate first:
+	// a concurrent change to it then fails the merge before anything moved,
+	// and a failed move can be undone by restoring it
+	if err := fs.userRepo.Delete(duplicateID, duplicate.Version); err != nil {
+		return nil, translateRepoError(err)
+	}
+	if err := fs.identityRepo.Reassign(duplicateID, userID); err != nil {
+		if restoreErr := fs.userRepo.Restore(duplicateID); restoreErr != nil {
+			logrus.WithError(restoreErr).WithField("user_id", duplicateID).Error("Failed to restore the duplicate of a failed merge")
+		}
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			// The account kept linked the same provider in the meantime
+			return nil, ErrMergeConflict
+		}
+		return nil, err
+	}
+	publishUserEvent(fs.bus, pubsub.UserDeleted, duplicate)
+	logrus.WithFields(logrus.Fields{"user_id": userID, "duplicate_id": duplicateID, "identities": len(moved)}).Info("Accounts merged")
+	return fs.identityRepo.ListByUser(userID)
+}
+
+// provider returns the configured provider with the ID, or nil
+func (fs *federationServiceImpl) provider(id string) *remoteProvider {
+	for _, provider := range fs.providers {
+		if provider.config.ID == id {
+			return provider
+		}
+	}
+	return nil
+}
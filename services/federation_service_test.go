@@ -0,0 +1,452 @@
+package services_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+)
+
+// mockIdPUser is who the mock IdP logs in next, and how it misbehaves
+type mockIdPUser struct {
+	Subject       string
+	Email         string
+	EmailVerified interface{}
+	Username      string
+	// UserInfoOnly leaves the email out of the ID token
+	UserInfoOnly bool
+	// Nonce and Audience replace the right ones in the ID token
+	Nonce    string
+	Audience string
+	// ForeignKey signs the ID token with a key the JWKS doesn't have
+	ForeignKey bool
+}
+
+type mockIdPGrant struct {
+	user      mockIdPUser
+	nonce     string
+	challenge string
+	redirect  string
+}
+
+// mockIdP is a minimal OpenID Connect provider: its authorization endpoint
+// logs in whoever Next says at once, and its tokens are signed with a key
+// made for the test
+type mockIdP struct {
+	*httptest.Server
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	foreignKey   *rsa.PrivateKey
+
+	mu     sync.Mutex
+	next   mockIdPUser
+	codes  map[string]mockIdPGrant
+	tokens map[string]mockIdPUser
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := &mockIdP{
+		clientID:     "gin",
+		clientSecret: "s3cret",
+		codes:        map[string]mockIdPGrant{},
+		tokens:       map[string]mockIdPUser{},
+	}
+	var err error
+	if idp.key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	if idp.foreignKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/userinfo", idp.userInfo)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// Next sets who the next login is for
+func (idp *mockIdP) Next(user mockIdPUser) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.next = user
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"userinfo_endpoint":      idp.URL + "/userinfo",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "use": "sig", "kid": "k1", "alg": "RS256",
+		"n": b64(idp.key.N.Bytes()), "e": b64(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != idp.clientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	code := randomString()
+	idp.codes[code] = mockIdPGrant{idp.next, query.Get("nonce"), query.Get("code_challenge"), query.Get("redirect_uri")}
+	idp.mu.Unlock()
+
+	target, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	target.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if id, secret, ok := r.BasicAuth(); !ok || id != idp.clientID || secret != idp.clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	grant, found := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || b64(sum[:]) != grant.challenge || grant.redirect != r.PostFormValue("redirect_uri") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	user := grant.user
+	accessToken := randomString()
+	idp.tokens[accessToken] = user
+	claims := map[string]interface{}{
+		"iss":                idp.URL,
+		"sub":                user.Subject,
+		"aud":                idp.clientID,
+		"nonce":              grant.nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"preferred_username": user.Username,
+	}
+	if user.Nonce != "" {
+		claims["nonce"] = user.Nonce
+	}
+	if user.Audience != "" {
+		claims["aud"] = user.Audience
+	}
+	if !user.UserInfoOnly {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	key := idp.key
+	if user.ForeignKey {
+		key = idp.foreignKey
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"id_token":     signJWT(key, claims),
+	})
+}
+
+func (idp *mockIdP) userInfo(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	auth := r.Header.Get("Authorization")
+	user, ok := idp.tokens[auth[min(len(auth), len("Bearer ")):]]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"sub": user.Subject, "email": user.Email, "email_verified": user.EmailVerified})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64(b)
+}
+
+// signJWT signs claims with RS256 under the key ID the JWKS publishes
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	return signed + "." + b64(signature)
+}
+
+// newFederationService returns a federation service with the mock IdP as
+// provider "corp"
+func newFederationService(t *testing.T, env *testEnv, idp *mockIdP, allowSignup bool) services.FederationService {
+	t.Helper()
+	return services.NewFederationService(env.userRepo, env.identityRepo, env.history, env.bus, []services.FederationProvider{{
+		ID:           "corp",
+		Name:         "Corp",
+		Issuer:       idp.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.clientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+		AllowSignup:  allowSignup,
+	}}, services.FederationConfig{
+		JWTSecret: "test-secret",
+		AppURL:    "https://app.example.com",
+		StateTTL:  time.Minute,
+	})
+}
+
+// federatedLogin runs a login with the mock IdP as user and returns its
+// outcome
+func federatedLogin(t *testing.T, federation services.FederationService, idp *mockIdP, user mockIdPUser) (*services.FederatedLogin, error) {
+	t.Helper()
+	idp.Next(user)
+	authURL, stateToken, err := federation.Begin("corp", false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize at the IdP: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("IdP answered %d, %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != federation.CallbackURL("corp") {
+		t.Fatalf("IdP redirected to %s, want the callback", got)
+	}
+	query := callback.Query()
+	return federation.Complete(context.Background(), "corp", stateToken, query.Get("state"), query.Get("code"), services.LoginMeta{IP: "192.0.2.1"})
+}
+
+func TestFederatedLoginCreatesAndLinksAccounts(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newMockIdP(t)
+	federation := newFederationService(t, env, idp, true)
+
+	// The first login creates a verified account, linked to the subject
+	login, err := federatedLogin(t, federation, idp, mockIdPUser{Subject: "u-1", Email: "carol@corp.example", EmailVerified: true, Username: "carol"})
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if !login.Created || login.User.Email != "carol@corp.example" || login.User.VerifiedAt == nil {
+		t.Fatalf("first login = %+v, want a new verified account", login)
+	}
+	identities, err := federation.Identities(login.User.ID)
+	if err != nil || len(identities) != 1 || identities[0].Provider != "corp" || identities[0].Subject != "u-1" {
+		t.Fatalf("identities = %+v, %v", identities, err)
+	}
+
+	// The subject finds the account again, even with a new email
+	again, err := federatedLogin(t, federation, idp, mockIdPUser{Subject: "u-1", Email: "carol@new.example", EmailVerified: "true"})
+	if err != nil || again.Created || again.User.ID != login.User.ID {
+		t.Fatalf("second login = %+v, %v, want the same account", again, err)
+	}
+
+	// A verified email links an existing account
+	alice := createUser(t, env.userRepo, "alice", "correct horse 1")
+	linked, err := federatedLogin(t, federation, idp, mockIdPUser{Subject: "u-2", Email: alice.Email, EmailVerified: true})
+	if err != nil || linked.Created || linked.User.ID != alice.ID {
+		t.Fatalf("login with alice's email = %+v, %v, want alice's account", linked, err)
+	}
+
+	// Emails only in userinfo count too
+	fromUserInfo, err := federatedLogin(t, federation, idp, mockIdPUser{Subject: "u-3", Email: "dave@corp.example", EmailVerified: true, UserInfoOnly: true})
+	if err != nil || fromUserInfo.User.Email != "dave@corp.example" {
+		t.Fatalf("login with the email in userinfo = %+v, %v", fromUserInfo, err)
+	}
+}
+
+func TestFederatedLoginRejectsBadAnswers(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newMockIdP(t)
+	federation := newFederationService(t, env, idp, true)
+	unverified := createUser(t, env.userRepo, "bob", "correct horse 1")
+	unverified.VerifiedAt = nil
+	if err := env.userRepo.Update(unverified, unverified.Version); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		user mockIdPUser
+		want error
+	}{
+		{"wrong nonce", mockIdPUser{Subject: "x", Email: "x@corp.example", EmailVerified: true, Nonce: "replayed"}, services.ErrFederatedLogin},
+		{"wrong audience", mockIdPUser{Subject: "x", Email: "x@corp.example", EmailVerified: true, Audience: "someone-else"}, services.ErrFederatedLogin},
+		{"unknown signing key", mockIdPUser{Subject: "x", Email: "x@corp.example", EmailVerified: true, ForeignKey: true}, services.ErrFederatedLogin},
+		{"unverified email", mockIdPUser{Subject: "x", Email: "x@corp.example", EmailVerified: false}, services.ErrUnverifiedEmail},
+		{"account never verified its email", mockIdPUser{Subject: "x", Email: unverified.Email, EmailVerified: true}, services.ErrAccountNotLinkable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := federatedLogin(t, federation, idp, tt.user)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %+v, %v, want %v", login, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := env.userRepo.FindByEmail("x@corp.example"); err == nil {
+		t.Error("a rejected login created an account")
+	}
+
+	// The callback must carry the state the login started with
+	idp.Next(mockIdPUser{Subject: "x", Email: "x@corp.example", EmailVerified: true})
+	_, stateToken, err := federation.Begin("corp", false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := federation.Complete(context.Background(), "corp", stateToken, "forged", "code", services.LoginMeta{}); !errors.Is(err, services.ErrInvalidLoginState) {
+		t.Errorf("forged state: got %v, want ErrInvalidLoginState", err)
+	}
+}
+
+func TestFederatedLoginWithoutSignup(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newMockIdP(t)
+	federation := newFederationService(t, env, idp, false)
+
+	if _, err := federatedLogin(t, federation, idp, mockIdPUser{Subject: "u-1", Email: "carol@corp.example", EmailVerified: true}); !errors.Is(err, services.ErrSignupDisabled) {
+		t.Errorf("unknown email: got %v, want ErrSignupDisabled", err)
+	}
+	if _, err := env.userRepo.FindByEmail("carol@corp.example"); err == nil {
+		t.Error("a provider without signup created an account")
+	}
+}
+
+// linkingIdentityRepository links the account kept to a provider just
+// before a merge moves identities to it, the way a concurrent login would
+type linkingIdentityRepository struct {
+	repository.IdentityRepository
+	provider string
+}
+
+func (lr *linkingIdentityRepository) Reassign(fromUserID, toUserID uint) error {
+	if err := lr.Create(&models.Identity{UserID: toUserID, Provider: lr.provider, Subject: "late", LinkedAt: time.Now()}); err != nil {
+		return err
+	}
+	return lr.IdentityRepository.Reassign(fromUserID, toUserID)
+}
+
+func TestMergeIsAllOrNothing(t *testing.T) {
+	link := func(t *testing.T, repo repository.IdentityRepository, user *models.User, provider string) {
+		t.Helper()
+		if err := repo.Create(&models.Identity{UserID: user.ID, Provider: provider, Subject: user.Username, LinkedAt: time.Now()}); err != nil {
+			t.Fatalf("link %s to %s: %v", provider, user.Username, err)
+		}
+	}
+	unmerged := func(t *testing.T, env *testEnv, duplicate *models.User, identities int) {
+		t.Helper()
+		if _, err := env.userRepo.FindByID(duplicate.ID); err != nil {
+			t.Errorf("duplicate after a failed merge: %v", err)
+		}
+		if moved, err := env.identityRepo.ListByUser(duplicate.ID); err != nil || len(moved) != identities {
+			t.Errorf("duplicate's identities after a failed merge = %+v, %v, want %d", moved, err, identities)
+		}
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		env := newTestEnv(t, repository.NewMemoryUserRepository())
+		federation := newFederationService(t, env, newMockIdP(t), true)
+		alice := createUser(t, env.userRepo, "alice", "correct horse 1")
+		duplicate := createUser(t, env.userRepo, "alice2", "correct horse 2")
+		link(t, env.identityRepo, alice, "corp")
+		link(t, env.identityRepo, duplicate, "other")
+
+		identities, err := federation.Merge(alice.ID, duplicate.ID)
+		if err != nil || len(identities) != 2 {
+			t.Fatalf("Merge = %+v, %v, want both identities", identities, err)
+		}
+		if _, err := env.userRepo.FindByID(duplicate.ID); err == nil {
+			t.Error("the duplicate is still there")
+		}
+	})
+
+	t.Run("duplicate changed", func(t *testing.T) {
+		env := newTestEnv(t, &racingUserRepository{UserRepository: repository.NewMemoryUserRepository(), conflicts: 1})
+		federation := newFederationService(t, env, newMockIdP(t), true)
+		alice := createUser(t, env.userRepo, "alice", "correct horse 1")
+		duplicate := createUser(t, env.userRepo, "alice2", "correct horse 2")
+		link(t, env.identityRepo, duplicate, "corp")
+
+		if _, err := federation.Merge(alice.ID, duplicate.ID); !errors.Is(err, services.ErrVersionConflict) {
+			t.Fatalf("Merge: got %v, want ErrVersionConflict", err)
+		}
+		unmerged(t, env, duplicate, 1)
+	})
+
+	t.Run("kept account linked the same provider", func(t *testing.T) {
+		env := newTestEnv(t, repository.NewMemoryUserRepository())
+		env.identityRepo = &linkingIdentityRepository{IdentityRepository: env.identityRepo, provider: "corp"}
+		federation := newFederationService(t, env, newMockIdP(t), true)
+		alice := createUser(t, env.userRepo, "alice", "correct horse 1")
+		duplicate := createUser(t, env.userRepo, "alice2", "correct horse 2")
+		link(t, env.identityRepo, duplicate, "corp")
+		link(t, env.identityRepo, duplicate, "other")
+
+		if _, err := federation.Merge(alice.ID, duplicate.ID); !errors.Is(err, services.ErrMergeConflict) {
+			t.Fatalf("Merge: got %v, want ErrMergeConflict", err)
+		}
+		unmerged(t, env, duplicate, 2)
+	})
+
+	t.Run("directory entry onto a local password", func(t *testing.T) {
+		env := newTestEnv(t, repository.NewMemoryUserRepository())
+		federation := newFederationService(t, env, newMockIdP(t), true)
+		alice := createUser(t, env.userRepo, "alice", "correct horse 1")
+		duplicate := &models.User{Username: "alice2", Email: "alice2@example.com"}
+		if err := env.userRepo.Create(duplicate); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		link(t, env.identityRepo, duplicate, services.LDAPProvider)
+
+		if _, err := federation.Merge(alice.ID, duplicate.ID); !errors.Is(err, services.ErrMergeConflict) {
+			t.Fatalf("Merge: got %v, want ErrMergeConflict", err)
+		}
+		unmerged(t, env, duplicate, 1)
+		if err := env.users.ChangePassword(alice.ID, "correct horse 1", "correct horse 3"); err != nil {
+			t.Errorf("ChangePassword of the account kept: %v", err)
+		}
+	})
+}
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// LDAPProvider is the provider of the identity that links an account to its
+// directory entry. It marks the accounts whose password lives in the
+// directory, which can't be changed or reset here.
+const LDAPProvider = "ldap"
+
+// LDAPConfig holds the settings of the LDAP authenticator
+type LDAPConfig struct {
+	// URL is the server, ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS before binding
+	StartTLS bool
+	// TLSConfig verifies the server for ldaps:// and StartTLS; the system
+	// roots when nil
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account that looks up users;
+	// lookups are anonymous when BindDN is empty
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched
+	BaseDN string
+	// UserFilter finds the entry of the email a user logs in with; %s is
+	// replaced by the escaped email, e.g. (&(objectClass=person)(mail=%s))
+	UserFilter string
+	// EmailAttribute and UsernameAttribute are read from the entry for
+	// the account, e.g. mail and uid (sAMAccountName on Active Directory)
+	EmailAttribute    string
+	UsernameAttribute string
+	// GroupFilter finds the groups of a user below GroupBaseDN (BaseDN if
+	// empty); %s is replaced by the escaped DN of the user's entry, e.g.
+	// (member=%s). When empty, the entry's memberOf attribute is read.
+	GroupBaseDN string
+	GroupFilter string
+	// AdminGroups are the DNs of the groups whose members get the admin
+	// role; everyone else gets the user role. Roles are left alone when
+	// empty.
+	AdminGroups []string
+	// AllowSignup creates an account on the first login of a directory
+	// user who has none
+	AllowSignup bool
+	// Timeout limits connecting and each request
+	Timeout time.Duration
+}
+
+// ldapAuthenticator checks passwords by binding to an LDAP directory, such
+// as Active Directory, as the user
+type ldapAuthenticator struct {
+	userRepo     repository.UserRepository
+	identityRepo repository.IdentityRepository
+	bus          pubsub.Bus
+	config       LDAPConfig
+	adminGroups  []*ldap.DN
+}
+
+// NewLDAPAuthenticator creates the Authenticator for users of an LDAP
+// directory. It looks up the entry of the email with the service account,
+// binds as the entry with the password, and logs in the account with the
+// entry's email, creating it on the first login. The account is linked to
+// the entry with an identity of LDAPProvider.
+func NewLDAPAuthenticator(userRepo repository.UserRepository, identityRepo repository.IdentityRepository, bus pubsub.Bus, config LDAPConfig) (Authenticator, error) {
+	server, err := url.Parse(config.URL)
+	if err != nil || (server.Scheme != "ldap" && server.Scheme != "ldaps") || server.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", config.URL)
+	}
+	if config.StartTLS && server.Scheme == "ldaps" {
+		return nil, errors.New("StartTLS only applies to ldap:// URLs")
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, errors.New("the LDAP user filter must contain %s for the email")
+	}
+	if config.GroupFilter != "" && !strings.Contains(config.GroupFilter, "%s") {
+		return nil, errors.New("the LDAP group filter must contain %s for the user's DN")
+	}
+	adminGroups := make([]*ldap.DN, len(config.AdminGroups))
+	for i, group := range config.AdminGroups {
+		if adminGroups[i], err = ldap.ParseDN(group); err != nil {
+			return nil, fmt.Errorf("invalid admin group %q: %w", group, err)
+		}
+	}
+
+	if config.TLSConfig == nil {
+		config.TLSConfig = &tls.Config{}
+	}
+	if config.TLSConfig.ServerName == "" {
+		// StartTLS can't tell the name from the connection
+		config.TLSConfig = config.TLSConfig.Clone()
+		config.TLSConfig.ServerName = server.Hostname()
+	}
+	if config.GroupBaseDN == "" {
+		config.GroupBaseDN = config.BaseDN
+	}
+	return &ldapAuthenticator{
+		userRepo:     userRepo,
+		identityRepo: identityRepo,
+		bus:          bus,
+		config:       config,
+		adminGroups:  adminGroups,
+	}, nil
+}
+
+// Name is LDAPProvider
+func (la *ldapAuthenticator) Name() string {
+	return LDAPProvider
+}
+
+// Authenticate binds as the directory entry of the email
+func (la *ldapAuthenticator) Authenticate(email, password string) (*models.User, error) {
+	conn, err := la.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := la.findEntry(conn, email)
+	if err != nil {
+		return nil, err
+	}
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if password == "" {
+		user, _ := la.userRepo.FindByEmail(email)
+		return user, ErrInvalidCredentials
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			user, _ := la.userRepo.FindByEmail(email)
+			return user, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("bind as %s: %w", entry.DN, err)
+	}
+
+	role := ""
+	if len(la.adminGroups) > 0 {
+		groups, err := la.groups(conn, entry)
+		if err != nil {
+			return nil, err
+		}
+		role = la.role(groups)
+	}
+	user, err := la.account(entry, email, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := la.link(user, entry); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// connect dials the server, upgrades the connection with StartTLS if asked
+// to, and binds as the service account
+func (la *ldapAuthenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(la.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: la.config.Timeout}),
+		ldap.DialWithTLSConfig(la.config.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(la.config.Timeout)
+	if la.config.StartTLS {
+		if err := conn.StartTLS(la.config.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+	}
+	if err := la.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bindService binds as the service account, if there is one
+func (la *ldapAuthenticator) bindService(conn *ldap.Conn) error {
+	if la.config.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(la.config.BindDN, la.config.BindPassword); err != nil {
+		return fmt.Errorf("bind as the service account: %w", err)
+	}
+	return nil
+}
+
+// findEntry returns the only entry the user filter matches for the email,
+// or fails with ErrAccountNotFound
+func (la *ldapAuthenticator) findEntry(conn *ldap.Conn, email string) (*ldap.Entry, error) {
+	attributes := []string{la.config.EmailAttribute, la.config.UsernameAttribute}
+	if la.config.GroupFilter == "" {
+		attributes = append(attributes, "memberOf")
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		la.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(la.config.Timeout.Seconds()), false,
+		strings.ReplaceAll(la.config.UserFilter, "%s", ldap.EscapeFilter(email)),
+		attributes, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(result.Entries) > 1) {
+		// Better no login than one into whichever entry came first
+		logrus.WithField("email", email).Warn("LDAP user filter matches several entries")
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("search for the user: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrAccountNotFound
+	}
+	return result.Entries[0], nil
+}
+
+// groups returns the DNs of the groups the entry is a member of. The
+// connection is bound as the user by then, who may not see the groups, so
+// it is bound as the service account again first.
+func (la *ldapAuthenticator) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if la.config.GroupFilter == "" {
+		return entry.GetAttributeValues("memberOf"), nil
+	}
+	if err := la.bindService(conn); err != nil {
+		return nil, err
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		la.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(la.config.Timeout.Seconds()), false,
+		strings.ReplaceAll(la.config.GroupFilter, "%s", ldap.EscapeFilter(entry.DN)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search for the user's groups: %w", err)
+	}
+	groups := make([]string, len(result.Entries))
+	for i, group := range result.Entries {
+		groups[i] = group.DN
+	}
+	return groups, nil
+}
+
+// role maps the groups onto the role of the account
+func (la *ldapAuthenticator) role(groups []string) string {
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		if err != nil {
+			continue
+		}
+		for _, admin := range la.adminGroups {
+			if dn.EqualFold(admin) {
+				return models.RoleAdmin
+			}
+		}
+	}
+	return models.RoleUser
+}
+
+// account returns the account linked to the entry or, for an entry not
+// linked yet, the account of its email, creating it on the first login. It
+// updates the role if role is set.
+func (la *ldapAuthenticator) account(entry *ldap.Entry, email, role string) (*models.User, error) {
+	if value := entry.GetAttributeValue(la.config.EmailAttribute); value != "" {
+		email = value
+	}
+	user, err := la.linkedAccount(entry, email)
+	if err == nil {
+		if role == "" || user.Role == role {
+			return user, nil
+		}
+		updated, err := updateRole(la.userRepo, la.bus, user, role)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "role": role}).Info("Role updated from LDAP groups")
+		return updated, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if !la.config.AllowSignup {
+		logrus.WithField("dn", entry.DN).Info("LDAP user has no account and signup is disabled")
+		return nil, ErrAccountNotFound
+	}
+
+	if role == "" {
+		role = models.RoleUser
+	}
+	now := time.Now()
+	user, created, err := provisionUser(la.userRepo, la.bus, &models.User{
+		Username: deriveUsername(entry.GetAttributeValue(la.config.UsernameAttribute), email),
+		Email:    email,
+		Role:     role,
+		// The directory vouches for the email
+		VerifiedAt: &now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "dn": entry.DN}).Info("Account created by LDAP login")
+	}
+	return user, nil
+}
+
+// linkedAccount finds the account of the entry by its DN, and only then by
+// email. An account of the email that is linked to another entry belongs to
+// whoever had the email before the directory gave it to this entry.
+func (la *ldapAuthenticator) linkedAccount(entry *ldap.Entry, email string) (*models.User, error) {
+	identity, err := la.identityRepo.FindBySubject(LDAPProvider, entry.DN)
+	if err == nil {
+		user, err := la.userRepo.FindByID(identity.UserID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Deleted; a new account would not be linkable either
+			return nil, ErrAccountNotFound
+		}
+		return user, err
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	user, err := la.userRepo.FindByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := ldapSubject(la.identityRepo, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if subject != "" && !sameDN(subject, entry.DN) {
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "dn": entry.DN, "linked_dn": subject}).
+			Warn("Account of the LDAP entry's email is linked to another entry")
+		return nil, ErrAccountNotFound
+	}
+	return user, nil
+}
+
+// link records that the account belongs to the entry, unless it is linked
+// already. Accounts from before the link was recorded get it at their next
+// login.
+func (la *ldapAuthenticator) link(user *models.User, entry *ldap.Entry) error {
+	subject, err := ldapSubject(la.identityRepo, user.ID)
+	if err != nil || subject != "" {
+		return err
+	}
+	err = la.identityRepo.Create(&models.Identity{
+		UserID:   user.ID,
+		Provider: LDAPProvider,
+		Subject:  entry.DN,
+		Email:    user.Email,
+		LinkedAt: time.Now(),
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// A concurrent login linked it, to this entry or to another one
+		// with the same email, or the entry is linked to another account
+		subject, err := ldapSubject(la.identityRepo, user.ID)
+		if err != nil || sameDN(subject, entry.DN) {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "dn": entry.DN}).Warn("LDAP entry or account is linked elsewhere")
+		return ErrAccountNotFound
+	}
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"user_id": user.ID, "dn": entry.DN}).Info("Account linked to its LDAP entry")
+	return nil
+}
+
+// ldapSubject returns the DN of the entry the account is linked to, or ""
+func ldapSubject(identityRepo repository.IdentityRepository, userID uint) (string, error) {
+	identities, err := identityRepo.ListByUser(userID)
+	if err != nil {
+		return "", err
+	}
+	for _, identity := range identities {
+		if identity.Provider == LDAPProvider {
+			return identity.Subject, nil
+		}
+	}
+	return "", nil
+}
+
+// sameDN compares DNs the way the directory does, ignoring case and spacing
+func sameDN(a, b string) bool {
+	parsedA, errA := ldap.ParseDN(a)
+	parsedB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return parsedA.EqualFold(parsedB)
+}
+
+// directoryManaged reports whether the account is linked to an LDAP entry,
+// whose password is the account's
+func directoryManaged(identityRepo repository.IdentityRepository, userID uint) (bool, error) {
+	subject, err := ldapSubject(identityRepo, userID)
+	return subject != "", err
+}
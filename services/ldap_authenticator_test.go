@@ -0,0 +1,356 @@
+package services_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/pquerna/otp/totp"
+)
+
+// fakeLDAPEntry is an entry of the fake directory; entries without a
+// password can't be bound as
+type fakeLDAPEntry struct {
+	dn, password string
+	attributes   map[string][]string
+}
+
+// fakeLDAP is a directory server that knows just enough of the protocol for
+// the LDAP authenticator: simple binds, and searches with equality filters
+type fakeLDAP struct {
+	listener net.Listener
+	entries  []fakeLDAPEntry
+}
+
+func newFakeLDAP(t *testing.T, entries ...fakeLDAPEntry) *fakeLDAP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &fakeLDAP{listener: listener, entries: entries}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (fl *fakeLDAP) URL() string {
+	return "ldap://" + fl.listener.Addr().String()
+}
+
+func (fl *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldapBindRequest:
+			conn.Write(ldapResult(id, ldapBindResponse, fl.bind(op.Children[1].Data.String(), op.Children[2].Data.String())).Bytes())
+		case ldapSearchRequest:
+			base := strings.ToLower(op.Children[0].Data.String())
+			filter := map[string]string{}
+			equalities(op.Children[6], filter)
+			for _, entry := range fl.entries {
+				if strings.HasSuffix(strings.ToLower(entry.dn), base) && entry.matches(filter) {
+					conn.Write(ldapSearchEntry(id, entry).Bytes())
+				}
+			}
+			conn.Write(ldapResult(id, ldapSearchDone, 0).Bytes())
+		default:
+			// Unbind, or something the authenticator doesn't send
+			return
+		}
+	}
+}
+
+// bind returns the result code of a simple bind
+func (fl *fakeLDAP) bind(dn, password string) int64 {
+	for _, entry := range fl.entries {
+		if strings.EqualFold(entry.dn, dn) && entry.password != "" && entry.password == password {
+			return 0
+		}
+	}
+	return ldapInvalidCredentials
+}
+
+func (entry fakeLDAPEntry) matches(filter map[string]string) bool {
+	for name, want := range filter {
+		found := false
+		for attribute, values := range entry.attributes {
+			if strings.EqualFold(attribute, name) {
+				for _, value := range values {
+					found = found || strings.EqualFold(value, want)
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Protocol numbers of RFC 4511
+const (
+	ldapBindRequest        = 0
+	ldapBindResponse       = 1
+	ldapSearchRequest      = 3
+	ldapSearchEntryTag     = 4
+	ldapSearchDone         = 5
+	ldapEqualityMatch      = 3
+	ldapInvalidCredentials = 49
+)
+
+// equalities collects the attribute=value assertions of a search filter;
+// the fake treats every filter as their conjunction
+func equalities(filter *ber.Packet, out map[string]string) {
+	if filter.ClassType == ber.ClassContext && filter.Tag == ldapEqualityMatch {
+		out[strings.ToLower(filter.Children[0].Data.String())] = filter.Children[1].Data.String()
+		return
+	}
+	for _, child := range filter.Children {
+		equalities(child, out)
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	return message
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func ldapSearchEntry(id int64, entry fakeLDAPEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchEntryTag, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range entry.attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return ldapMessage(id, op)
+}
+
+// newLDAPEnv returns a test environment whose logins try the local password
+// and then the fake directory, which knows bob
+func newLDAPEnv(t *testing.T) *testEnv {
+	t.Helper()
+	directory := newFakeLDAP(t,
+		fakeLDAPEntry{"cn=svc,dc=example,dc=org", "svc-secret", map[string][]string{"objectClass": {"account"}}},
+		fakeLDAPEntry{"uid=bob,ou=people,dc=example,dc=org", "directory pass 1", map[string][]string{
+			"objectClass": {"person"}, "mail": {"bob@corp.example"}, "uid": {"bob"},
+		}},
+	)
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	ldapAuthenticator, err := services.NewLDAPAuthenticator(env.userRepo, env.identityRepo, env.bus, services.LDAPConfig{
+		URL:               directory.URL(),
+		BindDN:            "cn=svc,dc=example,dc=org",
+		BindPassword:      "svc-secret",
+		BaseDN:            "dc=example,dc=org",
+		UserFilter:        "(&(objectClass=person)(mail=%s))",
+		EmailAttribute:    "mail",
+		UsernameAttribute: "uid",
+		AllowSignup:       true,
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewLDAPAuthenticator: %v", err)
+	}
+	env.authenticate([]services.Authenticator{services.NewLocalAuthenticator(env.userRepo, env.bus, env.hashPool), ldapAuthenticator})
+	return env
+}
+
+func TestLDAPLoginLinksTheAccountToItsEntry(t *testing.T) {
+	env := newLDAPEnv(t)
+	meta := services.LoginMeta{IP: "192.0.2.1"}
+
+	// From elsewhere, as a failure locks the IP out in the test environment
+	if _, err := env.users.LoginUser("bob@corp.example", "wrong", services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Fatalf("wrong directory password: got %v, want ErrInvalidCredentials", err)
+	}
+	bob, err := env.users.LoginUser("bob@corp.example", "directory pass 1", meta)
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	if bob.Username != "bob" || bob.HasPassword() || bob.VerifiedAt == nil {
+		t.Errorf("provisioned account = %+v, want a verified bob without a local password", bob)
+	}
+	identities, err := env.identityRepo.ListByUser(bob.ID)
+	if err != nil || len(identities) != 1 || identities[0].Provider != services.LDAPProvider ||
+		identities[0].Subject != "uid=bob,ou=people,dc=example,dc=org" {
+		t.Fatalf("identities = %+v, %v, want the directory entry", identities, err)
+	}
+
+	// Logging in again doesn't link it twice
+	if _, err := env.users.LoginUser("bob@corp.example", "directory pass 1", meta); err != nil {
+		t.Fatalf("second LoginUser: %v", err)
+	}
+	if identities, _ := env.identityRepo.ListByUser(bob.ID); len(identities) != 1 {
+		t.Errorf("identities after a second login = %+v", identities)
+	}
+}
+
+func TestLDAPLoginFindsTheAccountByEntry(t *testing.T) {
+	env := newLDAPEnv(t)
+	account := func(email, dn string) *models.User {
+		t.Helper()
+		user := &models.User{Username: strings.Split(email, "@")[0], Email: email}
+		if err := env.userRepo.Create(user); err != nil {
+			t.Fatalf("Create %s: %v", email, err)
+		}
+		if err := env.identityRepo.Create(&models.Identity{UserID: user.ID, Provider: services.LDAPProvider, Subject: dn, LinkedAt: time.Now()}); err != nil {
+			t.Fatalf("link %s: %v", email, err)
+		}
+		return user
+	}
+
+	// The directory gave bob's email to someone new, and bob's old entry
+	// still has the account
+	former := account("bob@corp.example", "uid=former,ou=people,dc=example,dc=org")
+	if _, err := env.users.LoginUser("bob@corp.example", "directory pass 1", services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Fatalf("login into the account of another entry: got %v, want ErrInvalidCredentials", err)
+	}
+	if identities, _ := env.identityRepo.ListByUser(former.ID); len(identities) != 1 || identities[0].Subject != "uid=former,ou=people,dc=example,dc=org" {
+		t.Errorf("identities of the former account = %+v", identities)
+	}
+
+	// Once that account is gone, bob's entry logs into its own account
+	// whatever its email is now
+	if err := env.userRepo.Delete(former.ID, former.Version); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	bob := account("robert@corp.example", "uid=bob,ou=people,dc=example,dc=org")
+	found, err := env.users.LoginUser("bob@corp.example", "directory pass 1", services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	if found.ID != bob.ID {
+		t.Errorf("logged into account %d, want bob's %d", found.ID, bob.ID)
+	}
+}
+
+func TestLDAPAccountsKeepTheirPasswordInTheDirectory(t *testing.T) {
+	env := newLDAPEnv(t)
+	bob, err := env.users.LoginUser("bob@corp.example", "directory pass 1", services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+
+	// No local password can be set
+	if err := env.users.ChangePassword(bob.ID, "directory pass 1", "local pass 123"); !errors.Is(err, services.ErrDirectoryAccount) {
+		t.Errorf("ChangePassword: got %v, want ErrDirectoryAccount", err)
+	}
+	if err := env.users.ForgotPassword(bob.Email, "192.0.2.1"); err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	sent := env.mail.messages(1)
+	if len(sent) != 1 || strings.Contains(sent[0].Body, "token=") || !strings.Contains(sent[0].Body, "directory password") {
+		t.Errorf("ForgotPassword sent %+v, want a note without a reset link", sent)
+	}
+	// A link from before the account was linked to its entry
+	token, err := env.tokens.Issue(bob, models.TokenPurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if err := env.users.ResetPassword(token, "local pass 123", "192.0.2.1"); !errors.Is(err, services.ErrDirectoryAccount) {
+		t.Errorf("ResetPassword: got %v, want ErrDirectoryAccount", err)
+	}
+	if stored, _ := env.userRepo.FindByID(bob.ID); stored.HasPassword() {
+		t.Error("the account got a local password")
+	}
+
+	// Re-authentication asks the directory; failures come from elsewhere,
+	// as they lock the IP out in the test environment
+	meta := services.LoginMeta{IP: "192.0.2.1"}
+	if err := env.users.ConfirmPassword(bob.ID, "directory pass 1", meta); err != nil {
+		t.Errorf("ConfirmPassword with the directory password: %v", err)
+	}
+	if err := env.users.ConfirmPassword(bob.ID, "wrong", services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrWrongPassword) {
+		t.Errorf("ConfirmPassword with a wrong password: got %v, want ErrWrongPassword", err)
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "test", AccountName: bob.Email})
+	if err != nil {
+		t.Fatalf("totp.Generate: %v", err)
+	}
+	now := time.Now()
+	bob.TOTPSecret, bob.TOTPEnabledAt = key.Secret(), &now
+	if err := env.userRepo.Update(bob, bob.Version); err != nil {
+		t.Fatalf("enable 2FA: %v", err)
+	}
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	if err := env.mfa.DisableTOTP(bob.ID, "wrong", code, services.LoginMeta{IP: "198.51.100.2"}); !errors.Is(err, services.ErrWrongPassword) {
+		t.Errorf("DisableTOTP with a wrong password: got %v, want ErrWrongPassword", err)
+	}
+	if err := env.mfa.DisableTOTP(bob.ID, "directory pass 1", code, meta); err != nil {
+		t.Errorf("DisableTOTP with the directory password: %v", err)
+	}
+}
+
+func TestLDAPEntryCountsAsALoginMethod(t *testing.T) {
+	env := newLDAPEnv(t)
+	federation := newFederationService(t, env, newMockIdP(t), true)
+	bob, err := env.users.LoginUser("bob@corp.example", "directory pass 1", services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	corp := &models.Identity{UserID: bob.ID, Provider: "corp", Subject: "u-1", LinkedAt: time.Now()}
+	if err := env.identityRepo.Create(corp); err != nil {
+		t.Fatalf("link corp: %v", err)
+	}
+	identities, err := federation.Identities(bob.ID)
+	if err != nil || len(identities) != 2 {
+		t.Fatalf("identities = %+v, %v", identities, err)
+	}
+	var entry models.Identity
+	for _, identity := range identities {
+		if identity.Provider == services.LDAPProvider {
+			entry = identity
+		}
+	}
+
+	if err := federation.Unlink(bob.ID, entry.ID); !errors.Is(err, services.ErrDirectoryAccount) {
+		t.Errorf("unlink the directory entry: got %v, want ErrDirectoryAccount", err)
+	}
+	// Bob has no local password, but can still log in with the directory's
+	if err := federation.Unlink(bob.ID, corp.ID); err != nil {
+		t.Errorf("unlink corp: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// LockoutPolicy configures brute-force protection for logins. After each
+// failure the account must wait BaseDelay, doubling with every further
+// failure, and once MaxAccountFailures is reached it is locked out for
+// Lockout. A client IP is only locked out, after MaxIPFailures, so one typo
+// behind a shared NAT doesn't slow everyone down. Counts restart once no
+// failure has happened for Window.
+type LockoutPolicy struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	Window             time.Duration
+	Lockout            time.Duration
+	BaseDelay          time.Duration
+}
+
+// LoginGuard tracks failed logins per account and per IP
+type LoginGuard interface {
+	// Allow reports whether a login for email from ip may be attempted now
+	Allow(email, ip string) bool
+	RecordFailure(email, ip string)
+	RecordSuccess(email string)
+	// Unlock clears the failures recorded against an account
+	Unlock(email string) error
+}
+
+// loginGuardImpl is the concrete implementation of LoginGuard
+type loginGuardImpl struct {
+	attemptRepo repository.LoginAttemptRepository
+	policy      LockoutPolicy
+}
+
+// NewLoginGuard creates a new LoginGuard instance
+func NewLoginGuard(attemptRepo repository.LoginAttemptRepository, policy LockoutPolicy) LoginGuard {
+	return &loginGuardImpl{
+		attemptRepo: attemptRepo,
+		policy:      policy,
+	}
+}
+
+// Allow reports whether neither the account nor the IP is throttled or locked.
+// If the counters can't be read, the login is allowed.
+func (lg *loginGuardImpl) Allow(email, ip string) bool {
+	now := time.Now()
+	return !lg.blocked(models.AttemptScopeAccount, normalizeEmail(email), now) &&
+		!lg.blocked(models.AttemptScopeIP, ip, now)
+}
+
+// RecordFailure counts a failed login against the account and the IP
+func (lg *loginGuardImpl) RecordFailure(email, ip string) {
+	now := time.Now()
+	for scope, identifier := range map[string]string{
+		models.AttemptScopeAccount: normalizeEmail(email),
+		models.AttemptScopeIP:      ip,
+	} {
+		attempt, err := lg.attemptRepo.RecordFailure(scope, identifier, now, lg.policy.Window)
+		if err != nil {
+			logrus.WithError(err).WithField("scope", scope).Error("Failed to record login failure")
+			continue
+		}
+		if attempt.Failures == lg.maxFailures(scope) {
+			logrus.WithFields(logrus.Fields{"scope": scope, "identifier": identifier}).Warn("Locked out after repeated login failures")
+		}
+	}
+}
+
+// RecordSuccess clears the account's failures. The IP's are kept, so one
+// valid account doesn't let an IP keep guessing at others.
+func (lg *loginGuardImpl) RecordSuccess(email string) {
+	if err := lg.Unlock(email); err != nil {
+		logrus.WithError(err).Error("Failed to reset login failures")
+	}
+}
+
+// Unlock clears the failures recorded against an account
+func (lg *loginGuardImpl) Unlock(email string) error {
+	return lg.attemptRepo.Reset(models.AttemptScopeAccount, normalizeEmail(email))
+}
+
+// blocked reports whether scope/identifier must still wait at now
+func (lg *loginGuardImpl) blocked(scope, identifier string, now time.Time) bool {
+	attempt, err := lg.attemptRepo.Find(scope, identifier)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("scope", scope).Error("Failed to read login failures")
+		return false
+	}
+	if attempt.LastFailureAt.Before(now.Add(-lg.policy.Window)) {
+		return false
+	}
+
+	wait := lg.policy.Lockout
+	if attempt.Failures < lg.maxFailures(scope) {
+		if scope == models.AttemptScopeIP {
+			return false
+		}
+		wait = min(lg.policy.BaseDelay<<min(attempt.Failures-1, 30), lg.policy.Lockout)
+	}
+	return now.Before(attempt.LastFailureAt.Add(wait))
+}
+
+func (lg *loginGuardImpl) maxFailures(scope string) int {
+	if scope == models.AttemptScopeIP {
+		return lg.policy.MaxIPFailures
+	}
+	return lg.policy.MaxAccountFailures
+}
+
+// normalizeEmail makes failures against Bob@x.io and bob@x.io count together
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
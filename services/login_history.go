@@ -0,0 +1,208 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gin-tutorial/mailer"
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LoginHistoryConfig holds the settings of the login history
+type LoginHistoryConfig struct {
+	// Alerts mails users when a login to their account looks suspicious
+	Alerts bool
+	// FailureBurst is how many failed logins since the last successful one,
+	// within FailureWindow, make the next success suspicious; 0 disables
+	// the check
+	FailureBurst  int
+	FailureWindow time.Duration
+}
+
+// LoginRecord describes a login attempt to record
+type LoginRecord struct {
+	// User is nil when the email isn't registered
+	User  *models.User
+	Email string
+	// Provider is the identity provider of a federated login; empty for
+	// passwords
+	Provider string
+	// SecondFactor marks the second step of a two-factor login; the first
+	// was recorded as pending
+	SecondFactor bool
+	Success      bool
+	Reason       string
+	Meta         LoginMeta
+}
+
+// LoginHistory keeps the login history of every account and flags
+// successful logins that look suspicious: from a device or network the
+// user hasn't logged in from before, or after a burst of failures
+type LoginHistory interface {
+	// Record appends an attempt to the history. Failures to record are only
+	// logged, so they never block a login.
+	Record(record LoginRecord)
+	// List returns the user's newest limit events, newest first
+	List(userID uint, limit int) ([]models.LoginEvent, error)
+}
+
+// loginHistoryImpl is the concrete implementation of LoginHistory
+type loginHistoryImpl struct {
+	eventRepo repository.LoginEventRepository
+	mailer    mailer.Mailer
+	config    LoginHistoryConfig
+}
+
+// NewLoginHistory creates a new LoginHistory instance
+func NewLoginHistory(eventRepo repository.LoginEventRepository, mailer mailer.Mailer, config LoginHistoryConfig) LoginHistory {
+	return &loginHistoryImpl{eventRepo: eventRepo, mailer: mailer, config: config}
+}
+
+// Record appends an attempt and alerts the user if it looks suspicious
+func (lh *loginHistoryImpl) Record(record LoginRecord) {
+	event := &models.LoginEvent{
+		Email:     record.Email,
+		Success:   record.Success,
+		Reason:    record.Reason,
+		Provider:  record.Provider,
+		IP:        record.Meta.IP,
+		UserAgent: truncate(record.Meta.UserAgent, 512),
+		Device:    describeDevice(record.Meta.UserAgent),
+		Network:   networkOf(record.Meta.IP),
+		CreatedAt: time.Now(),
+	}
+	if record.User != nil {
+		event.UserID = &record.User.ID
+		event.Email = record.User.Email
+	}
+
+	var flags []string
+	if record.User != nil && record.Success {
+		var err error
+		if flags, err = lh.assess(record.User.ID, event); err != nil {
+			logrus.WithError(err).WithField("user_id", record.User.ID).Warn("Failed to assess login")
+		}
+		event.Flags = strings.Join(flags, ",")
+	}
+
+	if err := lh.eventRepo.Create(event); err != nil {
+		logrus.WithError(err).WithField("email", event.Email).Error("Failed to record login event")
+	}
+
+	if len(flags) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"user_id": record.User.ID,
+			"ip":      event.IP,
+			"flags":   event.Flags,
+		}).Warn("Suspicious login")
+		if lh.config.Alerts {
+			lh.alert(record, event, flags)
+		}
+	}
+}
+
+// assess returns the flags a successful login deserves, judged by the
+// history before it
+func (lh *loginHistoryImpl) assess(userID uint, event *models.LoginEvent) ([]string, error) {
+	var flags []string
+
+	lastSuccess, err := lh.eventRepo.LastSuccess(userID)
+	if err != nil {
+		return nil, err
+	}
+	// The first login has nothing to be compared with
+	if lastSuccess != nil {
+		knownDevice, knownNetwork, err := lh.eventRepo.HasSucceededFrom(userID, event.Device, event.Network)
+		if err != nil {
+			return nil, err
+		}
+		if !knownDevice {
+			flags = append(flags, models.LoginFlagNewDevice)
+		}
+		if !knownNetwork {
+			flags = append(flags, models.LoginFlagNewNetwork)
+		}
+	}
+
+	if lh.config.FailureBurst > 0 {
+		since := event.CreatedAt.Add(-lh.config.FailureWindow)
+		if lastSuccess != nil && lastSuccess.After(since) {
+			since = *lastSuccess
+		}
+		failures, err := lh.eventRepo.CountFailuresSince(userID, since)
+		if err != nil {
+			return flags, err
+		}
+		if failures >= lh.config.FailureBurst {
+			flags = append(flags, models.LoginFlagFailureBurst)
+		}
+	}
+	return flags, nil
+}
+
+// alert mails the user about a suspicious login in the background
+func (lh *loginHistoryImpl) alert(record LoginRecord, event *models.LoginEvent, flags []string) {
+	user := record.User
+	reasons := make([]string, len(flags))
+	for i, flag := range flags {
+		switch flag {
+		case models.LoginFlagNewDevice:
+			reasons[i] = "- it came from a device you haven't used before"
+		case models.LoginFlagNewNetwork:
+			reasons[i] = "- it came from a network you haven't used before"
+		case models.LoginFlagFailureBurst:
+			reasons[i] = "- it followed several failed attempts"
+		}
+	}
+
+	// Say what was used to sign in, and what to do about it
+	used, advice := "Your password was", "change your password right away"
+	switch {
+	case record.SecondFactor:
+		// The first factor may have been a password or an identity provider
+		used, advice = "Your second factor was", "reset two-factor authentication, and your password or the account you sign in with, right away"
+	case record.Provider == "ldap":
+		used, advice = "Your directory password was", "change your directory password right away"
+	case record.Provider != "":
+		used, advice = fmt.Sprintf("Your %s account was", record.Provider), fmt.Sprintf("secure your %s account right away", record.Provider)
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body: fmt.Sprintf("Hi %s,\n\n%s just used to sign in to your account:\n\n"+
+			"Time: %s\nDevice: %s\nIP address: %s\n\nWe're letting you know because\n%s\n\n"+
+			"If this was you, you can ignore this email. If it wasn't, %s "+
+			"and sign out your other sessions.",
+			user.Username, used, event.CreatedAt.UTC().Format(time.RFC1123), event.Device, event.IP, strings.Join(reasons, "\n"), advice),
+	}
+	go func() {
+		if err := lh.mailer.Send(msg); err != nil {
+			logrus.WithError(err).WithField("subject", msg.Subject).Error("Failed to send email")
+		}
+	}()
+}
+
+// List returns the user's newest events
+func (lh *loginHistoryImpl) List(userID uint, limit int) ([]models.LoginEvent, error) {
+	return lh.eventRepo.ListByUser(userID, limit)
+}
+
+// networkOf returns the /24 (IPv4) or /48 (IPv6) block of ip, which is what
+// counts as the same network; a typical home or office network stays
+// within one
+func networkOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
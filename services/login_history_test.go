@@ -0,0 +1,165 @@
+package services_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/pquerna/otp/totp"
+)
+
+const testUserAgent = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+
+func TestLoginHistoryAlertNamesTheSignInMethod(t *testing.T) {
+	tests := []struct {
+		name   string
+		record services.LoginRecord
+		want   []string
+	}{
+		{"password", services.LoginRecord{}, []string{"Your password was just used", "change your password"}},
+		{"ldap", services.LoginRecord{Provider: "ldap"}, []string{"Your directory password was just used", "change your directory password"}},
+		{"federated", services.LoginRecord{Provider: "google"}, []string{"Your google account was just used", "secure your google account"}},
+		{"second factor", services.LoginRecord{SecondFactor: true}, []string{"Your second factor was just used", "reset two-factor authentication"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, repository.NewMemoryUserRepository())
+			user := createUser(t, env.userRepo, "alice", "correct horse 1")
+			env.history.Record(services.LoginRecord{User: user, Email: user.Email, Success: true,
+				Meta: services.LoginMeta{IP: "192.0.2.10", UserAgent: testUserAgent}})
+
+			record := tt.record
+			record.User, record.Email, record.Success = user, user.Email, true
+			record.Meta = services.LoginMeta{IP: "198.51.100.10", UserAgent: testUserAgent}
+			env.history.Record(record)
+
+			sent := env.mail.messages(1)
+			if len(sent) != 1 {
+				t.Fatalf("%d alerts sent, want 1", len(sent))
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(sent[0].Body, want) {
+					t.Errorf("alert doesn't say %q:\n%s", want, sent[0].Body)
+				}
+			}
+			if tt.record.Provider != "" && strings.Contains(sent[0].Body, "Your password") {
+				t.Errorf("alert for a %s login talks about the password:\n%s", tt.record.Provider, sent[0].Body)
+			}
+		})
+	}
+}
+
+func TestTwoFactorLoginIsJudgedWhenCompleted(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "correct horse 1")
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "test", AccountName: user.Email})
+	if err != nil {
+		t.Fatalf("totp.Generate: %v", err)
+	}
+	now := time.Now()
+	user.TOTPSecret, user.TOTPEnabledAt = key.Secret(), &now
+	if err := env.userRepo.Update(user, user.Version); err != nil {
+		t.Fatalf("enable 2FA: %v", err)
+	}
+	env.history.Record(services.LoginRecord{User: user, Email: user.Email, Success: true,
+		Meta: services.LoginMeta{IP: "192.0.2.10", UserAgent: testUserAgent}})
+
+	// The password alone is pending: not a success, not a failure, no alert
+	meta := services.LoginMeta{IP: "198.51.100.10", UserAgent: testUserAgent}
+	for i := 0; i < 3; i++ {
+		if _, err := env.users.LoginUser(user.Email, "correct horse 1", meta); err != nil {
+			t.Fatalf("LoginUser: %v", err)
+		}
+	}
+	events, err := env.loginEvents.ListByUser(user.ID, 1)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListByUser = %v, %v", events, err)
+	}
+	if events[0].Success || events[0].Reason != models.LoginReasonMFAPending {
+		t.Errorf("pending login recorded as success=%v reason=%q", events[0].Success, events[0].Reason)
+	}
+	if failures, _ := env.loginEvents.CountFailuresSince(user.ID, now.Add(-time.Minute)); failures != 0 {
+		t.Errorf("pending logins counted as %d failures", failures)
+	}
+	if sent := env.mail.messages(0); len(sent) != 0 {
+		t.Errorf("alerted before the second factor: %v", sent)
+	}
+
+	challenge, err := env.mfa.IssueChallenge(user)
+	if err != nil {
+		t.Fatalf("IssueChallenge: %v", err)
+	}
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	if _, err := env.mfa.CompleteChallenge(challenge, code, meta); err != nil {
+		t.Fatalf("CompleteChallenge: %v", err)
+	}
+
+	events, err = env.loginEvents.ListByUser(user.ID, 1)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListByUser = %v, %v", events, err)
+	}
+	if !events[0].Success || !strings.Contains(events[0].Flags, models.LoginFlagNewNetwork) {
+		t.Errorf("completed login recorded as success=%v flags=%q, want a flagged success", events[0].Success, events[0].Flags)
+	}
+	sent := env.mail.messages(1)
+	if len(sent) != 1 || !strings.Contains(sent[0].Body, "Your second factor was just used") {
+		t.Errorf("alerts after the second factor: %v", sent)
+	}
+}
+
+func TestUnverifiedLoginIsNoSuccess(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	users := services.NewUserService(env.userRepo, repository.NewMemoryPasswordHistoryRepository(), env.identityRepo,
+		env.tokens, env.loginGuard, env.history, services.NewRateLimiter(env.attemptRepo), env.bus, env.mail, env.hashPool,
+		services.UserServiceConfig{JWTSecret: "test-secret", AppURL: "https://app.example.com", RequireVerifiedEmail: true})
+	user := createUser(t, env.userRepo, "alice", "correct horse 1")
+	env.history.Record(services.LoginRecord{User: user, Email: user.Email, Success: true,
+		Meta: services.LoginMeta{IP: "192.0.2.10", UserAgent: testUserAgent}})
+	since := time.Now()
+	user.VerifiedAt = nil
+	if err := env.userRepo.Update(user, user.Version); err != nil {
+		t.Fatalf("unverify: %v", err)
+	}
+
+	// Refused logins are failures, but not guesses that count towards a burst
+	meta := services.LoginMeta{IP: "198.51.100.10", UserAgent: testUserAgent}
+	for i := 0; i < 3; i++ {
+		if _, err := users.LoginUser(user.Email, "correct horse 1", meta); !errors.Is(err, services.ErrEmailNotVerified) {
+			t.Fatalf("LoginUser: got %v, want ErrEmailNotVerified", err)
+		}
+	}
+	events, err := env.loginEvents.ListByUser(user.ID, 1)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListByUser = %v, %v", events, err)
+	}
+	if events[0].Success || events[0].Reason != models.LoginReasonEmailNotVerified {
+		t.Errorf("refused login recorded as success=%v reason=%q", events[0].Success, events[0].Reason)
+	}
+	if failures, _ := env.loginEvents.CountFailuresSince(user.ID, since); failures != 0 {
+		t.Errorf("refused logins counted as %d failures", failures)
+	}
+	if sent := env.mail.messages(0); len(sent) != 0 {
+		t.Errorf("alerted about a refused login: %v", sent)
+	}
+
+	// Nor do they make the network known
+	now := time.Now()
+	user.VerifiedAt = &now
+	if err := env.userRepo.Update(user, user.Version); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if _, err := users.LoginUser(user.Email, "correct horse 1", meta); err != nil {
+		t.Fatalf("LoginUser once verified: %v", err)
+	}
+	if sent := env.mail.messages(1); len(sent) != 1 {
+		t.Errorf("%d alerts for the first login from the network, want 1", len(sent))
+	}
+}
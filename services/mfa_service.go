@@ -0,0 +1,467 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrMFAAlreadyEnabled is returned when enrolling a user who already has 2FA
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFANotEnabled is returned for operations that need 2FA turned on
+	ErrMFANotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrMFANotEnrolled is returned when confirming without enrolling first
+	ErrMFANotEnrolled = errors.New("two-factor enrollment has not been started")
+	// ErrInvalidMFACode is returned for a wrong, reused or malformed TOTP or
+	// recovery code
+	ErrInvalidMFACode = errors.New("invalid two-factor code")
+	// ErrInvalidMFAToken is returned for an invalid, expired or used MFA
+	// pending token
+	ErrInvalidMFAToken = errors.New("invalid or expired MFA token")
+	// ErrTooManyAttempts is returned when a re-authentication is refused
+	// because of recent failures
+	ErrTooManyAttempts = errors.New("too many failed attempts, try again later")
+)
+
+// TOTP parameters; these are what authenticator apps assume anyway
+const (
+	totpPeriod = 30
+	totpDigits = otp.DigitsSix
+	totpSkew   = 1 // steps either side, for clock drift
+)
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: totpDigits, Algorithm: otp.AlgorithmSHA1}
+
+// recoveryCodeEncoding spells recovery codes in lowercase base32
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// MFAServiceConfig holds the settings of the MFA service
+type MFAServiceConfig struct {
+	JWTSecret string
+	// Issuer names the service in authenticator apps
+	Issuer string
+	// ChallengeTTL is how long the MFA pending token of a login works
+	ChallengeTTL time.Duration
+	// RecoveryCodes is how many recovery codes a user gets
+	RecoveryCodes int
+
+	// Authenticators check the password of a re-authentication, like
+	// UserServiceConfig.Authenticators do for logins; only the local one
+	// when empty
+	Authenticators []Authenticator
+}
+
+// TOTPEnrollment is what an authenticator app needs to add an account
+type TOTPEnrollment struct {
+	Secret string
+	// URI is the otpauth:// URI, and QRCode a PNG of it
+	URI    string
+	QRCode []byte
+}
+
+// MFAService manages TOTP two-factor authentication and recovery codes
+type MFAService interface {
+	// EnrollTOTP creates a new TOTP secret for the user. It only takes
+	// effect once ConfirmTOTP is given a code it generated.
+	EnrollTOTP(userID uint) (*TOTPEnrollment, error)
+	// ConfirmTOTP turns on 2FA and returns the plaintext recovery codes,
+	// which are not shown again
+	ConfirmTOTP(userID uint, code string) ([]string, error)
+	// DisableTOTP turns off 2FA after checking the password and a TOTP or
+	// recovery code
+	DisableTOTP(userID uint, password, code string, meta LoginMeta) error
+	// RegenerateRecoveryCodes replaces the recovery codes after checking
+	// the password and a TOTP or recovery code
+	RegenerateRecoveryCodes(userID uint, password, code string, meta LoginMeta) ([]string, error)
+	// ResetMFA turns off 2FA without any checks, for admins helping users
+	// who lost both their authenticator and recovery codes
+	ResetMFA(userID uint) error
+	// IssueChallenge returns the MFA pending token for a user who passed
+	// the password check
+	IssueChallenge(user *models.User) (string, error)
+	// CompleteChallenge checks the second factor for an MFA pending token
+	// and returns the user to issue an access token for
+	CompleteChallenge(token, code string, meta LoginMeta) (*models.User, error)
+	// ChallengeTTL is how long MFA pending tokens work
+	ChallengeTTL() time.Duration
+}
+
+// mfaServiceImpl is the concrete implementation of MFAService
+type mfaServiceImpl struct {
+	userRepo     repository.UserRepository
+	recoveryRepo repository.RecoveryCodeRepository
+	revocations  RevocationService
+	loginGuard   LoginGuard
+	history      LoginHistory
+	bus          pubsub.Bus
+	hashPool     *password.Pool
+	config       MFAServiceConfig
+	jwtSecret    []byte
+
+	authenticators []Authenticator
+}
+
+// NewMFAService creates a new MFAService instance
+func NewMFAService(userRepo repository.UserRepository, recoveryRepo repository.RecoveryCodeRepository, revocations RevocationService, loginGuard LoginGuard, history LoginHistory, bus pubsub.Bus, hashPool *password.Pool, config MFAServiceConfig) MFAService {
+	authenticators := config.Authenticators
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{NewLocalAuthenticator(userRepo, bus, hashPool)}
+	}
+
+	return &mfaServiceImpl{
+		userRepo:     userRepo,
+		recoveryRepo: recoveryRepo,
+		revocations:  revocations,
+		loginGuard:   loginGuard,
+		history:      history,
+		bus:          bus,
+		hashPool:     hashPool,
+		config:       config,
+		jwtSecret:    []byte(config.JWTSecret),
+
+		authenticators: authenticators,
+	}
+}
+
+// EnrollTOTP creates a new, not yet enabled, TOTP secret for the user
+func (ms *mfaServiceImpl) EnrollTOTP(userID uint) (*TOTPEnrollment, error) {
+	user, err := ms.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	if user.MFAEnabled() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      ms.config.Issuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+		Digits:      totpDigits,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return nil, err
+	}
+
+	updated := *user
+	updated.TOTPSecret = key.Secret()
+	updated.TOTPLastStep = 0
+	if err := ms.save(user, &updated); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{Secret: key.Secret(), URI: key.URL(), QRCode: qr.Bytes()}, nil
+}
+
+// ConfirmTOTP enables the enrolled secret once code proves the user's
+// authenticator has it
+func (ms *mfaServiceImpl) ConfirmTOTP(userID uint, code string) ([]string, error) {
+	user, err := ms.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	if user.MFAEnabled() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	step, ok := ms.checkTOTP(user, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, err := ms.newRecoveryCodes(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	updated := *user
+	updated.TOTPEnabledAt = &now
+	updated.TOTPLastStep = step
+	if err := ms.save(user, &updated); err != nil {
+		return nil, err
+	}
+	logrus.WithField("user_id", user.ID).Info("Two-factor authentication enabled")
+	return codes, nil
+}
+
+// DisableTOTP turns off 2FA after re-authenticating the user
+func (ms *mfaServiceImpl) DisableTOTP(userID uint, password, code string, meta LoginMeta) error {
+	user, err := ms.reauthenticate(userID, password, code, meta)
+	if err != nil {
+		return err
+	}
+	if err := ms.disable(user); err != nil {
+		return err
+	}
+	logrus.WithField("user_id", user.ID).Info("Two-factor authentication disabled")
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after
+// re-authenticating the user
+func (ms *mfaServiceImpl) RegenerateRecoveryCodes(userID uint, password, code string, meta LoginMeta) ([]string, error) {
+	user, err := ms.reauthenticate(userID, password, code, meta)
+	if err != nil {
+		return nil, err
+	}
+	return ms.newRecoveryCodes(user.ID)
+}
+
+// ResetMFA turns off 2FA without any checks
+func (ms *mfaServiceImpl) ResetMFA(userID uint) error {
+	user, err := ms.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	if !user.MFAEnabled() && user.TOTPSecret == "" {
+		return ErrMFANotEnabled
+	}
+	if err := ms.disable(user); err != nil {
+		return err
+	}
+	logrus.WithField("user_id", user.ID).Warn("Two-factor authentication reset by an admin")
+	return nil
+}
+
+// IssueChallenge returns a short-lived token that only CompleteChallenge accepts
+func (ms *mfaServiceImpl) IssueChallenge(user *models.User) (string, error) {
+	now := time.Now()
+	claims := &models.Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		Purpose:  models.ClaimsPurposeMFA,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ms.config.ChallengeTTL).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ms.jwtSecret)
+}
+
+// ChallengeTTL is how long MFA pending tokens work
+func (ms *mfaServiceImpl) ChallengeTTL() time.Duration {
+	return ms.config.ChallengeTTL
+}
+
+// CompleteChallenge checks code for the user of an MFA pending token. Wrong
+// codes count as failed logins, and the token is revoked once it succeeds.
+func (ms *mfaServiceImpl) CompleteChallenge(token, code string, meta LoginMeta) (*models.User, error) {
+	claims := &models.Claims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return ms.jwtSecret, nil
+	})
+	if err != nil || !parsed.Valid || claims.Purpose != models.ClaimsPurposeMFA || ms.revocations.IsRevoked(claims.Id) {
+		return nil, ErrInvalidMFAToken
+	}
+
+	user, err := ms.userRepo.FindByID(claims.UserID)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	if user.SessionsRevokedAt != nil && claims.IssuedAt <= user.SessionsRevokedAt.Unix() {
+		return nil, ErrInvalidMFAToken
+	}
+	if !user.MFAEnabled() {
+		// 2FA was turned off in the meantime; log in again without it
+		return nil, ErrInvalidMFAToken
+	}
+
+	record := LoginRecord{User: user, Email: user.Email, SecondFactor: true, Meta: meta}
+	if !ms.loginGuard.Allow(user.Email, meta.IP) {
+		record.Reason = models.LoginReasonLockedOut
+		ms.history.Record(record)
+		return nil, ErrInvalidMFACode
+	}
+	if err := ms.verifySecondFactor(user, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			ms.loginGuard.RecordFailure(user.Email, meta.IP)
+			record.Reason = models.LoginReasonWrongMFACode
+			ms.history.Record(record)
+		}
+		return nil, err
+	}
+	ms.loginGuard.RecordSuccess(user.Email)
+	record.Success = true
+	ms.history.Record(record)
+
+	if err := ms.revocations.Revoke(claims); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// reauthenticate checks the password, with the authenticators of the login,
+// and a second factor of a user with 2FA enabled. Failures count against
+// the login lockout like logins do.
+func (ms *mfaServiceImpl) reauthenticate(userID uint, currentPassword, code string, meta LoginMeta) (*models.User, error) {
+	user, err := ms.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	if !user.MFAEnabled() {
+		return nil, ErrMFANotEnabled
+	}
+	if !ms.loginGuard.Allow(user.Email, meta.IP) {
+		return nil, ErrTooManyAttempts
+	}
+
+	found, _, err := authenticateChain(ms.authenticators, user.Email, currentPassword)
+	if hashPoolBusy(err) || errors.Is(err, ErrAuthenticatorUnavailable) {
+		return nil, err
+	}
+	if err != nil || found.ID != user.ID {
+		ms.loginGuard.RecordFailure(user.Email, meta.IP)
+		return nil, ErrWrongPassword
+	}
+	// The authenticator may have updated the account (a rehash, an LDAP
+	// role), so carry on with its copy
+	user = found
+	if err := ms.verifySecondFactor(user, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			ms.loginGuard.RecordFailure(user.Email, meta.IP)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery
+// code, and spends it
+func (ms *mfaServiceImpl) verifySecondFactor(user *models.User, code string) error {
+	if step, ok := ms.checkTOTP(user, code, time.Now()); ok {
+		updated := *user
+		updated.TOTPLastStep = step
+		if err := ms.save(user, &updated); err != nil {
+			if errors.Is(err, ErrVersionConflict) {
+				// Most likely the same code used concurrently
+				return ErrInvalidMFACode
+			}
+			return err
+		}
+		return nil
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if len(normalized) != 10 {
+		return ErrInvalidMFACode
+	}
+	used, err := ms.recoveryRepo.Use(user.ID, hashRecoveryCode(normalized), time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMFACode
+	}
+	if remaining, err := ms.recoveryRepo.Remaining(user.ID); err == nil {
+		logrus.WithFields(logrus.Fields{"user_id": user.ID, "remaining": remaining}).Info("Recovery code used")
+	}
+	return nil
+}
+
+// checkTOTP looks for code among the time steps around now that are newer
+// than the last accepted one, and returns the step it matched
+func (ms *mfaServiceImpl) checkTOTP(user *models.User, code string, now time.Time) (int64, bool) {
+	if user.TOTPSecret == "" || len(code) != totpDigits.Length() {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err != nil {
+			logrus.WithError(err).WithField("user_id", user.ID).Warn("Unusable TOTP secret")
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones in plaintext
+func (ms *mfaServiceImpl) newRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, ms.config.RecoveryCodes)
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		raw := make([]byte, 10*5/8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err := ms.recoveryRepo.Replace(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// disable removes the user's TOTP secret and recovery codes
+func (ms *mfaServiceImpl) disable(user *models.User) error {
+	updated := *user
+	updated.TOTPSecret = ""
+	updated.TOTPEnabledAt = nil
+	updated.TOTPLastStep = 0
+	if err := ms.save(user, &updated); err != nil {
+		return err
+	}
+	return ms.recoveryRepo.DeleteAll(user.ID)
+}
+
+// save stores updated over user and tells the other instances
+func (ms *mfaServiceImpl) save(user, updated *models.User) error {
+	if err := ms.userRepo.Update(updated, user.Version); err != nil {
+		return translateRepoError(err)
+	}
+	*user = *updated
+	publishUserEvent(ms.bus, pubsub.UserUpdated, user)
+	return nil
+}
+
+// normalizeRecoveryCode drops the separators and case users may type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// hashRecoveryCode hashes a normalized recovery code. The codes are random
+// enough (50 bits) that a fast hash is fine.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
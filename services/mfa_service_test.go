@@ -0,0 +1,175 @@
+package services_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpCode is the code an authenticator app shows at t
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+// enableTOTP turns 2FA on for user with the current code, and returns the
+// secret and the recovery codes
+func enableTOTP(t *testing.T, env *testEnv, user *models.User) (string, []string) {
+	t.Helper()
+	enrollment, err := env.mfa.EnrollTOTP(user.ID)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	codes, err := env.mfa.ConfirmTOTP(user.ID, totpCode(t, enrollment.Secret, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	return enrollment.Secret, codes
+}
+
+// challenge logs in with the password and returns the MFA pending token
+func challenge(t *testing.T, env *testEnv, email, pass string, meta services.LoginMeta) string {
+	t.Helper()
+	user, err := env.users.LoginUser(email, pass, meta)
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	token, err := env.mfa.IssueChallenge(user)
+	if err != nil {
+		t.Fatalf("IssueChallenge: %v", err)
+	}
+	return token
+}
+
+func TestTOTPCodesWorkOnce(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "password 1")
+	secret, _ := enableTOTP(t, env, user)
+
+	// The code that confirmed the enrollment is spent already
+	token := challenge(t, env, user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"})
+	if _, err := env.mfa.CompleteChallenge(token, totpCode(t, secret, time.Now()), services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Fatalf("replaying the enrollment code: got %v, want ErrInvalidMFACode", err)
+	}
+
+	next := totpCode(t, secret, time.Now().Add(30*time.Second))
+	if _, err := env.mfa.CompleteChallenge(token, next, services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("the next code: %v", err)
+	}
+	token = challenge(t, env, user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"})
+	if _, err := env.mfa.CompleteChallenge(token, next, services.LoginMeta{IP: "198.51.100.2"}); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Errorf("replaying the next code: got %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "password 1")
+	_, codes := enableTOTP(t, env, user)
+	if len(codes) != 8 {
+		t.Fatalf("got %d recovery codes, want 8", len(codes))
+	}
+
+	token := challenge(t, env, user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"})
+	if _, err := env.mfa.CompleteChallenge(token, codes[0], services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("a recovery code: %v", err)
+	}
+	// The token is spent along with the code
+	if _, err := env.mfa.CompleteChallenge(token, codes[1], services.LoginMeta{IP: "192.0.2.1"}); !errors.Is(err, services.ErrInvalidMFAToken) {
+		t.Errorf("reusing the token: got %v, want ErrInvalidMFAToken", err)
+	}
+
+	token = challenge(t, env, user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"})
+	if _, err := env.mfa.CompleteChallenge(token, codes[0], services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Errorf("reusing the recovery code: got %v, want ErrInvalidMFACode", err)
+	}
+	if _, err := env.mfa.CompleteChallenge(token, codes[1], services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Errorf("another recovery code: %v", err)
+	}
+}
+
+func TestWrongMFACodesLockTheAccount(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "password 1")
+	secret, _ := enableTOTP(t, env, user)
+
+	// From elsewhere each time, as a failure locks the IP out in the test
+	// environment
+	token := challenge(t, env, user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"})
+	for i := 0; i < 5; i++ {
+		meta := services.LoginMeta{IP: fmt.Sprintf("198.51.100.%d", i+1)}
+		if _, err := env.mfa.CompleteChallenge(token, "000000", meta); !errors.Is(err, services.ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d: got %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+
+	next := totpCode(t, secret, time.Now().Add(30*time.Second))
+	if _, err := env.mfa.CompleteChallenge(token, next, services.LoginMeta{IP: "192.0.2.1"}); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Errorf("a right code once locked out: got %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestPasswordLoginsDontResetMFAFailures(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "password 1")
+	enableTOTP(t, env, user)
+
+	// A fresh login before every guess must not clear the count
+	for i := 0; i < 5; i++ {
+		meta := services.LoginMeta{IP: fmt.Sprintf("198.51.100.%d", i+1)}
+		token := challenge(t, env, user.Email, "password 1", meta)
+		if _, err := env.mfa.CompleteChallenge(token, "000000", meta); !errors.Is(err, services.ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d: got %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+
+	if _, err := env.users.LoginUser(user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"}); !errors.Is(err, services.ErrInvalidCredentials) {
+		t.Errorf("login once locked out: got %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestDisableTOTPNeedsPasswordAndCode(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	user := createUser(t, env.userRepo, "alice", "password 1")
+	secret, _ := enableTOTP(t, env, user)
+	next := totpCode(t, secret, time.Now().Add(30*time.Second))
+
+	if err := env.mfa.DisableTOTP(user.ID, "wrong", next, services.LoginMeta{IP: "198.51.100.1"}); !errors.Is(err, services.ErrWrongPassword) {
+		t.Errorf("wrong password: got %v, want ErrWrongPassword", err)
+	}
+	if err := env.mfa.DisableTOTP(user.ID, "password 1", "000000", services.LoginMeta{IP: "198.51.100.2"}); !errors.Is(err, services.ErrInvalidMFACode) {
+		t.Errorf("wrong code: got %v, want ErrInvalidMFACode", err)
+	}
+	stored, err := env.userRepo.FindByID(user.ID)
+	if err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if !stored.MFAEnabled() {
+		t.Fatal("a failed re-authentication turned 2FA off")
+	}
+
+	if err := env.mfa.DisableTOTP(user.ID, "password 1", next, services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Fatalf("DisableTOTP: %v", err)
+	}
+	if stored, err = env.userRepo.FindByID(user.ID); err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if stored.MFAEnabled() {
+		t.Error("2FA is still on")
+	}
+	if _, err := env.users.LoginUser(user.Email, "password 1", services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Errorf("login without 2FA: %v", err)
+	}
+}
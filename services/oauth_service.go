@@ -0,0 +1,910 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrOAuthClientNotFound is returned when no OAuth client matches
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	// ErrInvalidRedirectURI is returned when registering a redirect URI
+	// that isn't an absolute https URL (http is allowed for localhost)
+	ErrInvalidRedirectURI = errors.New("redirect URIs must be absolute https URLs, or http URLs on localhost, without a fragment")
+	// ErrConsentNotFound is returned when the user hasn't allowed the app
+	ErrConsentNotFound = errors.New("app not found")
+	// ErrInvalidGrant is returned for authorization codes and refresh
+	// tokens that are unknown, expired, used or issued to another client,
+	// and for wrong PKCE code verifiers
+	ErrInvalidGrant = errors.New("invalid, expired or revoked grant")
+)
+
+// pkceVerifierPattern is the syntax of a PKCE code verifier (RFC 7636
+// section 4.1); an S256 challenge is its unpadded base64url SHA-256 hash
+var (
+	pkceVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+	pkceChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+)
+
+// OAuthConfig holds the settings of the authorization code flow
+type OAuthConfig struct {
+	JWTSecret string
+	// CodeTTL is how long an authorization code can be exchanged
+	CodeTTL time.Duration
+	// RefreshTokenTTL is how long a refresh token family lives without
+	// being used
+	RefreshTokenTTL time.Duration
+	// Issuer identifies this server in authorization responses (RFC 9207)
+	// and ID tokens
+	Issuer string
+	// SigningKey signs ID tokens
+	SigningKey *SigningKey
+}
+
+// OAuthClientInput holds the fields of a new OAuth client
+type OAuthClientInput struct {
+	Name         string
+	RedirectURIs []string
+	Scopes       []string
+	// Confidential clients get a secret; public ones rely on PKCE alone
+	Confidential bool
+	Trusted      bool
+}
+
+// OAuthClientChanges holds the fields of an OAuth client to change; nil
+// fields are left alone
+type OAuthClientChanges struct {
+	Name         *string
+	RedirectURIs []string
+	Scopes       []string
+	Trusted      *bool
+}
+
+// AuthorizeRequest holds the parameters of an authorization request
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// OpenID Connect parameters
+	Nonce  string
+	Prompt string
+	MaxAge string
+}
+
+// Authorization is a checked authorization request
+type Authorization struct {
+	Client        *models.OAuthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	// Nonce is copied into the ID token
+	Nonce string
+	// Prompt lists how the user must be asked: none, login, consent or
+	// select_account
+	Prompt []string
+	// MaxAge is how long ago the user may have logged in at most; nil when
+	// the app doesn't care
+	MaxAge *time.Duration
+}
+
+// HasPrompt reports whether the app asked for the prompt value
+func (a *Authorization) HasPrompt(prompt string) bool {
+	return slices.Contains(a.Prompt, prompt)
+}
+
+// RequiresLogin reports whether the user has to log in again even though
+// session is live: the app asked for a login, or session is older than
+// MaxAge
+func (a *Authorization) RequiresLogin(session *models.Session, now time.Time) bool {
+	if a.HasPrompt("login") || a.HasPrompt("select_account") {
+		return true
+	}
+	return a.MaxAge != nil && now.Sub(session.CreatedAt) > *a.MaxAge
+}
+
+// AuthorizeError is an error of an authorization request (RFC 6749 section
+// 4.1.2.1). Once the client and redirect URI are known to be good, it is
+// sent to the client's redirect URI; before that, it is shown to the user.
+type AuthorizeError struct {
+	Code        string
+	Description string
+	// Redirect reports whether the error may be sent to the redirect URI
+	Redirect bool
+}
+
+func (e *AuthorizeError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// OAuthService lets users log in to registered apps with the OAuth 2.1
+// authorization code flow and PKCE, and issues the apps' tokens
+type OAuthService interface {
+	// CreateClient registers an app and returns its secret if it is
+	// confidential; the secret can't be retrieved again
+	CreateClient(input OAuthClientInput) (string, *models.OAuthClient, error)
+	// ListClients returns every app, by name
+	ListClients() ([]models.OAuthClient, error)
+	GetClient(id uint) (*models.OAuthClient, error)
+	UpdateClient(id uint, changes OAuthClientChanges) (*models.OAuthClient, error)
+	// RotateSecret replaces the secret of a confidential app and returns it
+	RotateSecret(id uint) (string, *models.OAuthClient, error)
+	// DeleteClient removes an app; its tokens stop working right away
+	DeleteClient(id uint) error
+
+	// CheckAuthorization validates an authorization request; errors are
+	// *AuthorizeError
+	CheckAuthorization(request AuthorizeRequest) (*Authorization, error)
+	// CheckConsent returns the scopes the user can grant the app, which
+	// leaves out those the user's role doesn't allow, and whether the user
+	// still has to consent to them
+	CheckConsent(user *models.User, authorization *Authorization) ([]string, bool, error)
+	// Authorize records the user's consent and returns an authorization
+	// code for the app; session is the login the user authorized with
+	Authorize(user *models.User, session *models.Session, authorization *Authorization) (string, error)
+	// RedirectURL is the app's redirect URI with params, the request's
+	// state and the issuer added
+	RedirectURL(authorization *Authorization, params url.Values) string
+
+	// ExchangeCode implements the authorization_code grant
+	ExchangeCode(credentials ClientCredentials, code, redirectURI, codeVerifier string, meta LoginMeta) (*IssuedToken, error)
+	// Refresh implements the refresh_token grant. The refresh token is
+	// replaced by a new one; the access token may be limited to fewer
+	// space-separated scopes.
+	Refresh(credentials ClientCredentials, refreshToken, scope string, meta LoginMeta) (*IssuedToken, error)
+	// Revoke implements token revocation (RFC 7009) for the app's access
+	// and refresh tokens; unknown tokens are not an error
+	Revoke(credentials ClientCredentials, token string) error
+
+	// ListConsents returns the apps the user allowed, with their clients
+	ListConsents(userID uint) ([]models.OAuthConsent, error)
+	// RevokeConsent withdraws the user's consent for an app and revokes
+	// every token the app holds for the user
+	RevokeConsent(userID uint, clientID string) error
+	// UserInfo returns the OpenID Connect claims about the user that the
+	// scopes allow
+	UserInfo(userID uint, scopes []string) (map[string]interface{}, error)
+	// DeleteExpired removes expired codes and refresh tokens from storage
+	DeleteExpired() (int64, error)
+}
+
+// oauthServiceImpl is the concrete implementation of OAuthService
+type oauthServiceImpl struct {
+	clientRepo  repository.OAuthClientRepository
+	grantRepo   repository.OAuthGrantRepository
+	userService UserService
+	sessions    SessionService
+	config      OAuthConfig
+	jwtSecret   []byte
+}
+
+// NewOAuthService creates a new OAuthService instance
+func NewOAuthService(clientRepo repository.OAuthClientRepository, grantRepo repository.OAuthGrantRepository, userService UserService, sessions SessionService, config OAuthConfig) OAuthService {
+	return &oauthServiceImpl{
+		clientRepo:  clientRepo,
+		grantRepo:   grantRepo,
+		userService: userService,
+		sessions:    sessions,
+		config:      config,
+		jwtSecret:   []byte(config.JWTSecret),
+	}
+}
+
+// CreateClient registers an app with a random client ID
+func (oa *oauthServiceImpl) CreateClient(input OAuthClientInput) (string, *models.OAuthClient, error) {
+	redirectURIs, err := normalizeRedirectURIs(input.RedirectURIs)
+	if err != nil {
+		return "", nil, err
+	}
+	scopes, err := normalizeClientScopes(input.Scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	client := &models.OAuthClient{
+		ClientID:     "app-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Name:         strings.TrimSpace(input.Name),
+		RedirectURIs: strings.Join(redirectURIs, "\n"),
+		Scopes:       strings.Join(scopes, " "),
+		Trusted:      input.Trusted,
+	}
+	var secret string
+	if input.Confidential {
+		if secret, err = setClientSecret(client); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := oa.clientRepo.Create(client); err != nil {
+		return "", nil, err
+	}
+	logrus.WithField("client_id", client.ClientID).Info("OAuth client created")
+	return secret, client, nil
+}
+
+// ListClients returns every app
+func (oa *oauthServiceImpl) ListClients() ([]models.OAuthClient, error) {
+	return oa.clientRepo.List()
+}
+
+// GetClient returns an app
+func (oa *oauthServiceImpl) GetClient(id uint) (*models.OAuthClient, error) {
+	client, err := oa.clientRepo.Find(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// UpdateClient applies changes to an app. Narrower scopes only apply to
+// tokens issued from then on.
+func (oa *oauthServiceImpl) UpdateClient(id uint, changes OAuthClientChanges) (*models.OAuthClient, error) {
+	client, err := oa.GetClient(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if changes.Name != nil {
+		client.Name = strings.TrimSpace(*changes.Name)
+	}
+	if changes.RedirectURIs != nil {
+		redirectURIs, err := normalizeRedirectURIs(changes.RedirectURIs)
+		if err != nil {
+			return nil, err
+		}
+		client.RedirectURIs = strings.Join(redirectURIs, "\n")
+	}
+	if changes.Scopes != nil {
+		scopes, err := normalizeClientScopes(changes.Scopes)
+		if err != nil {
+			return nil, err
+		}
+		client.Scopes = strings.Join(scopes, " ")
+	}
+	if changes.Trusted != nil {
+		client.Trusted = *changes.Trusted
+	}
+
+	if err := oa.clientRepo.Update(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// RotateSecret replaces the secret of a confidential app. The old secret
+// stops working right away.
+func (oa *oauthServiceImpl) RotateSecret(id uint) (string, *models.OAuthClient, error) {
+	client, err := oa.GetClient(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if !client.Confidential() {
+		return "", nil, fmt.Errorf("%w: public clients have no secret", ErrInvalidClient)
+	}
+	secret, err := setClientSecret(client)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := oa.clientRepo.Update(client); err != nil {
+		return "", nil, err
+	}
+	logrus.WithField("client_id", client.ClientID).Info("OAuth client secret rotated")
+	return secret, client, nil
+}
+
+// DeleteClient removes an app with everything users granted it
+func (oa *oauthServiceImpl) DeleteClient(id uint) error {
+	client, err := oa.GetClient(id)
+	if err != nil {
+		return err
+	}
+	if _, err := oa.sessions.RevokeClient(client.ClientID, 0); err != nil {
+		return err
+	}
+	if err := oa.grantRepo.DeleteByClient(client.ID); err != nil {
+		return err
+	}
+	if err := oa.clientRepo.Delete(client.ID); err != nil {
+		return err
+	}
+	logrus.WithField("client_id", client.ClientID).Info("OAuth client deleted")
+	return nil
+}
+
+// CheckAuthorization validates an authorization request. OAuth 2.1 only
+// has the code response type and requires PKCE with S256 for every client.
+func (oa *oauthServiceImpl) CheckAuthorization(request AuthorizeRequest) (*Authorization, error) {
+	if request.ClientID == "" {
+		return nil, &AuthorizeError{Code: "invalid_request", Description: "client_id is required"}
+	}
+	client, err := oa.clientRepo.FindByClientID(request.ClientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, &AuthorizeError{Code: "invalid_request", Description: "unknown client_id"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Redirecting anywhere but a registered URI would make this an open
+	// redirector that leaks codes
+	redirectURI := request.RedirectURI
+	if redirectURI == "" {
+		return nil, &AuthorizeError{Code: "invalid_request", Description: "redirect_uri is required"}
+	}
+	if !client.AllowsRedirect(redirectURI) {
+		return nil, &AuthorizeError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+
+	authorization := &Authorization{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         request.State,
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+		Prompt:        strings.Fields(request.Prompt),
+	}
+	if request.ResponseType != "code" {
+		return authorization, &AuthorizeError{Code: "unsupported_response_type", Description: "response_type must be code", Redirect: true}
+	}
+	if request.CodeChallengeMethod != "S256" || !pkceChallengePattern.MatchString(request.CodeChallenge) {
+		return authorization, &AuthorizeError{Code: "invalid_request", Description: "a code_challenge with code_challenge_method S256 is required", Redirect: true}
+	}
+
+	allowed := client.ScopeList()
+	authorization.Scopes = allowed
+	if requested := strings.Fields(request.Scope); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(allowed, scope) {
+				return authorization, &AuthorizeError{Code: "invalid_scope", Description: fmt.Sprintf("scope %q is not allowed for this client", scope), Redirect: true}
+			}
+		}
+		authorization.Scopes = requested
+	}
+
+	if len(request.Nonce) > 255 {
+		return authorization, &AuthorizeError{Code: "invalid_request", Description: "nonce is too long", Redirect: true}
+	}
+	for _, prompt := range authorization.Prompt {
+		switch prompt {
+		case "none", "login", "consent", "select_account":
+		default:
+			return authorization, &AuthorizeError{Code: "invalid_request", Description: fmt.Sprintf("unsupported prompt %q", prompt), Redirect: true}
+		}
+	}
+	if authorization.HasPrompt("none") && len(authorization.Prompt) > 1 {
+		return authorization, &AuthorizeError{Code: "invalid_request", Description: "prompt none can't be combined with other values", Redirect: true}
+	}
+	if request.MaxAge != "" {
+		seconds, err := strconv.ParseUint(request.MaxAge, 10, 31)
+		if err != nil {
+			return authorization, &AuthorizeError{Code: "invalid_request", Description: "max_age must be a number of seconds", Redirect: true}
+		}
+		maxAge := time.Duration(seconds) * time.Second
+		authorization.MaxAge = &maxAge
+	}
+	return authorization, nil
+}
+
+// CheckConsent returns the scopes the user can grant. Trusted apps, and
+// apps the user already allowed every one of them, need no consent unless
+// they ask for it with prompt=consent. With prompt=none, needing consent is
+// an error sent to the app.
+func (oa *oauthServiceImpl) CheckConsent(user *models.User, authorization *Authorization) ([]string, bool, error) {
+	scopes := grantableScopes(user, authorization.Scopes)
+	if len(scopes) == 0 {
+		return nil, false, &AuthorizeError{Code: "invalid_scope", Description: "none of the requested scopes are available to this user", Redirect: true}
+	}
+
+	needsConsent, err := oa.needsConsent(user, authorization, scopes)
+	if err != nil {
+		return nil, false, err
+	}
+	if needsConsent && authorization.HasPrompt("none") {
+		return nil, false, &AuthorizeError{Code: "consent_required", Description: "the user hasn't allowed this app", Redirect: true}
+	}
+	return scopes, needsConsent, nil
+}
+
+// needsConsent reports whether the user has to be asked to allow scopes
+func (oa *oauthServiceImpl) needsConsent(user *models.User, authorization *Authorization, scopes []string) (bool, error) {
+	if authorization.HasPrompt("consent") {
+		return true, nil
+	}
+	if authorization.Client.Trusted {
+		return false, nil
+	}
+
+	consent, err := oa.grantRepo.FindConsent(user.ID, authorization.Client.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	consented := consent.ScopeList()
+	for _, scope := range scopes {
+		if !slices.Contains(consented, scope) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Authorize records the consent and issues a single-use code. Only the
+// code's hash is stored.
+func (oa *oauthServiceImpl) Authorize(user *models.User, session *models.Session, authorization *Authorization) (string, error) {
+	scopes := grantableScopes(user, authorization.Scopes)
+	if len(scopes) == 0 {
+		return "", &AuthorizeError{Code: "invalid_scope", Description: "none of the requested scopes are available to this user", Redirect: true}
+	}
+	client := authorization.Client
+
+	// Trusted apps get a consent record too, so that users see them among
+	// their apps and can revoke them
+	granted := scopes
+	if consent, err := oa.grantRepo.FindConsent(user.ID, client.ID); err == nil {
+		granted = mergeScopes(consent.ScopeList(), scopes)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+	err := oa.grantRepo.SaveConsent(&models.OAuthConsent{
+		UserID:   user.ID,
+		ClientID: client.ID,
+		Scopes:   strings.Join(granted, " "),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = oa.grantRepo.CreateCode(&models.OAuthAuthorizationCode{
+		ID:            hashSessionToken(code),
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   authorization.RedirectURI,
+		Scopes:        strings.Join(scopes, " "),
+		CodeChallenge: authorization.CodeChallenge,
+		Nonce:         authorization.Nonce,
+		AuthTime:      session.CreatedAt,
+		ExpiresAt:     time.Now().Add(oa.config.CodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedirectURL adds params, the state and the issuer (which protects
+// clients talking to several servers from mix-up attacks) to the redirect
+// URI's query
+func (oa *oauthServiceImpl) RedirectURL(authorization *Authorization, params url.Values) string {
+	target, err := url.Parse(authorization.RedirectURI)
+	if err != nil {
+		// Registered URIs are checked to parse
+		return authorization.RedirectURI
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if authorization.State != "" {
+		query.Set("state", authorization.State)
+	}
+	query.Set("iss", oa.config.Issuer)
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// ExchangeCode redeems an authorization code. A code that is redeemed
+// twice was probably stolen, so the tokens issued for it are revoked.
+func (oa *oauthServiceImpl) ExchangeCode(credentials ClientCredentials, code, redirectURI, codeVerifier string, meta LoginMeta) (*IssuedToken, error) {
+	client, err := oa.authenticateClient(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, fresh, err := oa.grantRepo.UseCode(hashSessionToken(code), time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if grant.ClientID != client.ID {
+		return nil, ErrInvalidGrant
+	}
+	if !fresh {
+		logrus.WithFields(logrus.Fields{"client_id": client.ClientID, "user_id": grant.UserID}).
+			Warn("Authorization code replayed; revoking the tokens issued for it")
+		if err := oa.revokeGrant(client, grant.UserID, grant.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidGrant
+	}
+	if !time.Now().Before(grant.ExpiresAt) || grant.RedirectURI != redirectURI || !verifyCodeChallenge(codeVerifier, grant.CodeChallenge) {
+		return nil, ErrInvalidGrant
+	}
+
+	familyID := uuid.New().String()
+	token, err := oa.issue(client, grant.UserID, strings.Fields(grant.Scopes), nil, grant.AuthTime, familyID, grant.Nonce, meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := oa.grantRepo.SetCodeFamily(grant.ID, familyID); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Refresh rotates a refresh token. A token that is used twice was
+// probably stolen, so its whole family is revoked (OAuth 2.1 section 4.3).
+func (oa *oauthServiceImpl) Refresh(credentials ClientCredentials, refreshToken, scope string, meta LoginMeta) (*IssuedToken, error) {
+	client, err := oa.authenticateClient(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	// The scope is checked before the token is used up, so that a bad
+	// request doesn't cost the client its refresh token
+	id := hashSessionToken(refreshToken)
+	grant, err := oa.grantRepo.FindRefreshToken(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if grant.ClientID != client.ID {
+		return nil, ErrInvalidGrant
+	}
+	scopes := grant.ScopeList()
+	var narrowed []string
+	if requested := strings.Fields(scope); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(scopes, scope) {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+			}
+		}
+		narrowed = requested
+	}
+
+	grant, fresh, err := oa.grantRepo.UseRefreshToken(id, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		logrus.WithFields(logrus.Fields{"client_id": client.ClientID, "user_id": grant.UserID}).
+			Warn("Refresh token reused; revoking its family")
+		if err := oa.revokeGrant(client, grant.UserID, grant.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidGrant
+	}
+	if !time.Now().Before(grant.ExpiresAt) {
+		return nil, ErrInvalidGrant
+	}
+
+	return oa.issue(client, grant.UserID, scopes, narrowed, grant.AuthTime, grant.FamilyID, "", meta)
+}
+
+// Revoke revokes one of the app's tokens. Revoking a refresh token revokes
+// its family; revoking an access token ends its session.
+func (oa *oauthServiceImpl) Revoke(credentials ClientCredentials, token string) error {
+	client, err := oa.authenticateClient(credentials)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(token, models.RefreshTokenPrefix) {
+		grant, err := oa.grantRepo.FindRefreshToken(hashSessionToken(token))
+		if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && grant.ClientID != client.ID) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return oa.grantRepo.DeleteFamily(grant.FamilyID)
+	}
+
+	claims := &models.Claims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return oa.jwtSecret, nil
+	})
+	if err != nil || claims.ClientID != client.ClientID {
+		return nil
+	}
+	err = oa.sessions.Revoke(claims.UserID, claims.Id)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// ListConsents returns the apps the user allowed
+func (oa *oauthServiceImpl) ListConsents(userID uint) ([]models.OAuthConsent, error) {
+	return oa.grantRepo.ListConsents(userID)
+}
+
+// RevokeConsent withdraws the user's consent for an app, so that the app
+// has to ask again, and revokes its tokens
+func (oa *oauthServiceImpl) RevokeConsent(userID uint, clientID string) error {
+	client, err := oa.clientRepo.FindByClientID(clientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrConsentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = oa.grantRepo.DeleteConsent(userID, client.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrConsentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := oa.revokeGrant(client, userID, ""); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"client_id": client.ClientID, "user_id": userID}).Info("OAuth consent revoked")
+	return nil
+}
+
+// UserInfo returns the claims about the user the scopes allow, as the
+// userinfo endpoint serves them. Logins without scopes (nil) get every
+// claim.
+func (oa *oauthServiceImpl) UserInfo(userID uint, scopes []string) (map[string]interface{}, error) {
+	user, err := oa.userService.GetProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+	return userClaims(user, scopes), nil
+}
+
+// DeleteExpired removes expired codes and refresh tokens
+func (oa *oauthServiceImpl) DeleteExpired() (int64, error) {
+	return oa.grantRepo.DeleteExpired(time.Now())
+}
+
+// issue starts an OAuth session for the user and returns its access token
+// with a new refresh token of the family. The access token gets narrowed
+// scopes if given; the refresh token keeps all of them. Scopes the user's
+// role no longer allows are dropped, and a user whose sessions were
+// revoked since authTime has to authorize again. With the openid scope, an
+// ID token carrying nonce comes along.
+func (oa *oauthServiceImpl) issue(client *models.OAuthClient, userID uint, scopes, narrowed []string, authTime time.Time, familyID, nonce string, meta LoginMeta) (*IssuedToken, error) {
+	user, err := oa.userService.GetProfile(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.SessionsRevokedAt != nil && !authTime.After(*user.SessionsRevokedAt) {
+		if err := oa.grantRepo.DeleteFamily(familyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidGrant
+	}
+
+	scopes = grantableScopes(user, scopes)
+	granted := scopes
+	if narrowed != nil {
+		granted = grantableScopes(user, narrowed)
+	}
+	if len(granted) == 0 {
+		return nil, ErrInvalidGrant
+	}
+
+	session, err := oa.sessions.StartClientSession(user, meta, client, granted)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := oa.userService.GenerateJWT(user, session)
+	if err != nil {
+		return nil, err
+	}
+	var idToken string
+	if slices.Contains(granted, models.ScopeOpenID) {
+		idToken, err = oa.config.SigningKey.idToken(oa.config.Issuer, user, client, authTime, nonce, accessToken, session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := models.RefreshTokenPrefix + secret
+	err = oa.grantRepo.CreateRefreshToken(&models.OAuthRefreshToken{
+		ID:        hashSessionToken(refreshToken),
+		FamilyID:  familyID,
+		ClientID:  client.ID,
+		UserID:    user.ID,
+		Scopes:    strings.Join(scopes, " "),
+		AuthTime:  authTime,
+		ExpiresAt: time.Now().Add(oa.config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuedToken{
+		AccessToken:  accessToken,
+		ExpiresIn:    time.Until(session.ExpiresAt).Round(time.Second),
+		Scopes:       granted,
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
+	}, nil
+}
+
+// revokeGrant revokes the refresh token family, or all of the user's
+// codes and refresh tokens for the app without one, and ends the app's
+// sessions of the user
+func (oa *oauthServiceImpl) revokeGrant(client *models.OAuthClient, userID uint, familyID string) error {
+	var err error
+	if familyID != "" {
+		err = oa.grantRepo.DeleteFamily(familyID)
+	} else {
+		err = oa.grantRepo.DeleteGrants(userID, client.ID)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = oa.sessions.RevokeClient(client.ClientID, userID)
+	return err
+}
+
+// authenticateClient returns the app making a token request. Confidential
+// apps must send their secret; public ones only their client ID.
+func (oa *oauthServiceImpl) authenticateClient(credentials ClientCredentials) (*models.OAuthClient, error) {
+	client, err := oa.findClient(credentials)
+	if err != nil {
+		logrus.WithError(err).WithField("client_id", credentials.ClientID).Warn("OAuth client authentication failed")
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// findClient checks the credentials of a token request
+func (oa *oauthServiceImpl) findClient(credentials ClientCredentials) (*models.OAuthClient, error) {
+	if credentials.Assertion != "" {
+		return nil, errors.New("client assertions are only supported for service accounts")
+	}
+	client, err := oa.clientRepo.FindByClientID(credentials.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case client.Confidential() && credentials.ClientSecret == "":
+		return nil, errors.New("confidential client sent no secret")
+	case client.Confidential():
+		hash := hashSessionToken(credentials.ClientSecret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(*client.SecretHash)) != 1 {
+			return nil, errors.New("wrong client secret")
+		}
+	case credentials.ClientSecret != "":
+		return nil, errors.New("public client sent a secret")
+	}
+	return client, nil
+}
+
+// setClientSecret gives a client a new secret and returns it
+func setClientSecret(client *models.OAuthClient) (string, error) {
+	random, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	secret := models.OAuthClientSecretPrefix + random
+	hash := hashSessionToken(secret)
+	client.SecretHash = &hash
+	client.SecretHint = secret[:len(models.OAuthClientSecretPrefix)+4]
+	return secret, nil
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against an S256 challenge
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if !pkceVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// normalizeRedirectURIs checks and deduplicates redirect URIs
+func normalizeRedirectURIs(uris []string) ([]string, error) {
+	if len(uris) == 0 {
+		return nil, ErrInvalidRedirectURI
+	}
+	normalized := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Host == "" || parsed.Fragment != "" || strings.ContainsAny(uri, " \n") {
+			return nil, ErrInvalidRedirectURI
+		}
+		switch host := parsed.Hostname(); {
+		case parsed.Scheme == "https":
+		case parsed.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1"):
+		default:
+			return nil, ErrInvalidRedirectURI
+		}
+		if !slices.Contains(normalized, uri) {
+			normalized = append(normalized, uri)
+		}
+	}
+	return normalized, nil
+}
+
+// normalizeClientScopes checks and sorts the scopes an app may request.
+// Unlike token scopes they aren't checked against a role: each user can
+// only grant the scopes their own role allows.
+func normalizeClientScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is needed", ErrInvalidScope)
+	}
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if _, known := models.OAuthScope(scope); !known {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+		if !slices.Contains(normalized, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// grantableScopes leaves out the scopes the user's role doesn't allow
+func grantableScopes(user *models.User, scopes []string) []string {
+	grantable := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if info, known := models.OAuthScope(scope); known && (info.Role == "" || info.Role == user.Role) {
+			grantable = append(grantable, scope)
+		}
+	}
+	return grantable
+}
+
+// mergeScopes returns the sorted union of two scope lists
+func mergeScopes(a, b []string) []string {
+	merged := slices.Clone(a)
+	for _, scope := range b {
+		if !slices.Contains(merged, scope) {
+			merged = append(merged, scope)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"time"
+
+	"gin-tutorial/models"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SigningKey is the RSA key ID tokens are signed with (RS256). Apps fetch
+// its public half from the JWKS endpoint.
+type SigningKey struct {
+	private *rsa.PrivateKey
+	// KeyID (kid) is the key's JWK thumbprint (RFC 7638)
+	KeyID string
+}
+
+// LoadSigningKey reads a PEM encoded RSA private key (PKCS #1 or PKCS #8)
+// from path
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var private *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key interface{}
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if private, ok = key.(*rsa.PrivateKey); !ok {
+				err = errors.New("not an RSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if private.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys need 2048 bits or more")
+	}
+	return newSigningKey(private), nil
+}
+
+// GenerateSigningKey makes a new 2048-bit key. ID tokens signed with it
+// can't be verified after a restart or by another instance's key, so it is
+// only meant for development.
+func GenerateSigningKey() (*SigningKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(private), nil
+}
+
+// newSigningKey computes the key's thumbprint
+func newSigningKey(private *rsa.PrivateKey) *SigningKey {
+	key := &SigningKey{private: private}
+	n, e := key.PublicComponents()
+	// The members of the thumbprint's JSON are in lexicographic order
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return key
+}
+
+// PublicComponents returns the modulus and exponent of the public key,
+// base64url encoded as in a JWK
+func (k *SigningKey) PublicComponents() (n, e string) {
+	public := k.private.PublicKey
+	return base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+}
+
+// Sign signs claims with RS256, naming the key in the header
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.KeyID
+	return token.SignedString(k.private)
+}
+
+// idToken makes the ID token issued together with accessToken
+func (k *SigningKey) idToken(issuer string, user *models.User, client *models.OAuthClient, authTime time.Time, nonce, accessToken string, expiresAt time.Time) (string, error) {
+	// at_hash is the left half of the access token's SHA-256 hash
+	sum := sha256.Sum256([]byte(accessToken))
+	return k.Sign(&models.IDTokenClaims{
+		AuthTime: authTime.Unix(),
+		Nonce:    nonce,
+		AtHash:   base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]),
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			Subject:   user.Subject(),
+			Audience:  client.ClientID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+}
+
+// userClaims maps the user's fields onto the standard OpenID Connect
+// claims the scopes allow; every claim when scopes is nil
+func userClaims(user *models.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.Subject()}
+	if scopes == nil || slices.Contains(scopes, models.ScopeProfile) {
+		claims["preferred_username"] = user.Username
+		claims["name"] = user.Username
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+	if scopes == nil || slices.Contains(scopes, models.ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.VerifiedAt != nil
+	}
+	return claims
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// jwksRefreshInterval limits how often an unknown kid makes us fetch a
+	// provider's keys again, so forged tokens can't make us hammer it
+	jwksRefreshInterval = time.Minute
+	// idTokenLeeway is the clock skew allowed when checking exp and iat
+	idTokenLeeway = time.Minute
+)
+
+// idTokenAlgorithms are the signature algorithms accepted on providers' ID
+// tokens; HS256 would need the client secret as key and none no key at all
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512"}
+
+// providerMetadata is the part of a provider's discovery document we use
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// providerClaims are the claims we read from a provider's ID token and
+// userinfo endpoint
+type providerClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     lenientBool `json:"email_verified"`
+	PreferredUsername string      `json:"preferred_username"`
+	Name              string      `json:"name"`
+	AuthorizedParty   string      `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// lenientBool is a boolean claim some providers send as a string
+type lenientBool bool
+
+func (b *lenientBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case bool:
+		*b = lenientBool(value)
+	case string:
+		*b = lenientBool(value == "true")
+	}
+	return nil
+}
+
+// providerTokens is a provider's token endpoint response
+type providerTokens struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// remoteProvider talks to an external OpenID Connect provider. Its
+// discovery document is fetched on first use and its keys are cached.
+type remoteProvider struct {
+	config FederationProvider
+	client *http.Client
+
+	mu        sync.Mutex
+	metadata  *providerMetadata
+	keys      map[string]interface{}
+	keysFetch time.Time
+}
+
+// newRemoteProvider creates a remoteProvider for a configured provider
+func newRemoteProvider(config FederationProvider, client *http.Client) *remoteProvider {
+	return &remoteProvider{config: config, client: client}
+}
+
+// discover returns the provider's metadata, fetching it on first use
+func (rp *remoteProvider) discover(ctx context.Context) (*providerMetadata, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.metadata != nil {
+		return rp.metadata, nil
+	}
+
+	metadata := &providerMetadata{}
+	discoveryURL := strings.TrimSuffix(rp.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := rp.getJSON(ctx, discoveryURL, "", metadata); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	// A document naming another issuer would let that issuer's tokens in
+	if metadata.Issuer != rp.config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q doesn't match the configured %q", metadata.Issuer, rp.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovery: the document lacks an endpoint")
+	}
+	rp.metadata = metadata
+	return metadata, nil
+}
+
+// exchange redeems an authorization code at the token endpoint, with the
+// client secret sent by HTTP Basic
+func (rp *remoteProvider) exchange(ctx context.Context, code, codeVerifier, redirectURI string) (*providerTokens, error) {
+	metadata, err := rp.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	// RFC 6749 section 2.3.1 form-encodes the credentials first
+	request.SetBasicAuth(url.QueryEscape(rp.config.ClientID), url.QueryEscape(rp.config.ClientSecret))
+
+	tokens := &providerTokens{}
+	if err := rp.do(request, tokens); err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token request: no ID token in the response")
+	}
+	return tokens, nil
+}
+
+// verify checks an ID token's signature against the provider's keys, and
+// its issuer, audience, lifetime and nonce
+func (rp *remoteProvider) verify(ctx context.Context, idToken, nonce string) (*providerClaims, error) {
+	claims := &providerClaims{}
+	parser := &jwt.Parser{ValidMethods: idTokenAlgorithms, SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return rp.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != rp.config.Issuer:
+		return nil, fmt.Errorf("ID token: unexpected issuer %q", claims.Issuer)
+	case !slices.Contains(claims.Audience, rp.config.ClientID):
+		return nil, errors.New("ID token: not issued to us")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != rp.config.ClientID:
+		return nil, errors.New("ID token: issued to several audiences, but not authorized for us")
+	case claims.ExpiresAt == nil || !now.Before(claims.ExpiresAt.Add(idTokenLeeway)):
+		return nil, errors.New("ID token: expired")
+	case claims.IssuedAt == nil || claims.IssuedAt.After(now.Add(idTokenLeeway)):
+		return nil, errors.New("ID token: issued in the future")
+	case claims.Subject == "":
+		return nil, errors.New("ID token: no subject")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token: wrong nonce")
+	}
+	return claims, nil
+}
+
+// userInfo fills in the email claims from the userinfo endpoint, for
+// providers that leave them out of the ID token
+func (rp *remoteProvider) userInfo(ctx context.Context, accessToken string, claims *providerClaims) error {
+	metadata, err := rp.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if metadata.UserInfoEndpoint == "" || accessToken == "" {
+		return nil
+	}
+
+	info := &providerClaims{}
+	if err := rp.getJSON(ctx, metadata.UserInfoEndpoint, accessToken, info); err != nil {
+		return fmt.Errorf("userinfo: %w", err)
+	}
+	// The response must be about the user the ID token is about (OpenID
+	// Connect Core section 5.3.2)
+	if info.Subject != claims.Subject {
+		return errors.New("userinfo: subject doesn't match the ID token")
+	}
+	claims.Email = info.Email
+	claims.EmailVerified = info.EmailVerified
+	if claims.PreferredUsername == "" {
+		claims.PreferredUsername = info.PreferredUsername
+	}
+	if claims.Name == "" {
+		claims.Name = info.Name
+	}
+	return nil
+}
+
+// key returns the provider's public key with the kid; without a kid the
+// provider must have a single key. Unknown kids make us fetch the keys
+// again, at most once per jwksRefreshInterval, to pick up rotations.
+func (rp *remoteProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	metadata, err := rp.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if key, ok := rp.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(rp.keysFetch) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	rp.keysFetch = time.Now()
+	if err := rp.getJSON(ctx, metadata.JWKSURI, "", &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, raw := range set.Keys {
+		// Keys of other types or uses are skipped, not fatal
+		if id, key, err := parseJWK(raw); err == nil {
+			keys[id] = key
+		}
+	}
+	rp.keys = keys
+
+	if key, ok := rp.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// lookupKey finds a cached key; rp.mu must be held
+func (rp *remoteProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(rp.keys) == 1 {
+		for _, key := range rp.keys {
+			return key, true
+		}
+	}
+	key, ok := rp.keys[kid]
+	return key, ok
+}
+
+// getJSON fetches a JSON document, with a bearer token if given
+func (rp *remoteProvider) getJSON(ctx context.Context, target, bearer string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		request.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return rp.do(request, v)
+}
+
+// do sends a request and decodes its JSON response
+func (rp *remoteProvider) do(request *http.Request, v interface{}) error {
+	response, err := rp.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d: %.200s", request.URL.Host, response.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// parseJWK decodes an RSA or EC signing key from its JSON Web Key form
+func parseJWK(raw json.RawMessage) (string, interface{}, error) {
+	var jwk struct {
+		KeyType string `json:"kty"`
+		Use     string `json:"use"`
+		KeyID   string `json:"kid"`
+		N       string `json:"n"`
+		E       string `json:"e"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, errors.New("not a signing key")
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) > 4 {
+			return "", nil, errors.New("invalid RSA exponent")
+		}
+		return jwk.KeyID, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return "", nil, errors.New("point not on curve")
+		}
+		return jwk.KeyID, key, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SchedulePurge permanently deletes users soft-deleted more than retention
+// ago, once at start-up and then every interval, until ctx is cancelled.
+// Running it on every replica is safe; purging is idempotent.
+func SchedulePurge(ctx context.Context, userService UserService, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := userService.PurgeDeletedUsers(retention)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to purge deleted users")
+		} else if purged > 0 {
+			logrus.WithField("purged", purged).Info("Purged deleted users")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScheduleSessionCleanup deletes expired and idle sessions every interval
+// until ctx is cancelled. Expired sessions are already refused; this only
+// keeps the table small.
+func ScheduleSessionCleanup(ctx context.Context, sessions SessionService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := sessions.DeleteExpired()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to delete expired sessions")
+		} else if deleted > 0 {
+			logrus.WithField("deleted", deleted).Info("Deleted expired sessions")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScheduleOAuthCleanup deletes expired authorization codes and refresh
+// tokens every interval until ctx is cancelled
+func ScheduleOAuthCleanup(ctx context.Context, oauth OAuthService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := oauth.DeleteExpired()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to delete expired OAuth grants")
+		} else if deleted > 0 {
+			logrus.WithField("deleted", deleted).Info("Deleted expired OAuth grants")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"gin-tutorial/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrRateLimited matches the errors returned when a caller has made too
+// many requests
+var ErrRateLimited = errors.New("too many requests, try again later")
+
+// RateLimitedError is returned when a rate limit is hit. It matches
+// ErrRateLimited and says how long to wait before retrying.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+// Is makes errors.Is(err, ErrRateLimited) match
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RateLimit allows Limit requests per key; the count restarts once a key has
+// been quiet for Window
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimiter counts requests per scope and key. The counters live in the
+// login attempt table, so they are shared by all replicas.
+type RateLimiter interface {
+	// Allow counts a request and returns a *RateLimitedError if it is over
+	// the limit. If the counter can't be updated, the request is allowed.
+	Allow(scope, key string, limit RateLimit) error
+}
+
+// rateLimiterImpl is the concrete implementation of RateLimiter
+type rateLimiterImpl struct {
+	attemptRepo repository.LoginAttemptRepository
+}
+
+// NewRateLimiter creates a new RateLimiter instance
+func NewRateLimiter(attemptRepo repository.LoginAttemptRepository) RateLimiter {
+	return &rateLimiterImpl{attemptRepo: attemptRepo}
+}
+
+// Allow counts a request for key and checks it against limit
+func (rl *rateLimiterImpl) Allow(scope, key string, limit RateLimit) error {
+	if limit.Limit <= 0 {
+		return nil
+	}
+	counter, err := rl.attemptRepo.RecordFailure(scope, key, time.Now(), limit.Window)
+	if err != nil {
+		logrus.WithError(err).WithField("scope", scope).Error("Failed to update rate limit counter")
+		return nil
+	}
+	if counter.Failures > limit.Limit {
+		return &RateLimitedError{RetryAfter: limit.Window}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RevocationService maintains the denylist of revoked JWTs. Revocations are
+// stored in the database and broadcast, so every instance rejects a revoked
+// token right away without a database lookup per request.
+type RevocationService interface {
+	Revoke(claims *models.Claims) error
+	IsRevoked(tokenID string) bool
+}
+
+// revocationServiceImpl is the concrete implementation of RevocationService
+type revocationServiceImpl struct {
+	tokenRepo repository.RevokedTokenRepository
+	bus       pubsub.Bus
+
+	mu      sync.RWMutex
+	revoked map[string]time.Time // token ID -> expiry
+}
+
+// NewRevocationService loads the current denylist and subscribes to
+// revocations made by other instances
+func NewRevocationService(tokenRepo repository.RevokedTokenRepository, bus pubsub.Bus) RevocationService {
+	rs := &revocationServiceImpl{
+		tokenRepo: tokenRepo,
+		bus:       bus,
+		revoked:   make(map[string]time.Time),
+	}
+	rs.reload()
+
+	bus.Subscribe(func(event pubsub.Event) {
+		switch event.Type {
+		case pubsub.TokenRevoked:
+			rs.add(event.TokenID, time.Unix(event.ExpiresAt, 0))
+		case pubsub.Resync:
+			rs.reload()
+		}
+	})
+	return rs
+}
+
+// Revoke adds the token described by claims to the denylist
+func (rs *revocationServiceImpl) Revoke(claims *models.Claims) error {
+	token := models.RevokedToken{
+		ID:        claims.Id,
+		UserID:    claims.UserID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+	if err := rs.tokenRepo.Create(&token); err != nil {
+		return err
+	}
+
+	rs.add(token.ID, token.ExpiresAt)
+	return rs.bus.Publish(pubsub.Event{
+		Type:      pubsub.TokenRevoked,
+		UserID:    token.UserID,
+		TokenID:   token.ID,
+		ExpiresAt: token.ExpiresAt.Unix(),
+	})
+}
+
+// IsRevoked reports whether the token with the given ID has been revoked
+func (rs *revocationServiceImpl) IsRevoked(tokenID string) bool {
+	if tokenID == "" {
+		return false
+	}
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	_, revoked := rs.revoked[tokenID]
+	return revoked
+}
+
+func (rs *revocationServiceImpl) add(tokenID string, expiresAt time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	for id, expiry := range rs.revoked {
+		if expiry.Before(now) {
+			delete(rs.revoked, id)
+		}
+	}
+	rs.revoked[tokenID] = expiresAt
+}
+
+// reload merges the denylist in the database into the local one
+func (rs *revocationServiceImpl) reload() {
+	now := time.Now()
+	if err := rs.tokenRepo.DeleteExpired(now); err != nil {
+		logrus.WithError(err).Warn("Failed to delete expired revoked tokens")
+	}
+
+	tokens, err := rs.tokenRepo.FindActive(now)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to load revoked tokens")
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, token := range tokens {
+		rs.revoked[token.ID] = token.ExpiresAt
+	}
+}
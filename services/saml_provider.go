@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// samlMetadataRefresh is how long an identity provider's fetched
+	// metadata is used before it is fetched again, picking up new
+	// certificates when the provider rotates them
+	samlMetadataRefresh = 24 * time.Hour
+	// samlMetadataRetry is how long a stale copy is used after a refresh
+	// failed, before trying again
+	samlMetadataRetry = time.Minute
+)
+
+// samlRemoteProvider holds the metadata of an external SAML identity
+// provider: given inline, or fetched from its URL on first use and
+// refreshed daily
+type samlRemoteProvider struct {
+	config SAMLProvider
+	client *http.Client
+
+	mu        sync.Mutex
+	metadata  *saml.EntityDescriptor
+	fetchedAt time.Time
+}
+
+// newSAMLRemoteProvider creates a samlRemoteProvider for a configured
+// provider, checking its inline metadata if it has some
+func newSAMLRemoteProvider(config SAMLProvider, client *http.Client) (*samlRemoteProvider, error) {
+	rp := &samlRemoteProvider{config: config, client: client}
+	if len(config.Metadata) > 0 {
+		metadata, err := parseIDPMetadata(config.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		rp.metadata = metadata
+	}
+	return rp, nil
+}
+
+// idpMetadata returns the provider's metadata, fetching it when there is
+// none yet or it is stale. A stale copy is used while the provider can't be
+// reached.
+func (rp *samlRemoteProvider) idpMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.metadata != nil && (rp.config.MetadataURL == "" || time.Since(rp.fetchedAt) < samlMetadataRefresh) {
+		return rp.metadata, nil
+	}
+
+	metadata, err := rp.fetchMetadata(ctx)
+	if err != nil {
+		if rp.metadata == nil {
+			return nil, err
+		}
+		logrus.WithError(err).WithField("provider", rp.config.ID).Warn("Failed to refresh SAML metadata, using the cached copy")
+		rp.fetchedAt = time.Now().Add(samlMetadataRetry - samlMetadataRefresh)
+		return rp.metadata, nil
+	}
+	rp.metadata, rp.fetchedAt = metadata, time.Now()
+	return metadata, nil
+}
+
+// fetchMetadata downloads the provider's metadata from its URL
+func (rp *samlRemoteProvider) fetchMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rp.config.MetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/samlmetadata+xml, application/xml")
+	response, err := rp.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata: %s answered %d", request.URL.Host, response.StatusCode)
+	}
+	return parseIDPMetadata(body)
+}
+
+// parseIDPMetadata reads the metadata of an identity provider, which may
+// come as the one IdP of an EntitiesDescriptor
+func parseIDPMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	entity := &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(data, entity); err != nil {
+		entities := &saml.EntitiesDescriptor{}
+		if xml.Unmarshal(data, entities) != nil {
+			return nil, fmt.Errorf("metadata: %w", err)
+		}
+		entity = nil
+		for i := range entities.EntityDescriptors {
+			if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+				entity = &entities.EntityDescriptors[i]
+				break
+			}
+		}
+		if entity == nil {
+			return nil, errors.New("metadata: no identity provider among the entities")
+		}
+	}
+	if entity.EntityID == "" || len(entity.IDPSSODescriptors) == 0 {
+		return nil, errors.New("metadata: not an identity provider's")
+	}
+	return entity, nil
+}
@@ -0,0 +1,488 @@
+package services
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/golang-jwt/jwt/v4"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/sirupsen/logrus"
+)
+
+// SAML bindings an AuthnRequest can be sent to the identity provider with
+const (
+	SAMLBindingRedirect = "redirect"
+	SAMLBindingPost     = "post"
+)
+
+// SAMLProvider is an external SAML 2.0 identity provider users can log in
+// with. It is trusted with the emails of its users: an account with the
+// email a user logs in with is linked to them, so only add providers that
+// control their users' emails.
+type SAMLProvider struct {
+	// ID names the provider in URLs, e.g. /auth/saml/{id}/login; it must not
+	// be an OpenID Connect provider's too, since identities are stored by it
+	ID   string
+	Name string
+	// MetadataURL is where the provider's metadata is fetched from, unless
+	// Metadata holds it
+	MetadataURL string
+	Metadata    []byte
+	// Binding sends AuthnRequests by redirect (SAMLBindingRedirect) or
+	// with an auto-submitted form (SAMLBindingPost)
+	Binding string
+	// NameIDFormat is asked for in AuthnRequests; the provider picks when
+	// empty. Transient NameIDs change on every login, so a SubjectAttribute
+	// is needed with them.
+	NameIDFormat string
+	// SubjectAttribute names the attribute identifying the user for good;
+	// the NameID does when empty. Attributes are matched by Name or
+	// FriendlyName.
+	SubjectAttribute string
+	// EmailAttribute names the attribute with the user's email; a NameID in
+	// the emailAddress format is used without it
+	EmailAttribute string
+	// UsernameAttribute names the attribute with the username new accounts
+	// get; the email's local part is used without it
+	UsernameAttribute string
+	// RoleAttribute names the attribute listing the user's roles or groups.
+	// Users with one of AdminRoles get the admin role, everyone else the
+	// user role. Roles are left alone when empty.
+	RoleAttribute string
+	AdminRoles    []string
+	// AllowSignup creates an account on the first login of an email that
+	// has none
+	AllowSignup bool
+	// AllowIDPInitiated accepts responses the provider sends unasked, when
+	// users start at the provider's portal. They can't be tied to the
+	// browser, so someone could log a victim into their own account.
+	AllowIDPInitiated bool
+}
+
+// SAMLConfig holds the settings of SAML login
+type SAMLConfig struct {
+	JWTSecret string
+	// AppURL is the base of the URLs registered with providers
+	AppURL string
+	// StateTTL is how long the user has to log in at the provider
+	StateTTL time.Duration
+	// Key and Certificate sign AuthnRequests and decrypt encrypted
+	// assertions. Without them requests are unsigned and assertions must
+	// come unencrypted.
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	// HTTPClient fetches the providers' metadata
+	HTTPClient *http.Client
+}
+
+// SAMLRequest is an AuthnRequest on its way to an identity provider
+type SAMLRequest struct {
+	// URL is where to send the browser: the whole request with the
+	// redirect binding, or where to post Form to with the POST binding
+	URL string
+	// Form holds the fields to post with the POST binding
+	Form map[string]string
+}
+
+// SAMLService lets users log in with external SAML 2.0 identity providers,
+// as our service provider (SP). Accounts are found, linked and created as
+// with OpenID Connect providers (see FederationService), and linked
+// identities show up with theirs.
+type SAMLService interface {
+	// Providers lists the configured providers
+	Providers() []SAMLProvider
+	// Metadata returns our SP metadata for a provider, to register there
+	Metadata(providerID string) ([]byte, error)
+	// Begin starts a login with a provider. It returns the AuthnRequest to
+	// send the browser with and a state token for the browser to keep until
+	// the response.
+	Begin(providerID string, session bool) (*SAMLRequest, string, error)
+	// Complete checks the response the provider posted to our assertion
+	// consumer service (ACS), with the state token kept by the browser if
+	// the login started here, and logs in the account of its user
+	Complete(ctx context.Context, providerID, stateToken, samlResponse, relayState string, meta LoginMeta) (*FederatedLogin, error)
+	// StateTTL is how long state tokens work
+	StateTTL() time.Duration
+}
+
+// samlServiceImpl is the concrete implementation of SAMLService
+type samlServiceImpl struct {
+	accounts    *federatedAccounts
+	revocations RevocationService
+	providers   []*samlRemoteProvider
+	config      SAMLConfig
+	jwtSecret   []byte
+}
+
+// NewSAMLService creates a new SAMLService instance. It fails on settings
+// that can't work, like inline metadata that doesn't parse.
+func NewSAMLService(userRepo repository.UserRepository, identityRepo repository.IdentityRepository, history LoginHistory, revocations RevocationService, bus pubsub.Bus, providers []SAMLProvider, config SAMLConfig) (SAMLService, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if (config.Key == nil) != (config.Certificate == nil) {
+		return nil, errors.New("the SAML key and certificate go together")
+	}
+	remote := make([]*samlRemoteProvider, len(providers))
+	for i, provider := range providers {
+		if provider.Binding != SAMLBindingRedirect && provider.Binding != SAMLBindingPost {
+			return nil, fmt.Errorf("SAML provider %s: unknown binding %q", provider.ID, provider.Binding)
+		}
+		if provider.MetadataURL == "" && len(provider.Metadata) == 0 {
+			return nil, fmt.Errorf("SAML provider %s: no metadata", provider.ID)
+		}
+		var err error
+		if remote[i], err = newSAMLRemoteProvider(provider, config.HTTPClient); err != nil {
+			return nil, fmt.Errorf("SAML provider %s: %w", provider.ID, err)
+		}
+	}
+	return &samlServiceImpl{
+		accounts: &federatedAccounts{
+			userRepo:     userRepo,
+			identityRepo: identityRepo,
+			history:      history,
+			bus:          bus,
+		},
+		revocations: revocations,
+		providers:   remote,
+		config:      config,
+		jwtSecret:   []byte(config.JWTSecret),
+	}, nil
+}
+
+// LoadSAMLKeyPair reads the PEM encoded certificate and RSA private key of
+// our service provider
+func LoadSAMLKeyPair(certFile, keyFile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("not an RSA key")
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certificate, nil
+}
+
+// Providers lists the configured providers
+func (ss *samlServiceImpl) Providers() []SAMLProvider {
+	providers := make([]SAMLProvider, len(ss.providers))
+	for i, provider := range ss.providers {
+		providers[i] = provider.config
+	}
+	return providers
+}
+
+// StateTTL is how long state tokens work
+func (ss *samlServiceImpl) StateTTL() time.Duration {
+	return ss.config.StateTTL
+}
+
+// Metadata returns our SP metadata for a provider. It only lists the POST
+// binding for the ACS: artifacts aren't resolved.
+func (ss *samlServiceImpl) Metadata(providerID string) ([]byte, error) {
+	provider := ss.provider(providerID)
+	if provider == nil {
+		return nil, ErrProviderNotFound
+	}
+	metadata := ss.serviceProvider(provider, nil, false).Metadata()
+	for i := range metadata.SPSSODescriptors {
+		descriptor := &metadata.SPSSODescriptors[i]
+		descriptor.AssertionConsumerServices = slices.DeleteFunc(descriptor.AssertionConsumerServices, func(endpoint saml.IndexedEndpoint) bool {
+			return endpoint.Binding != saml.HTTPPostBinding
+		})
+	}
+	document, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), document...), nil
+}
+
+// Begin makes an AuthnRequest for the provider and signs its ID, along
+// with the relay state sent with it, into the state token
+func (ss *samlServiceImpl) Begin(providerID string, session bool) (*SAMLRequest, string, error) {
+	provider := ss.provider(providerID)
+	if provider == nil {
+		return nil, "", ErrProviderNotFound
+	}
+	log := logrus.WithField("provider", providerID)
+	metadata, err := provider.idpMetadata(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Identity provider unavailable")
+		return nil, "", ErrProviderUnavailable
+	}
+
+	sp := ss.serviceProvider(provider, metadata, false)
+	binding := saml.HTTPRedirectBinding
+	if provider.config.Binding == SAMLBindingPost {
+		binding = saml.HTTPPostBinding
+	}
+	location := sp.GetSSOBindingLocation(binding)
+	if location == "" {
+		log.WithField("binding", binding).Error("Identity provider has no single sign-on service for the binding")
+		return nil, "", ErrProviderUnavailable
+	}
+	authnRequest, err := sp.MakeAuthenticationRequest(location, binding, saml.HTTPPostBinding)
+	if err != nil {
+		return nil, "", err
+	}
+	// URL-safe, since the redirect binding adds it to the URL unescaped
+	relayState, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	stateToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &models.SAMLLoginClaims{
+		Purpose:    models.ClaimsPurposeSAMLLogin,
+		Provider:   providerID,
+		RelayState: relayState,
+		RequestID:  authnRequest.ID,
+		Session:    session,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ss.config.StateTTL).Unix(),
+		},
+	}).SignedString(ss.jwtSecret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if binding == saml.HTTPRedirectBinding {
+		target, err := authnRequest.Redirect(relayState, sp)
+		if err != nil {
+			return nil, "", err
+		}
+		return &SAMLRequest{URL: target.String()}, stateToken, nil
+	}
+	document := etree.NewDocument()
+	document.SetRoot(authnRequest.Element())
+	encoded, err := document.WriteToBytes()
+	if err != nil {
+		return nil, "", err
+	}
+	return &SAMLRequest{
+		URL: location,
+		Form: map[string]string{
+			"SAMLRequest": base64.StdEncoding.EncodeToString(encoded),
+			"RelayState":  relayState,
+		},
+	}, stateToken, nil
+}
+
+// Complete checks the response's signature, issuer, audience, recipient,
+// validity period and the request it answers, makes sure its assertion
+// isn't replayed, and logs in the account of its user. A response without
+// a state token of this browser answering it is only accepted from
+// providers that allow IdP-initiated logins.
+func (ss *samlServiceImpl) Complete(ctx context.Context, providerID, stateToken, samlResponse, relayState string, meta LoginMeta) (*FederatedLogin, error) {
+	provider := ss.provider(providerID)
+	if provider == nil {
+		return nil, ErrProviderNotFound
+	}
+	log := logrus.WithField("provider", providerID)
+
+	var requestIDs []string
+	session := false
+	pending := &models.SAMLLoginClaims{}
+	parsed, err := jwt.ParseWithClaims(stateToken, pending, func(token *jwt.Token) (interface{}, error) {
+		return ss.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err == nil && parsed.Valid && pending.Purpose == models.ClaimsPurposeSAMLLogin &&
+		pending.Provider == providerID && pending.RelayState != "" && pending.RelayState == relayState {
+		requestIDs = []string{pending.RequestID}
+		session = pending.Session
+	} else if !provider.config.AllowIDPInitiated {
+		return nil, ErrInvalidLoginState
+	}
+
+	metadata, err := provider.idpMetadata(ctx)
+	if err != nil {
+		log.WithError(err).Error("Identity provider unavailable")
+		return nil, ErrProviderUnavailable
+	}
+	decoded, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		log.WithError(err).Warn("SAML login failed")
+		return nil, ErrFederatedLogin
+	}
+	// The library skips every InResponseTo check once IdP-initiated logins
+	// are allowed, so they only are for responses nobody here asked for
+	sp := ss.serviceProvider(provider, metadata, requestIDs == nil)
+	assertion, err := sp.ParseXMLResponse(decoded, requestIDs)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		log.WithError(err).Warn("SAML login failed")
+		return nil, ErrFederatedLogin
+	}
+	// The library only checks the recipient and request of the subject's
+	// confirmations, so there must be one
+	if !slices.ContainsFunc(assertion.Subject.SubjectConfirmations, func(confirmation saml.SubjectConfirmation) bool {
+		return confirmation.Method == "urn:oasis:names:tc:SAML:2.0:cm:bearer" && confirmation.SubjectConfirmationData != nil
+	}) {
+		log.Warn("SAML login failed: the assertion has no bearer subject confirmation")
+		return nil, ErrFederatedLogin
+	}
+	if err := ss.spend(providerID, assertion); err != nil {
+		log.WithError(err).Warn("SAML login failed")
+		return nil, ErrFederatedLogin
+	}
+
+	claims, role, err := ss.mapAssertion(provider, assertion)
+	if err != nil {
+		log.WithError(err).Warn("SAML login failed")
+		return nil, ErrFederatedLogin
+	}
+	user, created, err := ss.accounts.login(providerID, provider.config.AllowSignup, claims, meta)
+	if err != nil {
+		return nil, err
+	}
+	if role != "" && user.Role != role {
+		if user, err = updateRole(ss.accounts.userRepo, ss.accounts.bus, user, role); err != nil {
+			return nil, err
+		}
+		log.WithFields(logrus.Fields{"user_id": user.ID, "role": role}).Info("Role updated from SAML attributes")
+	}
+	return &FederatedLogin{User: user, Session: session, Created: created}, nil
+}
+
+// spend remembers the assertion's ID for as long as the assertion is
+// accepted, so it can't be used twice
+func (ss *samlServiceImpl) spend(providerID string, assertion *saml.Assertion) error {
+	if assertion.ID == "" {
+		return errors.New("the assertion has no ID")
+	}
+	replayID := "saml:" + providerID + ":" + assertion.ID
+	if ss.revocations.IsRevoked(replayID) {
+		return errors.New("the assertion was already used")
+	}
+	return ss.revocations.Revoke(&models.Claims{StandardClaims: jwt.StandardClaims{
+		Id:        replayID,
+		ExpiresAt: assertion.IssueInstant.Add(saml.MaxIssueDelay).Unix(),
+	}})
+}
+
+// mapAssertion reads the user's subject, email and username, and the role
+// their roles map onto, from the assertion. The provider vouches for the
+// email.
+func (ss *samlServiceImpl) mapAssertion(provider *samlRemoteProvider, assertion *saml.Assertion) (*providerClaims, string, error) {
+	config := provider.config
+	nameID := assertion.Subject.NameID
+	claims := &providerClaims{EmailVerified: true}
+
+	if config.SubjectAttribute != "" {
+		claims.Subject = firstValue(assertion, config.SubjectAttribute)
+	} else if nameID != nil && nameID.Format != string(saml.TransientNameIDFormat) {
+		claims.Subject = nameID.Value
+	}
+	if claims.Subject == "" {
+		return nil, "", errors.New("no lasting subject: the NameID is missing or transient, and so is the subject attribute")
+	}
+	if config.EmailAttribute != "" {
+		claims.Email = firstValue(assertion, config.EmailAttribute)
+	} else if nameID != nil && nameID.Format == string(saml.EmailAddressNameIDFormat) {
+		claims.Email = nameID.Value
+	}
+	if config.UsernameAttribute != "" {
+		claims.PreferredUsername = firstValue(assertion, config.UsernameAttribute)
+	}
+
+	role := ""
+	if config.RoleAttribute != "" {
+		role = models.RoleUser
+		for _, value := range attributeValues(assertion, config.RoleAttribute) {
+			if slices.Contains(config.AdminRoles, value) {
+				role = models.RoleAdmin
+				break
+			}
+		}
+	}
+	return claims, role, nil
+}
+
+// serviceProvider describes us to the provider with its metadata.
+// Responses must answer one of our AuthnRequests unless allowUnsolicited
+// is set.
+func (ss *samlServiceImpl) serviceProvider(provider *samlRemoteProvider, metadata *saml.EntityDescriptor, allowUnsolicited bool) *saml.ServiceProvider {
+	base := ss.config.AppURL + "/auth/saml/" + url.PathEscape(provider.config.ID)
+	metadataURL, _ := url.Parse(base + "/metadata")
+	acsURL, _ := url.Parse(base + "/acs")
+	sp := &saml.ServiceProvider{
+		Key:               ss.config.Key,
+		Certificate:       ss.config.Certificate,
+		HTTPClient:        ss.config.HTTPClient,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       metadata,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		AllowIDPInitiated: allowUnsolicited,
+	}
+	if provider.config.NameIDFormat != "" {
+		sp.AuthnNameIDFormat = saml.NameIDFormat(provider.config.NameIDFormat)
+	}
+	if sp.Key != nil {
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	return sp
+}
+
+// provider returns the configured provider with the ID, or nil
+func (ss *samlServiceImpl) provider(id string) *samlRemoteProvider {
+	for _, provider := range ss.providers {
+		if provider.config.ID == id {
+			return provider
+		}
+	}
+	return nil
+}
+
+// attributeValues returns the values of the assertion's attribute with
+// the name or friendly name
+func attributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && !strings.EqualFold(attribute.FriendlyName, name) {
+				continue
+			}
+			for _, value := range attribute.Values {
+				if value := strings.TrimSpace(value.Value); value != "" {
+					values = append(values, value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// firstValue returns the first value of the assertion's attribute, or ""
+func firstValue(assertion *saml.Assertion, name string) string {
+	if values := attributeValues(assertion, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
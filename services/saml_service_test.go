@@ -0,0 +1,310 @@
+package services_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/crewjam/saml"
+)
+
+// samlIdP is an identity provider with a freshly generated key and
+// certificate, which answers AuthnRequests with signed responses
+type samlIdP struct {
+	idp *saml.IdentityProvider
+	// sp is our service provider's metadata, as registered with the IdP
+	sp *saml.EntityDescriptor
+}
+
+func newSAMLIdP(t *testing.T) *samlIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test IdP"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.com/sso")
+	idp := &samlIdP{}
+	idp.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: idp,
+	}
+	return idp
+}
+
+// GetServiceProvider knows our service provider only
+func (idp *samlIdP) GetServiceProvider(*http.Request, string) (*saml.EntityDescriptor, error) {
+	return idp.sp, nil
+}
+
+// metadata returns what the IdP publishes about itself
+func (idp *samlIdP) metadata(t *testing.T) []byte {
+	t.Helper()
+	metadata, err := xml.Marshal(idp.idp.Metadata())
+	if err != nil {
+		t.Fatalf("marshal IdP metadata: %v", err)
+	}
+	return metadata
+}
+
+// register hands the IdP our service provider's metadata for provider
+// "corp"
+func (idp *samlIdP) register(t *testing.T, service services.SAMLService) {
+	t.Helper()
+	metadata, err := service.Metadata("corp")
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	idp.sp = &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(metadata, idp.sp); err != nil {
+		t.Fatalf("parse SP metadata: %v", err)
+	}
+}
+
+// respond logs user in for the AuthnRequest and returns the signed
+// SAMLResponse and RelayState the browser posts back
+func (idp *samlIdP) respond(t *testing.T, request *services.SAMLRequest, user saml.Session) (string, string) {
+	t.Helper()
+	authnRequest, err := saml.NewIdpAuthnRequest(idp.idp, httptest.NewRequest(http.MethodGet, request.URL, nil))
+	if err != nil {
+		t.Fatalf("read AuthnRequest: %v", err)
+	}
+	if err := authnRequest.Validate(); err != nil {
+		t.Fatalf("AuthnRequest: %v", err)
+	}
+	return idp.sign(t, authnRequest, user)
+}
+
+// respondUnasked returns a signed SAMLResponse that answers no
+// AuthnRequest, as from a login started at the IdP's portal
+func (idp *samlIdP) respondUnasked(t *testing.T, user saml.Session) string {
+	t.Helper()
+	descriptor := &idp.sp.SPSSODescriptors[0]
+	response, _ := idp.sign(t, &saml.IdpAuthnRequest{
+		IDP:                     idp.idp,
+		HTTPRequest:             httptest.NewRequest(http.MethodGet, "https://idp.example.com/start", nil),
+		Now:                     time.Now(),
+		ServiceProviderMetadata: idp.sp,
+		SPSSODescriptor:         descriptor,
+		ACSEndpoint:             &descriptor.AssertionConsumerServices[0],
+	}, user)
+	return response
+}
+
+func (idp *samlIdP) sign(t *testing.T, authnRequest *saml.IdpAuthnRequest, user saml.Session) (string, string) {
+	t.Helper()
+	user.ID, user.Index = "session-1", "1"
+	user.CreateTime, user.ExpireTime = time.Now(), time.Now().Add(time.Hour)
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(authnRequest, &user); err != nil {
+		t.Fatalf("MakeAssertion: %v", err)
+	}
+	form, err := authnRequest.PostBinding()
+	if err != nil {
+		t.Fatalf("sign the response: %v", err)
+	}
+	return form.SAMLResponse, form.RelayState
+}
+
+// samlUser is a user of the IdP with a lasting NameID
+func samlUser(subject, email string, groups ...string) saml.Session {
+	user := saml.Session{
+		NameID:       subject,
+		NameIDFormat: string(saml.PersistentNameIDFormat),
+		UserEmail:    email,
+		UserName:     strings.Split(email, "@")[0],
+	}
+	if len(groups) > 0 {
+		values := make([]saml.AttributeValue, len(groups))
+		for i, group := range groups {
+			values[i] = saml.AttributeValue{Type: "xs:string", Value: group}
+		}
+		user.CustomAttributes = []saml.Attribute{{Name: "groups", Values: values}}
+	}
+	return user
+}
+
+// newSAMLService returns a SAML service with the IdP as provider "corp",
+// registered with it
+func newSAMLService(t *testing.T, env *testEnv, idp *samlIdP, allowIDPInitiated bool) services.SAMLService {
+	t.Helper()
+	service, err := services.NewSAMLService(env.userRepo, env.identityRepo, env.history, env.revocations, env.bus, []services.SAMLProvider{{
+		ID:                "corp",
+		Name:              "Corp",
+		Metadata:          idp.metadata(t),
+		Binding:           services.SAMLBindingRedirect,
+		EmailAttribute:    "eduPersonPrincipalName",
+		UsernameAttribute: "uid",
+		RoleAttribute:     "groups",
+		AdminRoles:        []string{"admins"},
+		AllowSignup:       true,
+		AllowIDPInitiated: allowIDPInitiated,
+	}}, services.SAMLConfig{
+		JWTSecret: "test-secret",
+		AppURL:    "https://app.example.com",
+		StateTTL:  time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewSAMLService: %v", err)
+	}
+	idp.register(t, service)
+	return service
+}
+
+// beginSAMLLogin starts a login with provider "corp" and returns the
+// AuthnRequest and the browser's state token
+func beginSAMLLogin(t *testing.T, service services.SAMLService) (*services.SAMLRequest, string) {
+	t.Helper()
+	request, stateToken, err := service.Begin("corp", false)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	return request, stateToken
+}
+
+func TestSAMLLoginCreatesAndLinksAccounts(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newSAMLIdP(t)
+	service := newSAMLService(t, env, idp, false)
+	meta := services.LoginMeta{IP: "192.0.2.1"}
+
+	request, stateToken := beginSAMLLogin(t, service)
+	response, relayState := idp.respond(t, request, samlUser("u-1", "carol@corp.example"))
+	login, err := service.Complete(context.Background(), "corp", stateToken, response, relayState, meta)
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if !login.Created || login.User.Email != "carol@corp.example" || login.User.Username != "carol" || login.User.Role != models.RoleUser {
+		t.Fatalf("first login = %+v, want a new account for carol", login.User)
+	}
+	identities, err := env.identityRepo.ListByUser(login.User.ID)
+	if err != nil || len(identities) != 1 || identities[0].Provider != "corp" || identities[0].Subject != "u-1" {
+		t.Fatalf("identities = %+v, %v", identities, err)
+	}
+
+	// The same response can't log in twice
+	if _, err := service.Complete(context.Background(), "corp", stateToken, response, relayState, meta); !errors.Is(err, services.ErrFederatedLogin) {
+		t.Errorf("replayed response: got %v, want ErrFederatedLogin", err)
+	}
+
+	// The NameID finds the account again, and the groups set its role
+	request, stateToken = beginSAMLLogin(t, service)
+	response, relayState = idp.respond(t, request, samlUser("u-1", "carol@corp.example", "staff", "admins"))
+	again, err := service.Complete(context.Background(), "corp", stateToken, response, relayState, meta)
+	if err != nil || again.Created || again.User.ID != login.User.ID || again.User.Role != models.RoleAdmin {
+		t.Fatalf("second login = %+v, %v, want carol's account as an admin", again, err)
+	}
+}
+
+func TestSAMLLoginRejectsBadResponses(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newSAMLIdP(t)
+	service := newSAMLService(t, env, idp, false)
+	// Knows our SP too, but isn't the IdP configured for provider "corp"
+	impostor := newSAMLIdP(t)
+	impostor.sp = idp.sp
+
+	tests := []struct {
+		name    string
+		respond func(request *services.SAMLRequest) (string, string)
+		want    error
+	}{
+		{"altered after signing", func(request *services.SAMLRequest) (string, string) {
+			response, relayState := idp.respond(t, request, samlUser("u-1", "carol@corp.example"))
+			decoded, _ := base64.StdEncoding.DecodeString(response)
+			altered := strings.ReplaceAll(string(decoded), "carol@corp.example", "mallory@corp.example")
+			return base64.StdEncoding.EncodeToString([]byte(altered)), relayState
+		}, services.ErrFederatedLogin},
+		{"signed by another key", func(request *services.SAMLRequest) (string, string) {
+			return impostor.respond(t, request, samlUser("u-1", "carol@corp.example"))
+		}, services.ErrFederatedLogin},
+		{"transient NameID", func(request *services.SAMLRequest) (string, string) {
+			user := samlUser("u-1", "carol@corp.example")
+			user.NameIDFormat = string(saml.TransientNameIDFormat)
+			return idp.respond(t, request, user)
+		}, services.ErrFederatedLogin},
+		{"not base64", func(request *services.SAMLRequest) (string, string) {
+			_, relayState := idp.respond(t, request, samlUser("u-1", "carol@corp.example"))
+			return "<Response/>", relayState
+		}, services.ErrFederatedLogin},
+		{"another relay state", func(request *services.SAMLRequest) (string, string) {
+			response, _ := idp.respond(t, request, samlUser("u-1", "carol@corp.example"))
+			return response, "forged"
+		}, services.ErrInvalidLoginState},
+		{"unasked", func(*services.SAMLRequest) (string, string) {
+			return idp.respondUnasked(t, samlUser("u-1", "carol@corp.example")), ""
+		}, services.ErrInvalidLoginState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, stateToken := beginSAMLLogin(t, service)
+			response, relayState := tt.respond(request)
+			login, err := service.Complete(context.Background(), "corp", stateToken, response, relayState, services.LoginMeta{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %+v, %v, want %v", login, err, tt.want)
+			}
+		})
+	}
+
+	// A response to one request doesn't answer another
+	first, _ := beginSAMLLogin(t, service)
+	response, _ := idp.respond(t, first, samlUser("u-1", "carol@corp.example"))
+	second, stateToken := beginSAMLLogin(t, service)
+	_, relayState := idp.respond(t, second, samlUser("u-1", "carol@corp.example"))
+	if _, err := service.Complete(context.Background(), "corp", stateToken, response, relayState, services.LoginMeta{}); !errors.Is(err, services.ErrFederatedLogin) {
+		t.Errorf("response to another request: got %v, want ErrFederatedLogin", err)
+	}
+
+	for _, email := range []string{"carol@corp.example", "mallory@corp.example"} {
+		if _, err := env.userRepo.FindByEmail(email); err == nil {
+			t.Errorf("a rejected response created an account for %s", email)
+		}
+	}
+}
+
+func TestSAMLIDPInitiatedLogin(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	idp := newSAMLIdP(t)
+	service := newSAMLService(t, env, idp, true)
+
+	response := idp.respondUnasked(t, samlUser("u-1", "carol@corp.example"))
+	login, err := service.Complete(context.Background(), "corp", "", response, "", services.LoginMeta{IP: "192.0.2.1"})
+	if err != nil || login.User.Email != "carol@corp.example" {
+		t.Fatalf("unasked response = %+v, %v, want carol's login", login, err)
+	}
+	if _, err := service.Complete(context.Background(), "corp", "", response, "", services.LoginMeta{IP: "192.0.2.1"}); !errors.Is(err, services.ErrFederatedLogin) {
+		t.Errorf("replayed unasked response: got %v, want ErrFederatedLogin", err)
+	}
+}
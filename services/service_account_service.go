@@ -0,0 +1,577 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrServiceAccountNotFound is returned when no service account matches
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	// ErrServiceAccountConflict is returned when the name is taken
+	ErrServiceAccountConflict = errors.New("a service account with this name already exists")
+	// ErrCredentialNotFound is returned when the account has no such credential
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrInvalidPublicKey is returned for keys that can't be used to verify
+	// client assertions
+	ErrInvalidPublicKey = errors.New("public key must be a PEM encoded RSA (2048 bits or more), ECDSA or Ed25519 key")
+	// ErrInvalidOwner is returned when a service account's owner isn't an admin
+	ErrInvalidOwner = errors.New("the owner must be an admin")
+	// ErrInvalidClient is returned when a client can't be authenticated; the
+	// reason is only logged
+	ErrInvalidClient = errors.New("client authentication failed")
+)
+
+// maxAssertionLifetime caps how far in the future a client assertion may
+// expire, which bounds how long its jti has to be remembered
+const maxAssertionLifetime = 5 * time.Minute
+
+// ServiceAccountConfig holds the settings of service account tokens
+type ServiceAccountConfig struct {
+	JWTSecret string
+	TokenTTL  time.Duration
+	// TokenEndpoint is the URL client assertions must be addressed to (aud)
+	TokenEndpoint string
+}
+
+// ServiceAccountInput holds the fields of a new service account
+type ServiceAccountInput struct {
+	Name        string
+	Description string
+	Role        string
+	Scopes      []string
+}
+
+// ServiceAccountChanges holds the fields of a service account to change;
+// nil fields are left alone
+type ServiceAccountChanges struct {
+	Name        *string
+	Description *string
+	OwnerID     *uint
+	Role        *string
+	Scopes      []string
+	Disabled    *bool
+}
+
+// ClientCredentials is how a client authenticates at the token endpoint:
+// with a client secret, or with a JWT assertion signed by its private key
+type ClientCredentials struct {
+	ClientID     string
+	ClientSecret string
+	Assertion    string
+}
+
+// IssuedToken is an access token handed out by the token endpoint
+type IssuedToken struct {
+	AccessToken string
+	ExpiresIn   time.Duration
+	Scopes      []string
+	// RefreshToken is only issued to apps users logged in to
+	RefreshToken string
+	// IDToken is only issued to apps that asked for the openid scope
+	IDToken string
+}
+
+// ServiceAccountService manages service accounts, the principals other
+// backends use, and issues their tokens
+type ServiceAccountService interface {
+	// Create makes a service account owned by owner, without credentials
+	Create(owner *models.User, input ServiceAccountInput) (*models.ServiceAccount, error)
+	// List returns every service account
+	List() ([]models.ServiceAccount, error)
+	Get(id uint) (*models.ServiceAccount, error)
+	Update(id uint, changes ServiceAccountChanges) (*models.ServiceAccount, error)
+	// Delete removes a service account; its tokens stop working right away
+	Delete(id uint) error
+	// AddSecret makes a client secret for the account and returns it; it
+	// can't be retrieved again
+	AddSecret(id uint, expiresAt *time.Time) (string, *models.ServiceAccountCredential, error)
+	// AddPublicKey registers a PEM public key to verify client assertions with
+	AddPublicKey(id uint, publicKey string, expiresAt *time.Time) (*models.ServiceAccountCredential, error)
+	// RemoveCredential deletes a credential; tokens issued for it stop
+	// working right away
+	RemoveCredential(id, credentialID uint) error
+	// IssueToken implements the client_credentials grant: it authenticates
+	// the client, which needs an admin owner, and returns a token limited to the requested
+	// space-separated scopes, or to all of the account's if there are none
+	IssueToken(credentials ClientCredentials, scope string) (*IssuedToken, error)
+	// Authenticate returns the account a service account JWT belongs to,
+	// and the scopes it still grants
+	Authenticate(claims *models.Claims) (*models.ServiceAccount, []string, error)
+}
+
+// serviceAccountServiceImpl is the concrete implementation of ServiceAccountService
+type serviceAccountServiceImpl struct {
+	accountRepo repository.ServiceAccountRepository
+	userRepo    repository.UserRepository
+	revocations RevocationService
+	config      ServiceAccountConfig
+	jwtSecret   []byte
+}
+
+// NewServiceAccountService creates a new ServiceAccountService instance
+func NewServiceAccountService(accountRepo repository.ServiceAccountRepository, userRepo repository.UserRepository, revocations RevocationService, config ServiceAccountConfig) ServiceAccountService {
+	return &serviceAccountServiceImpl{
+		accountRepo: accountRepo,
+		userRepo:    userRepo,
+		revocations: revocations,
+		config:      config,
+		jwtSecret:   []byte(config.JWTSecret),
+	}
+}
+
+// Create makes a new service account with a random client ID
+func (ss *serviceAccountServiceImpl) Create(owner *models.User, input ServiceAccountInput) (*models.ServiceAccount, error) {
+	scopes, err := normalizeScopes(input.Role, false, input.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	account := &models.ServiceAccount{
+		ClientID:    "sa-" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Name:        strings.TrimSpace(input.Name),
+		Description: input.Description,
+		OwnerID:     &owner.ID,
+		Role:        input.Role,
+		Scopes:      strings.Join(scopes, " "),
+	}
+	if err := ss.accountRepo.Create(account); err != nil {
+		return nil, translateServiceAccountError(err)
+	}
+	logrus.WithFields(logrus.Fields{"client_id": account.ClientID, "owner_id": owner.ID}).Info("Service account created")
+	return account, nil
+}
+
+// List returns every service account
+func (ss *serviceAccountServiceImpl) List() ([]models.ServiceAccount, error) {
+	return ss.accountRepo.List()
+}
+
+// Get returns a service account with its credentials
+func (ss *serviceAccountServiceImpl) Get(id uint) (*models.ServiceAccount, error) {
+	account, err := ss.accountRepo.Find(id)
+	if err != nil {
+		return nil, translateServiceAccountError(err)
+	}
+	return account, nil
+}
+
+// Update applies changes to a service account. Disabling it also revokes
+// its tokens, so that enabling it again doesn't bring them back.
+func (ss *serviceAccountServiceImpl) Update(id uint, changes ServiceAccountChanges) (*models.ServiceAccount, error) {
+	account, err := ss.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if changes.Name != nil {
+		account.Name = strings.TrimSpace(*changes.Name)
+	}
+	if changes.Description != nil {
+		account.Description = *changes.Description
+	}
+	if changes.OwnerID != nil {
+		owner, err := ss.userRepo.FindByID(*changes.OwnerID)
+		if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && owner.Role != models.RoleAdmin) {
+			return nil, ErrInvalidOwner
+		}
+		if err != nil {
+			return nil, err
+		}
+		account.OwnerID = &owner.ID
+	}
+	if changes.Role != nil {
+		account.Role = *changes.Role
+	}
+	scopes := account.ScopeList()
+	if changes.Scopes != nil {
+		scopes = changes.Scopes
+	}
+	// A new role must still allow every scope
+	if scopes, err = normalizeScopes(account.Role, false, scopes); err != nil {
+		return nil, err
+	}
+	account.Scopes = strings.Join(scopes, " ")
+	if changes.Disabled != nil {
+		switch now := time.Now(); {
+		case *changes.Disabled && account.DisabledAt == nil:
+			account.DisabledAt = &now
+			account.TokensRevokedAt = &now
+		case !*changes.Disabled:
+			account.DisabledAt = nil
+		}
+	}
+
+	if err := ss.accountRepo.Update(account); err != nil {
+		return nil, translateServiceAccountError(err)
+	}
+	return account, nil
+}
+
+// Delete removes a service account
+func (ss *serviceAccountServiceImpl) Delete(id uint) error {
+	account, err := ss.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := ss.accountRepo.Delete(id); err != nil {
+		return err
+	}
+	logrus.WithField("client_id", account.ClientID).Info("Service account deleted")
+	return nil
+}
+
+// AddSecret makes and stores a new client secret
+func (ss *serviceAccountServiceImpl) AddSecret(id uint, expiresAt *time.Time) (string, *models.ServiceAccountCredential, error) {
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", nil, ErrInvalidExpiry
+	}
+	account, err := ss.Get(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	random, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	secret := models.ServiceAccountSecretPrefix + random
+	hash := hashSessionToken(secret)
+	credential := &models.ServiceAccountCredential{
+		ServiceAccountID: account.ID,
+		Kind:             models.CredentialKindSecret,
+		SecretHash:       &hash,
+		Hint:             secret[:len(models.ServiceAccountSecretPrefix)+4],
+		ExpiresAt:        expiresAt,
+	}
+	if err := ss.accountRepo.AddCredential(credential); err != nil {
+		return "", nil, err
+	}
+	logrus.WithFields(logrus.Fields{"client_id": account.ClientID, "credential_id": credential.ID}).Info("Service account secret added")
+	return secret, credential, nil
+}
+
+// AddPublicKey checks and stores a public key
+func (ss *serviceAccountServiceImpl) AddPublicKey(id uint, publicKey string, expiresAt *time.Time) (*models.ServiceAccountCredential, error) {
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, ErrInvalidExpiry
+	}
+	der, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	account, err := ss.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	credential := &models.ServiceAccountCredential{
+		ServiceAccountID: account.ID,
+		Kind:             models.CredentialKindPublicKey,
+		Hint:             "SHA256:" + base64.RawStdEncoding.EncodeToString(fingerprint[:])[:22],
+		PublicKey:        string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		ExpiresAt:        expiresAt,
+	}
+	if err := ss.accountRepo.AddCredential(credential); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"client_id": account.ClientID, "credential_id": credential.ID}).Info("Service account public key added")
+	return credential, nil
+}
+
+// RemoveCredential deletes one of the account's credentials
+func (ss *serviceAccountServiceImpl) RemoveCredential(id, credentialID uint) error {
+	err := ss.accountRepo.DeleteCredential(id, credentialID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrCredentialNotFound
+	}
+	return err
+}
+
+// IssueToken authenticates the client and signs a token for it
+func (ss *serviceAccountServiceImpl) IssueToken(credentials ClientCredentials, scope string) (*IssuedToken, error) {
+	account, credential, err := ss.authenticateClient(credentials)
+	if err != nil {
+		logrus.WithError(err).WithField("client_id", credentials.ClientID).Warn("Service account authentication failed")
+		return nil, ErrInvalidClient
+	}
+
+	granted := account.ScopeList()
+	if requested := strings.Fields(scope); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(granted, scope) {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+			}
+		}
+		granted = requested
+	}
+
+	now := time.Now()
+	if err := ss.accountRepo.TouchCredential(credential.ID, now); err != nil {
+		return nil, err
+	}
+	claims := &models.Claims{
+		Scope:        strings.Join(granted, " "),
+		CredentialID: credential.ID,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   account.Subject(),
+			Id:        uuid.New().String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ss.config.TokenTTL).Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ss.jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"client_id":     account.ClientID,
+		"credential_id": credential.ID,
+		"scope":         claims.Scope,
+	}).Info("Service account token issued")
+	return &IssuedToken{AccessToken: token, ExpiresIn: ss.config.TokenTTL, Scopes: granted}, nil
+}
+
+// authenticateClient returns the enabled account and the live credential
+// the client authenticated with
+func (ss *serviceAccountServiceImpl) authenticateClient(credentials ClientCredentials) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	var account *models.ServiceAccount
+	var credential *models.ServiceAccountCredential
+	var err error
+	switch {
+	case credentials.Assertion != "":
+		account, credential, err = ss.verifyAssertion(credentials.ClientID, credentials.Assertion)
+	case credentials.ClientSecret != "":
+		account, credential, err = ss.verifySecret(credentials.ClientID, credentials.ClientSecret)
+	default:
+		err = errors.New("no client credentials")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if account.DisabledAt != nil {
+		return nil, nil, errors.New("service account is disabled")
+	}
+	if err := ss.checkOwner(account); err != nil {
+		return nil, nil, err
+	}
+	if credential.Expired(time.Now()) {
+		return nil, nil, errors.New("credential has expired")
+	}
+	return account, credential, nil
+}
+
+// verifySecret looks the account up by the hash of the secret
+func (ss *serviceAccountServiceImpl) verifySecret(clientID, secret string) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	hash := hashSessionToken(secret)
+	account, err := ss.accountRepo.FindBySecretHash(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if account.ClientID != clientID {
+		return nil, nil, errors.New("secret belongs to another client")
+	}
+	for i := range account.Credentials {
+		if sh := account.Credentials[i].SecretHash; sh != nil && *sh == hash {
+			return account, &account.Credentials[i], nil
+		}
+	}
+	return nil, nil, gorm.ErrRecordNotFound
+}
+
+// verifyAssertion checks a private_key_jwt client assertion (RFC 7523):
+// signed by one of the account's keys, issued by and about the client,
+// addressed to the token endpoint, short-lived and not seen before
+func (ss *serviceAccountServiceImpl) verifyAssertion(clientID, assertion string) (*models.ServiceAccount, *models.ServiceAccountCredential, error) {
+	unverified := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, unverified); err != nil {
+		return nil, nil, err
+	}
+	if clientID == "" {
+		clientID = unverified.Issuer
+	}
+	account, err := ss.accountRepo.FindByClientID(clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range account.Credentials {
+		credential := &account.Credentials[i]
+		if credential.Kind != models.CredentialKindPublicKey {
+			continue
+		}
+		claims := &jwt.RegisteredClaims{}
+		token, err := jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+			return verificationKey(credential.PublicKey, token.Method)
+		})
+		if err != nil || !token.Valid {
+			continue
+		}
+
+		now := time.Now()
+		switch {
+		case claims.Issuer != clientID || claims.Subject != clientID:
+			return nil, nil, errors.New("assertion iss and sub must be the client ID")
+		case !claims.VerifyAudience(ss.config.TokenEndpoint, true):
+			return nil, nil, errors.New("assertion aud must be the token endpoint")
+		case claims.ExpiresAt == nil || claims.ExpiresAt.After(now.Add(maxAssertionLifetime)):
+			return nil, nil, errors.New("assertion must expire within 5 minutes")
+		case claims.ID == "":
+			return nil, nil, errors.New("assertion has no jti")
+		}
+		// Remember the jti until the assertion expires, so it can't be
+		// replayed
+		replayID := "assertion:" + clientID + ":" + claims.ID
+		if ss.revocations.IsRevoked(replayID) {
+			return nil, nil, errors.New("assertion was already used")
+		}
+		err = ss.revocations.Revoke(&models.Claims{StandardClaims: jwt.StandardClaims{
+			Id:        replayID,
+			ExpiresAt: claims.ExpiresAt.Unix(),
+		}})
+		if err != nil {
+			return nil, nil, err
+		}
+		return account, credential, nil
+	}
+	return nil, nil, errors.New("assertion is not signed by a registered key")
+}
+
+// Authenticate checks that a service account token's account is still
+// enabled and owned, and its credential still there
+func (ss *serviceAccountServiceImpl) Authenticate(claims *models.Claims) (*models.ServiceAccount, []string, error) {
+	account, err := ss.accountRepo.FindByClientID(strings.TrimPrefix(claims.Subject, models.SubjectServiceAccountPrefix))
+	if err != nil {
+		return nil, nil, translateServiceAccountError(err)
+	}
+	if account.DisabledAt != nil {
+		return nil, nil, ErrInvalidClient
+	}
+	if err := ss.checkOwner(account); err != nil {
+		logrus.WithError(err).WithField("client_id", account.ClientID).Warn("Service account token refused")
+		return nil, nil, ErrInvalidClient
+	}
+	if account.TokensRevokedAt != nil && claims.IssuedAt <= account.TokensRevokedAt.Unix() {
+		return nil, nil, ErrInvalidClient
+	}
+	live := false
+	for _, credential := range account.Credentials {
+		if credential.ID == claims.CredentialID && !credential.Expired(time.Now()) {
+			live = true
+		}
+	}
+	if !live {
+		return nil, nil, ErrInvalidClient
+	}
+
+	// Scopes taken away since the token was issued no longer count
+	allowed := account.ScopeList()
+	var scopes []string
+	for _, scope := range claims.ScopeList() {
+		if slices.Contains(allowed, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return account, scopes, nil
+}
+
+// checkOwner fails unless an admin still answers for the account. The
+// owner may have been purged, deleted or demoted since; the account then
+// does nothing until it gets a new owner, rather than keep its role with
+// nobody responsible for it.
+func (ss *serviceAccountServiceImpl) checkOwner(account *models.ServiceAccount) error {
+	if account.OwnerID == nil {
+		return errors.New("service account has no owner")
+	}
+	owner, err := ss.userRepo.FindProfile(*account.OwnerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.New("service account owner no longer exists")
+	}
+	if err != nil {
+		return err
+	}
+	if owner.Role != models.RoleAdmin {
+		return errors.New("service account owner is no longer an admin")
+	}
+	return nil
+}
+
+// parsePublicKey checks a PEM public key and returns its DER encoding
+func parsePublicKey(publicKey string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(publicKey)))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidPublicKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, ErrInvalidPublicKey
+		}
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, ErrInvalidPublicKey
+	}
+	return block.Bytes, nil
+}
+
+// verificationKey returns the key of a stored PEM public key, if method
+// is an algorithm for that kind of key
+func verificationKey(publicKey string, method jwt.SigningMethod) (interface{}, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, ErrInvalidPublicKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodEd25519:
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", method.Alg())
+}
+
+// translateServiceAccountError maps repository errors onto service errors
+func translateServiceAccountError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrServiceAccountNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return ErrServiceAccountConflict
+	default:
+		return err
+	}
+}
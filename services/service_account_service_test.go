@@ -0,0 +1,83 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestServiceAccountNeedsAnAdminOwner(t *testing.T) {
+	env := newTestEnv(t, repository.NewMemoryUserRepository())
+	accounts := services.NewServiceAccountService(repository.NewMemoryServiceAccountRepository(), env.userRepo, env.revocations,
+		services.ServiceAccountConfig{JWTSecret: "test-secret", TokenTTL: time.Hour})
+
+	promote := func(user *models.User, role string) {
+		t.Helper()
+		user.Role = role
+		if err := env.userRepo.Update(user, user.Version); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+	owner := createUser(t, env.userRepo, "owner", "correct horse 1")
+	promote(owner, models.RoleAdmin)
+	successor := createUser(t, env.userRepo, "successor", "correct horse 1")
+	promote(successor, models.RoleAdmin)
+
+	account, err := accounts.Create(owner, services.ServiceAccountInput{Name: "backup", Role: models.RoleAdmin, Scopes: []string{models.ScopeUsersRead}})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	secret, _, err := accounts.AddSecret(account.ID, nil)
+	if err != nil {
+		t.Fatalf("AddSecret: %v", err)
+	}
+	credentials := services.ClientCredentials{ClientID: account.ClientID, ClientSecret: secret}
+	issued, err := accounts.IssueToken(credentials, "")
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	claims := &models.Claims{}
+	if _, err := jwt.ParseWithClaims(issued.AccessToken, claims, func(*jwt.Token) (interface{}, error) { return []byte("test-secret"), nil }); err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	works := func() bool {
+		t.Helper()
+		_, issueErr := accounts.IssueToken(credentials, "")
+		_, _, authErr := accounts.Authenticate(claims)
+		if (issueErr == nil) != (authErr == nil) {
+			t.Fatalf("IssueToken = %v but Authenticate = %v", issueErr, authErr)
+		}
+		if issueErr != nil && !errors.Is(issueErr, services.ErrInvalidClient) {
+			t.Fatalf("IssueToken: %v", issueErr)
+		}
+		return issueErr == nil
+	}
+	if !works() {
+		t.Fatal("the account doesn't work with an admin owner")
+	}
+
+	promote(owner, models.RoleUser)
+	if works() {
+		t.Error("the account still works after its owner was demoted")
+	}
+
+	if _, err := accounts.Update(account.ID, services.ServiceAccountChanges{OwnerID: &successor.ID}); err != nil {
+		t.Fatalf("reassign: %v", err)
+	}
+	if !works() {
+		t.Error("the account doesn't work after it was reassigned")
+	}
+
+	if err := env.userRepo.Delete(successor.ID, successor.Version); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if works() {
+		t.Error("the account still works after its owner was deleted")
+	}
+}
@@ -0,0 +1,133 @@
+package services_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gin-tutorial/mailer"
+	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+)
+
+func TestMain(m *testing.M) {
+	// Cheap hashes keep the tests fast; the parameters don't matter here
+	models.Passwords = password.MustNewRegistry(password.Options{
+		Argon2: password.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+	})
+	os.Exit(m.Run())
+}
+
+// captureMailer keeps every message it is asked to send
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (cm *captureMailer) Send(msg mailer.Message) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.sent = append(cm.sent, msg)
+	return nil
+}
+
+// messages returns what was sent so far; mail goes out in the background,
+// so it waits briefly for at least want messages
+func (cm *captureMailer) messages(want int) []mailer.Message {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		cm.mu.Lock()
+		sent := append([]mailer.Message(nil), cm.sent...)
+		cm.mu.Unlock()
+		if len(sent) >= want || time.Now().After(deadline) {
+			return sent
+		}
+	}
+}
+
+// testEnv wires the services the way main does, over in-memory repositories
+type testEnv struct {
+	bus      pubsub.Bus
+	mail     *captureMailer
+	hashPool *password.Pool
+
+	userRepo      repository.UserRepository
+	userTokenRepo repository.UserTokenRepository
+	loginEvents   repository.LoginEventRepository
+	identityRepo  repository.IdentityRepository
+	attemptRepo   repository.LoginAttemptRepository
+
+	loginGuard  services.LoginGuard
+	history     services.LoginHistory
+	tokens      services.TokenService
+	users       services.UserService
+	revocations services.RevocationService
+	mfa         services.MFAService
+}
+
+func newTestEnv(t *testing.T, userRepo repository.UserRepository) *testEnv {
+	t.Helper()
+	env := &testEnv{
+		bus:           pubsub.NewLocalBus(),
+		mail:          &captureMailer{},
+		hashPool:      password.NewPool(2, 10, time.Second),
+		userRepo:      userRepo,
+		userTokenRepo: repository.NewMemoryUserTokenRepository(),
+		loginEvents:   repository.NewMemoryLoginEventRepository(),
+		identityRepo:  repository.NewMemoryIdentityRepository(),
+		attemptRepo:   repository.NewMemoryLoginAttemptRepository(),
+	}
+	env.loginGuard = services.NewLoginGuard(env.attemptRepo, services.LockoutPolicy{
+		MaxAccountFailures: 5,
+		Window:             time.Minute,
+		Lockout:            time.Minute,
+	})
+	env.history = services.NewLoginHistory(env.loginEvents, env.mail, services.LoginHistoryConfig{
+		Alerts:        true,
+		FailureBurst:  3,
+		FailureWindow: time.Hour,
+	})
+	env.tokens = services.NewTokenService(env.userTokenRepo, "test-secret")
+	env.revocations = services.NewRevocationService(repository.NewMemoryRevokedTokenRepository(), env.bus)
+	env.authenticate(nil)
+	return env
+}
+
+// authenticate (re)creates the services that check passwords, with the
+// authenticators given; only the local one when nil
+func (env *testEnv) authenticate(authenticators []services.Authenticator) {
+	env.users = services.NewUserService(env.userRepo, repository.NewMemoryPasswordHistoryRepository(), env.identityRepo,
+		env.tokens, env.loginGuard, env.history, services.NewRateLimiter(env.attemptRepo), env.bus, env.mail, env.hashPool,
+		services.UserServiceConfig{
+			JWTSecret:        "test-secret",
+			AppURL:           "https://app.example.com",
+			PasswordResetTTL: time.Hour,
+			VerificationTTL:  time.Hour,
+			Authenticators:   authenticators,
+		})
+	env.mfa = services.NewMFAService(env.userRepo, repository.NewMemoryRecoveryCodeRepository(), env.revocations,
+		env.loginGuard, env.history, env.bus, env.hashPool, services.MFAServiceConfig{
+			JWTSecret:      "test-secret",
+			Issuer:         "test",
+			ChallengeTTL:   time.Minute,
+			RecoveryCodes:  8,
+			Authenticators: authenticators,
+		})
+}
+
+// createUser stores a verified user with password
+func createUser(t *testing.T, repo repository.UserRepository, name, pass string) *models.User {
+	t.Helper()
+	now := time.Now()
+	user := &models.User{Username: name, Email: name + "@example.com", Password: pass, VerifiedAt: &now}
+	if err := user.HashPassword(); err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if err := repo.Create(user); err != nil {
+		t.Fatalf("Create %s: %v", name, err)
+	}
+	return user
+}
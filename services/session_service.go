@@ -0,0 +1,369 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/mssola/useragent"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidSession is returned for session cookies that are unknown,
+	// expired or idle for too long
+	ErrInvalidSession = errors.New("invalid or expired session")
+	// ErrSessionNotFound is returned when the user has no such session
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// SessionConfig holds the timeouts of login sessions
+type SessionConfig struct {
+	// TokenTTL is how long a JWT, and so its session, lasts
+	TokenTTL time.Duration
+	// IdleTimeout ends a cookie session after this long without requests
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends a cookie session this long after login, however
+	// active
+	AbsoluteTimeout time.Duration
+	// ClientTokenTTL is how long an access token issued to an OAuth client
+	// lasts
+	ClientTokenTTL time.Duration
+}
+
+// SessionService records every login as a session users can review and end
+type SessionService interface {
+	// StartTokenSession records a login handed a JWT, whose jti must be the
+	// session's ID and which must expire with it
+	StartTokenSession(user *models.User, meta LoginMeta) (*models.Session, error)
+	// StartCookieSession starts a browser session and returns the cookie
+	// value for it
+	StartCookieSession(user *models.User, meta LoginMeta) (string, *models.Session, error)
+	// StartClientSession records an access token issued to an OAuth client
+	// on the user's behalf; like a token session, the JWT's jti must be
+	// the session's ID
+	StartClientSession(user *models.User, meta LoginMeta, client *models.OAuthClient, scopes []string) (*models.Session, error)
+	// Authenticate returns the live cookie session a cookie value belongs
+	// to and records the activity
+	Authenticate(token string) (*models.Session, error)
+	// Seen records activity on a token session
+	Seen(id string)
+	// List returns the user's live sessions, newest first
+	List(user *models.User) ([]models.Session, error)
+	// Revoke ends one of the user's sessions; a revoked JWT is refused
+	// right away on every instance
+	Revoke(userID uint, id string) error
+	// RevokeOthers ends every session of the user except keepID and
+	// returns how many it ended
+	RevokeOthers(user *models.User, keepID string) (int, error)
+	// RevokeClient ends the sessions of an OAuth client, of one user or of
+	// every user when userID is 0, and returns how many it ended
+	RevokeClient(clientID string, userID uint) (int, error)
+	// DeleteExpired removes expired and idle sessions from storage
+	DeleteExpired() (int64, error)
+	// IdleExpiry is when a cookie session ends if it isn't used before then
+	IdleExpiry(session *models.Session) time.Time
+}
+
+// sessionServiceImpl is the concrete implementation of SessionService
+type sessionServiceImpl struct {
+	sessionRepo repository.SessionRepository
+	revocations RevocationService
+	config      SessionConfig
+
+	// lastTouched throttles activity writes of token sessions per instance
+	mu          sync.Mutex
+	lastTouched map[string]time.Time
+}
+
+// NewSessionService creates a new SessionService instance
+func NewSessionService(sessionRepo repository.SessionRepository, revocations RevocationService, config SessionConfig) SessionService {
+	return &sessionServiceImpl{
+		sessionRepo: sessionRepo,
+		revocations: revocations,
+		config:      config,
+		lastTouched: make(map[string]time.Time),
+	}
+}
+
+// StartTokenSession records a JWT login
+func (ss *sessionServiceImpl) StartTokenSession(user *models.User, meta LoginMeta) (*models.Session, error) {
+	session := ss.newSession(user, meta, models.SessionKindToken, ss.config.TokenTTL)
+	if err := ss.sessionRepo.Create(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// StartCookieSession starts a browser session with its own CSRF token
+func (ss *sessionServiceImpl) StartCookieSession(user *models.User, meta LoginMeta) (string, *models.Session, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	session := ss.newSession(user, meta, models.SessionKindCookie, ss.config.AbsoluteTimeout)
+	tokenHash := hashSessionToken(token)
+	session.TokenHash = &tokenHash
+	session.CSRFToken = csrfToken
+	if err := ss.sessionRepo.Create(session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// StartClientSession records an access token issued to an OAuth client.
+// The session is named after the client rather than the device, which is
+// often a server.
+func (ss *sessionServiceImpl) StartClientSession(user *models.User, meta LoginMeta, client *models.OAuthClient, scopes []string) (*models.Session, error) {
+	session := ss.newSession(user, meta, models.SessionKindOAuth, ss.config.ClientTokenTTL)
+	session.Device = truncate(client.Name, 128)
+	session.ClientID = client.ClientID
+	session.Scopes = strings.Join(scopes, " ")
+	if err := ss.sessionRepo.Create(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// newSession describes a login made now from meta's device
+func (ss *sessionServiceImpl) newSession(user *models.User, meta LoginMeta, kind string, ttl time.Duration) *models.Session {
+	now := time.Now()
+	return &models.Session{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		Kind:       kind,
+		IP:         meta.IP,
+		UserAgent:  truncate(meta.UserAgent, 512),
+		Device:     describeDevice(meta.UserAgent),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// Authenticate checks both timeouts of a cookie session. Activity is only
+// written every so often, so that a busy session doesn't cost a database
+// write per request.
+func (ss *sessionServiceImpl) Authenticate(token string) (*models.Session, error) {
+	session, err := ss.sessionRepo.FindByTokenHash(hashSessionToken(token))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !now.Before(session.ExpiresAt) || !now.Before(ss.IdleExpiry(session)) {
+		return nil, ErrInvalidSession
+	}
+	if now.Sub(session.LastSeenAt) >= ss.touchInterval() {
+		if err := ss.sessionRepo.Touch(session.ID, now); err != nil {
+			return nil, err
+		}
+		session.LastSeenAt = now
+	}
+	return session, nil
+}
+
+// Seen records activity on a token session, at most once per touch
+// interval per instance. Failures only cost an outdated last-seen time.
+func (ss *sessionServiceImpl) Seen(id string) {
+	now := time.Now()
+	ss.mu.Lock()
+	if now.Sub(ss.lastTouched[id]) < ss.touchInterval() {
+		ss.mu.Unlock()
+		return
+	}
+	ss.lastTouched[id] = now
+	ss.mu.Unlock()
+
+	_ = ss.sessionRepo.Touch(id, now)
+}
+
+// touchInterval is how stale a session's last-seen time may get
+func (ss *sessionServiceImpl) touchInterval() time.Duration {
+	if ss.config.IdleTimeout <= 0 {
+		return time.Minute
+	}
+	return min(time.Minute, ss.config.IdleTimeout/10)
+}
+
+// List returns the user's live sessions. Sessions from before the user's
+// sessions were last revoked (e.g. by a password reset) no longer work and
+// are left out.
+func (ss *sessionServiceImpl) List(user *models.User) ([]models.Session, error) {
+	now := time.Now()
+	sessions, err := ss.sessionRepo.ListByUser(user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	live := sessions[:0]
+	for _, session := range sessions {
+		if session.Kind == models.SessionKindCookie && !now.Before(ss.IdleExpiry(&session)) {
+			continue
+		}
+		if user.SessionsRevokedAt != nil && !session.CreatedAt.After(*user.SessionsRevokedAt) {
+			continue
+		}
+		if session.Kind != models.SessionKindCookie && ss.revocations.IsRevoked(session.ID) {
+			continue
+		}
+		live = append(live, session)
+	}
+	return live, nil
+}
+
+// Revoke ends one of the user's sessions
+func (ss *sessionServiceImpl) Revoke(userID uint, id string) error {
+	session, err := ss.sessionRepo.Find(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && session.UserID != userID) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ss.end(session)
+}
+
+// RevokeOthers ends every session of the user except keepID
+func (ss *sessionServiceImpl) RevokeOthers(user *models.User, keepID string) (int, error) {
+	sessions, err := ss.List(user)
+	if err != nil {
+		return 0, err
+	}
+
+	ended := 0
+	for i := range sessions {
+		if sessions[i].ID == keepID {
+			continue
+		}
+		if err := ss.end(&sessions[i]); err != nil {
+			return ended, err
+		}
+		ended++
+	}
+	return ended, nil
+}
+
+// RevokeClient ends the sessions of an OAuth client
+func (ss *sessionServiceImpl) RevokeClient(clientID string, userID uint) (int, error) {
+	sessions, err := ss.sessionRepo.ListByClient(clientID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	ended := 0
+	for i := range sessions {
+		if userID != 0 && sessions[i].UserID != userID {
+			continue
+		}
+		if err := ss.end(&sessions[i]); err != nil {
+			return ended, err
+		}
+		ended++
+	}
+	return ended, nil
+}
+
+// end deletes a session. The JWT of a token or OAuth session is revoked
+// first, since requests made with it don't look the session up.
+func (ss *sessionServiceImpl) end(session *models.Session) error {
+	if session.Kind != models.SessionKindCookie {
+		err := ss.revocations.Revoke(&models.Claims{
+			UserID: session.UserID,
+			StandardClaims: jwt.StandardClaims{
+				Id:        session.ID,
+				ExpiresAt: session.ExpiresAt.Unix(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return ss.sessionRepo.Delete(session.ID)
+}
+
+// DeleteExpired removes expired and idle sessions from storage
+func (ss *sessionServiceImpl) DeleteExpired() (int64, error) {
+	now := time.Now()
+
+	ss.mu.Lock()
+	for id, touched := range ss.lastTouched {
+		if now.Sub(touched) >= ss.touchInterval() {
+			delete(ss.lastTouched, id)
+		}
+	}
+	ss.mu.Unlock()
+
+	return ss.sessionRepo.DeleteExpired(now, now.Add(-ss.config.IdleTimeout))
+}
+
+// IdleExpiry is when a cookie session ends if it isn't used before then
+func (ss *sessionServiceImpl) IdleExpiry(session *models.Session) time.Time {
+	return session.LastSeenAt.Add(ss.config.IdleTimeout)
+}
+
+// describeDevice summarizes a User-Agent header, e.g. "Firefox on Linux"
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	ua := useragent.New(userAgent)
+	browser, _ := ua.Browser()
+	os := ua.OSInfo().Name
+	switch {
+	case ua.Bot():
+		return truncate("Bot: "+browser, 128)
+	case browser == "" && os == "":
+		return truncate(userAgent, 128)
+	case os == "":
+		return truncate(browser, 128)
+	case browser == "":
+		return truncate(os, 128)
+	}
+	device := browser + " on " + os
+	if ua.Mobile() {
+		device += " (mobile)"
+	}
+	return truncate(device, 128)
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// randomToken returns 256 random bits, URL-safe encoded
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashSessionToken returns the hash a session cookie value is stored under
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidToken is returned for tokens that are forged, unknown, expired,
+// already used or meant for something else
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// TokenService issues and redeems single-use tokens that are mailed to users
+type TokenService interface {
+	// Issue creates a token for purpose sent to user's current email
+	Issue(user *models.User, purpose string, ttl time.Duration) (string, error)
+	// Consume redeems a token for purpose; it can't be used again
+	Consume(token, purpose string) (*models.UserToken, error)
+	// Peek checks a token for purpose like Consume, without using it up
+	Peek(token, purpose string) (*models.UserToken, error)
+	// Latest returns the newest token issued to a user for purpose, if any
+	Latest(userID uint, purpose string) (*models.UserToken, error)
+	// Invalidate uses up the user's outstanding tokens for purpose
+	Invalidate(userID uint, purpose string) error
+}
+
+// tokenServiceImpl is the concrete implementation of TokenService. Tokens
+// look like <id>.<signature>: the ID is random and only its SHA-256 hash is
+// stored, the signature is an HMAC of purpose and ID, so a token can't be
+// recovered or made from the table alone.
+type tokenServiceImpl struct {
+	tokenRepo repository.UserTokenRepository
+	key       []byte
+}
+
+// NewTokenService creates a TokenService signing with a key derived from secret
+func NewTokenService(tokenRepo repository.UserTokenRepository, secret string) TokenService {
+	// Derive a separate key so these signatures can't be confused with JWTs
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("user-tokens"))
+	return &tokenServiceImpl{tokenRepo: tokenRepo, key: mac.Sum(nil)}
+}
+
+// Issue creates and stores a new token
+func (ts *tokenServiceImpl) Issue(user *models.User, purpose string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	err := ts.tokenRepo.Create(&models.UserToken{
+		ID:        hashTokenID(id),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return id + "." + ts.sign(purpose, id), nil
+}
+
+// Consume checks the signature, then uses up the token
+func (ts *tokenServiceImpl) Consume(token, purpose string) (*models.UserToken, error) {
+	id, err := ts.verify(token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	consumed, err := ts.tokenRepo.Consume(hashTokenID(id), purpose, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	return consumed, err
+}
+
+// Peek checks the signature and that the token is still usable
+func (ts *tokenServiceImpl) Peek(token, purpose string) (*models.UserToken, error) {
+	id, err := ts.verify(token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := ts.tokenRepo.FindActive(hashTokenID(id), purpose, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	return found, err
+}
+
+// Latest returns the newest token issued to a user for purpose, or nil
+func (ts *tokenServiceImpl) Latest(userID uint, purpose string) (*models.UserToken, error) {
+	token, err := ts.tokenRepo.Latest(userID, purpose)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return token, err
+}
+
+// Invalidate uses up the user's outstanding tokens for purpose
+func (ts *tokenServiceImpl) Invalidate(userID uint, purpose string) error {
+	return ts.tokenRepo.Invalidate(userID, purpose, time.Now())
+}
+
+// verify checks a token's signature and returns its ID
+func (ts *tokenServiceImpl) verify(token, purpose string) (string, error) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(ts.sign(purpose, id))) {
+		return "", ErrInvalidToken
+	}
+	return id, nil
+}
+
+func (ts *tokenServiceImpl) sign(purpose, id string) string {
+	mac := hmac.New(sha256.New, ts.key)
+	mac.Write([]byte(purpose + "." + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashTokenID is what is stored in place of a token's ID
+func hashTokenID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
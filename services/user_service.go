@@ -1,42 +1,188 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"gin-tutorial/mailer"
 	"gin-tutorial/models"
+	"gin-tutorial/password"
+	"gin-tutorial/pubsub"
 	"gin-tutorial/repository"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
-var jwtSecretKey = []byte("your_jwt_secret_key")
+var (
+	// ErrInvalidCredentials is the one error every failed login gets, so the
+	// response doesn't reveal whether the email exists or is locked out
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUserNotFound is returned when the target user doesn't exist (or is
+	// in the wrong soft-delete state for the operation)
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserConflict is returned when an active user already has the email or username
+	ErrUserConflict = errors.New("a user with this email or username already exists")
+	// ErrInvalidFilter is returned for an unknown ?deleted= value
+	ErrInvalidFilter = errors.New("deleted must be one of include or only")
+	// ErrVersionConflict is returned when the user changed since the caller read it
+	ErrVersionConflict = errors.New("user has been modified by someone else")
+	// ErrWrongPassword is returned when the current password given to
+	// confirm a change is wrong
+	ErrWrongPassword = errors.New("current password is incorrect")
+	// ErrNoPassword is returned by ConfirmPassword for accounts that have no
+	// password to confirm
+	ErrNoPassword = errors.New("account has no password")
+	// ErrDirectoryAccount is returned when changing or resetting the
+	// password of an account whose password lives in the LDAP directory,
+	// or unlinking the account from its directory entry
+	ErrDirectoryAccount = errors.New("the password of this account is managed by the LDAP directory")
+	// ErrEmailNotVerified is returned by LoginUser, after a correct password,
+	// when verified emails are required and the user's isn't
+	ErrEmailNotVerified = errors.New("email address has not been verified")
+)
+
+// LoginMeta describes the client a login comes from
+type LoginMeta struct {
+	IP        string
+	UserAgent string
+}
+
+// UserChanges lists the fields UpdateUser changes; nil fields are left alone
+type UserChanges struct {
+	Username *string
+	Email    *string
+	Role     *string
+}
+
+// UserServiceConfig holds the settings of the user service
+type UserServiceConfig struct {
+	JWTSecret string
+	// PrivateRegistration hides whether an email is already registered:
+	// RegisterUser always succeeds from the caller's point of view and the
+	// owner of the existing account is told by email instead
+	PrivateRegistration bool
+	// PasswordPolicy applies to every password a user chooses
+	PasswordPolicy password.Policy
+	// PasswordHistory is how many recent passwords can't be chosen again
+	PasswordHistory int
+	// RequireVerifiedEmail refuses logins until the email is verified
+	RequireVerifiedEmail bool
+	// VerificationTTL is how long an email verification link works
+	VerificationTTL time.Duration
+	// VerificationResendInterval is how often a verification email can be resent
+	VerificationResendInterval time.Duration
+	// AppURL is where links in emails point to
+	AppURL string
+	// PasswordResetTTL is how long a password reset link works
+	PasswordResetTTL time.Duration
+	// ResetEmailLimit and ResetIPLimit throttle the password reset endpoints
+	ResetEmailLimit RateLimit
+	ResetIPLimit    RateLimit
+
+	// Authenticators are asked in turn to check the password of a login;
+	// only the local one when empty
+	Authenticators []Authenticator
+}
 
 // UserService defines the interface for the user service
 type UserService interface {
+	// RegisterUser returns a nil user (and nil error) when private
+	// registration hides the outcome
 	RegisterUser(username, email, password string) (*models.User, error)
-	LoginUser(email, password string) (*models.User, error)
-	GenerateJWT(username string) (string, error)
+	LoginUser(email, password string, meta LoginMeta) (*models.User, error)
+	// GenerateJWT issues the token of a token or OAuth session started for
+	// user
+	GenerateJWT(user *models.User, session *models.Session) (string, error)
+	// GetProfile returns a user without its password hash and TOTP secret;
+	// it may come from the cache
 	GetProfile(userID uint) (*models.User, error)
+	// GetUserIncludingDeleted is GetProfile that finds soft-deleted users
+	// too, never from the cache
+	GetUserIncludingDeleted(userID uint) (*models.User, error)
+	ListUsers(deleted string) ([]models.User, error)
+	UpdateUser(userID uint, expectedVersion uint, changes UserChanges) (*models.User, error)
+	DeleteUser(userID uint, expectedVersion uint) error
+	RestoreUser(userID uint) (*models.User, error)
+	PurgeUser(userID uint, expectedVersion uint) error
+	PurgeDeletedUsers(retention time.Duration) (int64, error)
+	UnlockUser(userID uint) error
+	// ChangePassword sets a new password after checking the current one.
+	// It fails with ErrDirectoryAccount for accounts of the LDAP directory.
+	ChangePassword(userID uint, currentPassword, newPassword string) error
+	// ConfirmPassword re-authenticates a logged-in user before a sensitive
+	// change, with the authenticators logins use. Failures count against
+	// the login lockout like logins do. It fails with ErrNoPassword for
+	// accounts without a password.
+	ConfirmPassword(userID uint, password string, meta LoginMeta) error
+	// VerifyEmail marks the email a verification token was sent to as verified
+	VerifyEmail(token string) error
+	// ResendVerification mails a new verification token, unless the email is
+	// unknown, already verified or was sent one too recently. It doesn't
+	// report which, so it can't be used to probe for accounts.
+	ResendVerification(email string) error
+	// ForgotPassword mails a password reset link, or for accounts of the
+	// LDAP directory a note that the password is reset there. Like
+	// ResendVerification it doesn't report whether the email is registered.
+	ForgotPassword(email, ip string) error
+	// ResetPassword sets a new password with a reset token and revokes every
+	// session and personal access token of the user. It fails with
+	// ErrDirectoryAccount for accounts of the LDAP directory.
+	ResetPassword(token, newPassword, ip string) error
 }
 
 // userServiceImpl is the concrete implementation of UserService
 type userServiceImpl struct {
-	userRepo repository.UserRepository
+	userRepo     repository.UserRepository
+	historyRepo  repository.PasswordHistoryRepository
+	identityRepo repository.IdentityRepository
+	tokens       TokenService
+	loginGuard   LoginGuard
+	history      LoginHistory
+	rateLimiter  RateLimiter
+	bus          pubsub.Bus
+	mailer       mailer.Mailer
+	hashPool     *password.Pool
+	config       UserServiceConfig
+	jwtSecret    []byte
+
+	authenticators []Authenticator
 }
 
 // NewUserService creates a new UserService instance
-func NewUserService(userRepo repository.UserRepository) UserService {
+func NewUserService(userRepo repository.UserRepository, historyRepo repository.PasswordHistoryRepository, identityRepo repository.IdentityRepository, tokens TokenService, loginGuard LoginGuard, history LoginHistory, rateLimiter RateLimiter, bus pubsub.Bus, mailer mailer.Mailer, hashPool *password.Pool, config UserServiceConfig) UserService {
+	authenticators := config.Authenticators
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{NewLocalAuthenticator(userRepo, bus, hashPool)}
+	}
+
 	return &userServiceImpl{
-		userRepo: userRepo,
+		userRepo:     userRepo,
+		historyRepo:  historyRepo,
+		identityRepo: identityRepo,
+		tokens:       tokens,
+		loginGuard:   loginGuard,
+		history:      history,
+		rateLimiter:  rateLimiter,
+		bus:          bus,
+		mailer:       mailer,
+		hashPool:     hashPool,
+		config:       config,
+		jwtSecret:    []byte(config.JWTSecret),
+
+		authenticators: authenticators,
 	}
 }
 
 // RegisterUser handles user registration
 func (us *userServiceImpl) RegisterUser(username, email, password string) (*models.User, error) {
-	// Check if user exists
-	existingUser, _ := us.userRepo.FindByEmail(email)
-	if existingUser != nil {
-		return nil, errors.New("user with this email already exists")
+	if err := us.config.PasswordPolicy.Check(password, username, email); err != nil {
+		return nil, err
 	}
 
 	// Create user object
@@ -44,52 +190,687 @@ func (us *userServiceImpl) RegisterUser(username, email, password string) (*mode
 		Username: username,
 		Email:    email,
 		Password: password,
+		Role:     models.RoleUser,
 	}
 
-	// Hash password
-	if err := user.HashPassword(); err != nil {
+	// Hash password first, so taken and free emails cost the same time
+	var hashErr error
+	if err := us.hashPool.Do(func() { hashErr = user.HashPassword() }); err != nil {
+		return nil, err
+	}
+	if hashErr != nil {
 		return nil, errors.New("failed to hash password")
 	}
 
+	// Check if user exists
+	existingUser, _ := us.userRepo.FindByEmail(email)
+	if existingUser != nil {
+		if us.config.PrivateRegistration {
+			us.sendMail(mailer.Message{
+				To:      existingUser.Email,
+				Subject: "Someone tried to register with your email",
+				Body: "Somebody tried to create a new account with this email address, " +
+					"which already has an account. If this was you, log in with your " +
+					"existing password instead. Otherwise you can ignore this email.",
+			})
+			return nil, nil
+		}
+		return nil, errors.New("user with this email already exists")
+	}
+
 	// Save user to database
 	if err := us.userRepo.Create(&user); err != nil {
+		if us.config.PrivateRegistration && errors.Is(err, gorm.ErrDuplicatedKey) {
+			// Only the username can clash here; tell the address that asked
+			us.sendMail(mailer.Message{
+				To:      email,
+				Subject: "Your registration could not be completed",
+				Body:    fmt.Sprintf("The username %q is already taken. Please register again with another one.", username),
+			})
+			return nil, nil
+		}
 		return nil, errors.New("failed to create user")
 	}
 
+	us.remember(&user)
+	us.sendVerification(&user)
+
+	// Other instances may have cached that this email didn't exist
+	us.publish(pubsub.UserCreated, &user)
+
+	if us.config.PrivateRegistration {
+		return nil, nil
+	}
 	return &user, nil
 }
 
-// LoginUser authenticates the user
-func (us *userServiceImpl) LoginUser(email, password string) (*models.User, error) {
-	// Find user by email
-	user, err := us.userRepo.FindByEmail(email)
-	if err != nil {
-		return nil, errors.New("invalid credentials")
+// LoginUser authenticates the user with the first authenticator of the
+// chain that knows the email. Throttled or locked-out logins still run one
+// password check, against a dummy hash, so response times don't reveal
+// which emails are locked out. Every outcome goes into the login history.
+func (us *userServiceImpl) LoginUser(email, password string, meta LoginMeta) (*models.User, error) {
+	// Throttled or locked-out accounts and IPs are refused with the same error
+	if !us.loginGuard.Allow(email, meta.IP) {
+		dummy := &models.User{Password: dummyPasswordHash()}
+		if err := us.hashPool.Do(func() { dummy.CheckPassword(password) }); err != nil {
+			return nil, err
+		}
+		user, _ := us.userRepo.FindByEmail(email)
+		us.history.Record(LoginRecord{User: user, Email: email, Reason: models.LoginReasonLockedOut, Meta: meta})
+		return nil, ErrInvalidCredentials
 	}
 
-	// Check password
-	if !user.CheckPassword(password) {
-		return nil, errors.New("invalid credentials")
+	user, source, err := authenticateChain(us.authenticators, email, password)
+	if hashPoolBusy(err) || errors.Is(err, ErrAuthenticatorUnavailable) {
+		return nil, err
 	}
 
+	record := LoginRecord{User: user, Email: email, Meta: meta}
+	if source != "local" {
+		record.Provider = source
+	}
+	if err != nil {
+		us.loginGuard.RecordFailure(email, meta.IP)
+		record.Reason = models.LoginReasonWrongPassword
+		if user == nil {
+			record.Reason = models.LoginReasonUnknownEmail
+		}
+		us.history.Record(record)
+		return nil, ErrInvalidCredentials
+	}
+
+	switch {
+	case us.config.RequireVerifiedEmail && user.VerifiedAt == nil:
+		// Refused, so neither a success nor a guess at the password
+		record.Reason = models.LoginReasonEmailNotVerified
+	case user.MFAEnabled():
+		// CompleteChallenge records the success, and judges it
+		record.Reason = models.LoginReasonMFAPending
+	default:
+		record.Success = true
+	}
+	// A pending second factor keeps the account's failures, so guessing codes
+	// and logging in again doesn't reset the count CompleteChallenge checks
+	if record.Reason != models.LoginReasonMFAPending {
+		us.loginGuard.RecordSuccess(email)
+	}
+	us.history.Record(record)
+	if record.Reason == models.LoginReasonEmailNotVerified {
+		return nil, ErrEmailNotVerified
+	}
 	return user, nil
 }
 
-// GenerateJWT generates a JWT token for the user
-func (us *userServiceImpl) GenerateJWT(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateJWT generates a JWT token for the user. It carries the session's
+// ID as jti and expires with it, so revoking the session revokes the token.
+// Tokens of OAuth sessions also carry the client and its scopes.
+func (us *userServiceImpl) GenerateJWT(user *models.User, session *models.Session) (string, error) {
 	claims := &models.Claims{
-		Username: username,
+		UserID:   user.ID,
+		Username: user.Username,
+		Scope:    session.Scopes,
+		ClientID: session.ClientID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Subject:   user.Subject(),
+			Id:        session.ID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: session.ExpiresAt.Unix(),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecretKey)
+	return token.SignedString(us.jwtSecret)
 }
 
-// GetProfile retrieves a user's profile by ID
+// GetProfile retrieves a user's profile by ID, without its credentials
 func (us *userServiceImpl) GetProfile(userID uint) (*models.User, error) {
-	return us.userRepo.FindByID(userID)
+	user, err := us.userRepo.FindProfile(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	return user, nil
+}
+
+// GetUserIncludingDeleted retrieves a user by ID, whether soft-deleted or
+// not, without its credentials
+func (us *userServiceImpl) GetUserIncludingDeleted(userID uint) (*models.User, error) {
+	user, err := us.userRepo.FindByIDIncludingDeleted(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	user.Password = ""
+	user.TOTPSecret = ""
+	return user, nil
+}
+
+// ListUsers lists users, filtered by soft-delete state ("", "include" or "only")
+func (us *userServiceImpl) ListUsers(deleted string) ([]models.User, error) {
+	filter := repository.DeletedFilter(deleted)
+	switch filter {
+	case repository.ExcludeDeleted, repository.IncludeDeleted, repository.OnlyDeleted:
+	default:
+		return nil, ErrInvalidFilter
+	}
+	return us.userRepo.List(repository.ListOptions{Deleted: filter})
+}
+
+// UpdateUser applies changes to a user, provided it is still at expectedVersion
+func (us *userServiceImpl) UpdateUser(userID uint, expectedVersion uint, changes UserChanges) (*models.User, error) {
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+	if user.Version != expectedVersion {
+		return nil, ErrVersionConflict
+	}
+
+	previous := *user
+	if changes.Username != nil {
+		user.Username = *changes.Username
+	}
+	if changes.Email != nil && *changes.Email != user.Email {
+		// The new address has to be verified again
+		user.Email = *changes.Email
+		user.VerifiedAt = nil
+	}
+	if changes.Role != nil {
+		user.Role = *changes.Role
+	}
+
+	if err := us.userRepo.Update(user, expectedVersion); err != nil {
+		return nil, translateRepoError(err)
+	}
+
+	us.publish(pubsub.UserUpdated, &previous)
+	if user.Email != previous.Email {
+		// Other instances may have cached that the new email didn't exist
+		us.publish(pubsub.UserUpdated, user)
+		us.sendVerification(user)
+	}
+	if user.Role != previous.Role {
+		us.publish(pubsub.UserRoleChanged, user)
+	}
+	return user, nil
+}
+
+// DeleteUser soft-deletes a user, provided it is still at expectedVersion;
+// it can be restored until it is purged
+func (us *userServiceImpl) DeleteUser(userID uint, expectedVersion uint) error {
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	if err := us.userRepo.Delete(userID, expectedVersion); err != nil {
+		return translateRepoError(err)
+	}
+
+	us.publish(pubsub.UserDeleted, user)
+	return nil
+}
+
+// RestoreUser brings back a soft-deleted user
+func (us *userServiceImpl) RestoreUser(userID uint) (*models.User, error) {
+	if err := us.userRepo.Restore(userID); err != nil {
+		return nil, translateRepoError(err)
+	}
+
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, translateRepoError(err)
+	}
+
+	us.publish(pubsub.UserUpdated, user)
+	return user, nil
+}
+
+// PurgeUser permanently deletes a user, whether soft-deleted or not
+func (us *userServiceImpl) PurgeUser(userID uint, expectedVersion uint) error {
+	if err := us.userRepo.Purge(userID, expectedVersion); err != nil {
+		return translateRepoError(err)
+	}
+
+	us.publish(pubsub.UserDeleted, &models.User{Model: gorm.Model{ID: userID}})
+	return nil
+}
+
+// PurgeDeletedUsers permanently deletes users soft-deleted more than retention ago
+func (us *userServiceImpl) PurgeDeletedUsers(retention time.Duration) (int64, error) {
+	return us.userRepo.PurgeDeletedBefore(time.Now().Add(-retention))
+}
+
+// UnlockUser clears the failed logins that locked out a user
+func (us *userServiceImpl) UnlockUser(userID uint) error {
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	return us.loginGuard.Unlock(user.Email)
+}
+
+// ChangePassword sets a new password after checking the current one
+func (us *userServiceImpl) ChangePassword(userID uint, currentPassword, newPassword string) error {
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	if err := us.checkLocalPassword(user.ID); err != nil {
+		return err
+	}
+
+	var currentOK bool
+	if err := us.hashPool.Do(func() { currentOK = user.CheckPassword(currentPassword) }); err != nil {
+		return err
+	}
+	if !currentOK {
+		return ErrWrongPassword
+	}
+	return us.setPassword(user, newPassword)
+}
+
+// ConfirmPassword checks the password of a logged-in user with the
+// authenticators of the login, so directory accounts confirm the password
+// of their entry
+func (us *userServiceImpl) ConfirmPassword(userID uint, password string, meta LoginMeta) error {
+	user, err := us.userRepo.FindByID(userID)
+	if err != nil {
+		return translateRepoError(err)
+	}
+	if !user.HasPassword() {
+		managed, err := directoryManaged(us.identityRepo, user.ID)
+		if err != nil {
+			return err
+		}
+		if !managed {
+			return ErrNoPassword
+		}
+	}
+	if !us.loginGuard.Allow(user.Email, meta.IP) {
+		return ErrTooManyAttempts
+	}
+
+	found, _, err := authenticateChain(us.authenticators, user.Email, password)
+	switch {
+	case hashPoolBusy(err), errors.Is(err, ErrAuthenticatorUnavailable):
+		return err
+	case err == nil && found.ID == user.ID:
+		return nil
+	}
+	us.loginGuard.RecordFailure(user.Email, meta.IP)
+	return ErrWrongPassword
+}
+
+// checkLocalPassword fails with ErrDirectoryAccount if the user's password
+// lives in the LDAP directory rather than here
+func (us *userServiceImpl) checkLocalPassword(userID uint) error {
+	managed, err := directoryManaged(us.identityRepo, userID)
+	if err != nil {
+		return err
+	}
+	if managed {
+		return ErrDirectoryAccount
+	}
+	return nil
+}
+
+// setPassword checks newPassword against the policy and the user's recent
+// passwords, then stores its hash
+func (us *userServiceImpl) setPassword(user *models.User, newPassword string) error {
+	updated, err := us.preparePassword(user, newPassword)
+	if err != nil {
+		return err
+	}
+	return us.storePassword(user, updated)
+}
+
+// preparePassword checks newPassword against the policy and the user's
+// recent passwords, and returns a copy of user with its hash
+func (us *userServiceImpl) preparePassword(user *models.User, newPassword string) (*models.User, error) {
+	if err := us.config.PasswordPolicy.Check(newPassword, user.Username, user.Email); err != nil {
+		return nil, err
+	}
+
+	var recent []string
+	if us.config.PasswordHistory > 0 {
+		var err error
+		if recent, err = us.historyRepo.Recent(user.ID, us.config.PasswordHistory); err != nil {
+			return nil, err
+		}
+	}
+
+	updated := *user
+	updated.Password = newPassword
+	var reused bool
+	var hashErr error
+	err := us.hashPool.Do(func() {
+		// The current hash counts even if it predates the history
+		for _, hash := range append([]string{user.Password}, recent...) {
+			if (&models.User{Password: hash}).CheckPassword(newPassword) {
+				reused = true
+				return
+			}
+		}
+		hashErr = updated.HashPassword()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, &password.PolicyError{Problems: []string{
+			fmt.Sprintf("must not be one of your last %d passwords", max(us.config.PasswordHistory, 1)),
+		}}
+	}
+	if hashErr != nil {
+		return nil, errors.New("failed to hash password")
+	}
+	return &updated, nil
+}
+
+// storePassword saves updated (from preparePassword) over user
+func (us *userServiceImpl) storePassword(user, updated *models.User) error {
+	if err := us.userRepo.Update(updated, user.Version); err != nil {
+		return translateRepoError(err)
+	}
+	*user = *updated
+	us.remember(user)
+
+	us.publish(pubsub.UserUpdated, user)
+	return nil
+}
+
+// ForgotPassword mails a password reset link if email is registered
+func (us *userServiceImpl) ForgotPassword(email, ip string) error {
+	if err := us.rateLimiter.Allow(models.RateScopeResetIP, ip, us.config.ResetIPLimit); err != nil {
+		return err
+	}
+	if err := us.rateLimiter.Allow(models.RateScopeResetEmail, normalizeEmail(email), us.config.ResetEmailLimit); err != nil {
+		return err
+	}
+
+	user, err := us.userRepo.FindByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	managed, err := directoryManaged(us.identityRepo, user.ID)
+	if err != nil {
+		return err
+	}
+
+	// In the background, so the response time doesn't tell whether the
+	// email is registered
+	if managed {
+		go us.sendDirectoryPasswordNote(user)
+		return nil
+	}
+	go us.sendPasswordReset(user)
+	return nil
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword and
+// signs the user out everywhere
+func (us *userServiceImpl) ResetPassword(token, newPassword, ip string) error {
+	if err := us.rateLimiter.Allow(models.RateScopeResetIP, ip, us.config.ResetIPLimit); err != nil {
+		return err
+	}
+
+	// Check everything before using up the token, so a password the policy
+	// rejects doesn't cost the user their link
+	pending, err := us.tokens.Peek(token, models.TokenPurposeResetPassword)
+	if err != nil {
+		return err
+	}
+	user, err := us.userRepo.FindByID(pending.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email != pending.Email {
+		return ErrInvalidToken
+	}
+	// A link sent before the account's first LDAP login
+	if err := us.checkLocalPassword(user.ID); err != nil {
+		return err
+	}
+
+	updated, err := us.preparePassword(user, newPassword)
+	if err != nil {
+		return err
+	}
+	if _, err := us.tokens.Consume(token, models.TokenPurposeResetPassword); err != nil {
+		return err
+	}
+
+	// Retry if the user changes under us (a login rehashing their password,
+	// say); the token is already used up, and a conflict mustn't burn it
+	hash := updated.Password
+	for attempt := 0; ; attempt++ {
+		now := time.Now()
+		updated.SessionsRevokedAt = &now
+		if updated.VerifiedAt == nil {
+			// Following the link proves they own the address
+			updated.VerifiedAt = &now
+		}
+		err := us.storePassword(user, updated)
+		if !errors.Is(err, ErrVersionConflict) || attempt >= 3 {
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		user, err = us.userRepo.FindByID(pending.UserID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if user.Email != pending.Email {
+			// The address changed since the link was sent
+			return ErrInvalidToken
+		}
+		fresh := *user
+		fresh.Password = hash
+		updated = &fresh
+	}
+
+	if err := us.tokens.Invalidate(user.ID, models.TokenPurposeResetPassword); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to invalidate reset tokens")
+	}
+	if err := us.loginGuard.Unlock(user.Email); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to clear login failures")
+	}
+	return nil
+}
+
+// sendPasswordReset mails user a reset link, making earlier ones unusable
+func (us *userServiceImpl) sendPasswordReset(user *models.User) {
+	if err := us.tokens.Invalidate(user.ID, models.TokenPurposeResetPassword); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to invalidate reset tokens")
+	}
+	token, err := us.tokens.Issue(user, models.TokenPurposeResetPassword, us.config.PasswordResetTTL)
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Error("Failed to create password reset token")
+		return
+	}
+
+	us.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. To choose a new "+
+			"password, open this link:\n\n%s/reset-password?token=%s\n\nThe link expires in %s and works once. "+
+			"Resetting your password signs you out everywhere. If you didn't ask for this, you can ignore this email.",
+			user.Username, us.config.AppURL, url.QueryEscape(token), us.config.PasswordResetTTL),
+	})
+}
+
+// sendDirectoryPasswordNote answers a password reset request for an account
+// of the LDAP directory, whose password can't be reset here
+func (us *userServiceImpl) sendDirectoryPasswordNote(user *models.User) {
+	us.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. You log in with "+
+			"your directory password, which can't be reset here; ask your administrator or use your "+
+			"organization's password reset. If you didn't ask for this, you can ignore this email.",
+			user.Username),
+	})
+}
+
+// VerifyEmail redeems a verification token
+func (us *userServiceImpl) VerifyEmail(token string) error {
+	redeemed, err := us.tokens.Consume(token, models.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	// Retry if the user changes under us; the token is already used up
+	for attempt := 0; ; attempt++ {
+		user, err := us.userRepo.FindByID(redeemed.UserID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if user.Email != redeemed.Email {
+			// The address changed since the token was sent
+			return ErrInvalidToken
+		}
+		if user.VerifiedAt != nil {
+			return nil
+		}
+
+		now := time.Now()
+		user.VerifiedAt = &now
+		err = us.userRepo.Update(user, user.Version)
+		if errors.Is(err, repository.ErrVersionConflict) && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return translateRepoError(err)
+		}
+
+		us.publish(pubsub.UserUpdated, user)
+		return nil
+	}
+}
+
+// ResendVerification mails a new verification token if appropriate
+func (us *userServiceImpl) ResendVerification(email string) error {
+	user, err := us.userRepo.FindByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.VerifiedAt != nil {
+		return nil
+	}
+
+	latest, err := us.tokens.Latest(user.ID, models.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	if latest != nil && time.Since(latest.CreatedAt) < us.config.VerificationResendInterval {
+		return nil
+	}
+
+	us.sendVerification(user)
+	return nil
+}
+
+// sendVerification mails user a link to verify their current email, and
+// makes any link sent before unusable
+func (us *userServiceImpl) sendVerification(user *models.User) {
+	if err := us.tokens.Invalidate(user.ID, models.TokenPurposeVerifyEmail); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to invalidate verification tokens")
+	}
+	token, err := us.tokens.Issue(user, models.TokenPurposeVerifyEmail, us.config.VerificationTTL)
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Error("Failed to create verification token")
+		return
+	}
+
+	us.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n"+
+			"%s/verify-email?token=%s\n\nThe link expires in %s. If you didn't create an account, "+
+			"you can ignore this email.", user.Username, us.config.AppURL, url.QueryEscape(token), us.config.VerificationTTL),
+	})
+}
+
+// remember adds the user's current password hash to their history
+func (us *userServiceImpl) remember(user *models.User) {
+	if us.config.PasswordHistory <= 0 {
+		return
+	}
+	if err := us.historyRepo.Add(user.ID, user.Password, us.config.PasswordHistory); err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to record password history")
+	}
+}
+
+// translateRepoError maps repository errors onto the service's errors
+func translateRepoError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return ErrUserConflict
+	case errors.Is(err, repository.ErrVersionConflict):
+		return ErrVersionConflict
+	default:
+		return err
+	}
+}
+
+// sendMail sends msg in the background, so the caller's response time
+// doesn't depend on whether an email was sent
+func (us *userServiceImpl) sendMail(msg mailer.Message) {
+	go func() {
+		if err := us.mailer.Send(msg); err != nil {
+			logrus.WithError(err).WithField("subject", msg.Subject).Error("Failed to send email")
+		}
+	}()
+}
+
+// publish broadcasts a change to user so other instances drop stale state
+func (us *userServiceImpl) publish(eventType string, user *models.User) {
+	publishUserEvent(us.bus, eventType, user)
+}
+
+// publishUserEvent broadcasts a change to user on bus
+func publishUserEvent(bus pubsub.Bus, eventType string, user *models.User) {
+	err := bus.Publish(pubsub.Event{Type: eventType, UserID: user.ID, Email: user.Email})
+	if err != nil {
+		logrus.WithError(err).WithField("user_id", user.ID).Warn("Failed to publish user event")
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns the hash of a random password, created with the
+// same algorithm and cost as real ones, to check against when there is no user
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+		dummy := models.User{Password: hex.EncodeToString(secret)}
+		if err := dummy.HashPassword(); err != nil {
+			panic(err)
+		}
+		dummyHash = dummy.Password
+	})
+	return dummyHash
 }
@@ -0,0 +1,75 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gin-tutorial/models"
+	"gin-tutorial/repository"
+	"gin-tutorial/services"
+)
+
+// racingUserRepository changes the user under the caller before its first
+// conflicts Updates or Deletes go through, the way a concurrent login's
+// rehash would
+type racingUserRepository struct {
+	repository.UserRepository
+	conflicts int
+}
+
+func (rr *racingUserRepository) Update(user *models.User, version uint) error {
+	if err := rr.race(user.ID); err != nil {
+		return err
+	}
+	return rr.UserRepository.Update(user, version)
+}
+
+func (rr *racingUserRepository) Delete(userID uint, version uint) error {
+	if err := rr.race(userID); err != nil {
+		return err
+	}
+	return rr.UserRepository.Delete(userID, version)
+}
+
+func (rr *racingUserRepository) race(userID uint) error {
+	if rr.conflicts == 0 {
+		return nil
+	}
+	rr.conflicts--
+	current, err := rr.UserRepository.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	return rr.UserRepository.Update(current, current.Version)
+}
+
+func TestResetPasswordSurvivesConcurrentUpdates(t *testing.T) {
+	repo := &racingUserRepository{UserRepository: repository.NewMemoryUserRepository()}
+	env := newTestEnv(t, repo)
+	user := createUser(t, repo, "alice", "old password 1")
+	token, err := env.tokens.Issue(user, models.TokenPurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	repo.conflicts = 2
+	if err := env.users.ResetPassword(token, "new password 1", "192.0.2.1"); err != nil {
+		t.Fatalf("ResetPassword with a concurrent update: %v", err)
+	}
+	if _, err := env.users.LoginUser(user.Email, "new password 1", services.LoginMeta{IP: "192.0.2.1"}); err != nil {
+		t.Errorf("login with the new password: %v", err)
+	}
+	stored, err := repo.FindByID(user.ID)
+	if err != nil {
+		t.Fatalf("FindByID: %v", err)
+	}
+	if stored.SessionsRevokedAt == nil {
+		t.Error("the reset didn't revoke existing sessions")
+	}
+
+	// The link still works only once
+	if err := env.users.ResetPassword(token, "newer password 1", "192.0.2.1"); !errors.Is(err, services.ErrInvalidToken) {
+		t.Errorf("reusing the link: got %v, want ErrInvalidToken", err)
+	}
+}